@@ -2,83 +2,275 @@ package bookstore
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/13thuser/bookstore/bookstore/entities"
+	"github.com/13thuser/bookstore/bookstore/shipping"
+	"github.com/13thuser/bookstore/bookstore/tax"
 	"github.com/13thuser/bookstore/datastore"
 	"github.com/13thuser/bookstore/payments"
 )
 
 // BookstoreService defines the structure of the bookstore service
 type BookstoreService struct {
-	Datastore      *datastore.Datastore
+	Datastore      datastore.Store
 	PaymentGateway payments.PaymentProcessor
+	// TaxRules are applied to the orders at checkout, there is no tax without rules
+	TaxRules tax.Rules
+	// Shipping quotes the shipping methods of the orders, they ship for free without it
+	Shipping shipping.Provider
+	// Cards gives out the cards of the tokens the orders are paid with, the
+	// service never sees their numbers; the tokens go unchecked to the payment
+	// gateway without it
+	Cards payments.CardLookup
 }
 
 // NewBookstoreService creates a new bookstore service
-func NewBookstoreService(ds *datastore.Datastore, pg payments.PaymentProcessor) *BookstoreService {
+func NewBookstoreService(ds datastore.Store, pg payments.PaymentProcessor) *BookstoreService {
 	return &BookstoreService{
 		Datastore:      ds,
 		PaymentGateway: pg,
 	}
 }
 
+// ListItems lists the items that are still sold
 func (s *BookstoreService) ListItems(ctx context.Context) ([]entities.Item, error) {
-	return s.Datastore.ListItems(ctx)
+	items, err := s.Datastore.ListItems(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sold := make([]entities.Item, 0, len(items))
+	for _, item := range items {
+		if !item.Retired {
+			sold = append(sold, item)
+		}
+	}
+	return sold, nil
+}
+
+func (s *BookstoreService) GetItem(ctx context.Context, sku string) (entities.ItemWithStock, error) {
+	item, err := s.Datastore.GetItem(ctx, sku)
+	if err != nil {
+		return entities.ItemWithStock{}, err
+	}
+	inStock, err := s.Datastore.GetStock(ctx, sku)
+	if err != nil {
+		return entities.ItemWithStock{}, err
+	}
+	reserved, err := s.Datastore.GetReservedStock(ctx, sku)
+	if err != nil {
+		return entities.ItemWithStock{}, err
+	}
+	withStock := entities.NewItemWithStock(item, inStock, reserved)
+	if item.TitleID == "" {
+		return withStock, nil
+	}
+	formats, err := s.Datastore.SearchItems(ctx, entities.ItemQuery{TitleID: item.TitleID, Limit: entities.MaxItemPageSize})
+	if err != nil {
+		return entities.ItemWithStock{}, err
+	}
+	for _, format := range formats.Items {
+		if format.SKU != sku {
+			withStock.Formats = append(withStock.Formats, entities.TitleFormat{
+				SKU:       format.SKU,
+				Format:    format.Format,
+				Price:     format.Price,
+				Available: format.Available,
+			})
+		}
+	}
+	return withStock, nil
+}
+
+// ListCategories lists the category tree of the items still sold, each level sorted by name
+func (s *BookstoreService) ListCategories(ctx context.Context) ([]*entities.CategoryNode, error) {
+	items, err := s.ListItems(ctx)
+	if err != nil {
+		return nil, err
+	}
+	root := &entities.CategoryNode{}
+	for _, item := range items {
+		// count an item once per category even when several of its paths share a parent
+		counted := make(map[*entities.CategoryNode]bool)
+		for _, category := range item.Categories {
+			node := root
+			for _, name := range strings.Split(category, entities.CategorySeparator) {
+				node = childCategory(node, name)
+				if !counted[node] {
+					counted[node] = true
+					node.Items++
+				}
+			}
+		}
+	}
+	return root.Children, nil
+}
+
+// childCategory returns the sub-category of the node with the name, adding it in name order if needed
+func childCategory(node *entities.CategoryNode, name string) *entities.CategoryNode {
+	i := sort.Search(len(node.Children), func(i int) bool { return node.Children[i].Name >= name })
+	if i < len(node.Children) && node.Children[i].Name == name {
+		return node.Children[i]
+	}
+	path := name
+	if node.Path != "" {
+		path = node.Path + entities.CategorySeparator + name
+	}
+	child := &entities.CategoryNode{Name: name, Path: path}
+	node.Children = append(node.Children, nil)
+	copy(node.Children[i+1:], node.Children[i:])
+	node.Children[i] = child
+	return child
 }
 
-func (s *BookstoreService) GetItem(ctx context.Context, sku string) (entities.Item, error) {
-	return s.Datastore.GetItem(ctx, sku)
+// SearchItems searches the catalog for the items still sold
+func (s *BookstoreService) SearchItems(ctx context.Context, query entities.ItemQuery) (entities.ItemPage, error) {
+	return s.Datastore.SearchItems(ctx, query)
 }
 
 func (s *BookstoreService) AddToCart(ctx context.Context, userID string, sku string, quantity int) (entities.Cart, error) {
-	return s.Datastore.AddToCart(ctx, userID, sku, quantity)
+	cart, err := s.Datastore.AddToCart(ctx, userID, sku, quantity)
+	if err != nil {
+		return entities.Cart{}, err
+	}
+	return s.priceCart(ctx, cart)
 }
 
 func (s *BookstoreService) RemoveFromCart(ctx context.Context, userID string, sku string, quantity int) (entities.Cart, error) {
-	return s.Datastore.RemoveFromCart(ctx, userID, sku, quantity)
+	cart, err := s.Datastore.RemoveFromCart(ctx, userID, sku, quantity)
+	if err != nil {
+		return entities.Cart{}, err
+	}
+	return s.priceCart(ctx, cart)
 }
 
+// ReleaseCart releases the stock reserved for the cart of the user, the items stay in the cart
+func (s *BookstoreService) ReleaseCart(ctx context.Context, userID string) error {
+	return s.Datastore.ReleaseReservations(ctx, userID)
+}
+
+// GetCart gets the cart of the user with the discounts of the promotions it is eligible for
 func (s *BookstoreService) GetCart(ctx context.Context, userID string) entities.Cart {
-	return s.Datastore.GetCart(ctx, userID)
+	cart := s.Datastore.GetCart(ctx, userID)
+	priced, err := s.priceCart(ctx, cart)
+	if err != nil {
+		log.Printf("Unable to price the cart of %s: %s\n", userID, err)
+		return cart
+	}
+	return priced
 }
 
-func (s *BookstoreService) GetCartTotalPrice(ctx context.Context, userID string) float64 {
+func (s *BookstoreService) GetCartTotalPrice(ctx context.Context, userID string) entities.Money {
 	return s.Datastore.GetCartTotalPrice(ctx, userID)
 }
 
-func (s *BookstoreService) Checkout(ctx context.Context, userID string) (entities.Order, error) {
-	return s.Datastore.Checkout(ctx, userID)
+// Checkout turns the cart of the user into an order shipped to the address of
+// the request with the chosen method, and adds the shipping cost and the taxes
+func (s *BookstoreService) Checkout(ctx context.Context, userID string, req entities.CheckoutRequest) (entities.Order, error) {
+	finalize, err := s.orderFinalizer(ctx, userID, req)
+	if err != nil {
+		return entities.Order{}, err
+	}
+	return s.Datastore.Checkout(ctx, userID, finalize)
 }
 
-func (s *BookstoreService) ConfirmPurchase(ctx context.Context, userID string, orderID string, creditCardDetails payments.CreditCardDetails) (entities.Order, error) {
-	var order entities.Order
-	if orderID == "" {
-		order, err := s.Datastore.ConfirmOrder(ctx, userID)
-		if err != nil {
-			return entities.Order{}, err
+// orderFinalizer returns the function completing the orders checked out with the request
+func (s *BookstoreService) orderFinalizer(ctx context.Context, userID string, req entities.CheckoutRequest) (datastore.OrderFinalizer, error) {
+	address, err := s.shippingAddress(ctx, userID, req)
+	if err != nil {
+		return nil, err
+	}
+	if address == nil && req.ShippingMethod != "" {
+		return nil, fmt.Errorf("%w: a shipping method needs a shipping address", entities.ErrInvalidShipping)
+	}
+	return func(order *entities.Order) error {
+		order.ShippingAddress = address
+		order.Shipping = nil
+		if address == nil && s.TaxRules.Taxable(order.Items) {
+			return fmt.Errorf("%w: a shipping address is required to compute the taxes", entities.ErrInvalidAddress)
+		}
+		if address == nil && s.Shipping != nil && !shipping.NewShipment(entities.Address{}, order.Items, order.TotalPrice.Currency).Empty() {
+			return fmt.Errorf("%w: a shipping address is required to ship the items", entities.ErrInvalidAddress)
+		}
+		if address != nil {
+			shipment := shipping.NewShipment(*address, order.Items, order.TotalPrice.Currency)
+			rate, err := s.shippingRate(ctx, shipment, req.ShippingMethod)
+			if err != nil {
+				return err
+			}
+			order.Shipping = rate
 		}
-		orderID = order.ID
-	} else {
-		order, err := s.Datastore.FindOrder(ctx, userID, orderID)
+		s.TaxRules.Apply(order)
+		return nil
+	}, nil
+}
+
+// ConfirmPurchase authorizes the payment of an order of the user, checked out
+// with Checkout, on the card of the payment source. The amount is only held on
+// the card: it is charged as the order is fulfilled, see CaptureOrder.
+func (s *BookstoreService) ConfirmPurchase(ctx context.Context, userID string, orderID string, source entities.PaymentSource) (entities.Order, error) {
+	cardToken, err := s.paymentCardToken(ctx, userID, source)
+	if err != nil {
+		return entities.Order{}, err
+	}
+	var card *entities.PaymentCard
+	if s.Cards != nil {
+		c, err := s.Cards.Card(userID, cardToken)
 		if err != nil {
 			return entities.Order{}, err
 		}
-		if order.PaymentConfirmation != "" {
-			return entities.Order{}, fmt.Errorf("order already confirmed")
-		}
+		c.Token = ""
+		card = &c
+	}
+	order, err := s.Datastore.FindOrder(ctx, userID, orderID)
+	if err != nil {
+		return entities.Order{}, err
+	}
+	if order.PaymentConfirmation != "" {
+		return entities.Order{}, fmt.Errorf("%w: order already confirmed", entities.ErrInvalidStatusTransition)
+	}
+	if status := order.CurrentStatus(); !status.CanTransitionTo(entities.OrderStatusAuthorized) {
+		return entities.Order{}, fmt.Errorf("%w: order %s cannot be paid", entities.ErrInvalidStatusTransition, status)
+	}
+	idempotencyKey, err := paymentIdempotencyKey(ctx, "authorize", orderID)
+	if err != nil {
+		return entities.Order{}, err
 	}
 	paymentRequest := payments.PaymentRequest{
-		ID:     orderID,
-		UserID: userID,
-		Amount: order.TotalPrice,
+		ID:             orderID,
+		UserID:         userID,
+		Amount:         order.AmountDue,
+		CardToken:      cardToken,
+		IdempotencyKey: idempotencyKey,
+	}
+	if card != nil {
+		paymentRequest.CardBrand = card.Brand
 	}
-	paymentConfirmationID, err := s.PaymentGateway.ProcessPayment(ctx, paymentRequest, creditCardDetails)
+	authorization, err := s.PaymentGateway.Authorize(ctx, paymentRequest)
 	if err != nil {
-		return order, fmt.Errorf("payment processing failed for order id %s. please retry", order.ID)
+		if errors.Is(err, payments.ErrDeclined) || payments.IsTransient(err) {
+			return entities.Order{}, err
+		}
+		return entities.Order{}, fmt.Errorf("payment processing failed for order id %s: %w", order.ID, err)
+	}
+	if authorization.Amount.Cmp(order.AmountDue) < 0 {
+		// a partial approval does not pay for the order, the card is not held for nothing
+		s.voidAuthorization(ctx, orderID, authorization.ID)
+		return entities.Order{}, fmt.Errorf("%w: only %s of %s was approved", payments.ErrDeclined, authorization.Amount, order.AmountDue)
 	}
-	order, err = s.Datastore.ConfirmPayment(ctx, userID, orderID, paymentConfirmationID)
+	order, err = datastore.RecordAuthorization(ctx, s.Datastore, userID, orderID, authorization.ID, order.AmountDue, card)
 	if err != nil {
+		// the payment provider may have confirmed the authorization meanwhile, see ApplyPaymentEvent
+		if recorded, findErr := s.Datastore.FindOrder(ctx, userID, orderID); findErr == nil && recorded.PaymentConfirmation == authorization.ID {
+			return recorded, nil
+		}
+		// e.g. the order expired meanwhile
+		s.voidAuthorization(ctx, orderID, authorization.ID)
 		return entities.Order{}, err
 	}
 	return order, nil
@@ -87,3 +279,73 @@ func (s *BookstoreService) ConfirmPurchase(ctx context.Context, userID string, o
 func (s *BookstoreService) GetOrderHistory(ctx context.Context, userID string) []entities.Order {
 	return s.Datastore.GetOrderHistory(ctx, userID)
 }
+
+// CancelOrder cancels an order of the user, puts its items back in stock and
+// voids what was not captured of its payment. Only the orders nothing was
+// captured of can be cancelled, the others are given back with a refund.
+func (s *BookstoreService) CancelOrder(ctx context.Context, userID string, orderID string) (entities.Order, error) {
+	order, err := datastore.ChangeOrderStatus(ctx, s.Datastore, userID, orderID, entities.OrderStatusCancelled, func(order *entities.Order) error {
+		status := order.CurrentStatus()
+		if status != entities.OrderStatusPendingPayment && status != entities.OrderStatusAuthorized {
+			return fmt.Errorf("%w: order %s is %s, it can only be refunded", entities.ErrInvalidStatusTransition, order.ID, status)
+		}
+		if order.Captured().IsPositive() {
+			return fmt.Errorf("%w: %s of order %s was captured, it can only be refunded", entities.ErrInvalidStatusTransition, order.Captured(), order.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		return entities.Order{}, err
+	}
+	s.releaseAuthorization(ctx, order)
+	return order, nil
+}
+
+// ExpireUnpaidOrders cancels the orders left waiting for payment for longer than ttl
+func (s *BookstoreService) ExpireUnpaidOrders(ctx context.Context, ttl time.Duration) ([]entities.Order, error) {
+	return datastore.ExpireOrders(ctx, s.Datastore, time.Now().Add(-ttl))
+}
+
+// ExpireAuthorizations closes the authorizations left uncaptured for longer
+// than ttl, see datastore.ExpireAuthorizations, and voids what was not captured
+func (s *BookstoreService) ExpireAuthorizations(ctx context.Context, ttl time.Duration) ([]entities.Order, error) {
+	expired, err := datastore.ExpireAuthorizations(ctx, s.Datastore, time.Now().Add(-ttl))
+	if err != nil {
+		return nil, err
+	}
+	for _, order := range expired {
+		s.releaseAuthorization(ctx, order)
+	}
+	return expired, nil
+}
+
+// RunSweeper expires unpaid orders and uncaptured authorizations and purges
+// expired stock reservations every interval until the context is done
+func (s *BookstoreService) RunSweeper(ctx context.Context, interval time.Duration, orderTTL time.Duration, authorizationTTL time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			expired, err := s.ExpireUnpaidOrders(ctx, orderTTL)
+			if err != nil {
+				log.Printf("Unable to expire unpaid orders: %s\n", err)
+			}
+			for _, order := range expired {
+				log.Printf("Cancelled unpaid order %s of user %s\n", order.ID, order.UserID)
+			}
+			closed, err := s.ExpireAuthorizations(ctx, authorizationTTL)
+			if err != nil {
+				log.Printf("Unable to expire authorizations: %s\n", err)
+			}
+			for _, order := range closed {
+				log.Printf("Expired the authorization of order %s of user %s, the order is %s\n", order.ID, order.UserID, order.Status)
+			}
+			if _, err := s.Datastore.ReleaseExpiredReservations(ctx); err != nil {
+				log.Printf("Unable to release expired reservations: %s\n", err)
+			}
+		}
+	}
+}
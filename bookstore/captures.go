@@ -0,0 +1,76 @@
+package bookstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+	"github.com/13thuser/bookstore/datastore"
+	"github.com/13thuser/bookstore/payments"
+)
+
+// CaptureOrder charges part or all of the authorized payment of an order of
+// any user through the payment gateway, e.g. as each of its shipments leaves;
+// a final capture voids the rest of the authorization
+func (s *BookstoreService) CaptureOrder(ctx context.Context, actor entities.UserID, orderID string, req entities.CaptureRequest) (entities.Order, error) {
+	order, err := s.Datastore.GetOrder(ctx, orderID)
+	if err != nil {
+		return entities.Order{}, err
+	}
+	order, capture, err := datastore.BeginCapture(ctx, s.Datastore, order.UserID, order.ID, req, actor)
+	if err != nil {
+		return entities.Order{}, err
+	}
+	confirmation, err := s.PaymentGateway.Capture(ctx, order.Authorization.ID, capture.Amount)
+	if err != nil {
+		if _, failErr := datastore.FailCapture(ctx, s.Datastore, order.UserID, order.ID, capture.ID, err); failErr != nil {
+			log.Printf("Unable to record the failure of capture %s of order %s: %s\n", capture.ID, order.ID, failErr)
+		}
+		if !errors.Is(err, payments.ErrCaptureFailed) {
+			err = fmt.Errorf("%w: %v", payments.ErrCaptureFailed, err)
+		}
+		return entities.Order{}, err
+	}
+	order, err = datastore.CompleteCapture(ctx, s.Datastore, order.UserID, order.ID, capture.ID, confirmation)
+	if err != nil {
+		// the capture stays pending, so its amount cannot be captured twice
+		log.Printf("Unable to record the confirmation %s of capture %s of order %s: %s\n", confirmation, capture.ID, order.ID, err)
+		return entities.Order{}, err
+	}
+	if capture.Final {
+		s.releaseAuthorization(ctx, order)
+	}
+	return order, nil
+}
+
+// FulfillOrder moves a paid order of any user along its fulfillment, see
+// entities.FulfillmentRequest; the statuses follow each other in order
+func (s *BookstoreService) FulfillOrder(ctx context.Context, orderID string, req entities.FulfillmentRequest) (entities.Order, error) {
+	if err := req.Validate(); err != nil {
+		return entities.Order{}, err
+	}
+	order, err := s.Datastore.GetOrder(ctx, orderID)
+	if err != nil {
+		return entities.Order{}, err
+	}
+	return datastore.ChangeOrderStatus(ctx, s.Datastore, order.UserID, order.ID, req.Status, nil)
+}
+
+// releaseAuthorization voids with the payment gateway what was not captured
+// of the authorization of the order, once the order released it
+func (s *BookstoreService) releaseAuthorization(ctx context.Context, order entities.Order) {
+	if order.Authorization == nil || !order.Authorization.Voided || !order.Authorization.Uncaptured().IsPositive() {
+		return
+	}
+	s.voidAuthorization(ctx, order.ID, order.Authorization.ID)
+}
+
+// voidAuthorization voids an authorization of the order with the payment
+// gateway; a failure is only logged as the authorization lapses on its own
+func (s *BookstoreService) voidAuthorization(ctx context.Context, orderID string, authorizationID string) {
+	if err := s.PaymentGateway.Void(ctx, authorizationID); err != nil {
+		log.Printf("Unable to void authorization %s of order %s: %s\n", authorizationID, orderID, err)
+	}
+}
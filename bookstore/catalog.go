@@ -0,0 +1,296 @@
+package bookstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+	"github.com/13thuser/bookstore/datastore"
+)
+
+// Catalog management used by the admin endpoints; every change is recorded in
+// the audit trail along with the user who made it.
+
+// CreateItem adds a new item to the catalog with its initial stock
+func (s *BookstoreService) CreateItem(ctx context.Context, actor entities.UserID, item entities.Item, stock int) (entities.ItemWithStock, error) {
+	item.Retired = false
+	item, err := item.Normalize()
+	if err != nil {
+		return entities.ItemWithStock{}, err
+	}
+	if stock < 0 {
+		return entities.ItemWithStock{}, fmt.Errorf("%w: stock cannot be negative", entities.ErrInvalidItem)
+	}
+	if err := s.Datastore.CreateItem(ctx, item, stock); err != nil {
+		return entities.ItemWithStock{}, err
+	}
+	err = s.recordCatalogChange(ctx, entities.CatalogChange{
+		Actor:    actor,
+		SKU:      item.SKU,
+		Action:   entities.CatalogActionCreate,
+		NewPrice: &item.Price,
+		NewStock: &stock,
+	})
+	if err != nil {
+		return entities.ItemWithStock{}, err
+	}
+	return s.GetItem(ctx, item.SKU)
+}
+
+// UpdateItem replaces the details of an item
+func (s *BookstoreService) UpdateItem(ctx context.Context, actor entities.UserID, item entities.Item) (entities.ItemWithStock, error) {
+	item, err := item.Normalize()
+	if err != nil {
+		return entities.ItemWithStock{}, err
+	}
+	previous, err := s.Datastore.UpdateItem(ctx, item)
+	if err != nil {
+		return entities.ItemWithStock{}, err
+	}
+	err = s.recordCatalogChange(ctx, entities.CatalogChange{
+		Actor:    actor,
+		SKU:      item.SKU,
+		Action:   entities.CatalogActionUpdate,
+		OldPrice: &previous.Price,
+		NewPrice: &item.Price,
+	})
+	if err != nil {
+		return entities.ItemWithStock{}, err
+	}
+	return s.GetItem(ctx, item.SKU)
+}
+
+// RetireItem stops selling an item, it stays in the catalog for the order history
+func (s *BookstoreService) RetireItem(ctx context.Context, actor entities.UserID, sku string) (entities.ItemWithStock, error) {
+	if _, err := s.Datastore.RetireItem(ctx, sku); err != nil {
+		return entities.ItemWithStock{}, err
+	}
+	err := s.recordCatalogChange(ctx, entities.CatalogChange{
+		Actor:  actor,
+		SKU:    sku,
+		Action: entities.CatalogActionRetire,
+	})
+	if err != nil {
+		return entities.ItemWithStock{}, err
+	}
+	return s.GetItem(ctx, sku)
+}
+
+// RestockItem adds quantity units of an item to the stock
+func (s *BookstoreService) RestockItem(ctx context.Context, actor entities.UserID, sku string, quantity int) (entities.ItemWithStock, error) {
+	if quantity <= 0 {
+		return entities.ItemWithStock{}, fmt.Errorf("%w: restock quantity must be positive", entities.ErrInvalidItem)
+	}
+	newStock, err := s.Datastore.AddStock(ctx, sku, quantity)
+	if err != nil {
+		return entities.ItemWithStock{}, err
+	}
+	oldStock := newStock - quantity
+	err = s.recordCatalogChange(ctx, entities.CatalogChange{
+		Actor:    actor,
+		SKU:      sku,
+		Action:   entities.CatalogActionRestock,
+		OldStock: &oldStock,
+		NewStock: &newStock,
+	})
+	if err != nil {
+		return entities.ItemWithStock{}, err
+	}
+	return s.GetItem(ctx, sku)
+}
+
+// GetCatalogChanges gets the audit trail of an item, oldest change first
+func (s *BookstoreService) GetCatalogChanges(ctx context.Context, sku string) ([]entities.CatalogChange, error) {
+	if _, err := s.Datastore.GetItem(ctx, sku); err != nil {
+		return nil, err
+	}
+	return s.Datastore.ListCatalogChanges(ctx, sku)
+}
+
+// recordCatalogChange timestamps the change and appends it to the audit trail
+func (s *BookstoreService) recordCatalogChange(ctx context.Context, change entities.CatalogChange) error {
+	change.At = time.Now()
+	if err := s.Datastore.RecordCatalogChange(ctx, change); err != nil {
+		return fmt.Errorf("unable to record the %s of item %s in the audit trail: %w", change.Action, change.SKU, err)
+	}
+	return nil
+}
+
+// ImportItems upserts the rows of a catalog file: new SKUs are created, the
+// details and stock level of existing ones are replaced, retired items stay
+// retired. Invalid rows are reported and skipped, a failure of the datastore
+// stops the import. In a dry run the rows are checked but nothing is written.
+func (s *BookstoreService) ImportItems(ctx context.Context, actor entities.UserID, rows []entities.ImportRow, dryRun bool) (entities.ImportReport, error) {
+	report := entities.ImportReport{DryRun: dryRun, Errors: []entities.ImportError{}}
+	lines := make(map[entities.SKU]int, len(rows))
+	for _, row := range rows {
+		action, err := s.importItem(ctx, actor, row, lines, dryRun)
+		if err := addToImportReport(&report, row.Line, row.Item.SKU, action, err); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// addToImportReport counts the outcome of a row in the report, only the
+// failures of the datastore are returned as they stop the import
+func addToImportReport(report *entities.ImportReport, line int, sku entities.SKU, action entities.ImportAction, err error) error {
+	if err != nil && !errors.Is(err, entities.ErrInvalidItem) {
+		return fmt.Errorf("unable to import line %d: %w", line, err)
+	}
+	switch action {
+	case entities.ImportActionCreate:
+		report.Created++
+	case entities.ImportActionUpdate:
+		report.Updated++
+	case entities.ImportActionRetire:
+		report.Retired++
+	case entities.ImportActionUnchanged:
+		report.Unchanged++
+	default:
+		report.Failed++
+		report.Errors = append(report.Errors, entities.ImportError{Line: line, SKU: sku, Error: err.Error()})
+	}
+	return nil
+}
+
+// importItem upserts the item of the row, lines maps the SKUs already imported to their line
+func (s *BookstoreService) importItem(ctx context.Context, actor entities.UserID, row entities.ImportRow, lines map[entities.SKU]int, dryRun bool) (entities.ImportAction, error) {
+	if row.Err != nil {
+		return entities.ImportActionFail, row.Err
+	}
+	item, err := normalizeImportedItem(row.Item)
+	if err != nil {
+		return entities.ImportActionFail, err
+	}
+	if row.Stock != nil && *row.Stock < 0 {
+		return entities.ImportActionFail, fmt.Errorf("%w: stock cannot be negative", entities.ErrInvalidItem)
+	}
+	if err := checkImportedOnce(lines, item.SKU, row.Line); err != nil {
+		return entities.ImportActionFail, err
+	}
+	return s.upsertItem(ctx, actor, item, row.Stock, dryRun)
+}
+
+// normalizeImportedItem normalizes an imported item, its creation date and
+// its retirement are kept by the catalog, not imported
+func normalizeImportedItem(item entities.Item) (entities.Item, error) {
+	item.CreatedAt, item.Retired = time.Time{}, false
+	return item.Normalize()
+}
+
+// checkImportedOnce records the line of the SKU, failing if an earlier line already imported it
+func checkImportedOnce(lines map[entities.SKU]int, sku entities.SKU, line int) error {
+	if previous, ok := lines[sku]; ok {
+		return fmt.Errorf("%w: sku %s was already imported on line %d", entities.ErrInvalidItem, sku, previous)
+	}
+	lines[sku] = line
+	return nil
+}
+
+// upsertItem adds the normalized item to the catalog, or replaces the details
+// of the existing item and sets its stock level if stock is not nil
+func (s *BookstoreService) upsertItem(ctx context.Context, actor entities.UserID, item entities.Item, stock *int, dryRun bool) (entities.ImportAction, error) {
+	existing, err := s.Datastore.GetItem(ctx, item.SKU)
+	if errors.Is(err, datastore.ErrItemNotFound) {
+		return entities.ImportActionCreate, s.addImportedItem(ctx, actor, item, stock, dryRun)
+	}
+	if err != nil {
+		return entities.ImportActionFail, err
+	}
+
+	item.CreatedAt = existing.CreatedAt
+	item.Retired = existing.Retired
+	detailsChanged := !reflect.DeepEqual(item, existing)
+	oldStock, err := s.Datastore.GetStock(ctx, item.SKU)
+	if err != nil {
+		return entities.ImportActionFail, err
+	}
+	stockChanged := stock != nil && *stock != oldStock
+	if !detailsChanged && !stockChanged {
+		return entities.ImportActionUnchanged, nil
+	}
+	if dryRun {
+		return entities.ImportActionUpdate, nil
+	}
+
+	if detailsChanged {
+		if _, err := s.Datastore.UpdateItem(ctx, item); err != nil {
+			return entities.ImportActionFail, err
+		}
+		err := s.recordCatalogChange(ctx, entities.CatalogChange{
+			Actor:    actor,
+			SKU:      item.SKU,
+			Action:   entities.CatalogActionUpdate,
+			OldPrice: &existing.Price,
+			NewPrice: &item.Price,
+		})
+		if err != nil {
+			return entities.ImportActionFail, err
+		}
+	}
+	if stockChanged {
+		newStock, err := s.Datastore.AddStock(ctx, item.SKU, *stock-oldStock)
+		if err != nil {
+			return entities.ImportActionFail, err
+		}
+		err = s.recordCatalogChange(ctx, entities.CatalogChange{
+			Actor:    actor,
+			SKU:      item.SKU,
+			Action:   entities.CatalogActionRestock,
+			OldStock: &oldStock,
+			NewStock: &newStock,
+		})
+		if err != nil {
+			return entities.ImportActionFail, err
+		}
+	}
+	return entities.ImportActionUpdate, nil
+}
+
+// addImportedItem adds an imported item to the catalog, without stock if none was given
+func (s *BookstoreService) addImportedItem(ctx context.Context, actor entities.UserID, item entities.Item, stock *int, dryRun bool) error {
+	if dryRun {
+		return nil
+	}
+	quantity := 0
+	if stock != nil {
+		quantity = *stock
+	}
+	if err := s.Datastore.AddItem(ctx, item, quantity); err != nil {
+		return err
+	}
+	return s.recordCatalogChange(ctx, entities.CatalogChange{
+		Actor:    actor,
+		SKU:      item.SKU,
+		Action:   entities.CatalogActionCreate,
+		NewPrice: &item.Price,
+		NewStock: &quantity,
+	})
+}
+
+// ExportItems lists every item of the catalog sorted by SKU, retired ones included, with its stock levels
+func (s *BookstoreService) ExportItems(ctx context.Context) ([]entities.ItemWithStock, error) {
+	items, err := s.Datastore.ListItems(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].SKU < items[j].SKU })
+	exported := make([]entities.ItemWithStock, 0, len(items))
+	for _, item := range items {
+		inStock, err := s.Datastore.GetStock(ctx, item.SKU)
+		if err != nil {
+			return nil, err
+		}
+		reserved, err := s.Datastore.GetReservedStock(ctx, item.SKU)
+		if err != nil {
+			return nil, err
+		}
+		exported = append(exported, entities.NewItemWithStock(item, inStock, reserved))
+	}
+	return exported, nil
+}
@@ -0,0 +1,85 @@
+// Package catalogio reads and writes catalog files, used to import supplier
+// feeds and to export the catalog along with its stock levels.
+//
+// Two formats are supported:
+//
+//   - CSV with a header row naming the columns, see Columns. Prices are
+//     decimals in major units of the currency column, which defaults to USD,
+//     and the authors and categories are separated by ListSeparator.
+//   - JSON Lines with one item per line, using the field names of the API.
+//
+// The reserved, available, retired and created_at columns are only written by
+// exports, they are ignored when importing.
+package catalogio
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+)
+
+// Format defines the format of a catalog file
+type Format string
+
+const (
+	FormatCSV   Format = "csv"
+	FormatJSONL Format = "jsonl"
+)
+
+// ErrUnknownFormat is returned for a catalog file format that is not supported
+var ErrUnknownFormat = errors.New("unknown catalog file format")
+
+// ParseFormat parses the name of a format, a file extension or a media type, e.g. "csv", ".jsonl" or "application/x-ndjson"
+func ParseFormat(name string) (Format, error) {
+	if mediaType, _, err := mime.ParseMediaType(name); err == nil {
+		name = mediaType
+	}
+	switch strings.ToLower(strings.TrimPrefix(name, ".")) {
+	case "csv", "text/csv":
+		return FormatCSV, nil
+	case "jsonl", "ndjson", "application/jsonl", "application/x-ndjson", "application/x-jsonlines":
+		return FormatJSONL, nil
+	}
+	return "", fmt.Errorf("%w %q, use csv or jsonl", ErrUnknownFormat, name)
+}
+
+// ContentType returns the media type of the format
+func (f Format) ContentType() string {
+	if f == FormatCSV {
+		return "text/csv; charset=utf-8"
+	}
+	return "application/x-ndjson"
+}
+
+// invalidRow wraps an error found while reading a row so that it is reported as an invalid item
+func invalidRow(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", entities.ErrInvalidItem, fmt.Sprintf(format, args...))
+}
+
+// Read reads the rows of a catalog file. Rows that cannot be read have their
+// Err set and are reported by the import; an error is only returned when the
+// file itself cannot be read, e.g. a CSV header naming an unknown column.
+func Read(r io.Reader, format Format) ([]entities.ImportRow, error) {
+	switch format {
+	case FormatCSV:
+		return readCSV(r)
+	case FormatJSONL:
+		return readJSONL(r)
+	}
+	return nil, fmt.Errorf("%w %q", ErrUnknownFormat, format)
+}
+
+// Write writes the items with their stock levels as a catalog file that can be imported back
+func Write(w io.Writer, format Format, items []entities.ItemWithStock) error {
+	switch format {
+	case FormatCSV:
+		return writeCSV(w, items)
+	case FormatJSONL:
+		return writeJSONL(w, items)
+	}
+	return fmt.Errorf("%w %q", ErrUnknownFormat, format)
+}
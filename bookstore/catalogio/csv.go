@@ -0,0 +1,190 @@
+package catalogio
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+)
+
+// ListSeparator separates the authors and the categories in a CSV cell
+const ListSeparator = "|"
+
+// Columns lists the columns of a CSV catalog file in the order they are exported
+var Columns = []string{
+	"sku", "name", "authors", "description", "price", "currency",
+	"isbn", "title_id", "format", "publisher", "publication_date", "page_count",
+	"weight_grams", "language", "cover_url", "categories", "stock",
+	"reserved", "available", "retired", "created_at",
+}
+
+// requiredColumns lists the columns a CSV catalog file must have
+var requiredColumns = []string{"sku", "name", "price"}
+
+// readCSV reads a CSV catalog file whose first row names the columns
+func readCSV(r io.Reader) ([]entities.ImportRow, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("the CSV file is empty, it needs a header row")
+	}
+	if err != nil {
+		return nil, err
+	}
+	columns, err := csvColumns(header)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []entities.ImportRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) && errors.Is(err, csv.ErrFieldCount) {
+			// the other rows can still be read
+			rows = append(rows, entities.ImportRow{Line: parseErr.StartLine, Err: invalidRow("expected %d columns, got %d", len(header), len(record))})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		row := entities.ImportRow{Line: line}
+		cells := make(map[string]string, len(columns))
+		for i, column := range columns {
+			cells[column] = strings.TrimSpace(record[i])
+		}
+		row.Item, row.Stock, row.Err = csvItem(cells)
+		rows = append(rows, row)
+	}
+}
+
+// csvColumns checks the header of a CSV catalog file and returns the column of each field
+func csvColumns(header []string) ([]string, error) {
+	known := make(map[string]bool, len(Columns))
+	for _, column := range Columns {
+		known[column] = true
+	}
+	columns := make([]string, len(header))
+	seen := make(map[string]bool, len(header))
+	for i, name := range header {
+		if i == 0 {
+			// spreadsheets often start their exports with a byte order mark
+			name = strings.TrimPrefix(name, "\ufeff")
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch {
+		case !known[name]:
+			return nil, fmt.Errorf("unknown column %q, the columns are %s", name, strings.Join(Columns, ", "))
+		case seen[name]:
+			return nil, fmt.Errorf("column %q appears twice", name)
+		}
+		seen[name] = true
+		columns[i] = name
+	}
+	for _, name := range requiredColumns {
+		if !seen[name] {
+			return nil, fmt.Errorf("missing column %q", name)
+		}
+	}
+	return columns, nil
+}
+
+// csvItem reads the item of a CSV row from its cells by column, along with its stock if the cell is not empty
+func csvItem(cells map[string]string) (entities.Item, *int, error) {
+	item := entities.Item{
+		SKU:             cells["sku"],
+		Name:            cells["name"],
+		Authors:         splitList(cells["authors"]),
+		Description:     cells["description"],
+		ISBN:            cells["isbn"],
+		TitleID:         cells["title_id"],
+		Format:          entities.Format(strings.ToLower(cells["format"])),
+		Publisher:       cells["publisher"],
+		PublicationDate: cells["publication_date"],
+		Language:        cells["language"],
+		CoverURL:        cells["cover_url"],
+		Categories:      splitList(cells["categories"]),
+	}
+	currency := cells["currency"]
+	if currency == "" {
+		currency = entities.DefaultCurrency
+	}
+	price, err := entities.ParseMoney(cells["price"], currency)
+	if err != nil {
+		return item, nil, invalidRow("price: %v", err)
+	}
+	item.Price = price
+	if cells["page_count"] != "" {
+		if item.PageCount, err = strconv.Atoi(cells["page_count"]); err != nil {
+			return item, nil, invalidRow("page count %q is not a number", cells["page_count"])
+		}
+	}
+	if cells["weight_grams"] != "" {
+		if item.WeightGrams, err = strconv.Atoi(cells["weight_grams"]); err != nil {
+			return item, nil, invalidRow("weight %q is not a number", cells["weight_grams"])
+		}
+	}
+	if cells["stock"] == "" {
+		return item, nil, nil
+	}
+	stock, err := strconv.Atoi(cells["stock"])
+	if err != nil {
+		return item, nil, invalidRow("stock %q is not a number", cells["stock"])
+	}
+	return item, &stock, nil
+}
+
+// splitList splits a cell holding a list, an empty cell is an empty list
+func splitList(cell string) []string {
+	if cell == "" {
+		return nil
+	}
+	return strings.Split(cell, ListSeparator)
+}
+
+// writeCSV writes the items as a CSV catalog file with all the columns
+func writeCSV(w io.Writer, items []entities.ItemWithStock) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(Columns); err != nil {
+		return err
+	}
+	for _, item := range items {
+		pageCount, weight := "", ""
+		if item.PageCount != 0 {
+			pageCount = strconv.Itoa(item.PageCount)
+		}
+		if item.WeightGrams != 0 {
+			weight = strconv.Itoa(item.WeightGrams)
+		}
+		record := []string{
+			item.SKU, item.Name, strings.Join(item.Authors, ListSeparator), item.Description,
+			item.Price.Decimal(), item.Price.Currency,
+			item.ISBN, item.TitleID, string(item.Format), item.Publisher, item.PublicationDate, pageCount,
+			weight, item.Language, item.CoverURL, strings.Join(item.Categories, ListSeparator), strconv.Itoa(item.InStock),
+			strconv.Itoa(item.Reserved), strconv.Itoa(item.Available), strconv.FormatBool(item.Retired), formatTime(item.CreatedAt),
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// formatTime formats the time in RFC 3339, or returns "" for the zero time
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
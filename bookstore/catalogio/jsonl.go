@@ -0,0 +1,61 @@
+package catalogio
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+)
+
+// maxJSONLLineSize is the longest line of a JSON Lines catalog file
+const maxJSONLLineSize = 1 << 20
+
+// jsonlRecord defines a line of a JSON Lines catalog file
+type jsonlRecord struct {
+	entities.Item
+	// Stock is the stock level to set, omitting it leaves the stock of an existing item unchanged
+	Stock *int `json:"stock,omitempty"`
+	// Reserved and Available are only written by exports
+	Reserved  *int `json:"reserved,omitempty"`
+	Available *int `json:"available,omitempty"`
+}
+
+// readJSONL reads a JSON Lines catalog file, blank lines are skipped
+func readJSONL(r io.Reader) ([]entities.ImportRow, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxJSONLLineSize)
+	var rows []entities.ImportRow
+	for line := 1; scanner.Scan(); line++ {
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		var record jsonlRecord
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		row := entities.ImportRow{Line: line}
+		if err := decoder.Decode(&record); err != nil {
+			row.Err = invalidRow("%v", err)
+		} else if decoder.More() {
+			row.Err = invalidRow("a line holds a single item")
+		}
+		row.Item, row.Stock = record.Item, record.Stock
+		rows = append(rows, row)
+	}
+	return rows, scanner.Err()
+}
+
+// writeJSONL writes the items as a JSON Lines catalog file
+func writeJSONL(w io.Writer, items []entities.ItemWithStock) error {
+	encoder := json.NewEncoder(w)
+	for _, item := range items {
+		inStock, reserved, available := item.InStock, item.Reserved, item.Available
+		record := jsonlRecord{Item: item.Item, Stock: &inStock, Reserved: &reserved, Available: &available}
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
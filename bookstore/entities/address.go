@@ -0,0 +1,65 @@
+package entities
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrInvalidAddress is returned when an address fails validation
+var ErrInvalidAddress = errors.New("invalid address")
+
+// Address defines a postal address orders are shipped to
+type Address struct {
+	Name  string `json:"name"`
+	Line1 string `json:"line1"`
+	Line2 string `json:"line2,omitempty"`
+	City  string `json:"city"`
+	// Region is the state, province or county code, e.g. "CA" in the US
+	Region     string `json:"region,omitempty"`
+	PostalCode string `json:"postal_code,omitempty"`
+	// Country is the ISO 3166-1 alpha-2 code of the country, e.g. "US"
+	Country string `json:"country"`
+}
+
+// Normalize returns the address with its fields trimmed and its codes in upper case
+func (a Address) Normalize() Address {
+	a.Name = strings.TrimSpace(a.Name)
+	a.Line1 = strings.TrimSpace(a.Line1)
+	a.Line2 = strings.TrimSpace(a.Line2)
+	a.City = strings.TrimSpace(a.City)
+	a.Region = strings.ToUpper(strings.TrimSpace(a.Region))
+	a.PostalCode = strings.ToUpper(strings.TrimSpace(a.PostalCode))
+	a.Country = strings.ToUpper(strings.TrimSpace(a.Country))
+	return a
+}
+
+// Validate checks that orders can be shipped to the address
+func (a Address) Validate() error {
+	switch {
+	case a.Name == "":
+		return fmt.Errorf("%w: name is required", ErrInvalidAddress)
+	case a.Line1 == "":
+		return fmt.Errorf("%w: line1 is required", ErrInvalidAddress)
+	case a.City == "":
+		return fmt.Errorf("%w: city is required", ErrInvalidAddress)
+	case len(a.Country) != 2:
+		return fmt.Errorf("%w: country needs a 2 letter ISO code", ErrInvalidAddress)
+	}
+	return nil
+}
+
+// SavedAddress defines an address of the address book of a user
+type SavedAddress struct {
+	ID string `json:"id"`
+	Address
+}
+
+// CheckoutRequest defines the structure of a checkout request, the body is optional
+type CheckoutRequest struct {
+	// ShippingAddress is the address the order ships to, or AddressID the ID of one of the address book
+	ShippingAddress *Address `json:"shipping_address,omitempty"`
+	AddressID       string   `json:"address_id,omitempty"`
+	// ShippingMethod is the ID of the shipping method, see ShippingRate
+	ShippingMethod string `json:"shipping_method,omitempty"`
+}
@@ -0,0 +1,196 @@
+package entities
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Errors returned when capturing the payment of an order
+var (
+	// ErrInvalidCapture is returned when a capture request is malformed
+	ErrInvalidCapture = errors.New("invalid capture")
+	// ErrCaptureNotAllowed is returned when the payment of an order cannot be
+	// captured as requested, e.g. for more than what is left of its authorization
+	ErrCaptureNotAllowed = errors.New("capture not allowed")
+)
+
+// CaptureStatus defines the state of a capture with the payment gateway
+type CaptureStatus string
+
+const (
+	// CapturePending captures were recorded but the gateway did not answer yet,
+	// they count against the amount left to capture
+	CapturePending   CaptureStatus = "pending"
+	CaptureSucceeded CaptureStatus = "succeeded"
+	CaptureFailed    CaptureStatus = "failed"
+)
+
+// Capture defines part or all of an authorization charged to the user, e.g. for a shipment
+type Capture struct {
+	ID     string        `json:"id"`
+	Amount Money         `json:"amount"`
+	Status CaptureStatus `json:"status"`
+	// Final captures release the rest of the authorization
+	Final bool `json:"final,omitempty"`
+	// Confirmation is the ID of the capture at the payment gateway
+	Confirmation string `json:"confirmation,omitempty"`
+	// Failure is why the payment gateway declined the capture
+	Failure   string    `json:"failure,omitempty"`
+	By        UserID    `json:"by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Authorization defines the payment of an order held on the card of the user.
+// The order stays authorized until it was captured in full, or until a final
+// capture, and is then paid; what was not captured is voided when the order
+// is cancelled or the authorization expires.
+type Authorization struct {
+	// ID is the ID of the authorization at the payment gateway
+	ID     string `json:"id"`
+	Amount Money  `json:"amount"`
+	// Card is the card the amount is held on
+	Card     *PaymentCard `json:"card,omitempty"`
+	Captures []Capture    `json:"captures,omitempty"`
+	// Voided is set once what was not captured was released
+	Voided    bool      `json:"voided,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CaptureRequest defines the structure of an admin request to capture the payment of an order
+type CaptureRequest struct {
+	// Amount defaults to what is left to capture of the authorization
+	Amount *Money `json:"amount,omitempty"`
+	// Final releases what is left of the authorization once captured, e.g. for the last shipment
+	Final bool `json:"final,omitempty"`
+}
+
+// Captured returns what the succeeded captures charged
+func (a *Authorization) Captured() Money {
+	captured := Money{Currency: a.Amount.Currency}
+	for _, capture := range a.Captures {
+		if capture.Status == CaptureSucceeded {
+			captured = captured.Add(capture.Amount)
+		}
+	}
+	return captured
+}
+
+// Uncaptured returns what is held and was not captured, which voiding releases
+func (a *Authorization) Uncaptured() Money {
+	return a.Amount.Sub(a.Captured())
+}
+
+// Capturable returns what is left to capture of the authorization of the
+// order, the pending captures are deducted; nothing once it was voided
+func (o *Order) Capturable() Money {
+	if o.Authorization == nil || o.Authorization.Voided {
+		return Money{Currency: o.AmountDue.Currency}
+	}
+	left := o.Authorization.Amount
+	for _, capture := range o.Authorization.Captures {
+		if capture.Status != CaptureFailed {
+			left = left.Sub(capture.Amount)
+		}
+	}
+	return left
+}
+
+// AddCapture records a pending capture of the order for the request and
+// returns it; it fails if the order is not authorized or if the amount is
+// more than what is left to capture
+func (o *Order) AddCapture(req CaptureRequest, id string, by UserID, now time.Time) (Capture, error) {
+	if status := o.CurrentStatus(); status != OrderStatusAuthorized || o.Authorization == nil {
+		return Capture{}, fmt.Errorf("%w: order %s is %s", ErrCaptureNotAllowed, o.ID, status)
+	}
+	left := o.Capturable()
+	capture := Capture{
+		ID:        id,
+		Amount:    left,
+		Status:    CapturePending,
+		Final:     req.Final,
+		By:        by,
+		CreatedAt: now,
+	}
+	if req.Amount != nil {
+		capture.Amount = *req.Amount
+	}
+	switch {
+	case !capture.Amount.SameCurrency(left):
+		return Capture{}, fmt.Errorf("%w: the amount must be in %s", ErrInvalidCapture, left.Currency)
+	case req.Amount != nil && !capture.Amount.IsPositive():
+		return Capture{}, fmt.Errorf("%w: the amount must be positive", ErrInvalidCapture)
+	case !left.IsPositive():
+		return Capture{}, fmt.Errorf("%w: nothing is left to capture of order %s", ErrCaptureNotAllowed, o.ID)
+	case capture.Amount.Cmp(left) > 0:
+		return Capture{}, fmt.Errorf("%w: only %s is left to capture", ErrCaptureNotAllowed, left)
+	}
+	capture.Amount.Currency = left.Currency
+
+	o.Authorization.Captures = append(o.Authorization.Captures, capture)
+	return capture, nil
+}
+
+// CompleteCapture marks a pending capture of the order as succeeded and
+// returns it. A final capture releases the rest of the authorization, and the
+// order moves to paid once nothing is left to capture.
+func (o *Order) CompleteCapture(id string, confirmation string, now time.Time) (Capture, error) {
+	capture, err := o.pendingCapture(id)
+	if err != nil {
+		return Capture{}, err
+	}
+	capture.Status = CaptureSucceeded
+	capture.Confirmation = confirmation
+	if capture.Final {
+		o.Authorization.Voided = true
+	}
+	if !o.Capturable().IsPositive() && o.CurrentStatus().CanTransitionTo(OrderStatusPaid) {
+		if err := o.TransitionTo(OrderStatusPaid, now); err != nil {
+			return Capture{}, err
+		}
+	}
+	return *capture, nil
+}
+
+// FailCapture marks a pending capture of the order as declined, its amount can be captured again
+func (o *Order) FailCapture(id string, failure string) error {
+	capture, err := o.pendingCapture(id)
+	if err != nil {
+		return err
+	}
+	capture.Status = CaptureFailed
+	capture.Failure = failure
+	return nil
+}
+
+// ReleaseAuthorization marks what was not captured of the authorization of
+// the order as voided, which the payment gateway must then be asked to do;
+// it fails while a capture is pending
+func (o *Order) ReleaseAuthorization() error {
+	if o.Authorization == nil || o.Authorization.Voided {
+		return nil
+	}
+	for _, capture := range o.Authorization.Captures {
+		if capture.Status == CapturePending {
+			return fmt.Errorf("%w: capture %s of order %s is in progress", ErrCaptureNotAllowed, capture.ID, o.ID)
+		}
+	}
+	o.Authorization.Voided = true
+	return nil
+}
+
+// pendingCapture returns the pending capture of the order with the ID
+func (o *Order) pendingCapture(id string) (*Capture, error) {
+	if o.Authorization != nil {
+		for i := range o.Authorization.Captures {
+			capture := &o.Authorization.Captures[i]
+			if capture.ID == id {
+				if capture.Status != CapturePending {
+					return nil, fmt.Errorf("%w: capture %s is %s", ErrCaptureNotAllowed, id, capture.Status)
+				}
+				return capture, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%w: unknown capture %s", ErrInvalidCapture, id)
+}
@@ -0,0 +1,97 @@
+package entities
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func testAuthorizedOrder() Order {
+	order := testPaidOrder()
+	order.Status = OrderStatusAuthorized
+	order.Authorization = &Authorization{ID: "payment-1", Amount: order.AmountDue}
+	return order
+}
+
+func TestOrderAddCapture(t *testing.T) {
+	usd := func(amount int64) *Money {
+		m := NewMoney(amount, "USD")
+		return &m
+	}
+	tests := []struct {
+		name   string
+		req    CaptureRequest
+		amount int64
+		err    error
+	}{
+		{"full by default", CaptureRequest{}, 5000, nil},
+		{"partial", CaptureRequest{Amount: usd(2000)}, 2000, nil},
+		{"negative amount", CaptureRequest{Amount: usd(-100)}, 0, ErrInvalidCapture},
+		{"other currency", CaptureRequest{Amount: &Money{Amount: 100, Currency: "EUR"}}, 0, ErrInvalidCapture},
+		{"more than authorized", CaptureRequest{Amount: usd(5001)}, 0, ErrCaptureNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order := testAuthorizedOrder()
+			capture, err := order.AddCapture(tt.req, "capture-1", "admin", time.Now())
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) || len(order.Authorization.Captures) != 0 {
+					t.Fatalf("expected %v without recording the capture, got %v and %+v", tt.err, err, order.Authorization.Captures)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if capture.Status != CapturePending || capture.Amount != NewMoney(tt.amount, "USD") || len(order.Authorization.Captures) != 1 {
+				t.Errorf("unexpected capture %+v", capture)
+			}
+			if left := order.Capturable(); left != NewMoney(5000-tt.amount, "USD") {
+				t.Errorf("expected the pending capture to be deducted, got %v left", left)
+			}
+		})
+	}
+
+	paid := testPaidOrder()
+	if _, err := paid.AddCapture(CaptureRequest{}, "capture-1", "admin", time.Now()); !errors.Is(err, ErrCaptureNotAllowed) {
+		t.Errorf("expected capturing an order that is not authorized to fail, got %v", err)
+	}
+}
+
+func TestOrderCaptureInParts(t *testing.T) {
+	order := testAuthorizedOrder()
+	now := time.Now()
+	first, _ := order.AddCapture(CaptureRequest{Amount: &Money{Amount: 3000, Currency: "USD"}}, "capture-1", "admin", now)
+	if _, err := order.AddCapture(CaptureRequest{}, "capture-2", "admin", now); err != nil {
+		t.Fatal(err)
+	}
+	if err := order.ReleaseAuthorization(); !errors.Is(err, ErrCaptureNotAllowed) {
+		t.Errorf("expected releasing the authorization to wait for the pending captures, got %v", err)
+	}
+	if err := order.FailCapture("capture-2", "declined"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := order.CompleteCapture(first.ID, "confirmation-1", now); err != nil {
+		t.Fatal(err)
+	}
+	if order.Captured() != NewMoney(3000, "USD") || order.CurrentStatus() != OrderStatusAuthorized {
+		t.Errorf("expected a partly captured order to stay authorized, got %v captured and %s", order.Captured(), order.CurrentStatus())
+	}
+	if _, err := order.CompleteCapture(first.ID, "confirmation-1", now); !errors.Is(err, ErrCaptureNotAllowed) {
+		t.Errorf("expected completing a capture twice to fail, got %v", err)
+	}
+
+	last, err := order.AddCapture(CaptureRequest{Amount: &Money{Amount: 1000, Currency: "USD"}, Final: true}, "capture-3", "admin", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := order.CompleteCapture(last.ID, "confirmation-3", now); err != nil {
+		t.Fatal(err)
+	}
+	if order.CurrentStatus() != OrderStatusPaid || !order.Authorization.Voided || order.Authorization.Uncaptured() != NewMoney(1000, "USD") {
+		t.Errorf("expected the final capture to release the rest and pay the order, got %s and %+v", order.CurrentStatus(), order.Authorization)
+	}
+	if order.Refundable() != NewMoney(4000, "USD") {
+		t.Errorf("expected only the captured amount to be refundable, got %v", order.Refundable())
+	}
+}
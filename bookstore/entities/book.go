@@ -0,0 +1,227 @@
+package entities
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Format defines the physical or digital form in which a title is sold, each
+// format of a title is a separate SKU sharing the same TitleID
+type Format string
+
+const (
+	FormatHardcover Format = "hardcover"
+	FormatPaperback Format = "paperback"
+	FormatEbook     Format = "ebook"
+)
+
+// Valid reports whether the format is one of the known formats
+func (f Format) Valid() bool {
+	switch f {
+	case FormatHardcover, FormatPaperback, FormatEbook:
+		return true
+	}
+	return false
+}
+
+// Digital reports whether the format is delivered without shipping, items without a format are shipped
+func (f Format) Digital() bool {
+	return f == FormatEbook
+}
+
+// CategorySeparator separates the levels of a category path, e.g. "Fiction/Science Fiction"
+const CategorySeparator = "/"
+
+// NormalizeISBN checks the checksum of an ISBN-10 or ISBN-13, ignoring
+// hyphens and spaces, and returns it as an ISBN-13
+func NormalizeISBN(isbn string) (string, error) {
+	digits := strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(isbn))
+	switch len(digits) {
+	case 10:
+		if !validISBN10(digits) {
+			return "", fmt.Errorf("%w: invalid ISBN-10 %q", ErrInvalidItem, isbn)
+		}
+		isbn13 := "978" + digits[:9]
+		return isbn13 + string(isbn13CheckDigit(isbn13)), nil
+	case 13:
+		if !allDigits(digits) || isbn13CheckDigit(digits[:12]) != digits[12] {
+			return "", fmt.Errorf("%w: invalid ISBN-13 %q", ErrInvalidItem, isbn)
+		}
+		return digits, nil
+	}
+	return "", fmt.Errorf("%w: an ISBN has 10 or 13 digits, got %q", ErrInvalidItem, isbn)
+}
+
+// validISBN10 checks the digits and the mod 11 checksum of an ISBN-10, whose check digit may be X
+func validISBN10(digits string) bool {
+	if !allDigits(digits[:9]) {
+		return false
+	}
+	sum := 0
+	for i := 0; i < 9; i++ {
+		sum += (10 - i) * int(digits[i]-'0')
+	}
+	switch check := digits[9]; {
+	case check == 'X':
+		sum += 10
+	case check >= '0' && check <= '9':
+		sum += int(check - '0')
+	default:
+		return false
+	}
+	return sum%11 == 0
+}
+
+// isbn13CheckDigit computes the check digit of the first 12 digits of an ISBN-13
+func isbn13CheckDigit(digits string) byte {
+	sum := 0
+	for i := 0; i < 12; i++ {
+		weight := 1
+		if i%2 == 1 {
+			weight = 3
+		}
+		sum += weight * int(digits[i]-'0')
+	}
+	return byte('0' + (10-sum%10)%10)
+}
+
+// allDigits reports whether s only has ASCII digits
+func allDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// NormalizeCategory trims the levels of a category path and drops the empty ones
+func NormalizeCategory(category string) string {
+	var levels []string
+	for _, level := range strings.Split(category, CategorySeparator) {
+		if level = strings.Join(strings.Fields(level), " "); level != "" {
+			levels = append(levels, level)
+		}
+	}
+	return strings.Join(levels, CategorySeparator)
+}
+
+// InCategory reports whether the item is in the category or in one of its sub-categories
+func (i Item) InCategory(category string) bool {
+	category = strings.ToLower(NormalizeCategory(category))
+	for _, c := range i.Categories {
+		c = strings.ToLower(c)
+		if c == category || strings.HasPrefix(c, category+CategorySeparator) {
+			return true
+		}
+	}
+	return false
+}
+
+// validPublicationDate checks a publication date, which may only have a year or a month
+func validPublicationDate(date string) bool {
+	for _, layout := range []string{"2006-01-02", "2006-01", "2006"} {
+		if _, err := time.Parse(layout, date); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// validLanguage checks an ISO 639-1 or 639-2 language code, e.g. "en" or "fre"
+func validLanguage(language string) bool {
+	if len(language) != 2 && len(language) != 3 {
+		return false
+	}
+	for _, r := range language {
+		if r < 'a' || r > 'z' {
+			return false
+		}
+	}
+	return true
+}
+
+// validCoverURL checks that the cover image is an absolute http or https URL
+func validCoverURL(cover string) bool {
+	u, err := url.Parse(cover)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// Normalize returns the item with its ISBN as an ISBN-13, its language in
+// lower case and its authors and categories trimmed, sorted and deduplicated
+// where it makes sense, then validates it
+func (i Item) Normalize() (Item, error) {
+	if i.ISBN != "" {
+		isbn, err := NormalizeISBN(i.ISBN)
+		if err != nil {
+			return Item{}, err
+		}
+		i.ISBN = isbn
+	}
+	i.Name = strings.TrimSpace(i.Name)
+	i.Publisher = strings.TrimSpace(i.Publisher)
+	i.Language = strings.ToLower(strings.TrimSpace(i.Language))
+	i.Authors = normalizeList(i.Authors, strings.TrimSpace, false)
+	i.Categories = normalizeList(i.Categories, NormalizeCategory, true)
+	return i, i.Validate()
+}
+
+// normalizeList normalizes each entry of the list, dropping the empty and duplicate ones, and sorts it if asked
+func normalizeList(list []string, normalize func(string) string, sorted bool) []string {
+	var result []string
+	seen := make(map[string]bool, len(list))
+	for _, entry := range list {
+		entry = normalize(entry)
+		if entry != "" && !seen[entry] {
+			seen[entry] = true
+			result = append(result, entry)
+		}
+	}
+	if sorted {
+		sort.Strings(result)
+	}
+	return result
+}
+
+// validateBook checks the book metadata of the item
+func (i Item) validateBook() error {
+	switch {
+	case i.ISBN != "" && (len(i.ISBN) != 13 || !allDigits(i.ISBN) || isbn13CheckDigit(i.ISBN) != i.ISBN[12]):
+		return fmt.Errorf("%w: isbn must be a valid ISBN-13", ErrInvalidItem)
+	case i.Format != "" && !i.Format.Valid():
+		return fmt.Errorf("%w: unknown format %q", ErrInvalidItem, i.Format)
+	case i.PublicationDate != "" && !validPublicationDate(i.PublicationDate):
+		return fmt.Errorf("%w: publication date must be YYYY, YYYY-MM or YYYY-MM-DD", ErrInvalidItem)
+	case i.PageCount < 0:
+		return fmt.Errorf("%w: page count cannot be negative", ErrInvalidItem)
+	case i.WeightGrams < 0:
+		return fmt.Errorf("%w: weight cannot be negative", ErrInvalidItem)
+	case i.Language != "" && !validLanguage(i.Language):
+		return fmt.Errorf("%w: language must be an ISO 639 code", ErrInvalidItem)
+	case i.CoverURL != "" && !validCoverURL(i.CoverURL):
+		return fmt.Errorf("%w: cover url must be an absolute http or https URL", ErrInvalidItem)
+	case strings.ContainsAny(i.TitleID, "/?#% \t\n"):
+		return fmt.Errorf("%w: title id %q contains characters not allowed in a URL path", ErrInvalidItem, i.TitleID)
+	}
+	return nil
+}
+
+// TitleFormat defines another format in which the title of an item is sold
+type TitleFormat struct {
+	SKU       SKU    `json:"sku"`
+	Format    Format `json:"format,omitempty"`
+	Price     Money  `json:"price"`
+	Available int    `json:"available"`
+}
+
+// CategoryNode defines a category of the catalog along with its sub-categories
+type CategoryNode struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	// Items is the number of items in the category, including its sub-categories
+	Items    int             `json:"items"`
+	Children []*CategoryNode `json:"children,omitempty"`
+}
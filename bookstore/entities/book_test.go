@@ -0,0 +1,83 @@
+package entities
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeISBN(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "978-0-441-17271-9", want: "9780441172719"},
+		{in: "0-441-17271-7", want: "9780441172719"},
+		{in: "080442957X", want: "9780804429573"},
+		{in: "080442957x", want: "9780804429573"},
+		{in: "978 0 441 17271 9", want: "9780441172719"},
+		{in: "9780441172718", wantErr: true},
+		{in: "0441172718", wantErr: true},
+		{in: "04411727X7", wantErr: true},
+		{in: "978044117271", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := NormalizeISBN(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("NormalizeISBN(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if err != nil && !errors.Is(err, ErrInvalidItem) {
+			t.Errorf("NormalizeISBN(%q) error = %v, want ErrInvalidItem", tt.in, err)
+		}
+		if got != tt.want {
+			t.Errorf("NormalizeISBN(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestItemNormalize(t *testing.T) {
+	item := Item{
+		SKU:        "dune-pb",
+		Name:       "  Dune ",
+		Price:      NewMoney(999, "USD"),
+		ISBN:       "0-441-17271-7",
+		Format:     FormatPaperback,
+		Language:   " EN ",
+		Authors:    []string{" Frank Herbert", "Frank Herbert", ""},
+		Categories: []string{"Fiction / Science  Fiction", "Classics", "Fiction/Science Fiction/"},
+	}
+	got, err := item.Normalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "Dune" || got.ISBN != "9780441172719" || got.Language != "en" {
+		t.Errorf("unexpected normalized item %+v", got)
+	}
+	if want := []string{"Frank Herbert"}; !reflect.DeepEqual(got.Authors, want) {
+		t.Errorf("authors = %q, want %q", got.Authors, want)
+	}
+	if want := []string{"Classics", "Fiction/Science Fiction"}; !reflect.DeepEqual(got.Categories, want) {
+		t.Errorf("categories = %q, want %q", got.Categories, want)
+	}
+	if !got.InCategory("fiction") || !got.InCategory("Fiction/Science Fiction") || got.InCategory("Fict") {
+		t.Error("expected the item to only be in Fiction and its sub-categories")
+	}
+
+	for name, invalid := range map[string]Item{
+		"isbn":             {ISBN: "0441172718"},
+		"format":           {Format: "scroll"},
+		"publication date": {PublicationDate: "1965-13"},
+		"page count":       {PageCount: -1},
+		"language":         {Language: "english"},
+		"cover url":        {CoverURL: "ftp://covers.example.com/dune.jpg"},
+		"title id":         {TitleID: "dune/1965"},
+	} {
+		invalid.SKU, invalid.Name, invalid.Price = "book", "Book", NewMoney(100, "USD")
+		if _, err := invalid.Normalize(); !errors.Is(err, ErrInvalidItem) {
+			t.Errorf("expected an invalid %s to be rejected, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package entities
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidCard is returned when the details of a card fail validation
+var ErrInvalidCard = errors.New("invalid card")
+
+// CardBrand defines the network of a card, known from the first digits of its number
+type CardBrand string
+
+const (
+	CardBrandVisa       CardBrand = "visa"
+	CardBrandMastercard CardBrand = "mastercard"
+	CardBrandAmex       CardBrand = "amex"
+	CardBrandDiscover   CardBrand = "discover"
+	CardBrandUnknown    CardBrand = "unknown"
+)
+
+// PaymentCard defines a card without its number nor CVV, as the tokenization
+// vault gives it out; only the vault and the payment gateway see the details
+type PaymentCard struct {
+	// Token stands for the card in the payment requests
+	Token       string    `json:"token,omitempty"`
+	Brand       CardBrand `json:"brand"`
+	Last4       string    `json:"last4"`
+	ExpiryMonth int       `json:"expiry_month"`
+	ExpiryYear  int       `json:"expiry_year"`
+}
+
+// VaultCard defines a token of the tokenization vault as it is stored, with
+// the brand, last four digits and expiry of its card but never its number
+type VaultCard struct {
+	Token  string `json:"token"`
+	UserID string `json:"user_id"`
+	// Fingerprint identifies the card of the user, tokenizing it again gives
+	// the same token; it is keyed with a secret that is not stored with it
+	Fingerprint string      `json:"fingerprint"`
+	Card        PaymentCard `json:"card"`
+}
+
+// PaymentMethod defines a card a user saved to pay with
+type PaymentMethod struct {
+	ID string `json:"id"`
+	PaymentCard
+	// Default is the payment method of the purchases confirmed without one
+	Default   bool      `json:"default"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// PaymentSource defines what a purchase is paid with: the card of a token of
+// the vault, a saved payment method or, without either, the default payment
+// method of the user
+type PaymentSource struct {
+	CardToken       string `json:"card_token,omitempty"`
+	PaymentMethodID string `json:"payment_method_id,omitempty"`
+}
+
+// PaymentMethodRequest defines the structure of a request to save a card, the
+// card of a token of the vault or the details of a card, which are tokenized first
+type PaymentMethodRequest struct {
+	CardToken         string             `json:"card_token,omitempty"`
+	CreditCardDetails *CreditCardDetails `json:"credit_card_details,omitempty"`
+	// Default makes the card the default payment method, the first one saved always is
+	Default bool `json:"default,omitempty"`
+}
+
+// Expired tells if the card is no longer valid at now, cards are valid through their expiry month
+func (c PaymentCard) Expired(now time.Time) bool {
+	end := time.Date(c.ExpiryYear, time.Month(c.ExpiryMonth)+1, 1, 0, 0, 0, 0, now.Location())
+	return !now.Before(end)
+}
+
+// Normalize returns the details with the spaces and dashes of the number removed and the other fields trimmed
+func (d CreditCardDetails) Normalize() CreditCardDetails {
+	d.FirstName = strings.TrimSpace(d.FirstName)
+	d.LastName = strings.TrimSpace(d.LastName)
+	d.Number = strings.NewReplacer(" ", "", "-", "").Replace(d.Number)
+	d.Expiration = strings.TrimSpace(d.Expiration)
+	d.CVV = strings.TrimSpace(d.CVV)
+	return d
+}
+
+// Validate checks the number of the normalized details against its Luhn
+// checksum, that the card is not expired at now and the format of the CVV,
+// and returns the card without its number nor CVV
+func (d CreditCardDetails) Validate(now time.Time) (PaymentCard, error) {
+	if len(d.Number) < 12 || len(d.Number) > 19 || !digitsOnly(d.Number) {
+		return PaymentCard{}, fmt.Errorf("%w: the number needs 12 to 19 digits", ErrInvalidCard)
+	}
+	if !luhnValid(d.Number) {
+		return PaymentCard{}, fmt.Errorf("%w: the number is mistyped", ErrInvalidCard)
+	}
+	month, year, err := parseExpiration(d.Expiration)
+	if err != nil {
+		return PaymentCard{}, err
+	}
+	card := PaymentCard{
+		Brand:       cardBrand(d.Number),
+		Last4:       d.Number[len(d.Number)-4:],
+		ExpiryMonth: month,
+		ExpiryYear:  year,
+	}
+	if card.Expired(now) {
+		return PaymentCard{}, fmt.Errorf("%w: the card expired", ErrInvalidCard)
+	}
+	cvvLength := 3
+	if card.Brand == CardBrandAmex {
+		cvvLength = 4
+	}
+	if len(d.CVV) != cvvLength || !digitsOnly(d.CVV) {
+		return PaymentCard{}, fmt.Errorf("%w: the CVV needs %d digits", ErrInvalidCard, cvvLength)
+	}
+	return card, nil
+}
+
+// parseExpiration parses an expiration date formatted MM/YY or MM/YYYY
+func parseExpiration(expiration string) (int, int, error) {
+	parts := strings.Split(expiration, "/")
+	if len(parts) != 2 || len(parts[0]) != 2 || (len(parts[1]) != 2 && len(parts[1]) != 4) || !digitsOnly(parts[0]) || !digitsOnly(parts[1]) {
+		return 0, 0, fmt.Errorf("%w: the expiration needs to be formatted MM/YY", ErrInvalidCard)
+	}
+	month, _ := strconv.Atoi(parts[0])
+	year, _ := strconv.Atoi(parts[1])
+	if month < 1 || month > 12 {
+		return 0, 0, fmt.Errorf("%w: the expiration month %02d does not exist", ErrInvalidCard, month)
+	}
+	if len(parts[1]) == 2 {
+		year += 2000
+	}
+	return month, year, nil
+}
+
+// luhnValid tells if the digits end with their Luhn check digit
+func luhnValid(number string) bool {
+	sum := 0
+	for i := 0; i < len(number); i++ {
+		digit := int(number[len(number)-1-i] - '0')
+		if i%2 == 1 {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+	}
+	return sum%10 == 0
+}
+
+// cardBrand returns the brand of a card number from its first digits
+func cardBrand(number string) CardBrand {
+	prefix := func(n int) int {
+		p, _ := strconv.Atoi(number[:n])
+		return p
+	}
+	switch {
+	case number[0] == '4':
+		return CardBrandVisa
+	case prefix(2) >= 51 && prefix(2) <= 55, prefix(4) >= 2221 && prefix(4) <= 2720:
+		return CardBrandMastercard
+	case prefix(2) == 34, prefix(2) == 37:
+		return CardBrandAmex
+	case prefix(4) == 6011, prefix(2) == 65, prefix(3) >= 644 && prefix(3) <= 649:
+		return CardBrandDiscover
+	}
+	return CardBrandUnknown
+}
+
+// digitsOnly tells if s is made of decimal digits only
+func digitsOnly(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
@@ -0,0 +1,59 @@
+package entities
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCreditCardDetailsValidate(t *testing.T) {
+	now := time.Date(2026, time.June, 15, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		details CreditCardDetails
+		brand   CardBrand
+		err     bool
+	}{
+		{"visa", CreditCardDetails{Number: "4242 4242 4242 4242", Expiration: "12/30", CVV: "123"}, CardBrandVisa, false},
+		{"mastercard", CreditCardDetails{Number: "5555-5555-5555-4444", Expiration: "06/2026", CVV: "123"}, CardBrandMastercard, false},
+		{"mastercard 2 series", CreditCardDetails{Number: "2223003122003222", Expiration: "01/27", CVV: "123"}, CardBrandMastercard, false},
+		{"amex", CreditCardDetails{Number: "378282246310005", Expiration: "01/27", CVV: "1234"}, CardBrandAmex, false},
+		{"discover", CreditCardDetails{Number: "6011111111111117", Expiration: "01/27", CVV: "123"}, CardBrandDiscover, false},
+		{"mistyped number", CreditCardDetails{Number: "4242424242424241", Expiration: "12/30", CVV: "123"}, "", true},
+		{"short number", CreditCardDetails{Number: "123456789", Expiration: "12/30", CVV: "123"}, "", true},
+		{"letters", CreditCardDetails{Number: "4242abcd42424242", Expiration: "12/30", CVV: "123"}, "", true},
+		{"expired", CreditCardDetails{Number: "4242424242424242", Expiration: "05/26", CVV: "123"}, "", true},
+		{"no such month", CreditCardDetails{Number: "4242424242424242", Expiration: "13/30", CVV: "123"}, "", true},
+		{"malformed expiration", CreditCardDetails{Number: "4242424242424242", Expiration: "2030-12", CVV: "123"}, "", true},
+		{"short CVV", CreditCardDetails{Number: "4242424242424242", Expiration: "12/30", CVV: "12"}, "", true},
+		{"amex needs 4 digits", CreditCardDetails{Number: "378282246310005", Expiration: "12/30", CVV: "123"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			card, err := tt.details.Normalize().Validate(now)
+			if tt.err {
+				if !errors.Is(err, ErrInvalidCard) {
+					t.Errorf("expected ErrInvalidCard, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			number := tt.details.Normalize().Number
+			if card.Brand != tt.brand || card.Last4 != number[len(number)-4:] {
+				t.Errorf("expected a %s card ending in %s, got %+v", tt.brand, number[len(number)-4:], card)
+			}
+		})
+	}
+}
+
+func TestPaymentCardExpired(t *testing.T) {
+	card := PaymentCard{ExpiryMonth: 12, ExpiryYear: 2026}
+	if card.Expired(time.Date(2026, time.December, 31, 23, 0, 0, 0, time.UTC)) {
+		t.Error("expected the card to be valid through its expiry month")
+	}
+	if !card.Expired(time.Date(2027, time.January, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Error("expected the card to expire after its expiry month")
+	}
+}
@@ -0,0 +1,97 @@
+package entities
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrInvalidItem is returned when an item fails validation
+var ErrInvalidItem = errors.New("invalid item")
+
+// Validate checks that the item can be put in the catalog
+func (i Item) Validate() error {
+	switch {
+	case i.SKU == "":
+		return fmt.Errorf("%w: sku is required", ErrInvalidItem)
+	case strings.ContainsAny(i.SKU, "/?#% \t\n"):
+		return fmt.Errorf("%w: sku %q contains characters not allowed in a URL path", ErrInvalidItem, i.SKU)
+	case strings.TrimSpace(i.Name) == "":
+		return fmt.Errorf("%w: name is required", ErrInvalidItem)
+	case len(i.Price.Currency) != 3:
+		return fmt.Errorf("%w: price needs a 3 letter ISO currency code", ErrInvalidItem)
+	case i.Price.IsNegative():
+		return fmt.Errorf("%w: price cannot be negative", ErrInvalidItem)
+	}
+	return i.validateBook()
+}
+
+// ItemRequest defines the structure of an admin request to create or update an item
+type ItemRequest struct {
+	SKU             SKU      `json:"sku"`
+	Name            string   `json:"name"`
+	Authors         []string `json:"authors"`
+	Description     string   `json:"description"`
+	Price           Money    `json:"price"`
+	ISBN            string   `json:"isbn"`
+	TitleID         string   `json:"title_id"`
+	Format          Format   `json:"format"`
+	Publisher       string   `json:"publisher"`
+	PublicationDate string   `json:"publication_date"`
+	PageCount       int      `json:"page_count"`
+	WeightGrams     int      `json:"weight_grams"`
+	Language        string   `json:"language"`
+	CoverURL        string   `json:"cover_url"`
+	Categories      []string `json:"categories"`
+	// Stock is the initial stock of a new item, it is ignored on updates
+	Stock int `json:"stock"`
+}
+
+// Item returns the item described by the request
+func (req ItemRequest) Item() Item {
+	return Item{
+		SKU:             req.SKU,
+		Name:            req.Name,
+		Authors:         req.Authors,
+		Description:     req.Description,
+		Price:           req.Price,
+		ISBN:            req.ISBN,
+		TitleID:         req.TitleID,
+		Format:          req.Format,
+		Publisher:       req.Publisher,
+		PublicationDate: req.PublicationDate,
+		PageCount:       req.PageCount,
+		WeightGrams:     req.WeightGrams,
+		Language:        req.Language,
+		CoverURL:        req.CoverURL,
+		Categories:      req.Categories,
+	}
+}
+
+// StockRequest defines the structure of an admin request to restock an item
+type StockRequest struct {
+	Quantity int `json:"quantity"`
+}
+
+// CatalogAction defines the kind of change made to the catalog
+type CatalogAction string
+
+const (
+	CatalogActionCreate  CatalogAction = "create"
+	CatalogActionUpdate  CatalogAction = "update"
+	CatalogActionRetire  CatalogAction = "retire"
+	CatalogActionRestock CatalogAction = "restock"
+)
+
+// CatalogChange records who changed an item of the catalog, and how its price and stock changed
+type CatalogChange struct {
+	At       time.Time     `json:"at"`
+	Actor    UserID        `json:"actor"`
+	SKU      SKU           `json:"sku"`
+	Action   CatalogAction `json:"action"`
+	OldPrice *Money        `json:"old_price,omitempty"`
+	NewPrice *Money        `json:"new_price,omitempty"`
+	OldStock *int          `json:"old_stock,omitempty"`
+	NewStock *int          `json:"new_stock,omitempty"`
+}
@@ -0,0 +1,22 @@
+package entities
+
+import "time"
+
+// Dispute defines a payment the cardholder disputed with their issuer, as the payment provider reported it
+type Dispute struct {
+	// ID is the ID of the dispute at the payment provider
+	ID        string    `json:"id"`
+	Amount    Money     `json:"amount"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Dispute returns the dispute of the order with the ID
+func (o *Order) Dispute(id string) (Dispute, bool) {
+	for _, dispute := range o.Disputes {
+		if dispute.ID == id {
+			return dispute, true
+		}
+	}
+	return Dispute{}, false
+}
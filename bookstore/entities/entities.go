@@ -1,6 +1,9 @@
 package entities
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 // Type aliases for better code readability
 type UserID = string
@@ -9,8 +12,9 @@ type OrderID = string
 
 // User defines the structure of a user
 type User struct {
-	ID   UserID
-	Name string
+	ID    UserID `json:"id"`
+	Name  string `json:"name"`
+	Roles []Role `json:"roles"`
 }
 
 // UserCredentials defines the structure of user credentials
@@ -21,9 +25,52 @@ type UserCredentials struct {
 
 // Item defines the structure of an item
 type Item struct {
-	SKU   SKU     `json:"sku"`
-	Name  string  `json:"name"`
-	Price float64 `json:"price"`
+	SKU         SKU      `json:"sku"`
+	Name        string   `json:"name"`
+	Authors     []string `json:"authors,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Price       Money    `json:"price"`
+	// ISBN is the ISBN-13 of the item, ISBN-10s are converted
+	ISBN string `json:"isbn,omitempty"`
+	// TitleID groups the SKUs of the formats of one title
+	TitleID         string `json:"title_id,omitempty"`
+	Format          Format `json:"format,omitempty"`
+	Publisher       string `json:"publisher,omitempty"`
+	PublicationDate string `json:"publication_date,omitempty"`
+	PageCount       int    `json:"page_count,omitempty"`
+	// WeightGrams is the shipping weight of one unit, used to price weight-based shipping
+	WeightGrams int    `json:"weight_grams,omitempty"`
+	Language    string `json:"language,omitempty"`
+	CoverURL    string `json:"cover_url,omitempty"`
+	// Categories are category paths such as "Fiction/Science Fiction"
+	Categories []string `json:"categories,omitempty"`
+	// CreatedAt is when the item was added to the catalog
+	CreatedAt time.Time `json:"created_at"`
+	// Retired items are kept for the order history but can no longer be bought
+	Retired bool `json:"retired,omitempty"`
+}
+
+// ItemWithStock defines an item along with its stock levels
+type ItemWithStock struct {
+	Item
+	// InStock is the number of units in the warehouse, including the reserved ones
+	InStock int `json:"in_stock"`
+	// Reserved is the number of units held by the carts of users
+	Reserved int `json:"reserved"`
+	// Available is the number of units that can still be added to a cart
+	Available int `json:"available"`
+	// Formats lists the other formats of the title that are still sold, only GetItem fills it
+	Formats []TitleFormat `json:"formats,omitempty"`
+}
+
+// NewItemWithStock creates an item with its stock levels, the units available
+// are the ones in stock that are not reserved
+func NewItemWithStock(item Item, inStock int, reserved int) ItemWithStock {
+	available := inStock - reserved
+	if available < 0 {
+		available = 0
+	}
+	return ItemWithStock{Item: item, InStock: inStock, Reserved: reserved, Available: available}
 }
 
 // Items defines a list of items
@@ -46,26 +93,54 @@ type CreditCardDetails struct {
 	CVV        string `json:"credit_card_cvv"`
 }
 
-// ConfirmPurchaseRequest defines the structure of a purchase confirmation request
+// ConfirmPurchaseRequest defines the structure of a purchase confirmation
+// request, paid as the payment source tells or with the details of a card,
+// which are tokenized first
 type ConfirmPurchaseRequest struct {
-	OrderID           string            `json:"order_id"`
-	CreditCardDetails CreditCardDetails `json:"credit_card_details"`
+	OrderID string `json:"order_id"`
+	PaymentSource
+	CreditCardDetails *CreditCardDetails `json:"credit_card_details,omitempty"`
 }
 
-// ItemWithQty defines the structure of a cart item
+// ItemWithQty defines the structure of an order line
 type ItemWithQty struct {
 	Item     Item
 	Quantity int
+	// Discount is the share of the discounts of the order taken off the line
+	Discount Money `json:"discount"`
+	// Tax is the tax on the line, included in its price or not
+	Tax Money `json:"tax"`
 }
 
 // Order defines the structure of an order
 type Order struct {
-	ID                  OrderID
-	UserID              UserID
-	Items               []ItemWithQty
-	TotalItems          int
-	TotalPrice          float64
+	ID              OrderID
+	UserID          UserID
+	Items           []ItemWithQty
+	TotalItems      int
+	TotalPrice      Money
+	Coupon          string     `json:"coupon,omitempty"`
+	Discounts       []Discount `json:"discounts,omitempty"`
+	TotalDiscount   Money      `json:"total_discount"`
+	ShippingAddress *Address   `json:"shipping_address,omitempty"`
+	// Shipping is the method chosen to ship the order and its cost, orders with nothing to ship have none
+	Shipping *ShippingRate `json:"shipping,omitempty"`
+	Taxes    []TaxLine     `json:"taxes,omitempty"`
+	// TotalTax includes the taxes already part of the prices
+	TotalTax Money `json:"total_tax"`
+	// AmountDue is the amount charged for the order, see UpdateAmountDue
+	AmountDue           Money  `json:"amount_due"`
 	PaymentConfirmation string `json:"payment_confirmation,omitempty"`
+	// Authorization is the payment held on the card of the user, captured as the order is fulfilled
+	Authorization *Authorization `json:"authorization,omitempty"`
+	Refunds       []Refund       `json:"refunds,omitempty"`
+	// TotalRefunded is what the succeeded refunds gave back
+	TotalRefunded Money `json:"total_refunded"`
+	// Disputes are the payments the cardholder disputed with their issuer
+	Disputes      []Dispute           `json:"disputes,omitempty"`
+	Status        OrderStatus         `json:"status"`
+	CreatedAt     time.Time           `json:"created_at"`
+	StatusHistory []OrderStatusChange `json:"status_history"`
 }
 
 // CartItem defines the structure of a cart item
@@ -79,7 +154,14 @@ type Cart struct {
 	UserID     UserID           `json:"user_id"`
 	Items      map[SKU]CartItem `json:"items"`
 	TotalItems int              `json:"total_items"`
-	TotalPrice float64          `json:"total_price"`
+	TotalPrice Money            `json:"total_price"`
+	// Coupon is the coupon code applied to the cart
+	Coupon string `json:"coupon,omitempty"`
+	// Discounts, TotalDiscount and AmountDue are filled when the cart is priced
+	// with the promotions, see ApplyDiscounts
+	Discounts     []Discount `json:"discounts,omitempty"`
+	TotalDiscount Money      `json:"total_discount"`
+	AmountDue     Money      `json:"amount_due"`
 }
 
 // NewCart creates a new cart
@@ -105,7 +187,15 @@ func (c *Cart) AddToCart(item *Item, quantity int) {
 		}
 	}
 	c.TotalItems += quantity
-	c.TotalPrice += item.Price * float64(quantity)
+	c.TotalPrice = c.TotalPrice.Add(item.Price.Mul(quantity))
+}
+
+// CheckCurrency returns an error if the price cannot be added to the cart because it is in another currency
+func (c *Cart) CheckCurrency(price Money) error {
+	if len(c.Items) > 0 && !c.TotalPrice.SameCurrency(price) {
+		return fmt.Errorf("cart is in %s, cannot add an item priced in %s", c.TotalPrice.Currency, price.Currency)
+	}
+	return nil
 }
 
 // RemoveFromCart removes an item from the cart and updates the total price
@@ -117,12 +207,28 @@ func (c *Cart) RemoveFromCart(item Item, quantity int) error {
 		if cartItem.Quantity > quantity {
 			cartItem.Quantity -= quantity
 			c.Items[item.SKU] = cartItem
-			c.TotalItems -= quantity
 		} else {
 			delete(c.Items, item.SKU)
-			c.TotalItems -= cartItem.Quantity
+			quantity = cartItem.Quantity
 		}
-		c.TotalPrice -= item.Price * float64(quantity)
+		c.TotalItems -= quantity
+		// Use the price the item was added at, not the current one
+		c.TotalPrice = c.TotalPrice.Sub(cartItem.Item.Price.Mul(quantity))
 	}
 	return nil
 }
+
+// Clone returns a deep copy of the cart that shares no state with the original
+func (c *Cart) Clone() Cart {
+	clone := *c
+	clone.Items = make(map[SKU]CartItem, len(c.Items))
+	for sku, cartItem := range c.Items {
+		if cartItem.Item != nil {
+			item := *cartItem.Item
+			cartItem.Item = &item
+		}
+		clone.Items[sku] = cartItem
+	}
+	clone.Discounts = append([]Discount(nil), c.Discounts...)
+	return clone
+}
@@ -0,0 +1,42 @@
+package entities
+
+// ImportRow defines an item read from a catalog file along with the stock level to set
+type ImportRow struct {
+	// Line is the line of the row in the file, starting at 1
+	Line int
+	Item Item
+	// Stock is the stock level to set, nil leaves the stock of an existing item unchanged
+	Stock *int
+	// Err is set when the row could not be read, the row is then reported as failed
+	Err error
+}
+
+// ImportAction defines what importing a row did to the catalog
+type ImportAction string
+
+const (
+	ImportActionCreate    ImportAction = "create"
+	ImportActionUpdate    ImportAction = "update"
+	ImportActionRetire    ImportAction = "retire"
+	ImportActionUnchanged ImportAction = "unchanged"
+	ImportActionFail      ImportAction = "fail"
+)
+
+// ImportError reports why a row of a catalog file, or a record of a feed, was not imported
+type ImportError struct {
+	Line  int    `json:"line"`
+	SKU   SKU    `json:"sku,omitempty"`
+	Error string `json:"error"`
+}
+
+// ImportReport sums up a catalog import, in a dry run nothing is written and
+// the counts tell what the import would do
+type ImportReport struct {
+	DryRun    bool          `json:"dry_run"`
+	Created   int           `json:"created"`
+	Updated   int           `json:"updated"`
+	Retired   int           `json:"retired"`
+	Unchanged int           `json:"unchanged"`
+	Failed    int           `json:"failed"`
+	Errors    []ImportError `json:"errors"`
+}
@@ -0,0 +1,219 @@
+package entities
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DefaultCurrency is the currency assumed for amounts that do not carry one,
+// such as the decimal prices of the legacy API
+const DefaultCurrency = "USD"
+
+// minorUnitDigits lists the currencies whose minor unit is not the cent
+var minorUnitDigits = map[string]int{
+	"JPY": 0,
+	"KRW": 0,
+	"BHD": 3,
+	"KWD": 3,
+	"OMR": 3,
+}
+
+// Money is an amount in the minor unit of an ISO 4217 currency (e.g. cents for
+// USD) so that arithmetic on prices is exact.
+//
+// The zero value has no currency and adopts the currency of the amount it is
+// combined with, which makes it usable as the starting value of a total.
+type Money struct {
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+// NewMoney creates an amount of minor units of the currency
+func NewMoney(amount int64, currency string) Money {
+	return Money{Amount: amount, Currency: strings.ToUpper(currency)}
+}
+
+// ParseMoney parses a decimal amount in major units, e.g. "12.34", without going through a float
+func ParseMoney(s string, currency string) (Money, error) {
+	currency = strings.ToUpper(currency)
+	digits := currencyDigits(currency)
+	s = strings.TrimSpace(s)
+	negative := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+	whole, frac, hasFrac := strings.Cut(s, ".")
+	if whole == "" || (hasFrac && frac == "") {
+		return Money{}, fmt.Errorf("invalid amount %q", s)
+	}
+	// Drop trailing zeros so "100.000" is accepted for a currency with 2 digits
+	frac = strings.TrimRight(frac, "0")
+	if len(frac) > digits {
+		return Money{}, fmt.Errorf("amount %q has more than %d decimal places for %s", s, digits, currency)
+	}
+	frac += strings.Repeat("0", digits-len(frac))
+	amount, err := strconv.ParseInt(whole+frac, 10, 64)
+	if err != nil || strings.ContainsAny(whole+frac, "+-") {
+		return Money{}, fmt.Errorf("invalid amount %q", s)
+	}
+	if negative {
+		amount = -amount
+	}
+	return Money{Amount: amount, Currency: currency}, nil
+}
+
+// MustParseMoney is like ParseMoney but panics on invalid input, for use with constants
+func MustParseMoney(s string, currency string) Money {
+	m, err := ParseMoney(s, currency)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// currencyDigits returns the number of digits of the minor unit of the currency
+func currencyDigits(currency string) int {
+	if digits, ok := minorUnitDigits[currency]; ok {
+		return digits
+	}
+	return 2
+}
+
+// IsZero reports whether the amount is zero
+func (m Money) IsZero() bool {
+	return m.Amount == 0
+}
+
+// IsNegative reports whether the amount is below zero
+func (m Money) IsNegative() bool {
+	return m.Amount < 0
+}
+
+// IsPositive reports whether the amount is above zero
+func (m Money) IsPositive() bool {
+	return m.Amount > 0
+}
+
+// SameCurrency reports whether both amounts can be combined, an amount without currency matches any currency
+func (m Money) SameCurrency(other Money) bool {
+	return m.Currency == "" || other.Currency == "" || m.Currency == other.Currency
+}
+
+// Add returns the sum of both amounts; it panics if the currencies differ
+func (m Money) Add(other Money) Money {
+	return Money{Amount: m.Amount + other.Amount, Currency: m.combinedCurrency(other)}
+}
+
+// Sub returns the difference of both amounts; it panics if the currencies differ
+func (m Money) Sub(other Money) Money {
+	return Money{Amount: m.Amount - other.Amount, Currency: m.combinedCurrency(other)}
+}
+
+// Mul returns the amount multiplied by n
+func (m Money) Mul(n int) Money {
+	return Money{Amount: m.Amount * int64(n), Currency: m.Currency}
+}
+
+// Cmp compares both amounts and returns -1, 0 or +1; it panics if the currencies differ
+func (m Money) Cmp(other Money) int {
+	m.combinedCurrency(other)
+	switch {
+	case m.Amount < other.Amount:
+		return -1
+	case m.Amount > other.Amount:
+		return 1
+	}
+	return 0
+}
+
+// combinedCurrency returns the currency of the result of combining both amounts
+func (m Money) combinedCurrency(other Money) string {
+	if !m.SameCurrency(other) {
+		panic(fmt.Sprintf("money: currency mismatch %s and %s", m.Currency, other.Currency))
+	}
+	if m.Currency == "" {
+		return other.Currency
+	}
+	return m.Currency
+}
+
+// String formats the amount in major units followed by its currency, e.g. "12.34 USD"
+func (m Money) String() string {
+	if m.Currency == "" {
+		return m.Decimal()
+	}
+	return m.Decimal() + " " + m.Currency
+}
+
+// Decimal formats the amount in major units without its currency, e.g. "12.34",
+// the inverse of ParseMoney
+func (m Money) Decimal() string {
+	digits := currencyDigits(m.Currency)
+	amount := m.Amount
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	s := strconv.FormatInt(amount, 10)
+	if digits > 0 {
+		if len(s) <= digits {
+			s = strings.Repeat("0", digits-len(s)+1) + s
+		}
+		s = s[:len(s)-digits] + "." + s[len(s)-digits:]
+	}
+	return sign + s
+}
+
+// UnmarshalJSON decodes either the {"amount", "currency"} object or, for
+// backward compatibility, a plain decimal number in major units of the default
+// currency as used by the previous float64 price fields
+func (m *Money) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+	if len(data) > 0 && data[0] != '{' {
+		var number json.Number
+		if err := json.Unmarshal(data, &number); err != nil {
+			return fmt.Errorf("invalid money value %s", data)
+		}
+		parsed, err := parseLegacyAmount(number.String())
+		if err != nil {
+			return err
+		}
+		*m = parsed
+		return nil
+	}
+	var raw struct {
+		Amount   int64  `json:"amount"`
+		Currency string `json:"currency"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*m = NewMoney(raw.Amount, raw.Currency)
+	return nil
+}
+
+// parseLegacyAmount parses a JSON number, possibly in exponent form, as major units of the default currency
+func parseLegacyAmount(s string) (Money, error) {
+	if strings.ContainsAny(s, "eE") {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return Money{}, fmt.Errorf("invalid amount %q", s)
+		}
+		s = strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	m, err := ParseMoney(s, DefaultCurrency)
+	if err != nil {
+		// Legacy float totals may carry rounding noise, round to the nearest minor unit
+		f, ferr := strconv.ParseFloat(s, 64)
+		if ferr != nil {
+			return Money{}, err
+		}
+		return ParseMoney(strconv.FormatFloat(f, 'f', currencyDigits(DefaultCurrency), 64), DefaultCurrency)
+	}
+	return m, nil
+}
@@ -0,0 +1,123 @@
+package entities
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		in       string
+		currency string
+		want     Money
+		wantErr  bool
+	}{
+		{in: "12.34", currency: "usd", want: NewMoney(1234, "USD")},
+		{in: "0.1", currency: "USD", want: NewMoney(10, "USD")},
+		{in: "-5.05", currency: "EUR", want: NewMoney(-505, "EUR")},
+		{in: "100.000", currency: "USD", want: NewMoney(10000, "USD")},
+		{in: "1500", currency: "JPY", want: NewMoney(1500, "JPY")},
+		{in: "1.005", currency: "KWD", want: NewMoney(1005, "KWD")},
+		{in: "1.005", currency: "USD", wantErr: true},
+		{in: "12.", currency: "USD", wantErr: true},
+		{in: "1-2", currency: "USD", wantErr: true},
+		{in: "abc", currency: "USD", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseMoney(tt.in, tt.currency)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseMoney(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseMoney(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestMoneyArithmeticIsExact(t *testing.T) {
+	// 0.1 + 0.2 famously drifts with float64
+	total := Money{}
+	for i := 0; i < 10; i++ {
+		total = total.Add(MustParseMoney("0.10", "USD")).Add(MustParseMoney("0.20", "USD"))
+	}
+	if want := NewMoney(300, "USD"); total != want {
+		t.Errorf("got %v, want %v", total, want)
+	}
+	if got := total.Sub(MustParseMoney("3", "USD")); !got.IsZero() {
+		t.Errorf("expected zero, got %v", got)
+	}
+}
+
+func TestMoneyCurrencyMismatchPanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected adding USD to EUR to panic")
+		}
+	}()
+	NewMoney(1, "USD").Add(NewMoney(1, "EUR"))
+}
+
+func TestMoneyString(t *testing.T) {
+	tests := map[Money]string{
+		NewMoney(1234, "USD"): "12.34 USD",
+		NewMoney(5, "USD"):    "0.05 USD",
+		NewMoney(-505, "EUR"): "-5.05 EUR",
+		NewMoney(1500, "JPY"): "1500 JPY",
+		NewMoney(1005, "KWD"): "1.005 KWD",
+		NewMoney(0, "USD"):    "0.00 USD",
+		{Amount: 100}:         "1.00",
+	}
+	for m, want := range tests {
+		if got := m.String(); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestMoneyJSON(t *testing.T) {
+	var item Item
+	if err := json.Unmarshal([]byte(`{"sku": "item-1", "price": {"amount": 1999, "currency": "EUR"}}`), &item); err != nil {
+		t.Fatal(err)
+	}
+	if want := NewMoney(1999, "EUR"); item.Price != want {
+		t.Errorf("got %v, want %v", item.Price, want)
+	}
+
+	// the legacy API sent prices as decimal numbers
+	for in, want := range map[string]Money{
+		`{"price": 19.99}`:               NewMoney(1999, DefaultCurrency),
+		`{"price": 100}`:                 NewMoney(10000, DefaultCurrency),
+		`{"price": 1e2}`:                 NewMoney(10000, DefaultCurrency),
+		`{"price": 0.30000000000000004}`: NewMoney(30, DefaultCurrency),
+	} {
+		var legacy Item
+		if err := json.Unmarshal([]byte(in), &legacy); err != nil {
+			t.Fatalf("unable to decode %s: %v", in, err)
+		}
+		if legacy.Price != want {
+			t.Errorf("decoding %s got %v, want %v", in, legacy.Price, want)
+		}
+	}
+
+	data, err := json.Marshal(NewMoney(1999, "EUR"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), `{"amount":1999,"currency":"EUR"}`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestCartTotalsAfterRemove(t *testing.T) {
+	cart := NewCart("user")
+	item := Item{SKU: "item-1", Price: MustParseMoney("19.99", "USD")}
+	cart.AddToCart(&item, 2)
+	// removing more than is in the cart must not drive the total negative
+	if err := cart.RemoveFromCart(item, 5); err != nil {
+		t.Fatal(err)
+	}
+	if !cart.TotalPrice.IsZero() || cart.TotalItems != 0 {
+		t.Errorf("expected empty totals, got %v and %d items", cart.TotalPrice, cart.TotalItems)
+	}
+}
@@ -0,0 +1,92 @@
+package entities
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// OrderStatus defines the lifecycle state of an order
+type OrderStatus string
+
+const (
+	OrderStatusPendingPayment OrderStatus = "pending_payment"
+	OrderStatusAuthorized     OrderStatus = "authorized"
+	OrderStatusPaid           OrderStatus = "paid"
+	OrderStatusFulfilled      OrderStatus = "fulfilled"
+	OrderStatusShipped        OrderStatus = "shipped"
+	OrderStatusDelivered      OrderStatus = "delivered"
+	OrderStatusCancelled      OrderStatus = "cancelled"
+	OrderStatusRefunded       OrderStatus = "refunded"
+)
+
+// ErrInvalidStatusTransition is returned when an order cannot move to the requested status
+var ErrInvalidStatusTransition = errors.New("invalid order status transition")
+
+// ErrInvalidFulfillment is returned when a fulfillment request is malformed
+var ErrInvalidFulfillment = errors.New("invalid fulfillment")
+
+// orderTransitions lists the statuses an order may move to from each status;
+// a paid order is no longer cancelled, it is refunded
+var orderTransitions = map[OrderStatus][]OrderStatus{
+	OrderStatusPendingPayment: {OrderStatusAuthorized, OrderStatusPaid, OrderStatusCancelled},
+	OrderStatusAuthorized:     {OrderStatusPaid, OrderStatusCancelled},
+	OrderStatusPaid:           {OrderStatusFulfilled, OrderStatusRefunded},
+	OrderStatusFulfilled:      {OrderStatusShipped, OrderStatusRefunded},
+	OrderStatusShipped:        {OrderStatusDelivered, OrderStatusRefunded},
+	OrderStatusDelivered:      {OrderStatusRefunded},
+}
+
+// CanTransitionTo reports whether an order in this status may move to next
+func (s OrderStatus) CanTransitionTo(next OrderStatus) bool {
+	for _, allowed := range orderTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// FulfillmentRequest defines the structure of an admin request moving a paid
+// order along its fulfillment: fulfilled, then shipped, then delivered
+type FulfillmentRequest struct {
+	Status OrderStatus `json:"status"`
+}
+
+// Validate checks that the status of the request is one of the fulfillment statuses
+func (r FulfillmentRequest) Validate() error {
+	switch r.Status {
+	case OrderStatusFulfilled, OrderStatusShipped, OrderStatusDelivered:
+		return nil
+	}
+	return fmt.Errorf("%w: status must be %s, %s or %s", ErrInvalidFulfillment, OrderStatusFulfilled, OrderStatusShipped, OrderStatusDelivered)
+}
+
+// OrderStatusChange records when an order entered a status
+type OrderStatusChange struct {
+	Status OrderStatus `json:"status"`
+	At     time.Time   `json:"at"`
+}
+
+// CurrentStatus returns the status of the order, deriving it for orders
+// created before statuses existed
+func (o *Order) CurrentStatus() OrderStatus {
+	if o.Status != "" {
+		return o.Status
+	}
+	if o.PaymentConfirmation != "" {
+		return OrderStatusPaid
+	}
+	return OrderStatusPendingPayment
+}
+
+// TransitionTo moves the order to the status, recording when it happened
+func (o *Order) TransitionTo(status OrderStatus, at time.Time) error {
+	current := o.CurrentStatus()
+	if !current.CanTransitionTo(status) {
+		return fmt.Errorf("%w from %s to %s", ErrInvalidStatusTransition, current, status)
+	}
+	o.Status = status
+	o.StatusHistory = append(o.StatusHistory, OrderStatusChange{Status: status, At: at})
+	return nil
+}
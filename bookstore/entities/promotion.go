@@ -0,0 +1,286 @@
+package entities
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PromotionKind defines how a promotion computes its discount
+type PromotionKind string
+
+const (
+	// PromotionPercentage takes a percentage off the eligible items
+	PromotionPercentage PromotionKind = "percentage"
+	// PromotionFixed takes a fixed amount off the eligible items
+	PromotionFixed PromotionKind = "fixed"
+	// PromotionBuyXGetY gives Get units of the eligible items for free for every Buy units bought
+	PromotionBuyXGetY PromotionKind = "buy_x_get_y"
+)
+
+var (
+	// ErrInvalidPromotion is returned when a promotion fails validation
+	ErrInvalidPromotion = errors.New("invalid promotion")
+	// ErrCouponUnavailable is returned when a coupon is not active or was used as many times as allowed
+	ErrCouponUnavailable = errors.New("coupon is not available")
+)
+
+// Promotion defines a discount on the carts. Promotions with a coupon code
+// only apply to the carts the code was entered for, the others apply to every
+// cart they are eligible for. All the promotions that apply are combined, each
+// on the prices of the items, and the total discount never exceeds the total
+// price of the cart.
+type Promotion struct {
+	ID string `json:"id"`
+	// Code is the coupon code customers enter, stored in upper case
+	Code        string        `json:"code,omitempty"`
+	Description string        `json:"description,omitempty"`
+	Kind        PromotionKind `json:"kind"`
+	// Percent is the percentage taken off by a percentage promotion, from 1 to 100
+	Percent int `json:"percent,omitempty"`
+	// Amount is the amount taken off by a fixed promotion
+	Amount *Money `json:"amount,omitempty"`
+	// Buy and Get are the units bought and the units given for free by a buy X get Y promotion
+	Buy int `json:"buy,omitempty"`
+	Get int `json:"get,omitempty"`
+	// Category restricts the promotion to the items of a category and its
+	// sub-categories, the promotion applies to all the items when it is empty
+	Category string `json:"category,omitempty"`
+	// MinSpend is the total price of the eligible items needed for the promotion to apply
+	MinSpend *Money `json:"min_spend,omitempty"`
+	// StartsAt and EndsAt bound when the promotion applies, either may be left open
+	StartsAt *time.Time `json:"starts_at,omitempty"`
+	EndsAt   *time.Time `json:"ends_at,omitempty"`
+	// UsageLimit is how many orders may use the promotion, 0 for no limit
+	UsageLimit int `json:"usage_limit,omitempty"`
+	// UsageLimitPerUser is how many orders of a user may use the promotion, 0 for no limit
+	UsageLimitPerUser int `json:"usage_limit_per_user,omitempty"`
+}
+
+// PromotionWithUsage defines a promotion along with the number of orders that used it
+type PromotionWithUsage struct {
+	Promotion
+	Redemptions int `json:"redemptions"`
+}
+
+// Discount defines what a promotion took off a cart or an order
+type Discount struct {
+	PromotionID string `json:"promotion_id"`
+	Code        string `json:"code,omitempty"`
+	Description string `json:"description,omitempty"`
+	Amount      Money  `json:"amount"`
+}
+
+// CouponRequest defines the structure of a request to apply a coupon to the cart
+type CouponRequest struct {
+	Code string `json:"code"`
+}
+
+// NormalizeCouponCode returns the code as stored, coupon codes are not case sensitive
+func NormalizeCouponCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// Normalize returns the promotion with its code and category in their canonical form
+func (p Promotion) Normalize() Promotion {
+	p.Code = NormalizeCouponCode(p.Code)
+	p.Description = strings.TrimSpace(p.Description)
+	if p.Category != "" {
+		p.Category = NormalizeCategory(p.Category)
+	}
+	return p
+}
+
+// Validate checks that the promotion can be stored
+func (p Promotion) Validate() error {
+	switch {
+	case p.ID == "":
+		return fmt.Errorf("%w: id is required", ErrInvalidPromotion)
+	case strings.ContainsAny(p.ID, "/?#% \t\n"):
+		return fmt.Errorf("%w: id %q contains characters not allowed in a URL path", ErrInvalidPromotion, p.ID)
+	case strings.ContainsAny(p.Code, " \t\n"):
+		return fmt.Errorf("%w: code %q contains spaces", ErrInvalidPromotion, p.Code)
+	case p.MinSpend != nil && (len(p.MinSpend.Currency) != 3 || p.MinSpend.IsNegative()):
+		return fmt.Errorf("%w: min_spend needs a 3 letter ISO currency code and cannot be negative", ErrInvalidPromotion)
+	case p.StartsAt != nil && p.EndsAt != nil && !p.EndsAt.After(*p.StartsAt):
+		return fmt.Errorf("%w: ends_at must be after starts_at", ErrInvalidPromotion)
+	case p.UsageLimit < 0 || p.UsageLimitPerUser < 0:
+		return fmt.Errorf("%w: usage limits cannot be negative", ErrInvalidPromotion)
+	}
+	switch p.Kind {
+	case PromotionPercentage:
+		if p.Percent < 1 || p.Percent > 100 {
+			return fmt.Errorf("%w: percent must be between 1 and 100", ErrInvalidPromotion)
+		}
+	case PromotionFixed:
+		if p.Amount == nil || len(p.Amount.Currency) != 3 || p.Amount.Amount <= 0 {
+			return fmt.Errorf("%w: amount must be positive with a 3 letter ISO currency code", ErrInvalidPromotion)
+		}
+		if p.MinSpend != nil && !p.MinSpend.SameCurrency(*p.Amount) {
+			return fmt.Errorf("%w: amount and min_spend must be in the same currency", ErrInvalidPromotion)
+		}
+	case PromotionBuyXGetY:
+		if p.Buy < 1 || p.Get < 1 {
+			return fmt.Errorf("%w: buy and get must be at least 1", ErrInvalidPromotion)
+		}
+	default:
+		return fmt.Errorf("%w: unknown kind %q", ErrInvalidPromotion, p.Kind)
+	}
+	return nil
+}
+
+// CheckAvailable returns an error wrapping ErrCouponUnavailable if the
+// promotion cannot be used at the time, given the number of orders that
+// already used it overall and for the user
+func (p Promotion) CheckAvailable(now time.Time, redemptions int, userRedemptions int) error {
+	switch {
+	case p.StartsAt != nil && now.Before(*p.StartsAt):
+		return fmt.Errorf("%w: %s has not started yet", ErrCouponUnavailable, p.label())
+	case p.EndsAt != nil && !now.Before(*p.EndsAt):
+		return fmt.Errorf("%w: %s has ended", ErrCouponUnavailable, p.label())
+	case p.UsageLimit > 0 && redemptions >= p.UsageLimit:
+		return fmt.Errorf("%w: %s was used as many times as allowed", ErrCouponUnavailable, p.label())
+	case p.UsageLimitPerUser > 0 && userRedemptions >= p.UsageLimitPerUser:
+		return fmt.Errorf("%w: you already used %s as many times as allowed", ErrCouponUnavailable, p.label())
+	}
+	return nil
+}
+
+// label names the promotion in error messages
+func (p Promotion) label() string {
+	if p.Code != "" {
+		return "coupon " + p.Code
+	}
+	return "promotion " + p.ID
+}
+
+// Discount computes the amount the promotion takes off the cart, it reports
+// false if the cart is not eligible. The promotion is assumed to be available.
+func (p Promotion) Discount(cart *Cart) (Money, bool) {
+	var eligible []CartItem
+	var subtotal Money
+	units := 0
+	for _, cartItem := range cart.Items {
+		if cartItem.Item == nil || (p.Category != "" && !cartItem.Item.InCategory(p.Category)) {
+			continue
+		}
+		eligible = append(eligible, cartItem)
+		subtotal = subtotal.Add(cartItem.Item.Price.Mul(cartItem.Quantity))
+		units += cartItem.Quantity
+	}
+	if units == 0 {
+		return Money{}, false
+	}
+	if p.MinSpend != nil && (!subtotal.SameCurrency(*p.MinSpend) || subtotal.Cmp(*p.MinSpend) < 0) {
+		return Money{}, false
+	}
+
+	discount := Money{Currency: subtotal.Currency}
+	switch p.Kind {
+	case PromotionPercentage:
+		// rounded down to the minor unit
+		discount.Amount = subtotal.Amount * int64(p.Percent) / 100
+	case PromotionFixed:
+		if p.Amount == nil || !subtotal.SameCurrency(*p.Amount) {
+			return Money{}, false
+		}
+		discount.Amount = p.Amount.Amount
+		if discount.Cmp(subtotal) > 0 {
+			discount = subtotal
+		}
+	case PromotionBuyXGetY:
+		discount = freeUnitsPrice(eligible, p.freeUnits(units))
+	}
+	if !discount.IsPositive() {
+		return Money{}, false
+	}
+	return discount, true
+}
+
+// freeUnits returns how many of the units are free: Get for every Buy plus
+// Get units, and the units taken beyond Buy in an incomplete group
+func (p Promotion) freeUnits(units int) int {
+	group := p.Buy + p.Get
+	free := units / group * p.Get
+	if extra := units%group - p.Buy; extra > 0 {
+		free += extra
+	}
+	return free
+}
+
+// freeUnitsPrice returns the price of the n cheapest units of the items
+func freeUnitsPrice(items []CartItem, n int) Money {
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Item.Price.Amount != items[j].Item.Price.Amount {
+			return items[i].Item.Price.Amount < items[j].Item.Price.Amount
+		}
+		return items[i].Item.SKU < items[j].Item.SKU
+	})
+	var price Money
+	for _, cartItem := range items {
+		if n == 0 {
+			break
+		}
+		quantity := cartItem.Quantity
+		if quantity > n {
+			quantity = n
+		}
+		price = price.Add(cartItem.Item.Price.Mul(quantity))
+		n -= quantity
+	}
+	return price
+}
+
+// ApplyDiscounts sets the discounts of the cart and the amount due, the
+// discounts are trimmed in order so that their total does not exceed the
+// total price of the cart
+func (c *Cart) ApplyDiscounts(discounts []Discount) {
+	c.Discounts = nil
+	c.TotalDiscount = Money{Currency: c.TotalPrice.Currency}
+	remaining := c.TotalPrice
+	for _, discount := range discounts {
+		if !remaining.IsPositive() {
+			break
+		}
+		if discount.Amount.Cmp(remaining) > 0 {
+			discount.Amount = remaining
+		}
+		c.Discounts = append(c.Discounts, discount)
+		c.TotalDiscount = c.TotalDiscount.Add(discount.Amount)
+		remaining = remaining.Sub(discount.Amount)
+	}
+	c.AmountDue = remaining
+}
+
+// UsedPromotion reports whether one of the discounts of the order came from the promotion
+func (o *Order) UsedPromotion(promotionID string) bool {
+	for _, discount := range o.Discounts {
+		if discount.PromotionID == promotionID {
+			return true
+		}
+	}
+	return false
+}
+
+// AllocateDiscount spreads the total discount of the order over its lines in
+// proportion to their price, the minor units left by rounding go to the first lines
+func (o *Order) AllocateDiscount() {
+	var allocated Money
+	for i := range o.Items {
+		line := &o.Items[i]
+		line.Discount = Money{Currency: o.TotalPrice.Currency}
+		if o.TotalPrice.IsPositive() {
+			line.Discount.Amount = o.TotalDiscount.Amount * line.Item.Price.Mul(line.Quantity).Amount / o.TotalPrice.Amount
+		}
+		allocated = allocated.Add(line.Discount)
+	}
+	for i := 0; allocated.Cmp(o.TotalDiscount) < 0 && i < len(o.Items); i++ {
+		line := &o.Items[i]
+		if line.Discount.Cmp(line.Item.Price.Mul(line.Quantity)) < 0 {
+			line.Discount.Amount++
+			allocated.Amount++
+		}
+	}
+}
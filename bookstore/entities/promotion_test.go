@@ -0,0 +1,122 @@
+package entities
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPromotionDiscount(t *testing.T) {
+	usd := func(amount int64) *Money {
+		m := NewMoney(amount, "USD")
+		return &m
+	}
+	cart := NewCart("test")
+	cart.AddToCart(&Item{SKU: "dune", Price: NewMoney(2000, "USD"), Categories: []string{"Fiction/Science Fiction"}}, 2)
+	cart.AddToCart(&Item{SKU: "emma", Price: NewMoney(1000, "USD"), Categories: []string{"Fiction/Classics"}}, 1)
+	cart.AddToCart(&Item{SKU: "atlas", Price: NewMoney(5000, "USD"), Categories: []string{"Travel"}}, 1)
+
+	tests := []struct {
+		name      string
+		promotion Promotion
+		want      int64
+		applies   bool
+	}{
+		{"percentage", Promotion{Kind: PromotionPercentage, Percent: 10}, 1000, true},
+		{"percentage rounds down", Promotion{Kind: PromotionPercentage, Percent: 33, Category: "fiction/classics"}, 330, true},
+		{"category sale", Promotion{Kind: PromotionPercentage, Percent: 50, Category: "Fiction"}, 2500, true},
+		{"other category", Promotion{Kind: PromotionPercentage, Percent: 50, Category: "Cooking"}, 0, false},
+		{"fixed", Promotion{Kind: PromotionFixed, Amount: usd(1500)}, 1500, true},
+		{"fixed capped at the eligible items", Promotion{Kind: PromotionFixed, Amount: usd(9900), Category: "Fiction/Classics"}, 1000, true},
+		{"fixed in another currency", Promotion{Kind: PromotionFixed, Amount: &Money{Amount: 100, Currency: "EUR"}}, 0, false},
+		{"min spend reached", Promotion{Kind: PromotionFixed, Amount: usd(500), MinSpend: usd(10000)}, 500, true},
+		{"min spend of the category not reached", Promotion{Kind: PromotionFixed, Amount: usd(500), MinSpend: usd(6000), Category: "Fiction"}, 0, false},
+		{"buy 2 get 1 gives the cheapest", Promotion{Kind: PromotionBuyXGetY, Buy: 2, Get: 1}, 1000, true},
+		{"buy 1 get 1", Promotion{Kind: PromotionBuyXGetY, Buy: 1, Get: 1}, 3000, true},
+		{"buy 3 get 1 in a category without enough units", Promotion{Kind: PromotionBuyXGetY, Buy: 3, Get: 1, Category: "Fiction"}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, applies := tt.promotion.Discount(cart)
+			if applies != tt.applies || got.Amount != tt.want {
+				t.Errorf("got %v (applies %v), want %d (applies %v)", got, applies, tt.want, tt.applies)
+			}
+		})
+	}
+}
+
+func TestPromotionCheckAvailable(t *testing.T) {
+	now := time.Date(2024, 11, 29, 12, 0, 0, 0, time.UTC)
+	before, after := now.Add(-time.Hour), now.Add(time.Hour)
+
+	tests := []struct {
+		name                         string
+		promotion                    Promotion
+		redemptions, userRedemptions int
+		available                    bool
+	}{
+		{"open ended", Promotion{}, 0, 0, true},
+		{"running", Promotion{StartsAt: &before, EndsAt: &after}, 0, 0, true},
+		{"not started", Promotion{StartsAt: &after}, 0, 0, false},
+		{"ended", Promotion{EndsAt: &before}, 0, 0, false},
+		{"ends now", Promotion{EndsAt: &now}, 0, 0, false},
+		{"under the limits", Promotion{UsageLimit: 10, UsageLimitPerUser: 2}, 9, 1, true},
+		{"global limit reached", Promotion{UsageLimit: 10}, 10, 0, false},
+		{"user limit reached", Promotion{UsageLimitPerUser: 1}, 5, 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.promotion.CheckAvailable(now, tt.redemptions, tt.userRedemptions)
+			if tt.available && err != nil {
+				t.Errorf("expected the promotion to be available, got %v", err)
+			}
+			if !tt.available && !errors.Is(err, ErrCouponUnavailable) {
+				t.Errorf("expected ErrCouponUnavailable, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCartApplyDiscounts(t *testing.T) {
+	cart := NewCart("test")
+	cart.AddToCart(&Item{SKU: "dune", Price: NewMoney(2000, "USD")}, 1)
+	cart.ApplyDiscounts([]Discount{
+		{PromotionID: "half", Amount: NewMoney(1000, "USD")},
+		{PromotionID: "coupon", Amount: NewMoney(1500, "USD")},
+		{PromotionID: "nothing-left", Amount: NewMoney(100, "USD")},
+	})
+	if len(cart.Discounts) != 2 || cart.Discounts[1].Amount != NewMoney(1000, "USD") {
+		t.Errorf("expected the discounts to be trimmed to the total price, got %+v", cart.Discounts)
+	}
+	if cart.TotalDiscount != NewMoney(2000, "USD") || !cart.AmountDue.IsZero() {
+		t.Errorf("unexpected total discount %v and amount due %v", cart.TotalDiscount, cart.AmountDue)
+	}
+}
+
+func TestPromotionValidate(t *testing.T) {
+	usd := NewMoney(500, "USD")
+	start := time.Date(2024, 11, 29, 0, 0, 0, 0, time.UTC)
+	end := start.Add(-time.Hour)
+	for name, promotion := range map[string]Promotion{
+		"missing id":         {Kind: PromotionPercentage, Percent: 10},
+		"unknown kind":       {ID: "p", Kind: "bogo"},
+		"percent too high":   {ID: "p", Kind: PromotionPercentage, Percent: 101},
+		"fixed without":      {ID: "p", Kind: PromotionFixed},
+		"buy without get":    {ID: "p", Kind: PromotionBuyXGetY, Buy: 2},
+		"ends before start":  {ID: "p", Kind: PromotionFixed, Amount: &usd, StartsAt: &start, EndsAt: &end},
+		"negative limit":     {ID: "p", Kind: PromotionPercentage, Percent: 10, UsageLimit: -1},
+		"code with a space":  {ID: "p", Code: "BLACK FRIDAY", Kind: PromotionPercentage, Percent: 10},
+		"min spend currency": {ID: "p", Kind: PromotionFixed, Amount: &usd, MinSpend: &Money{Amount: 100, Currency: "EUR"}},
+	} {
+		if err := promotion.Validate(); !errors.Is(err, ErrInvalidPromotion) {
+			t.Errorf("expected the promotion with %s to be invalid, got %v", name, err)
+		}
+	}
+	valid := Promotion{ID: "fiction-sale", Code: " fiction10 ", Kind: PromotionPercentage, Percent: 10, Category: " fiction / sci-fi "}.Normalize()
+	if err := valid.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if valid.Code != "FICTION10" || valid.Category != "fiction/sci-fi" {
+		t.Errorf("unexpected normalized promotion %+v", valid)
+	}
+}
@@ -0,0 +1,223 @@
+package entities
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Errors returned when refunding an order
+var (
+	// ErrInvalidRefund is returned when a refund request is malformed
+	ErrInvalidRefund = errors.New("invalid refund")
+	// ErrRefundNotAllowed is returned when an order cannot be refunded as requested,
+	// e.g. for more than what is left of its payment
+	ErrRefundNotAllowed = errors.New("refund not allowed")
+)
+
+// RefundStatus defines the state of a refund with the payment gateway
+type RefundStatus string
+
+const (
+	// RefundPending refunds were recorded but the gateway did not answer yet,
+	// they count against the amount left to refund
+	RefundPending   RefundStatus = "pending"
+	RefundSucceeded RefundStatus = "succeeded"
+	RefundFailed    RefundStatus = "failed"
+)
+
+// RestockLine defines units of an item put back in stock
+type RestockLine struct {
+	SKU      SKU `json:"sku"`
+	Quantity int `json:"quantity"`
+}
+
+// Refund defines money given back for an order
+type Refund struct {
+	ID     string       `json:"id"`
+	Amount Money        `json:"amount"`
+	Reason string       `json:"reason"`
+	Status RefundStatus `json:"status"`
+	// Restocked lists the units put back in stock once the refund succeeded
+	Restocked []RestockLine `json:"restocked,omitempty"`
+	// Confirmation is the ID of the refund at the payment gateway
+	Confirmation string `json:"confirmation,omitempty"`
+	// Failure is why the payment gateway declined the refund
+	Failure   string    `json:"failure,omitempty"`
+	By        UserID    `json:"by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// RefundRequest defines the structure of an admin request to refund an order
+type RefundRequest struct {
+	// Amount defaults to what is left to refund of the payment
+	Amount *Money `json:"amount,omitempty"`
+	Reason string `json:"reason"`
+	// RestockAll puts back in stock all the units not restocked yet, Restock only the given ones
+	RestockAll bool          `json:"restock_all,omitempty"`
+	Restock    []RestockLine `json:"restock,omitempty"`
+}
+
+// Captured returns the amount charged for the order: what was captured of
+// its authorization, or its amount due once paid for the orders charged at once
+func (o *Order) Captured() Money {
+	if o.Authorization != nil {
+		return o.Authorization.Captured()
+	}
+	if o.PaymentConfirmation == "" {
+		return Money{Currency: o.AmountDue.Currency}
+	}
+	return o.AmountDue
+}
+
+// Refundable returns what is left to refund of the payment of the order, the pending refunds are deducted
+func (o *Order) Refundable() Money {
+	left := o.Captured()
+	for _, refund := range o.Refunds {
+		if refund.Status != RefundFailed {
+			left = left.Sub(refund.Amount)
+		}
+	}
+	return left
+}
+
+// Restockable returns how many units of the item of the order can still be
+// put back in stock: none once the order was cancelled, as cancelling
+// restocks, and none of the units restocked by the refunds that did not fail
+func (o *Order) Restockable(sku SKU) int {
+	if o.CurrentStatus() == OrderStatusCancelled {
+		return 0
+	}
+	quantity := 0
+	for _, item := range o.Items {
+		if item.Item.SKU == sku {
+			quantity += item.Quantity
+		}
+	}
+	for _, refund := range o.Refunds {
+		if refund.Status == RefundFailed {
+			continue
+		}
+		for _, line := range refund.Restocked {
+			if line.SKU == sku {
+				quantity -= line.Quantity
+			}
+		}
+	}
+	return quantity
+}
+
+// AddRefund records a pending refund of the order for the request and returns
+// it; it fails if nothing was charged for the order, if the amount is more than what is
+// left to refund or if more units would be restocked than can be
+func (o *Order) AddRefund(req RefundRequest, id string, by UserID, now time.Time) (Refund, error) {
+	refund := Refund{
+		ID:        id,
+		Reason:    strings.TrimSpace(req.Reason),
+		Status:    RefundPending,
+		By:        by,
+		CreatedAt: now,
+	}
+	if refund.Reason == "" {
+		return Refund{}, fmt.Errorf("%w: reason is required", ErrInvalidRefund)
+	}
+	if !o.Captured().IsPositive() {
+		return Refund{}, fmt.Errorf("%w: nothing was charged for order %s", ErrRefundNotAllowed, o.ID)
+	}
+	left := o.Refundable()
+	refund.Amount = left
+	if req.Amount != nil {
+		refund.Amount = *req.Amount
+	}
+	switch {
+	case !refund.Amount.SameCurrency(left):
+		return Refund{}, fmt.Errorf("%w: the amount must be in %s", ErrInvalidRefund, left.Currency)
+	case req.Amount != nil && !refund.Amount.IsPositive():
+		return Refund{}, fmt.Errorf("%w: the amount must be positive", ErrInvalidRefund)
+	case !left.IsPositive():
+		return Refund{}, fmt.Errorf("%w: order %s was already refunded in full", ErrRefundNotAllowed, o.ID)
+	case refund.Amount.Cmp(left) > 0:
+		return Refund{}, fmt.Errorf("%w: only %s is left to refund", ErrRefundNotAllowed, left)
+	}
+	refund.Amount.Currency = left.Currency
+
+	if req.RestockAll && len(req.Restock) > 0 {
+		return Refund{}, fmt.Errorf("%w: give either restock_all or restock", ErrInvalidRefund)
+	}
+	restock := req.Restock
+	if req.RestockAll {
+		restock = nil
+		for _, item := range o.Items {
+			if quantity := o.Restockable(item.Item.SKU); quantity > 0 {
+				restock = append(restock, RestockLine{SKU: item.Item.SKU, Quantity: quantity})
+			}
+		}
+	}
+	requested := make(map[SKU]int, len(restock))
+	for _, line := range restock {
+		if line.Quantity <= 0 {
+			return Refund{}, fmt.Errorf("%w: the quantity to restock of %s must be positive", ErrInvalidRefund, line.SKU)
+		}
+		requested[line.SKU] += line.Quantity
+		if requested[line.SKU] > o.Restockable(line.SKU) {
+			return Refund{}, fmt.Errorf("%w: only %d units of %s can be restocked", ErrRefundNotAllowed, o.Restockable(line.SKU), line.SKU)
+		}
+		refund.Restocked = append(refund.Restocked, line)
+	}
+
+	o.Refunds = append(o.Refunds, refund)
+	return refund, nil
+}
+
+// RefundConfirmed returns the succeeded refund of the order with the confirmation of the payment gateway
+func (o *Order) RefundConfirmed(confirmation string) (Refund, bool) {
+	for _, refund := range o.Refunds {
+		if refund.Status == RefundSucceeded && refund.Confirmation == confirmation {
+			return refund, true
+		}
+	}
+	return Refund{}, false
+}
+
+// CompleteRefund marks a pending refund of the order as succeeded and returns
+// it. The order moves to refunded once its payment was refunded in full.
+func (o *Order) CompleteRefund(id string, confirmation string, now time.Time) (Refund, error) {
+	refund, err := o.pendingRefund(id)
+	if err != nil {
+		return Refund{}, err
+	}
+	refund.Status = RefundSucceeded
+	refund.Confirmation = confirmation
+	o.TotalRefunded = o.TotalRefunded.Add(refund.Amount)
+	if o.TotalRefunded.Cmp(o.Captured()) >= 0 && o.CurrentStatus().CanTransitionTo(OrderStatusRefunded) {
+		if err := o.TransitionTo(OrderStatusRefunded, now); err != nil {
+			return Refund{}, err
+		}
+	}
+	return *refund, nil
+}
+
+// FailRefund marks a pending refund of the order as failed, its amount and units can be refunded again
+func (o *Order) FailRefund(id string, failure string) error {
+	refund, err := o.pendingRefund(id)
+	if err != nil {
+		return err
+	}
+	refund.Status = RefundFailed
+	refund.Failure = failure
+	return nil
+}
+
+// pendingRefund returns the pending refund of the order with the ID
+func (o *Order) pendingRefund(id string) (*Refund, error) {
+	for i := range o.Refunds {
+		if o.Refunds[i].ID == id {
+			if o.Refunds[i].Status != RefundPending {
+				return nil, fmt.Errorf("%w: refund %s is %s", ErrRefundNotAllowed, id, o.Refunds[i].Status)
+			}
+			return &o.Refunds[i], nil
+		}
+	}
+	return nil, fmt.Errorf("%w: unknown refund %s", ErrInvalidRefund, id)
+}
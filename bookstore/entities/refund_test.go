@@ -0,0 +1,134 @@
+package entities
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func testPaidOrder() Order {
+	order := Order{
+		ID: "order-1",
+		Items: []ItemWithQty{
+			{Item: Item{SKU: "dune", Price: NewMoney(2000, "USD")}, Quantity: 2},
+			{Item: Item{SKU: "emma", Price: NewMoney(1000, "USD")}, Quantity: 1},
+		},
+		TotalPrice:          NewMoney(5000, "USD"),
+		AmountDue:           NewMoney(5000, "USD"),
+		PaymentConfirmation: "payment-1",
+		Status:              OrderStatusPaid,
+	}
+	return order
+}
+
+func TestOrderAddRefund(t *testing.T) {
+	usd := func(amount int64) *Money {
+		m := NewMoney(amount, "USD")
+		return &m
+	}
+	tests := []struct {
+		name    string
+		req     RefundRequest
+		amount  int64
+		restock map[SKU]int
+		err     error
+	}{
+		{"full by default", RefundRequest{Reason: "damaged"}, 5000, nil, nil},
+		{"partial with restock", RefundRequest{Reason: "returned", Amount: usd(2000), Restock: []RestockLine{{SKU: "dune", Quantity: 1}}}, 2000, map[SKU]int{"dune": 1}, nil},
+		{"restock all", RefundRequest{Reason: "returned", RestockAll: true}, 5000, map[SKU]int{"dune": 2, "emma": 1}, nil},
+		{"missing reason", RefundRequest{Amount: usd(100)}, 0, nil, ErrInvalidRefund},
+		{"negative amount", RefundRequest{Reason: "oops", Amount: usd(-100)}, 0, nil, ErrInvalidRefund},
+		{"other currency", RefundRequest{Reason: "oops", Amount: &Money{Amount: 100, Currency: "EUR"}}, 0, nil, ErrInvalidRefund},
+		{"more than paid", RefundRequest{Reason: "oops", Amount: usd(5001)}, 0, nil, ErrRefundNotAllowed},
+		{"restock more than ordered", RefundRequest{Reason: "returned", Restock: []RestockLine{{SKU: "emma", Quantity: 1}, {SKU: "emma", Quantity: 1}}}, 0, nil, ErrRefundNotAllowed},
+		{"restock an item not ordered", RefundRequest{Reason: "returned", Restock: []RestockLine{{SKU: "atlas", Quantity: 1}}}, 0, nil, ErrRefundNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order := testPaidOrder()
+			refund, err := order.AddRefund(tt.req, "refund-1", "admin", time.Now())
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) || len(order.Refunds) != 0 {
+					t.Fatalf("expected %v without recording the refund, got %v and %+v", tt.err, err, order.Refunds)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if refund.Status != RefundPending || refund.Amount != NewMoney(tt.amount, "USD") || len(order.Refunds) != 1 {
+				t.Errorf("unexpected refund %+v", refund)
+			}
+			restocked := make(map[SKU]int)
+			for _, line := range refund.Restocked {
+				restocked[line.SKU] += line.Quantity
+			}
+			if len(restocked) != len(tt.restock) {
+				t.Errorf("got restocked %v, want %v", restocked, tt.restock)
+			}
+			for sku, quantity := range tt.restock {
+				if restocked[sku] != quantity {
+					t.Errorf("got restocked %v, want %v", restocked, tt.restock)
+				}
+			}
+		})
+	}
+}
+
+func TestOrderRefundLifecycle(t *testing.T) {
+	order := testPaidOrder()
+	now := time.Now()
+	usd := NewMoney(3000, "USD")
+	first, err := order.AddRefund(RefundRequest{Reason: "late", Amount: &usd, Restock: []RestockLine{{SKU: "dune", Quantity: 2}}}, "refund-1", "admin", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the pending refund already counts against the payment and the stock
+	if order.Refundable() != NewMoney(2000, "USD") || order.Restockable("dune") != 0 {
+		t.Fatalf("unexpected refundable %v and restockable %d", order.Refundable(), order.Restockable("dune"))
+	}
+	if err := order.FailRefund(first.ID, "declined"); err != nil {
+		t.Fatal(err)
+	}
+	if order.Refundable() != NewMoney(5000, "USD") || order.Restockable("dune") != 2 {
+		t.Errorf("expected a failed refund to free its amount and units, got %v and %d", order.Refundable(), order.Restockable("dune"))
+	}
+	if _, err := order.CompleteRefund(first.ID, "confirmation", now); !errors.Is(err, ErrRefundNotAllowed) {
+		t.Errorf("expected completing a failed refund to fail, got %v", err)
+	}
+
+	second, _ := order.AddRefund(RefundRequest{Reason: "late", Amount: &usd}, "refund-2", "admin", now)
+	if _, err := order.CompleteRefund(second.ID, "confirmation-2", now); err != nil {
+		t.Fatal(err)
+	}
+	if order.TotalRefunded != usd || order.CurrentStatus() != OrderStatusPaid {
+		t.Errorf("expected a partial refund to keep the order paid, got %v refunded and status %s", order.TotalRefunded, order.CurrentStatus())
+	}
+	third, _ := order.AddRefund(RefundRequest{Reason: "late"}, "refund-3", "admin", now)
+	if _, err := order.CompleteRefund(third.ID, "confirmation-3", now); err != nil {
+		t.Fatal(err)
+	}
+	if order.TotalRefunded != NewMoney(5000, "USD") || order.CurrentStatus() != OrderStatusRefunded {
+		t.Errorf("expected the order to be refunded in full, got %v refunded and status %s", order.TotalRefunded, order.CurrentStatus())
+	}
+	if _, err := order.AddRefund(RefundRequest{Reason: "again"}, "refund-4", "admin", now); !errors.Is(err, ErrRefundNotAllowed) {
+		t.Errorf("expected refunding a refunded order to fail, got %v", err)
+	}
+}
+
+func TestOrderRefundNeedsPayment(t *testing.T) {
+	order := testPaidOrder()
+	order.PaymentConfirmation = ""
+	order.Status = OrderStatusPendingPayment
+	if _, err := order.AddRefund(RefundRequest{Reason: "oops"}, "refund-1", "admin", time.Now()); !errors.Is(err, ErrRefundNotAllowed) {
+		t.Errorf("expected refunding an unpaid order to fail, got %v", err)
+	}
+	paid := testPaidOrder()
+	paid.Status = OrderStatusCancelled
+	if _, err := paid.AddRefund(RefundRequest{Reason: "cancelled", RestockAll: true}, "refund-1", "admin", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if len(paid.Refunds[0].Restocked) != 0 {
+		t.Errorf("expected nothing to restock for a cancelled order, got %+v", paid.Refunds[0].Restocked)
+	}
+}
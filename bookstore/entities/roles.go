@@ -0,0 +1,91 @@
+package entities
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Role defines what a user is allowed to do in the bookstore
+type Role string
+
+const (
+	// RoleCustomer is the role of every registered user, it allows shopping
+	RoleCustomer Role = "customer"
+	// RoleStaff is the role of the employees managing the catalog
+	RoleStaff Role = "staff"
+	// RoleAdmin is the role of the users managing the bookstore and its users
+	RoleAdmin Role = "admin"
+)
+
+// Permission defines an action on the bookstore that is restricted to some roles
+type Permission string
+
+const (
+	// PermissionManageCatalog allows creating, updating, retiring and restocking items
+	PermissionManageCatalog Permission = "catalog:manage"
+	// PermissionViewAudit allows reading the audit trail of the catalog
+	PermissionViewAudit Permission = "audit:view"
+	// PermissionManageUsers allows reading and assigning the roles of the users
+	PermissionManageUsers Permission = "users:manage"
+	// PermissionManagePromotions allows creating and updating promotions and coupons
+	PermissionManagePromotions Permission = "promotions:manage"
+	// PermissionRefundOrders allows refunding the orders of any user
+	PermissionRefundOrders Permission = "orders:refund"
+	// PermissionCaptureOrders allows capturing the authorized payments of the orders of any user
+	PermissionCaptureOrders Permission = "orders:capture"
+	// PermissionFulfillOrders allows moving the paid orders of any user along their fulfillment
+	PermissionFulfillOrders Permission = "orders:fulfill"
+)
+
+// ErrInvalidRole is returned when a role is not one of the known roles
+var ErrInvalidRole = errors.New("invalid role")
+
+// rolePermissions lists the permissions granted by each role
+var rolePermissions = map[Role][]Permission{
+	RoleCustomer: {},
+	RoleStaff:    {PermissionManageCatalog, PermissionViewAudit, PermissionManagePromotions, PermissionRefundOrders, PermissionCaptureOrders, PermissionFulfillOrders},
+	RoleAdmin:    {PermissionManageCatalog, PermissionViewAudit, PermissionManageUsers, PermissionManagePromotions, PermissionRefundOrders, PermissionCaptureOrders, PermissionFulfillOrders},
+}
+
+// Validate checks that the role is one of the known roles
+func (r Role) Validate() error {
+	if _, ok := rolePermissions[r]; !ok {
+		return fmt.Errorf("%w %q", ErrInvalidRole, r)
+	}
+	return nil
+}
+
+// Grants reports whether the role grants the permission
+func (r Role) Grants(permission Permission) bool {
+	for _, granted := range rolePermissions[r] {
+		if granted == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// HasRole reports whether the user has the role
+func (u User) HasRole(role Role) bool {
+	for _, r := range u.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// HasPermission reports whether any of the roles of the user grants the permission
+func (u User) HasPermission(permission Permission) bool {
+	for _, r := range u.Roles {
+		if r.Grants(permission) {
+			return true
+		}
+	}
+	return false
+}
+
+// RolesRequest defines the structure of an admin request to assign the roles of a user
+type RolesRequest struct {
+	Roles []Role `json:"roles"`
+}
@@ -0,0 +1,86 @@
+package entities
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ItemSort defines the order of the items returned by a search
+type ItemSort string
+
+const (
+	ItemSortName      ItemSort = "name"
+	ItemSortNameDesc  ItemSort = "-name"
+	ItemSortPrice     ItemSort = "price"
+	ItemSortPriceDesc ItemSort = "-price"
+	ItemSortNewest    ItemSort = "newest"
+)
+
+const (
+	// DefaultItemPageSize is the number of items of a page when the query does not say
+	DefaultItemPageSize = 20
+	// MaxItemPageSize is the largest number of items of a page
+	MaxItemPageSize = 100
+)
+
+// ErrInvalidQuery is returned when a search query cannot be run
+var ErrInvalidQuery = errors.New("invalid query")
+
+// ItemQuery defines the structure of a search of the catalog
+type ItemQuery struct {
+	// Text is matched against the words of the name, authors and description, all the words must match
+	Text string
+	// MinPrice and MaxPrice bound the price of the items, both inclusive
+	MinPrice *Money
+	MaxPrice *Money
+	// Available only keeps the items with units that can be added to a cart
+	Available bool
+	// Category only keeps the items in the category path or its sub-categories
+	Category string
+	Format   Format
+	Language string
+	// TitleID only keeps the formats of one title
+	TitleID string
+	Sort    ItemSort
+	// Cursor is the NextCursor of the previous page, empty for the first page
+	Cursor string
+	Limit  int
+}
+
+// Validate checks the query, defaulting its sort and limit
+func (q *ItemQuery) Validate() error {
+	switch q.Sort {
+	case "":
+		q.Sort = ItemSortName
+	case ItemSortName, ItemSortNameDesc, ItemSortPrice, ItemSortPriceDesc, ItemSortNewest:
+	default:
+		return fmt.Errorf("%w: unknown sort %q", ErrInvalidQuery, q.Sort)
+	}
+	if q.Format != "" && !q.Format.Valid() {
+		return fmt.Errorf("%w: unknown format %q", ErrInvalidQuery, q.Format)
+	}
+	switch {
+	case q.Limit == 0:
+		q.Limit = DefaultItemPageSize
+	case q.Limit < 0 || q.Limit > MaxItemPageSize:
+		return fmt.Errorf("%w: limit must be between 1 and %d", ErrInvalidQuery, MaxItemPageSize)
+	}
+	if q.MinPrice != nil && q.MaxPrice != nil {
+		if !q.MinPrice.SameCurrency(*q.MaxPrice) {
+			return fmt.Errorf("%w: price bounds have different currencies", ErrInvalidQuery)
+		}
+		if q.MinPrice.Cmp(*q.MaxPrice) > 0 {
+			return fmt.Errorf("%w: min price is above max price", ErrInvalidQuery)
+		}
+	}
+	return nil
+}
+
+// ItemPage defines the structure of a page of search results
+type ItemPage struct {
+	Items []ItemWithStock `json:"items"`
+	// Total is the number of items matching the query across all the pages
+	Total int `json:"total"`
+	// NextCursor fetches the next page, it is empty on the last page
+	NextCursor string `json:"next_cursor,omitempty"`
+}
@@ -0,0 +1,34 @@
+package entities
+
+import "time"
+
+// Session defines the structure of a login of a user on one device; the tokens
+// of the session are secrets and are only handed out when they are issued
+type Session struct {
+	ID        string    `json:"id"`
+	UserID    UserID    `json:"user_id"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// LastSeenAt is when the session was last used, it expires after being idle for too long
+	LastSeenAt time.Time `json:"last_seen_at"`
+	// AccessExpiresAt is when the access token must be refreshed
+	AccessExpiresAt time.Time `json:"access_expires_at"`
+	// ExpiresAt is when the session ends whatever its activity
+	ExpiresAt time.Time `json:"expires_at"`
+	// Current is set when listing the sessions on the session making the request
+	Current bool `json:"current,omitempty"`
+}
+
+// SessionTokens defines the structure of the tokens issued on login and refresh
+type SessionTokens struct {
+	SessionID string `json:"session_id"`
+	// Token is the access token to send in the Authorization header
+	Token        string    `json:"token"`
+	RefreshToken string    `json:"refresh_token"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// RefreshRequest defines the structure of a request to refresh the tokens of a session
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
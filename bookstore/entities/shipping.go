@@ -0,0 +1,14 @@
+package entities
+
+import "errors"
+
+// ErrInvalidShipping is returned when an order cannot be shipped as requested
+var ErrInvalidShipping = errors.New("invalid shipping")
+
+// ShippingRate defines the cost of shipping an order with a method
+type ShippingRate struct {
+	// Method is the ID of the shipping method, e.g. "standard"
+	Method string `json:"method"`
+	Name   string `json:"name"`
+	Cost   Money  `json:"cost"`
+}
@@ -0,0 +1,106 @@
+package entities
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// TaxRate is a tax rate in millionths, e.g. 72500 for 7.25%, so that
+// computing a tax is exact integer arithmetic. In JSON it is the percentage,
+// e.g. 7.25.
+type TaxRate int64
+
+// taxRateScale is the rate of 100%, a percentage has up to 4 decimal places
+const (
+	taxRateScale         = 1000000
+	taxRatePercentDigits = 4
+)
+
+// ParseTaxRate parses a percentage with up to 4 decimal places, e.g. "8.875"
+func ParseTaxRate(percent string) (TaxRate, error) {
+	percent = strings.TrimSuffix(strings.TrimSpace(percent), "%")
+	whole, frac, hasFrac := strings.Cut(percent, ".")
+	if whole == "" || (hasFrac && frac == "") || strings.ContainsAny(percent, "+-") {
+		return 0, fmt.Errorf("invalid tax rate %q", percent)
+	}
+	frac = strings.TrimRight(frac, "0")
+	if len(frac) > taxRatePercentDigits {
+		return 0, fmt.Errorf("tax rate %q has more than %d decimal places", percent, taxRatePercentDigits)
+	}
+	frac += strings.Repeat("0", taxRatePercentDigits-len(frac))
+	rate, err := strconv.ParseInt(whole+frac, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid tax rate %q", percent)
+	}
+	return TaxRate(rate), nil
+}
+
+// String formats the rate as a percentage without trailing zeros, e.g. "7.25"
+func (r TaxRate) String() string {
+	s := strconv.FormatInt(int64(r), 10)
+	if len(s) <= taxRatePercentDigits {
+		s = strings.Repeat("0", taxRatePercentDigits-len(s)+1) + s
+	}
+	s = s[:len(s)-taxRatePercentDigits] + "." + s[len(s)-taxRatePercentDigits:]
+	return strings.TrimSuffix(strings.TrimRight(s, "0"), ".")
+}
+
+// MarshalJSON encodes the rate as a percentage number
+func (r TaxRate) MarshalJSON() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// UnmarshalJSON decodes a percentage given as a number or a string
+func (r *TaxRate) UnmarshalJSON(data []byte) error {
+	rate, err := ParseTaxRate(string(bytes.Trim(data, `"`)))
+	if err != nil {
+		return err
+	}
+	*r = rate
+	return nil
+}
+
+// Of returns the tax at the rate on an amount that excludes it, rounded half up to the minor unit
+func (r TaxRate) Of(m Money) Money {
+	return Money{Amount: roundedDiv(m.Amount*int64(r), taxRateScale), Currency: m.Currency}
+}
+
+// IncludedIn returns the tax at the rate included in an amount, rounded half up to the minor unit
+func (r TaxRate) IncludedIn(m Money) Money {
+	return Money{Amount: roundedDiv(m.Amount*int64(r), taxRateScale+int64(r)), Currency: m.Currency}
+}
+
+// roundedDiv divides a non-negative numerator, rounding half up
+func roundedDiv(numerator int64, denominator int64) int64 {
+	return (numerator + denominator/2) / denominator
+}
+
+// TaxLine defines the tax of a jurisdiction on an order
+type TaxLine struct {
+	Name    string  `json:"name"`
+	Country string  `json:"country"`
+	Region  string  `json:"region,omitempty"`
+	Rate    TaxRate `json:"rate"`
+	// Taxable is the price of the items taxed at the rate, after discounts
+	Taxable Money `json:"taxable"`
+	Amount  Money `json:"amount"`
+	// Inclusive taxes are part of the prices and do not add to the amount due
+	Inclusive bool `json:"inclusive,omitempty"`
+}
+
+// UpdateAmountDue sets the amount due for the order: its total price minus
+// its discounts plus the taxes not included in the prices and the shipping cost
+func (o *Order) UpdateAmountDue() {
+	due := o.TotalPrice.Sub(o.TotalDiscount)
+	for _, tax := range o.Taxes {
+		if !tax.Inclusive {
+			due = due.Add(tax.Amount)
+		}
+	}
+	if o.Shipping != nil {
+		due = due.Add(o.Shipping.Cost)
+	}
+	o.AmountDue = due
+}
@@ -0,0 +1,57 @@
+package entities
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseTaxRate(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    TaxRate
+		wantErr bool
+	}{
+		{in: "7.25", want: 72500},
+		{in: "8.875%", want: 88750},
+		{in: "20", want: 200000},
+		{in: "0.0001", want: 1},
+		{in: "5.50000", want: 55000},
+		{in: "7.12345", wantErr: true},
+		{in: "-5", wantErr: true},
+		{in: "7.", wantErr: true},
+		{in: "abc", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseTaxRate(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseTaxRate(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseTaxRate(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestTaxRateJSONRoundTrip(t *testing.T) {
+	for _, rate := range []TaxRate{0, 1, 72500, 88750, 200000} {
+		data, err := json.Marshal(rate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded TaxRate
+		if err := json.Unmarshal(data, &decoded); err != nil || decoded != rate {
+			t.Errorf("round trip of %d through %s gave %d, %v", rate, data, decoded, err)
+		}
+	}
+}
+
+func TestTaxRateAmounts(t *testing.T) {
+	rate := TaxRate(200000)
+	if got := rate.Of(NewMoney(1999, "GBP")); got != NewMoney(400, "GBP") {
+		t.Errorf("20%% of 19.99 = %v, want 4.00", got)
+	}
+	if got := rate.IncludedIn(NewMoney(1200, "GBP")); got != NewMoney(200, "GBP") {
+		t.Errorf("20%% included in 12.00 = %v, want 2.00", got)
+	}
+}
@@ -0,0 +1,77 @@
+package entities
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// ErrInvalidUser is returned when a registration fails validation
+var ErrInvalidUser = errors.New("invalid user")
+
+// ErrWeakPassword is returned when a password does not follow the password policy
+var ErrWeakPassword = errors.New("password does not meet the policy")
+
+const (
+	// MinPasswordLength is the minimum number of characters of a password
+	MinPasswordLength = 8
+	// MaxPasswordLength is the maximum length of a password in bytes, bcrypt ignores anything longer
+	MaxPasswordLength = 72
+)
+
+// RegistrationRequest defines the structure of a request to create an account
+type RegistrationRequest struct {
+	UserID   UserID `json:"username"`
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+// Validate checks the requested user ID, defaulting the name to it, and the password policy
+func (req *RegistrationRequest) Validate() error {
+	if err := ValidateUserID(req.UserID); err != nil {
+		return err
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		req.Name = req.UserID
+	}
+	return ValidatePassword(req.UserID, req.Password)
+}
+
+// ValidateUserID checks that the user ID is between 3 and 64 letters, digits, dots, dashes or underscores
+func ValidateUserID(userID UserID) error {
+	if len(userID) < 3 || len(userID) > 64 {
+		return fmt.Errorf("%w: username must be between 3 and 64 characters", ErrInvalidUser)
+	}
+	for _, r := range userID {
+		if r > unicode.MaxASCII || !(unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("._-", r)) {
+			return fmt.Errorf("%w: username may only contain letters, digits, '.', '-' and '_'", ErrInvalidUser)
+		}
+	}
+	return nil
+}
+
+// ValidatePassword checks that the password of the user follows the password
+// policy: between 8 and 72 bytes, at least one letter and one digit, and
+// different from the username
+func ValidatePassword(userID UserID, password string) error {
+	if len([]rune(password)) < MinPasswordLength {
+		return fmt.Errorf("%w: it must be at least %d characters long", ErrWeakPassword, MinPasswordLength)
+	}
+	if len(password) > MaxPasswordLength {
+		return fmt.Errorf("%w: it must be at most %d bytes long", ErrWeakPassword, MaxPasswordLength)
+	}
+	if strings.EqualFold(password, userID) {
+		return fmt.Errorf("%w: it must differ from the username", ErrWeakPassword)
+	}
+	var hasLetter, hasDigit bool
+	for _, r := range password {
+		hasLetter = hasLetter || unicode.IsLetter(r)
+		hasDigit = hasDigit || unicode.IsDigit(r)
+	}
+	if !hasLetter || !hasDigit {
+		return fmt.Errorf("%w: it must contain at least one letter and one digit", ErrWeakPassword)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package bookstore
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// idempotencyKeyContextKey is the context key of the idempotency key of a request
+type idempotencyKeyContextKey struct{}
+
+// idempotencyKey is the idempotency key a user sent with a request
+type idempotencyKey struct {
+	userID string
+	key    string
+}
+
+// WithIdempotencyKey returns a context carrying the idempotency key the user
+// sent with the request, the payments made for the request are sent to the
+// payment gateway with keys derived from it
+func WithIdempotencyKey(ctx context.Context, userID string, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyContextKey{}, idempotencyKey{userID: userID, key: key})
+}
+
+// paymentIdempotencyKey returns the idempotency key of the payment gateway
+// request for the operation on the order. It is derived from the idempotency
+// key of the request so that a request retried after a lost answer is
+// processed once by the gateway too; requests without one get a new key.
+func paymentIdempotencyKey(ctx context.Context, operation string, orderID string) (string, error) {
+	request, ok := ctx.Value(idempotencyKeyContextKey{}).(idempotencyKey)
+	if !ok || request.key == "" {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return "", fmt.Errorf("unable to create idempotency key")
+		}
+		return hex.EncodeToString(b), nil
+	}
+	sum := sha256.Sum256([]byte(request.userID + "\x00" + request.key + "\x00" + operation + "\x00" + orderID))
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,84 @@
+package bookstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+	"github.com/13thuser/bookstore/bookstore/onix"
+	"github.com/13thuser/bookstore/datastore"
+)
+
+// IngestONIX applies the product records of an ONIX message to the catalog:
+// new products are added, full records replace the existing items, block
+// updates only replace the blocks they carry and deletions retire the items.
+// Records that cannot be applied are reported and skipped like the rows of an
+// import, and in a dry run nothing is written.
+func (s *BookstoreService) IngestONIX(ctx context.Context, actor entities.UserID, products []onix.Product, dryRun bool) (entities.ImportReport, error) {
+	report := entities.ImportReport{DryRun: dryRun, Errors: []entities.ImportError{}}
+	lines := make(map[entities.SKU]int, len(products))
+	for _, product := range products {
+		action, err := s.ingestProduct(ctx, actor, product, lines, dryRun)
+		if err := addToImportReport(&report, product.Line, product.Item.SKU, action, err); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// ingestProduct applies a product record, lines maps the SKUs already ingested to their line
+func (s *BookstoreService) ingestProduct(ctx context.Context, actor entities.UserID, product onix.Product, lines map[entities.SKU]int, dryRun bool) (entities.ImportAction, error) {
+	if product.Err != nil {
+		return entities.ImportActionFail, product.Err
+	}
+	if err := checkImportedOnce(lines, product.Item.SKU, product.Line); err != nil {
+		return entities.ImportActionFail, err
+	}
+	if product.IsDeletion() {
+		return s.retireIngestedItem(ctx, actor, product.Item.SKU, dryRun)
+	}
+
+	item := product.Item
+	if product.Notification == onix.NotificationBlockUpdate {
+		existing, err := s.Datastore.GetItem(ctx, item.SKU)
+		if errors.Is(err, datastore.ErrItemNotFound) {
+			return entities.ImportActionFail, fmt.Errorf("%w: block update of %s which is not in the catalog", entities.ErrInvalidItem, item.SKU)
+		}
+		if err != nil {
+			return entities.ImportActionFail, err
+		}
+		item = product.Merge(existing)
+	}
+	item, err := normalizeImportedItem(item)
+	if err != nil {
+		return entities.ImportActionFail, err
+	}
+	return s.upsertItem(ctx, actor, item, product.Stock, dryRun)
+}
+
+// retireIngestedItem retires an item deleted by a feed, deleting an unknown or retired item changes nothing
+func (s *BookstoreService) retireIngestedItem(ctx context.Context, actor entities.UserID, sku entities.SKU, dryRun bool) (entities.ImportAction, error) {
+	item, err := s.Datastore.GetItem(ctx, sku)
+	if errors.Is(err, datastore.ErrItemNotFound) || (err == nil && item.Retired) {
+		return entities.ImportActionUnchanged, nil
+	}
+	if err != nil {
+		return entities.ImportActionFail, err
+	}
+	if dryRun {
+		return entities.ImportActionRetire, nil
+	}
+	if _, err := s.Datastore.RetireItem(ctx, sku); err != nil {
+		return entities.ImportActionFail, err
+	}
+	err = s.recordCatalogChange(ctx, entities.CatalogChange{
+		Actor:  actor,
+		SKU:    sku,
+		Action: entities.CatalogActionRetire,
+	})
+	if err != nil {
+		return entities.ImportActionFail, err
+	}
+	return entities.ImportActionRetire, nil
+}
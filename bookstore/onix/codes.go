@@ -0,0 +1,138 @@
+package onix
+
+import "github.com/13thuser/bookstore/bookstore/entities"
+
+// NotificationType defines what a product record does to the catalog, from ONIX code list 1
+type NotificationType string
+
+const (
+	NotificationEarly       NotificationType = "01"
+	NotificationAdvance     NotificationType = "02"
+	NotificationConfirmed   NotificationType = "03"
+	NotificationBlockUpdate NotificationType = "04"
+	NotificationDelete      NotificationType = "05"
+)
+
+// The ONIX codes used to map the products, from the ONIX 3.0 code lists
+const (
+	productIDISBN10 = "02" // list 5
+	productIDGTIN13 = "03"
+	productIDISBN13 = "15"
+
+	titleTypeDistinctive = "01" // list 15
+	titleLevelProduct    = "01" // list 149
+
+	contributorByAuthor = "A01" // list 17
+
+	languageOfText = "01" // list 22
+
+	extentMainContentPages = "00" // list 23
+	extentTotalPages       = "11"
+	extentUnitPages        = "03" // list 24
+
+	textDescription      = "03" // list 153
+	textShortDescription = "02"
+
+	resourceFrontCover = "01" // list 158
+	resourceImage      = "03" // list 159
+
+	publishingRolePublisher = "01" // list 45
+	publicationDate         = "01" // list 163
+
+	workManifestationOf = "01" // list 164
+
+	priceRRPExcludingTax = "01" // list 58
+	priceRRPIncludingTax = "02"
+)
+
+// productForms maps the ONIX product forms of list 150 to the formats of the catalog
+var productForms = map[string]entities.Format{
+	"BB": entities.FormatHardcover,
+	"BC": entities.FormatPaperback,
+	"EA": entities.FormatEbook,
+	"EB": entities.FormatEbook,
+	"EC": entities.FormatEbook,
+	"ED": entities.FormatEbook,
+}
+
+// unavailable lists the ONIX product availabilities of list 65 for which nothing can be sold
+var unavailable = map[string]bool{
+	"30": true, "31": true, "32": true, "33": true, "34": true,
+	"40": true, "41": true, "42": true, "43": true, "44": true, "45": true, "46": true, "47": true, "48": true, "49": true,
+	"50": true, "51": true, "52": true,
+}
+
+// shortTags maps the ONIX 3.0 short tags of the elements read by the parser to their reference names
+var shortTags = map[string]string{
+	"ONIXmessage":        "ONIXMessage",
+	"header":             "Header",
+	"sender":             "Sender",
+	"x298":               "SenderName",
+	"x307":               "SentDateTime",
+	"x312":               "DefaultCurrencyCode",
+	"product":            "Product",
+	"a001":               "RecordReference",
+	"a002":               "NotificationType",
+	"productidentifier":  "ProductIdentifier",
+	"b221":               "ProductIDType",
+	"b244":               "IDValue",
+	"descriptivedetail":  "DescriptiveDetail",
+	"b012":               "ProductForm",
+	"titledetail":        "TitleDetail",
+	"b202":               "TitleType",
+	"titleelement":       "TitleElement",
+	"x409":               "TitleElementLevel",
+	"b203":               "TitleText",
+	"b030":               "TitlePrefix",
+	"b031":               "TitleWithoutPrefix",
+	"b029":               "Subtitle",
+	"contributor":        "Contributor",
+	"b034":               "SequenceNumber",
+	"b035":               "ContributorRole",
+	"b036":               "PersonName",
+	"b039":               "NamesBeforeKey",
+	"b040":               "KeyNames",
+	"b047":               "CorporateName",
+	"language":           "Language",
+	"b253":               "LanguageRole",
+	"b252":               "LanguageCode",
+	"extent":             "Extent",
+	"b218":               "ExtentType",
+	"b219":               "ExtentValue",
+	"b220":               "ExtentUnit",
+	"subject":            "Subject",
+	"b067":               "SubjectSchemeIdentifier",
+	"b069":               "SubjectCode",
+	"b070":               "SubjectHeadingText",
+	"collateraldetail":   "CollateralDetail",
+	"textcontent":        "TextContent",
+	"x426":               "TextType",
+	"d104":               "Text",
+	"supportingresource": "SupportingResource",
+	"x436":               "ResourceContentType",
+	"x437":               "ResourceMode",
+	"resourceversion":    "ResourceVersion",
+	"x441":               "ResourceForm",
+	"x435":               "ResourceLink",
+	"publishingdetail":   "PublishingDetail",
+	"publisher":          "Publisher",
+	"b291":               "PublishingRole",
+	"b081":               "PublisherName",
+	"publishingdate":     "PublishingDate",
+	"x448":               "PublishingDateRole",
+	"b306":               "Date",
+	"relatedmaterial":    "RelatedMaterial",
+	"relatedwork":        "RelatedWork",
+	"x454":               "WorkRelationCode",
+	"workidentifier":     "WorkIdentifier",
+	"b201":               "WorkIDType",
+	"productsupply":      "ProductSupply",
+	"supplydetail":       "SupplyDetail",
+	"j396":               "ProductAvailability",
+	"stock":              "Stock",
+	"j350":               "OnHand",
+	"price":              "Price",
+	"x462":               "PriceType",
+	"j151":               "PriceAmount",
+	"j152":               "CurrencyCode",
+}
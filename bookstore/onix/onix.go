@@ -0,0 +1,485 @@
+// Package onix reads ONIX 3.0 messages, the XML format in which publishers
+// send their catalog data, and maps their product records to catalog items.
+//
+// Messages may use either the reference or the short tags. Only the parts of
+// a record that the catalog stores are read: the ISBN, the title,
+// contributors, form, language, extent, subjects, description, cover,
+// publisher, publication date, the work the product belongs to, prices and
+// availability.
+package onix
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+)
+
+// Message defines the parts of an ONIX message used by the catalog
+type Message struct {
+	Sender   string
+	SentAt   string
+	Products []Product
+}
+
+// Product defines a product record of an ONIX message mapped to a catalog item
+type Product struct {
+	// Line is the line of the record in the message
+	Line            int
+	RecordReference string
+	Notification    NotificationType
+	// Item holds the fields of the blocks sent, its SKU is the ISBN-13 of
+	// the product or else its record reference
+	Item entities.Item
+	// Stock is the number of units on hand, nil when the record does not tell
+	Stock *int
+	// Err is set when the record could not be mapped
+	Err    error
+	blocks blocks
+}
+
+// blocks tells which blocks of a product record were sent
+type blocks struct {
+	descriptive, collateral, publishing, related, supply bool
+}
+
+// IsDeletion reports whether the record asks to remove the product from the catalog
+func (p Product) IsDeletion() bool {
+	return p.Notification == NotificationDelete
+}
+
+// Merge returns the item described by the record. A full record replaces the
+// existing item while a block update only replaces the fields of the blocks it
+// carries.
+func (p Product) Merge(existing entities.Item) entities.Item {
+	if p.Notification != NotificationBlockUpdate {
+		return p.Item
+	}
+	item := existing
+	if p.Item.ISBN != "" {
+		item.ISBN = p.Item.ISBN
+	}
+	if p.blocks.descriptive {
+		item.Name = p.Item.Name
+		item.Authors = p.Item.Authors
+		item.Format = p.Item.Format
+		item.Language = p.Item.Language
+		item.PageCount = p.Item.PageCount
+		item.Categories = p.Item.Categories
+	}
+	if p.blocks.collateral {
+		item.Description = p.Item.Description
+		item.CoverURL = p.Item.CoverURL
+	}
+	if p.blocks.publishing {
+		item.Publisher = p.Item.Publisher
+		item.PublicationDate = p.Item.PublicationDate
+	}
+	if p.blocks.related {
+		item.TitleID = p.Item.TitleID
+	}
+	if p.blocks.supply && p.Item.Price.Currency != "" {
+		item.Price = p.Item.Price
+	}
+	return item
+}
+
+// Parse reads an ONIX 3.0 message. Records that cannot be mapped have their
+// Err set; an error is only returned when the message itself cannot be read.
+func Parse(r io.Reader) (Message, error) {
+	raw := xml.NewDecoder(r)
+	decoder := xml.NewTokenDecoder(shortTagReader{raw})
+	var message Message
+	var header xmlHeader
+	root := false
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return Message{}, err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch {
+		case !root && start.Name.Local == "ONIXMessage":
+			root = true
+			if release := attr(start, "release"); release != "" && !strings.HasPrefix(release, "3.") {
+				return Message{}, fmt.Errorf("ONIX release %s is not supported, only 3.0 is", release)
+			}
+		case !root:
+			return Message{}, fmt.Errorf("not an ONIX message, the root element is %s", start.Name.Local)
+		case start.Name.Local == "Header":
+			if err := decoder.DecodeElement(&header, &start); err != nil {
+				return Message{}, err
+			}
+			message.Sender = strings.TrimSpace(header.SenderName)
+			message.SentAt = strings.TrimSpace(header.SentDateTime)
+		case start.Name.Local == "Product":
+			line, _ := raw.InputPos()
+			var record xmlProduct
+			if err := decoder.DecodeElement(&record, &start); err != nil {
+				return Message{}, fmt.Errorf("line %d: %w", line, err)
+			}
+			product := newProduct(record, strings.TrimSpace(header.DefaultCurrencyCode))
+			product.Line = line
+			message.Products = append(message.Products, product)
+		default:
+			if err := decoder.Skip(); err != nil {
+				return Message{}, err
+			}
+		}
+	}
+	if !root {
+		return Message{}, errors.New("not an ONIX message, it is empty")
+	}
+	return message, nil
+}
+
+// shortTagReader renames the elements with a short tag to their reference name
+type shortTagReader struct {
+	decoder *xml.Decoder
+}
+
+func (r shortTagReader) Token() (xml.Token, error) {
+	token, err := r.decoder.Token()
+	switch t := token.(type) {
+	case xml.StartElement:
+		t.Name.Local = referenceName(t.Name.Local)
+		return t, err
+	case xml.EndElement:
+		t.Name.Local = referenceName(t.Name.Local)
+		return t, err
+	}
+	return token, err
+}
+
+// referenceName returns the reference name of a short tag, or the tag itself
+func referenceName(tag string) string {
+	if name, ok := shortTags[tag]; ok {
+		return name
+	}
+	return tag
+}
+
+// attr returns the value of an attribute of the element, or ""
+func attr(start xml.StartElement, name string) string {
+	for _, a := range start.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// invalidRecord wraps an error found in a record so that it is reported as an invalid item
+func invalidRecord(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", entities.ErrInvalidItem, fmt.Sprintf(format, args...))
+}
+
+// newProduct maps a product record, prices without a currency are in the default currency of the message
+func newProduct(record xmlProduct, defaultCurrency string) Product {
+	p := Product{
+		RecordReference: strings.TrimSpace(record.RecordReference),
+		Notification:    NotificationType(strings.TrimSpace(record.NotificationType)),
+	}
+	switch p.Notification {
+	case NotificationEarly, NotificationAdvance, NotificationConfirmed, NotificationBlockUpdate, NotificationDelete:
+	default:
+		p.Err = invalidRecord("unsupported notification type %q", p.Notification)
+		return p
+	}
+
+	isbn, err := productISBN(record.ProductIdentifiers)
+	if err != nil {
+		p.Err = err
+		return p
+	}
+	p.Item.ISBN = isbn
+	p.Item.SKU = isbn
+	if p.Item.SKU == "" {
+		p.Item.SKU = p.RecordReference
+	}
+	if p.Item.SKU == "" {
+		p.Err = invalidRecord("the record has neither an ISBN nor a record reference")
+		return p
+	}
+	if p.IsDeletion() {
+		return p
+	}
+
+	if detail := record.DescriptiveDetail; detail != nil {
+		p.blocks.descriptive = true
+		p.Err = mapDescriptiveDetail(&p.Item, detail)
+	}
+	if detail := record.CollateralDetail; detail != nil {
+		p.blocks.collateral = true
+		mapCollateralDetail(&p.Item, detail)
+	}
+	if detail := record.PublishingDetail; detail != nil {
+		p.blocks.publishing = true
+		mapPublishingDetail(&p.Item, detail)
+	}
+	if material := record.RelatedMaterial; material != nil {
+		p.blocks.related = true
+		p.Item.TitleID = workID(material)
+	}
+	if len(record.ProductSupplies) > 0 {
+		p.blocks.supply = true
+		price, stock, err := mapProductSupplies(record.ProductSupplies, defaultCurrency)
+		if p.Err == nil {
+			p.Err = err
+		}
+		p.Item.Price, p.Stock = price, stock
+	}
+	return p
+}
+
+// productISBN returns the ISBN-13 of the product, "" if it has none
+func productISBN(identifiers []xmlProductIdentifier) (string, error) {
+	values := make(map[string]string, len(identifiers))
+	for _, identifier := range identifiers {
+		values[strings.TrimSpace(identifier.ProductIDType)] = strings.TrimSpace(identifier.IDValue)
+	}
+	isbn := values[productIDISBN13]
+	if isbn == "" {
+		isbn = values[productIDISBN10]
+	}
+	// a GTIN-13 starting with the Bookland prefixes is an ISBN-13
+	if gtin := values[productIDGTIN13]; isbn == "" && (strings.HasPrefix(gtin, "978") || strings.HasPrefix(gtin, "979")) {
+		isbn = gtin
+	}
+	if isbn == "" {
+		return "", nil
+	}
+	return entities.NormalizeISBN(isbn)
+}
+
+// mapDescriptiveDetail maps the title, contributors, form, language, extent and subjects
+func mapDescriptiveDetail(item *entities.Item, detail *xmlDescriptiveDetail) error {
+	item.Name = title(detail.TitleDetails)
+	item.Authors = authors(detail.Contributors)
+	item.Format = productForms[strings.TrimSpace(detail.ProductForm)]
+	for _, language := range detail.Languages {
+		if strings.TrimSpace(language.LanguageRole) == languageOfText {
+			item.Language = strings.TrimSpace(language.LanguageCode)
+			break
+		}
+	}
+	for _, subject := range detail.Subjects {
+		if heading := strings.TrimSpace(subject.SubjectHeadingText); heading != "" {
+			item.Categories = append(item.Categories, heading)
+		}
+	}
+	pages, err := pageCount(detail.Extents)
+	item.PageCount = pages
+	return err
+}
+
+// title returns the distinctive title of the product, along with its subtitle
+func title(details []xmlTitleDetail) string {
+	for _, detail := range details {
+		if strings.TrimSpace(detail.TitleType) != titleTypeDistinctive {
+			continue
+		}
+		for _, element := range detail.TitleElements {
+			if level := strings.TrimSpace(element.TitleElementLevel); level != "" && level != titleLevelProduct {
+				continue
+			}
+			text := strings.TrimSpace(element.TitleText)
+			if text == "" {
+				text = strings.TrimSpace(strings.TrimSpace(element.TitlePrefix) + " " + strings.TrimSpace(element.TitleWithoutPrefix))
+			}
+			if subtitle := strings.TrimSpace(element.Subtitle); subtitle != "" {
+				text += ": " + subtitle
+			}
+			return text
+		}
+	}
+	return ""
+}
+
+// authors returns the names of the authors in the order of their sequence numbers
+func authors(contributors []xmlContributor) []string {
+	sorted := make([]xmlContributor, len(contributors))
+	copy(sorted, contributors)
+	sequence := func(c xmlContributor) int {
+		n, err := strconv.Atoi(strings.TrimSpace(c.SequenceNumber))
+		if err != nil {
+			return len(contributors) + 1
+		}
+		return n
+	}
+	sort.SliceStable(sorted, func(i, j int) bool { return sequence(sorted[i]) < sequence(sorted[j]) })
+
+	var names []string
+	for _, contributor := range sorted {
+		author := false
+		for _, role := range contributor.ContributorRole {
+			author = author || strings.TrimSpace(role) == contributorByAuthor
+		}
+		if !author {
+			continue
+		}
+		name := strings.TrimSpace(contributor.PersonName)
+		if name == "" {
+			name = strings.TrimSpace(strings.TrimSpace(contributor.NamesBeforeKey) + " " + strings.TrimSpace(contributor.KeyNames))
+		}
+		if name == "" {
+			name = strings.TrimSpace(contributor.CorporateName)
+		}
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// pageCount returns the number of pages of the main content, or else the total number of pages
+func pageCount(extents []xmlExtent) (int, error) {
+	pages := map[string]string{}
+	for _, extent := range extents {
+		if strings.TrimSpace(extent.ExtentUnit) == extentUnitPages {
+			pages[strings.TrimSpace(extent.ExtentType)] = strings.TrimSpace(extent.ExtentValue)
+		}
+	}
+	value := pages[extentMainContentPages]
+	if value == "" {
+		value = pages[extentTotalPages]
+	}
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, invalidRecord("page count %q is not a number", value)
+	}
+	return n, nil
+}
+
+// mapCollateralDetail maps the description and the front cover
+func mapCollateralDetail(item *entities.Item, detail *xmlCollateralDetail) {
+	texts := map[string]string{}
+	for _, content := range detail.TextContents {
+		if len(content.Texts) > 0 {
+			texts[strings.TrimSpace(content.TextType)] = string(content.Texts[0])
+		}
+	}
+	item.Description = texts[textDescription]
+	if item.Description == "" {
+		item.Description = texts[textShortDescription]
+	}
+	for _, resource := range detail.SupportingResources {
+		if strings.TrimSpace(resource.ResourceContentType) != resourceFrontCover || strings.TrimSpace(resource.ResourceMode) != resourceImage {
+			continue
+		}
+		for _, version := range resource.ResourceVersions {
+			if len(version.ResourceLinks) > 0 {
+				item.CoverURL = strings.TrimSpace(version.ResourceLinks[0])
+				return
+			}
+		}
+	}
+}
+
+// mapPublishingDetail maps the publisher and the publication date
+func mapPublishingDetail(item *entities.Item, detail *xmlPublishingDetail) {
+	for _, publisher := range detail.Publishers {
+		if strings.TrimSpace(publisher.PublishingRole) == publishingRolePublisher {
+			item.Publisher = strings.TrimSpace(publisher.PublisherName)
+			break
+		}
+	}
+	for _, date := range detail.PublishingDates {
+		if strings.TrimSpace(date.PublishingDateRole) == publicationDate {
+			item.PublicationDate = formatDate(strings.TrimSpace(date.Date))
+			break
+		}
+	}
+}
+
+// formatDate converts an ONIX date, YYYYMMDD, YYYYMM or YYYY, to the format of the catalog
+func formatDate(date string) string {
+	switch len(date) {
+	case 8:
+		return date[:4] + "-" + date[4:6] + "-" + date[6:]
+	case 6:
+		return date[:4] + "-" + date[4:]
+	}
+	return date
+}
+
+// workID returns the identifier of the work the product is a manifestation of, it groups the formats of a title
+func workID(material *xmlRelatedMaterial) string {
+	for _, work := range material.RelatedWorks {
+		if strings.TrimSpace(work.WorkRelationCode) != workManifestationOf {
+			continue
+		}
+		for _, identifier := range work.WorkIdentifiers {
+			if id := strings.TrimSpace(identifier.IDValue); id != "" {
+				return id
+			}
+		}
+	}
+	return ""
+}
+
+// mapProductSupplies returns the price of the product, preferring the
+// recommended retail price without tax, and its stock: the units on hand, or
+// none when every supplier reports it as unavailable
+func mapProductSupplies(supplies []xmlProductSupply, defaultCurrency string) (entities.Money, *int, error) {
+	var prices []xmlPrice
+	onHand, counted, available := 0, false, false
+	for _, supply := range supplies {
+		for _, detail := range supply.SupplyDetails {
+			prices = append(prices, detail.Prices...)
+			available = available || !unavailable[strings.TrimSpace(detail.ProductAvailability)]
+			for _, value := range detail.OnHand {
+				n, err := strconv.Atoi(strings.TrimSpace(value))
+				if err != nil || n < 0 {
+					return entities.Money{}, nil, invalidRecord("stock on hand %q is not a number of units", value)
+				}
+				onHand += n
+				counted = true
+			}
+		}
+	}
+
+	var stock *int
+	switch {
+	case counted:
+		stock = &onHand
+	case !available:
+		none := 0
+		stock = &none
+	}
+
+	for _, priceType := range []string{priceRRPExcludingTax, priceRRPIncludingTax, ""} {
+		for _, price := range prices {
+			if priceType != "" && strings.TrimSpace(price.PriceType) != priceType {
+				continue
+			}
+			currency := strings.TrimSpace(price.CurrencyCode)
+			if currency == "" {
+				currency = defaultCurrency
+			}
+			if currency == "" {
+				return entities.Money{}, stock, invalidRecord("price %s has no currency", price.PriceAmount)
+			}
+			amount, err := entities.ParseMoney(price.PriceAmount, currency)
+			if err != nil {
+				return entities.Money{}, stock, invalidRecord("price: %v", err)
+			}
+			return amount, stock, nil
+		}
+	}
+	return entities.Money{}, stock, nil
+}
@@ -0,0 +1,171 @@
+package onix
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+)
+
+// testHelperParseFixture parses an ONIX message of the testdata directory
+func testHelperParseFixture(t *testing.T, name string) Message {
+	f, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	message, err := Parse(f)
+	if err != nil {
+		t.Fatalf("failed to parse %s: %v", name, err)
+	}
+	return message
+}
+
+func TestParseReferenceTags(t *testing.T) {
+	message := testHelperParseFixture(t, "full.xml")
+	if message.Sender != "Chilton Books" || message.SentAt != "20240105T1030Z" {
+		t.Errorf("unexpected header %q %q", message.Sender, message.SentAt)
+	}
+	if len(message.Products) != 3 {
+		t.Fatalf("expected 3 products, got %d", len(message.Products))
+	}
+
+	hardcover := message.Products[0]
+	if hardcover.Err != nil {
+		t.Fatal(hardcover.Err)
+	}
+	want := entities.Item{
+		SKU:             "9780441172719",
+		Name:            "Dune: Deluxe Edition",
+		Authors:         []string{"Frank Herbert"},
+		Description:     "Set on the desert planet Arrakis, Dune is the story of Paul Atreides.",
+		Price:           entities.NewMoney(2999, "USD"),
+		ISBN:            "9780441172719",
+		TitleID:         "dune",
+		Format:          entities.FormatHardcover,
+		Publisher:       "Chilton Books",
+		PublicationDate: "1965-08-01",
+		PageCount:       412,
+		Language:        "eng",
+		CoverURL:        "https://covers.example.com/9780441172719.jpg",
+		Categories:      []string{"FICTION / Science Fiction / General", "Classics"},
+	}
+	if !reflect.DeepEqual(hardcover.Item, want) {
+		t.Errorf("mapped\n%+v\nwant\n%+v", hardcover.Item, want)
+	}
+	if hardcover.Line != 10 || hardcover.RecordReference != "com.chilton.dune.hc" || hardcover.Notification != NotificationConfirmed {
+		t.Errorf("unexpected record line %d, reference %q, notification %q", hardcover.Line, hardcover.RecordReference, hardcover.Notification)
+	}
+	if hardcover.Stock == nil || *hardcover.Stock != 12 {
+		t.Errorf("expected 12 units on hand, got %v", hardcover.Stock)
+	}
+
+	ebook := message.Products[1]
+	if ebook.Err != nil || ebook.Item.SKU != "9780593099322" || ebook.Item.Format != entities.FormatEbook || ebook.Item.TitleID != "dune" {
+		t.Errorf("unexpected ebook %+v (%v)", ebook.Item, ebook.Err)
+	}
+	if ebook.Stock != nil {
+		t.Errorf("expected an available product without stock on hand to leave the stock alone, got %d", *ebook.Stock)
+	}
+
+	if err := message.Products[2].Err; !errors.Is(err, entities.ErrInvalidItem) || !strings.Contains(err.Error(), "price") {
+		t.Errorf("expected the invalid price to be reported, got %v", err)
+	}
+}
+
+func TestParseShortTags(t *testing.T) {
+	message := testHelperParseFixture(t, "short.xml")
+	if len(message.Products) != 1 {
+		t.Fatalf("expected 1 product, got %d", len(message.Products))
+	}
+	product := message.Products[0]
+	want := entities.Item{
+		SKU:             "9780441172719",
+		Name:            "The Dune Chronicles",
+		Authors:         []string{"Frank Herbert"},
+		Description:     "Set on the desert planet Arrakis.",
+		Price:           entities.NewMoney(2999, "USD"),
+		ISBN:            "9780441172719",
+		Format:          entities.FormatHardcover,
+		Publisher:       "Chilton Books",
+		PublicationDate: "1965-08",
+		PageCount:       412,
+		Language:        "eng",
+		Categories:      []string{"FICTION / Science Fiction / General"},
+	}
+	if product.Err != nil || !reflect.DeepEqual(product.Item, want) {
+		t.Errorf("mapped\n%+v (%v)\nwant\n%+v", product.Item, product.Err, want)
+	}
+	if product.Stock == nil || *product.Stock != 12 {
+		t.Errorf("expected 12 units on hand, got %v", product.Stock)
+	}
+}
+
+func TestParseDeltas(t *testing.T) {
+	full := testHelperParseFixture(t, "full.xml").Products[0].Item
+	message := testHelperParseFixture(t, "delta.xml")
+	if len(message.Products) != 3 {
+		t.Fatalf("expected 3 products, got %d", len(message.Products))
+	}
+
+	update := message.Products[0]
+	if update.Err != nil || update.Notification != NotificationBlockUpdate {
+		t.Fatalf("unexpected block update %+v", update)
+	}
+	if update.Stock == nil || *update.Stock != 0 {
+		t.Errorf("expected a product no longer available to have no stock, got %v", update.Stock)
+	}
+	merged := update.Merge(full)
+	want := full
+	want.Price = entities.NewMoney(3499, "USD")
+	if !reflect.DeepEqual(merged, want) {
+		t.Errorf("expected the block update to only change the price, got\n%+v", merged)
+	}
+
+	deletion := message.Products[1]
+	if deletion.Err != nil || !deletion.IsDeletion() || deletion.Item.SKU != "9780593099322" {
+		t.Errorf("unexpected deletion %+v", deletion)
+	}
+
+	// a GTIN-13 with the 979 prefix is an ISBN
+	publishing := message.Products[2]
+	if publishing.Item.SKU != "9791234567896" {
+		t.Errorf("expected the GTIN-13 to be used as the ISBN, got %q", publishing.Item.SKU)
+	}
+	merged = publishing.Merge(full)
+	if merged.Publisher != "Ace" || merged.PublicationDate != "" || merged.Name != full.Name || merged.Price != full.Price {
+		t.Errorf("expected the publishing block to be replaced as a whole, got %+v", merged)
+	}
+}
+
+func TestParseRejectsOtherDocuments(t *testing.T) {
+	for name, document := range map[string]string{
+		"empty":      "",
+		"other root": `<catalog><Product/></catalog>`,
+		"onix 2.1":   `<ONIXMessage release="2.1"><Product/></ONIXMessage>`,
+		"malformed":  `<ONIXMessage release="3.0"><Product><RecordReference>x</Product></ONIXMessage>`,
+		"not closed": `<ONIXMessage release="3.0"><Product>`,
+	} {
+		if _, err := Parse(strings.NewReader(document)); err == nil {
+			t.Errorf("expected the %s document to be rejected", name)
+		}
+	}
+
+	message, err := Parse(strings.NewReader(`<ONIXMessage release="3.0">
+		<Product><RecordReference>no-isbn</RecordReference><NotificationType>09</NotificationType></Product>
+		<Product><NotificationType>03</NotificationType></Product>
+		<Product><NotificationType>03</NotificationType><ProductIdentifier><ProductIDType>15</ProductIDType><IDValue>9780441172718</IDValue></ProductIdentifier></Product>
+	</ONIXMessage>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, product := range message.Products {
+		if !errors.Is(product.Err, entities.ErrInvalidItem) {
+			t.Errorf("expected product %d to be invalid, got %v", i, product.Err)
+		}
+	}
+}
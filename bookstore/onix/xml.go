@@ -0,0 +1,181 @@
+package onix
+
+import (
+	"encoding/xml"
+	"strings"
+)
+
+// The structs below mirror the parts of an ONIX 3.0 message with reference
+// tags that the catalog uses, the other elements are skipped by the decoder.
+
+type xmlHeader struct {
+	SenderName          string `xml:"Sender>SenderName"`
+	SentDateTime        string `xml:"SentDateTime"`
+	DefaultCurrencyCode string `xml:"DefaultCurrencyCode"`
+}
+
+type xmlProduct struct {
+	RecordReference    string                 `xml:"RecordReference"`
+	NotificationType   string                 `xml:"NotificationType"`
+	ProductIdentifiers []xmlProductIdentifier `xml:"ProductIdentifier"`
+	DescriptiveDetail  *xmlDescriptiveDetail  `xml:"DescriptiveDetail"`
+	CollateralDetail   *xmlCollateralDetail   `xml:"CollateralDetail"`
+	PublishingDetail   *xmlPublishingDetail   `xml:"PublishingDetail"`
+	RelatedMaterial    *xmlRelatedMaterial    `xml:"RelatedMaterial"`
+	ProductSupplies    []xmlProductSupply     `xml:"ProductSupply"`
+}
+
+type xmlProductIdentifier struct {
+	ProductIDType string `xml:"ProductIDType"`
+	IDValue       string `xml:"IDValue"`
+}
+
+type xmlDescriptiveDetail struct {
+	ProductForm  string           `xml:"ProductForm"`
+	TitleDetails []xmlTitleDetail `xml:"TitleDetail"`
+	Contributors []xmlContributor `xml:"Contributor"`
+	Languages    []xmlLanguage    `xml:"Language"`
+	Extents      []xmlExtent      `xml:"Extent"`
+	Subjects     []xmlSubject     `xml:"Subject"`
+}
+
+type xmlTitleDetail struct {
+	TitleType     string            `xml:"TitleType"`
+	TitleElements []xmlTitleElement `xml:"TitleElement"`
+}
+
+type xmlTitleElement struct {
+	TitleElementLevel  string `xml:"TitleElementLevel"`
+	TitleText          string `xml:"TitleText"`
+	TitlePrefix        string `xml:"TitlePrefix"`
+	TitleWithoutPrefix string `xml:"TitleWithoutPrefix"`
+	Subtitle           string `xml:"Subtitle"`
+}
+
+type xmlContributor struct {
+	SequenceNumber  string   `xml:"SequenceNumber"`
+	ContributorRole []string `xml:"ContributorRole"`
+	PersonName      string   `xml:"PersonName"`
+	NamesBeforeKey  string   `xml:"NamesBeforeKey"`
+	KeyNames        string   `xml:"KeyNames"`
+	CorporateName   string   `xml:"CorporateName"`
+}
+
+type xmlLanguage struct {
+	LanguageRole string `xml:"LanguageRole"`
+	LanguageCode string `xml:"LanguageCode"`
+}
+
+type xmlExtent struct {
+	ExtentType  string `xml:"ExtentType"`
+	ExtentValue string `xml:"ExtentValue"`
+	ExtentUnit  string `xml:"ExtentUnit"`
+}
+
+type xmlSubject struct {
+	SubjectSchemeIdentifier string `xml:"SubjectSchemeIdentifier"`
+	SubjectCode             string `xml:"SubjectCode"`
+	SubjectHeadingText      string `xml:"SubjectHeadingText"`
+}
+
+type xmlCollateralDetail struct {
+	TextContents        []xmlTextContent        `xml:"TextContent"`
+	SupportingResources []xmlSupportingResource `xml:"SupportingResource"`
+}
+
+type xmlTextContent struct {
+	TextType string    `xml:"TextType"`
+	Texts    []xmlText `xml:"Text"`
+}
+
+type xmlSupportingResource struct {
+	ResourceContentType string               `xml:"ResourceContentType"`
+	ResourceMode        string               `xml:"ResourceMode"`
+	ResourceVersions    []xmlResourceVersion `xml:"ResourceVersion"`
+}
+
+type xmlResourceVersion struct {
+	ResourceForm  string   `xml:"ResourceForm"`
+	ResourceLinks []string `xml:"ResourceLink"`
+}
+
+type xmlPublishingDetail struct {
+	Publishers      []xmlPublisher      `xml:"Publisher"`
+	PublishingDates []xmlPublishingDate `xml:"PublishingDate"`
+}
+
+type xmlPublisher struct {
+	PublishingRole string `xml:"PublishingRole"`
+	PublisherName  string `xml:"PublisherName"`
+}
+
+type xmlPublishingDate struct {
+	PublishingDateRole string `xml:"PublishingDateRole"`
+	Date               string `xml:"Date"`
+}
+
+type xmlRelatedMaterial struct {
+	RelatedWorks []xmlRelatedWork `xml:"RelatedWork"`
+}
+
+type xmlRelatedWork struct {
+	WorkRelationCode string              `xml:"WorkRelationCode"`
+	WorkIdentifiers  []xmlWorkIdentifier `xml:"WorkIdentifier"`
+}
+
+type xmlWorkIdentifier struct {
+	WorkIDType string `xml:"WorkIDType"`
+	IDValue    string `xml:"IDValue"`
+}
+
+type xmlProductSupply struct {
+	SupplyDetails []xmlSupplyDetail `xml:"SupplyDetail"`
+}
+
+type xmlSupplyDetail struct {
+	ProductAvailability string     `xml:"ProductAvailability"`
+	OnHand              []string   `xml:"Stock>OnHand"`
+	Prices              []xmlPrice `xml:"Price"`
+}
+
+type xmlPrice struct {
+	PriceType    string `xml:"PriceType"`
+	PriceAmount  string `xml:"PriceAmount"`
+	CurrencyCode string `xml:"CurrencyCode"`
+}
+
+// xmlText is a text that may be marked up with XHTML, only its characters are kept
+type xmlText string
+
+// blockElements lists the XHTML elements whose text is kept apart from the text around them
+var blockElements = map[string]bool{
+	"p": true, "br": true, "div": true, "li": true, "dd": true, "dt": true, "tr": true, "blockquote": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+}
+
+// UnmarshalXML collects the characters of the element and of the elements it contains
+func (t *xmlText) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var text strings.Builder
+	for depth := 1; depth > 0; {
+		token, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			depth++
+			if blockElements[token.Name.Local] {
+				text.WriteByte(' ')
+			}
+		case xml.EndElement:
+			depth--
+			if blockElements[token.Name.Local] {
+				text.WriteByte(' ')
+			}
+		case xml.CharData:
+			text.Write(token)
+		}
+	}
+	*t = xmlText(strings.Join(strings.Fields(text.String()), " "))
+	return nil
+}
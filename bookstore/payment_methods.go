@@ -0,0 +1,78 @@
+package bookstore
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+)
+
+// ListPaymentMethods lists the cards the user saved, oldest first
+func (s *BookstoreService) ListPaymentMethods(ctx context.Context, userID string) ([]entities.PaymentMethod, error) {
+	return s.Datastore.ListPaymentMethods(ctx, userID)
+}
+
+// AddPaymentMethod saves the card of a token of the user to pay with, as the
+// default payment method when asked or when it is the first one. Saving a card
+// again returns the payment method it already is.
+func (s *BookstoreService) AddPaymentMethod(ctx context.Context, userID string, cardToken string, makeDefault bool) (entities.PaymentMethod, error) {
+	if s.Cards == nil {
+		return entities.PaymentMethod{}, fmt.Errorf("cards cannot be saved without a vault")
+	}
+	card, err := s.Cards.Card(userID, cardToken)
+	if err != nil {
+		return entities.PaymentMethod{}, err
+	}
+	methods, err := s.Datastore.ListPaymentMethods(ctx, userID)
+	if err != nil {
+		return entities.PaymentMethod{}, err
+	}
+	for _, method := range methods {
+		if method.Token == card.Token {
+			if makeDefault && !method.Default {
+				return s.SetDefaultPaymentMethod(ctx, userID, method.ID)
+			}
+			return method, nil
+		}
+	}
+	return s.Datastore.CreatePaymentMethod(ctx, userID, card, makeDefault)
+}
+
+// DeletePaymentMethod removes a saved card of the user, the orders it paid keep their card
+func (s *BookstoreService) DeletePaymentMethod(ctx context.Context, userID string, paymentMethodID string) error {
+	return s.Datastore.DeletePaymentMethod(ctx, userID, paymentMethodID)
+}
+
+// SetDefaultPaymentMethod makes a saved card of the user the one the purchases are paid with by default
+func (s *BookstoreService) SetDefaultPaymentMethod(ctx context.Context, userID string, paymentMethodID string) (entities.PaymentMethod, error) {
+	if err := s.Datastore.SetDefaultPaymentMethod(ctx, userID, paymentMethodID); err != nil {
+		return entities.PaymentMethod{}, err
+	}
+	return s.Datastore.GetPaymentMethod(ctx, userID, paymentMethodID)
+}
+
+// paymentCardToken returns the token of the card a purchase of the user is paid with
+func (s *BookstoreService) paymentCardToken(ctx context.Context, userID string, source entities.PaymentSource) (string, error) {
+	switch {
+	case source.CardToken != "" && source.PaymentMethodID != "":
+		return "", fmt.Errorf("%w: either a card token or a payment method is paid with", entities.ErrInvalidCard)
+	case source.CardToken != "":
+		return source.CardToken, nil
+	case source.PaymentMethodID != "":
+		method, err := s.Datastore.GetPaymentMethod(ctx, userID, source.PaymentMethodID)
+		if err != nil {
+			return "", err
+		}
+		return method.Token, nil
+	}
+	methods, err := s.Datastore.ListPaymentMethods(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+	for _, method := range methods {
+		if method.Default {
+			return method.Token, nil
+		}
+	}
+	return "", fmt.Errorf("%w: a card is required, there is no default payment method", entities.ErrInvalidCard)
+}
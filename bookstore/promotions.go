@@ -0,0 +1,88 @@
+package bookstore
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+	"github.com/13thuser/bookstore/datastore"
+)
+
+// CreatePromotion adds a promotion, it applies to the carts as soon as it is active
+func (s *BookstoreService) CreatePromotion(ctx context.Context, promotion entities.Promotion) (entities.Promotion, error) {
+	promotion = promotion.Normalize()
+	if err := promotion.Validate(); err != nil {
+		return entities.Promotion{}, err
+	}
+	if err := s.Datastore.CreatePromotion(ctx, promotion); err != nil {
+		return entities.Promotion{}, err
+	}
+	return promotion, nil
+}
+
+// UpdatePromotion replaces a promotion, the orders already placed keep their discounts
+func (s *BookstoreService) UpdatePromotion(ctx context.Context, promotion entities.Promotion) (entities.Promotion, error) {
+	promotion = promotion.Normalize()
+	if err := promotion.Validate(); err != nil {
+		return entities.Promotion{}, err
+	}
+	if err := s.Datastore.UpdatePromotion(ctx, promotion); err != nil {
+		return entities.Promotion{}, err
+	}
+	return promotion, nil
+}
+
+// ListPromotions lists the promotions along with the number of orders that used them
+func (s *BookstoreService) ListPromotions(ctx context.Context) ([]entities.PromotionWithUsage, error) {
+	promotions, err := s.Datastore.ListPromotions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	withUsage := make([]entities.PromotionWithUsage, 0, len(promotions))
+	for _, promotion := range promotions {
+		redemptions, _, err := s.Datastore.CountRedemptions(ctx, promotion.ID, "")
+		if err != nil {
+			return nil, err
+		}
+		withUsage = append(withUsage, entities.PromotionWithUsage{Promotion: promotion, Redemptions: redemptions})
+	}
+	return withUsage, nil
+}
+
+// ApplyCoupon applies a coupon code to the cart of the user, replacing the
+// previous one. The coupon must be active and not used up by the user, it
+// only takes something off once the cart is eligible for it.
+func (s *BookstoreService) ApplyCoupon(ctx context.Context, userID string, code string) (entities.Cart, error) {
+	promotion, err := s.Datastore.FindPromotionByCode(ctx, entities.NormalizeCouponCode(code))
+	if err != nil {
+		return entities.Cart{}, err
+	}
+	if err := datastore.CheckPromotionAvailable(ctx, s.Datastore, promotion, userID, time.Now()); err != nil {
+		return entities.Cart{}, err
+	}
+	cart, err := s.Datastore.SetCartCoupon(ctx, userID, promotion.Code)
+	if err != nil {
+		return entities.Cart{}, err
+	}
+	return s.priceCart(ctx, cart)
+}
+
+// RemoveCoupon removes the coupon applied to the cart of the user
+func (s *BookstoreService) RemoveCoupon(ctx context.Context, userID string) (entities.Cart, error) {
+	cart, err := s.Datastore.SetCartCoupon(ctx, userID, "")
+	if err != nil {
+		return entities.Cart{}, err
+	}
+	return s.priceCart(ctx, cart)
+}
+
+// priceCart applies the promotions to the cart, a coupon that is no longer
+// available stays on the cart without taking anything off; checkout rejects it
+func (s *BookstoreService) priceCart(ctx context.Context, cart entities.Cart) (entities.Cart, error) {
+	err := datastore.PriceCart(ctx, s.Datastore, &cart, time.Now())
+	if err != nil && !errors.Is(err, entities.ErrCouponUnavailable) {
+		return entities.Cart{}, err
+	}
+	return cart, nil
+}
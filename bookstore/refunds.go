@@ -0,0 +1,43 @@
+package bookstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+	"github.com/13thuser/bookstore/datastore"
+	"github.com/13thuser/bookstore/payments"
+)
+
+// RefundOrder refunds part or all of the payment of an order of any user
+// through the payment gateway, putting the requested units back in stock
+// once the gateway accepted the refund
+func (s *BookstoreService) RefundOrder(ctx context.Context, actor entities.UserID, orderID string, req entities.RefundRequest) (entities.Order, error) {
+	order, err := s.Datastore.GetOrder(ctx, orderID)
+	if err != nil {
+		return entities.Order{}, err
+	}
+	order, refund, err := datastore.BeginRefund(ctx, s.Datastore, order.UserID, order.ID, req, actor)
+	if err != nil {
+		return entities.Order{}, err
+	}
+	confirmation, err := s.PaymentGateway.Refund(ctx, order.PaymentConfirmation, refund.Amount)
+	if err != nil {
+		if _, failErr := datastore.FailRefund(ctx, s.Datastore, order.UserID, order.ID, refund.ID, err); failErr != nil {
+			log.Printf("Unable to record the failure of refund %s of order %s: %s\n", refund.ID, order.ID, failErr)
+		}
+		if !errors.Is(err, payments.ErrRefundFailed) {
+			err = fmt.Errorf("%w: %v", payments.ErrRefundFailed, err)
+		}
+		return entities.Order{}, err
+	}
+	order, err = datastore.CompleteRefund(ctx, s.Datastore, order.UserID, order.ID, refund.ID, confirmation)
+	if err != nil {
+		// the refund stays pending, so its amount cannot be refunded twice
+		log.Printf("Unable to record the confirmation %s of refund %s of order %s: %s\n", confirmation, refund.ID, order.ID, err)
+		return entities.Order{}, err
+	}
+	return order, nil
+}
@@ -0,0 +1,120 @@
+package bookstore
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+	"github.com/13thuser/bookstore/bookstore/shipping"
+	"github.com/13thuser/bookstore/datastore"
+)
+
+// ListAddresses lists the address book of the user, oldest first
+func (s *BookstoreService) ListAddresses(ctx context.Context, userID string) ([]entities.SavedAddress, error) {
+	return s.Datastore.ListAddresses(ctx, userID)
+}
+
+// AddAddress adds an address to the address book of the user
+func (s *BookstoreService) AddAddress(ctx context.Context, userID string, address entities.Address) (entities.SavedAddress, error) {
+	address = address.Normalize()
+	if err := address.Validate(); err != nil {
+		return entities.SavedAddress{}, err
+	}
+	return s.Datastore.CreateAddress(ctx, userID, address)
+}
+
+// UpdateAddress replaces an address of the address book of the user, the orders already placed keep their address
+func (s *BookstoreService) UpdateAddress(ctx context.Context, userID string, address entities.SavedAddress) (entities.SavedAddress, error) {
+	address.Address = address.Address.Normalize()
+	if err := address.Validate(); err != nil {
+		return entities.SavedAddress{}, err
+	}
+	if err := s.Datastore.UpdateAddress(ctx, userID, address); err != nil {
+		return entities.SavedAddress{}, err
+	}
+	return address, nil
+}
+
+// DeleteAddress removes an address from the address book of the user
+func (s *BookstoreService) DeleteAddress(ctx context.Context, userID string, addressID string) error {
+	return s.Datastore.DeleteAddress(ctx, userID, addressID)
+}
+
+// ShippingRates quotes the shipping methods for the cart of the user to the
+// address of the request; a cart with nothing to ship has none
+func (s *BookstoreService) ShippingRates(ctx context.Context, userID string, req entities.CheckoutRequest) ([]entities.ShippingRate, error) {
+	address, err := s.shippingAddress(ctx, userID, req)
+	if err != nil {
+		return nil, err
+	}
+	if address == nil {
+		return nil, fmt.Errorf("%w: a shipping address is required", entities.ErrInvalidAddress)
+	}
+	cart, err := s.priceCart(ctx, s.Datastore.GetCart(ctx, userID))
+	if err != nil {
+		return nil, err
+	}
+	// the order the cart would become, for its items with their share of the discounts
+	order, err := datastore.NewOrderFromCart(userID, &cart)
+	if err != nil {
+		return nil, err
+	}
+	shipment := shipping.NewShipment(*address, order.Items, order.TotalPrice.Currency)
+	if shipment.Empty() || s.Shipping == nil {
+		return []entities.ShippingRate{}, nil
+	}
+	rates, err := s.Shipping.Rates(ctx, shipment)
+	if err != nil {
+		return nil, err
+	}
+	if rates == nil {
+		rates = []entities.ShippingRate{}
+	}
+	return rates, nil
+}
+
+// shippingAddress returns the address the request ships to, given in full or
+// by its ID in the address book, or nil if the request has none
+func (s *BookstoreService) shippingAddress(ctx context.Context, userID string, req entities.CheckoutRequest) (*entities.Address, error) {
+	switch {
+	case req.ShippingAddress != nil && req.AddressID != "":
+		return nil, fmt.Errorf("%w: give either a shipping address or an address id", entities.ErrInvalidAddress)
+	case req.AddressID != "":
+		saved, err := s.Datastore.GetAddress(ctx, userID, req.AddressID)
+		if err != nil {
+			return nil, err
+		}
+		return &saved.Address, nil
+	case req.ShippingAddress != nil:
+		address := req.ShippingAddress.Normalize()
+		if err := address.Validate(); err != nil {
+			return nil, err
+		}
+		return &address, nil
+	}
+	return nil, nil
+}
+
+// shippingRate returns the rate of the method for the shipment, or nil when
+// there is nothing to ship or no shipping provider and no method was chosen
+func (s *BookstoreService) shippingRate(ctx context.Context, shipment shipping.Shipment, method string) (*entities.ShippingRate, error) {
+	if shipment.Empty() || (s.Shipping == nil && method == "") {
+		return nil, nil
+	}
+	if s.Shipping == nil {
+		return nil, fmt.Errorf("%w: no shipping method is available", entities.ErrInvalidShipping)
+	}
+	rates, err := s.Shipping.Rates(ctx, shipment)
+	if err != nil {
+		return nil, err
+	}
+	if method == "" {
+		return nil, fmt.Errorf("%w: a shipping method is required", entities.ErrInvalidShipping)
+	}
+	for _, rate := range rates {
+		if rate.Method == method {
+			return &rate, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: method %q does not ship to %s", entities.ErrInvalidShipping, method, shipment.Address.Country)
+}
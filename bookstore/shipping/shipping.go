@@ -0,0 +1,244 @@
+// Package shipping prices the shipping of orders.
+//
+// A Provider quotes the shipping methods available for a shipment. Table is
+// the local provider, loaded from a JSON file such as
+//
+//	{"methods": [
+//		{"id": "standard", "name": "Standard", "countries": ["US"], "rate": "flat",
+//		 "amount": {"amount": 499, "currency": "USD"}, "free_over": {"amount": 5000, "currency": "USD"}},
+//		{"id": "express", "name": "Express", "countries": ["US", "CA"], "rate": "weight",
+//		 "amount": {"amount": 999, "currency": "USD"}, "per_kg": {"amount": 200, "currency": "USD"}}
+//	]}
+//
+// A flat rate costs its amount, a weight rate its amount plus the price per
+// started kilogram, and any rate is free once the shipment is worth free_over.
+package shipping
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+)
+
+// Shipment defines what gets shipped for an order
+type Shipment struct {
+	Address entities.Address
+	// Items lists the items to ship, the digital ones are left out
+	Items []entities.ItemWithQty
+	// Value is the price of the items to ship after discounts
+	Value       entities.Money
+	WeightGrams int
+}
+
+// NewShipment returns the shipment of the items to the address, the digital
+// items are left out and the value of the others is after their discount
+func NewShipment(address entities.Address, items []entities.ItemWithQty, currency string) Shipment {
+	shipment := Shipment{Address: address, Value: entities.Money{Currency: currency}}
+	for _, item := range items {
+		if item.Item.Format.Digital() {
+			continue
+		}
+		shipment.Items = append(shipment.Items, item)
+		shipment.Value = shipment.Value.Add(item.Item.Price.Mul(item.Quantity).Sub(item.Discount))
+		shipment.WeightGrams += item.Item.WeightGrams * item.Quantity
+	}
+	return shipment
+}
+
+// Empty reports whether there is nothing to ship
+func (s Shipment) Empty() bool {
+	return len(s.Items) == 0
+}
+
+// Provider quotes the shipping methods available for a shipment. Checkout asks
+// for the rates within its unit of work, so they should come back quickly.
+type Provider interface {
+	// Rates returns the cost of each method that can ship the shipment, in the currency of its value
+	Rates(ctx context.Context, shipment Shipment) ([]entities.ShippingRate, error)
+}
+
+// Calculator computes the cost of a shipment with a method
+type Calculator interface {
+	Cost(shipment Shipment) entities.Money
+}
+
+// FlatRate costs the same whatever is shipped
+type FlatRate struct {
+	Amount entities.Money
+}
+
+// Cost returns the flat amount
+func (r FlatRate) Cost(shipment Shipment) entities.Money {
+	return r.Amount
+}
+
+// WeightRate costs a base amount plus a price per started kilogram
+type WeightRate struct {
+	Base        entities.Money
+	PerKilogram entities.Money
+}
+
+// Cost returns the base amount plus the price of the started kilograms of the shipment
+func (r WeightRate) Cost(shipment Shipment) entities.Money {
+	kilograms := (shipment.WeightGrams + 999) / 1000
+	return r.Base.Add(r.PerKilogram.Mul(kilograms))
+}
+
+// FreeOver makes the shipping free once the shipment is worth at least the threshold
+type FreeOver struct {
+	Threshold entities.Money
+	Calculator
+}
+
+// Cost returns nothing for the shipments worth the threshold and the cost of the calculator for the others
+func (r FreeOver) Cost(shipment Shipment) entities.Money {
+	if shipment.Value.Cmp(r.Threshold) >= 0 {
+		return entities.Money{Currency: r.Threshold.Currency}
+	}
+	return r.Calculator.Cost(shipment)
+}
+
+// Method defines a shipping method of a Table
+type Method struct {
+	ID   string
+	Name string
+	// Countries lists the ISO 3166-1 alpha-2 codes of the countries served by the method
+	Countries []string
+	// Currency is the currency of the costs, the method only quotes shipments in that currency
+	Currency   string
+	Calculator Calculator
+}
+
+// serves reports whether the method can ship to the country
+func (m Method) serves(country string) bool {
+	for _, served := range m.Countries {
+		if served == country {
+			return true
+		}
+	}
+	return false
+}
+
+// Table is a Provider quoting a fixed list of methods
+type Table []Method
+
+// Rates returns the cost of the methods of the table serving the country of the shipment, in the order of the table
+func (t Table) Rates(ctx context.Context, shipment Shipment) ([]entities.ShippingRate, error) {
+	var rates []entities.ShippingRate
+	for _, method := range t {
+		if !method.serves(shipment.Address.Country) || method.Currency != shipment.Value.Currency {
+			continue
+		}
+		rates = append(rates, entities.ShippingRate{Method: method.ID, Name: method.Name, Cost: method.Calculator.Cost(shipment)})
+	}
+	return rates, nil
+}
+
+// RateKind defines how the cost of a method of a table file is computed
+type RateKind string
+
+const (
+	RateFlat   RateKind = "flat"
+	RateWeight RateKind = "weight"
+)
+
+// methodConfig is a method as written in a table file
+type methodConfig struct {
+	ID          string          `json:"id"`
+	Name        string          `json:"name"`
+	Countries   []string        `json:"countries"`
+	Rate        RateKind        `json:"rate"`
+	Amount      entities.Money  `json:"amount"`
+	PerKilogram *entities.Money `json:"per_kg,omitempty"`
+	FreeOver    *entities.Money `json:"free_over,omitempty"`
+}
+
+// Load reads a table from JSON, see the package documentation
+func Load(r io.Reader) (Table, error) {
+	var file struct {
+		Methods []methodConfig `json:"methods"`
+	}
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&file); err != nil {
+		return nil, fmt.Errorf("unable to read shipping methods: %w", err)
+	}
+	table := make(Table, 0, len(file.Methods))
+	seen := make(map[string]bool, len(file.Methods))
+	for i, config := range file.Methods {
+		method, err := config.method()
+		if err != nil {
+			return nil, fmt.Errorf("shipping method %d: %w", i+1, err)
+		}
+		if seen[method.ID] {
+			return nil, fmt.Errorf("shipping method %d: duplicate id %q", i+1, method.ID)
+		}
+		seen[method.ID] = true
+		table = append(table, method)
+	}
+	return table, nil
+}
+
+// LoadFile reads a table from a JSON file, an empty path gives no table
+func LoadFile(path string) (Table, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Load(f)
+}
+
+// method checks the configuration and returns its method
+func (c methodConfig) method() (Method, error) {
+	method := Method{
+		ID:       strings.TrimSpace(c.ID),
+		Name:     strings.TrimSpace(c.Name),
+		Currency: c.Amount.Currency,
+	}
+	if method.ID == "" {
+		return Method{}, fmt.Errorf("id is required")
+	}
+	if method.Name == "" {
+		method.Name = method.ID
+	}
+	for _, country := range c.Countries {
+		country = strings.ToUpper(strings.TrimSpace(country))
+		if len(country) != 2 {
+			return Method{}, fmt.Errorf("country %q needs a 2 letter ISO code", country)
+		}
+		method.Countries = append(method.Countries, country)
+	}
+	if len(method.Countries) == 0 {
+		return Method{}, fmt.Errorf("countries are required")
+	}
+	if c.Amount.Currency == "" || c.Amount.IsNegative() {
+		return Method{}, fmt.Errorf("amount needs a currency and cannot be negative")
+	}
+	switch c.Rate {
+	case RateFlat:
+		method.Calculator = FlatRate{Amount: c.Amount}
+	case RateWeight:
+		if c.PerKilogram == nil || c.PerKilogram.Currency != method.Currency || c.PerKilogram.IsNegative() {
+			return Method{}, fmt.Errorf("per_kg is required in the currency of the amount and cannot be negative")
+		}
+		method.Calculator = WeightRate{Base: c.Amount, PerKilogram: *c.PerKilogram}
+	default:
+		return Method{}, fmt.Errorf("unknown rate %q, use %q or %q", c.Rate, RateFlat, RateWeight)
+	}
+	if c.FreeOver != nil {
+		if c.FreeOver.Currency != method.Currency {
+			return Method{}, fmt.Errorf("free_over must be in the currency of the amount")
+		}
+		method.Calculator = FreeOver{Threshold: *c.FreeOver, Calculator: method.Calculator}
+	}
+	return method, nil
+}
@@ -0,0 +1,99 @@
+package shipping
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+)
+
+const testTable = `{"methods": [
+	{"id": "standard", "name": "Standard", "countries": ["us", "CA"], "rate": "flat",
+	 "amount": {"amount": 499, "currency": "USD"}, "free_over": {"amount": 5000, "currency": "USD"}},
+	{"id": "express", "name": "Express", "countries": ["US"], "rate": "weight",
+	 "amount": {"amount": 999, "currency": "USD"}, "per_kg": {"amount": 200, "currency": "USD"}},
+	{"id": "europe", "countries": ["FR"], "rate": "flat", "amount": {"amount": 799, "currency": "EUR"}}
+]}`
+
+func testItems() []entities.ItemWithQty {
+	return []entities.ItemWithQty{
+		{Item: entities.Item{SKU: "dune-hc", Price: entities.NewMoney(3000, "USD"), Format: entities.FormatHardcover, WeightGrams: 900}, Quantity: 2, Discount: entities.NewMoney(1500, "USD")},
+		{Item: entities.Item{SKU: "dune-ebook", Price: entities.NewMoney(1000, "USD"), Format: entities.FormatEbook, WeightGrams: 500}, Quantity: 1},
+	}
+}
+
+func TestNewShipment(t *testing.T) {
+	shipment := NewShipment(entities.Address{Country: "US"}, testItems(), "USD")
+	if len(shipment.Items) != 1 || shipment.Value != entities.NewMoney(4500, "USD") || shipment.WeightGrams != 1800 {
+		t.Errorf("expected the hardcovers only, after their discount, got %+v", shipment)
+	}
+	ebooks := NewShipment(entities.Address{Country: "US"}, testItems()[1:], "USD")
+	if !ebooks.Empty() {
+		t.Errorf("expected nothing to ship for an ebook, got %+v", ebooks)
+	}
+}
+
+func TestTableRates(t *testing.T) {
+	table, err := Load(strings.NewReader(testTable))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		country string
+		items   []entities.ItemWithQty
+		want    map[string]int64
+	}{
+		{"flat and weight", "US", testItems(), map[string]int64{"standard": 499, "express": 1399}},
+		{"free over the threshold", "US", []entities.ItemWithQty{{Item: entities.Item{Price: entities.NewMoney(5000, "USD")}, Quantity: 1}}, map[string]int64{"standard": 0, "express": 999}},
+		{"country served by one method", "CA", testItems(), map[string]int64{"standard": 499}},
+		{"other currency", "FR", testItems(), map[string]int64{}},
+		{"country not served", "JP", testItems(), map[string]int64{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rates, err := table.Rates(context.Background(), NewShipment(entities.Address{Country: tt.country}, tt.items, "USD"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rates) != len(tt.want) {
+				t.Fatalf("got rates %+v, want %v", rates, tt.want)
+			}
+			for _, rate := range rates {
+				if want, ok := tt.want[rate.Method]; !ok || rate.Cost.Amount != want || rate.Cost.Currency != "USD" {
+					t.Errorf("got rate %+v, want %v", rate, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestWeightRateRoundsUpToTheKilogram(t *testing.T) {
+	rate := WeightRate{Base: entities.NewMoney(500, "USD"), PerKilogram: entities.NewMoney(100, "USD")}
+	for grams, want := range map[int]int64{0: 500, 1: 600, 1000: 600, 1001: 700} {
+		if got := rate.Cost(Shipment{WeightGrams: grams}); got.Amount != want {
+			t.Errorf("cost of %dg = %v, want %d", grams, got, want)
+		}
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	for name, table := range map[string]string{
+		"not json":               `methods`,
+		"unknown field":          `{"methods": [{"id": "a", "countries": ["US"], "rate": "flat", "amount": {"amount": 1, "currency": "USD"}, "cost": 1}]}`,
+		"missing id":             `{"methods": [{"countries": ["US"], "rate": "flat", "amount": {"amount": 1, "currency": "USD"}}]}`,
+		"duplicate id":           `{"methods": [{"id": "a", "countries": ["US"], "rate": "flat", "amount": {"amount": 1, "currency": "USD"}}, {"id": "a", "countries": ["CA"], "rate": "flat", "amount": {"amount": 1, "currency": "USD"}}]}`,
+		"no country":             `{"methods": [{"id": "a", "rate": "flat", "amount": {"amount": 1, "currency": "USD"}}]}`,
+		"bad country":            `{"methods": [{"id": "a", "countries": ["USA"], "rate": "flat", "amount": {"amount": 1, "currency": "USD"}}]}`,
+		"unknown rate":           `{"methods": [{"id": "a", "countries": ["US"], "rate": "zone", "amount": {"amount": 1, "currency": "USD"}}]}`,
+		"negative amount":        `{"methods": [{"id": "a", "countries": ["US"], "rate": "flat", "amount": {"amount": -1, "currency": "USD"}}]}`,
+		"weight without per kg":  `{"methods": [{"id": "a", "countries": ["US"], "rate": "weight", "amount": {"amount": 1, "currency": "USD"}}]}`,
+		"free over in other cur": `{"methods": [{"id": "a", "countries": ["US"], "rate": "flat", "amount": {"amount": 1, "currency": "USD"}, "free_over": {"amount": 1, "currency": "EUR"}}]}`,
+	} {
+		if _, err := Load(strings.NewReader(table)); err == nil {
+			t.Errorf("expected loading methods with %s to fail", name)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+// Package tax computes the taxes of orders from a table of rules per region.
+//
+// The rules are loaded from a JSON file such as
+//
+//	{"rules": [
+//		{"name": "California sales tax", "country": "US", "region": "CA", "rate": 7.25},
+//		{"name": "UK VAT", "country": "GB", "rate": 20, "inclusive": true, "exempt_categories": ["Books"]}
+//	]}
+//
+// Every rule matching the shipping address of an order applies to it: the
+// rules of a country without a region apply to all its regions, so a national
+// and a regional tax can be combined.
+package tax
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+)
+
+// maxRate is the highest rate accepted in a rules table, 100%
+const maxRate = entities.TaxRate(1000000)
+
+// Rule defines the tax of a jurisdiction
+type Rule struct {
+	Name string `json:"name,omitempty"`
+	// Country is the ISO 3166-1 alpha-2 code of the country of the jurisdiction
+	Country string `json:"country"`
+	// Region restricts the rule to a region of the country, it applies to the whole country when empty
+	Region string           `json:"region,omitempty"`
+	Rate   entities.TaxRate `json:"rate"`
+	// ExemptCategories lists the categories whose items, including the ones of their sub-categories, are not taxed
+	ExemptCategories []string `json:"exempt_categories,omitempty"`
+	// Inclusive rules are for prices that already include the tax, which is only reported
+	Inclusive bool `json:"inclusive,omitempty"`
+}
+
+// Rules is a table of tax rules
+type Rules []Rule
+
+// Load reads a rules table from JSON, see the package documentation
+func Load(r io.Reader) (Rules, error) {
+	var table struct {
+		Rules Rules `json:"rules"`
+	}
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&table); err != nil {
+		return nil, fmt.Errorf("unable to read tax rules: %w", err)
+	}
+	rules := table.Rules.normalize()
+	if err := rules.Validate(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// LoadFile reads a rules table from a JSON file, an empty path gives no rules
+func LoadFile(path string) (Rules, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Load(f)
+}
+
+// normalize returns the rules with their codes in upper case and their categories in canonical form
+func (rules Rules) normalize() Rules {
+	normalized := make(Rules, len(rules))
+	for i, rule := range rules {
+		rule.Name = strings.TrimSpace(rule.Name)
+		rule.Country = strings.ToUpper(strings.TrimSpace(rule.Country))
+		rule.Region = strings.ToUpper(strings.TrimSpace(rule.Region))
+		categories := make([]string, 0, len(rule.ExemptCategories))
+		for _, category := range rule.ExemptCategories {
+			if category = entities.NormalizeCategory(category); category != "" {
+				categories = append(categories, category)
+			}
+		}
+		rule.ExemptCategories = categories
+		normalized[i] = rule
+	}
+	return normalized
+}
+
+// Validate checks that every rule has a country and a rate between 0 and 100%
+func (rules Rules) Validate() error {
+	for i, rule := range rules {
+		if len(rule.Country) != 2 {
+			return fmt.Errorf("tax rule %d: country needs a 2 letter ISO code", i+1)
+		}
+		if rule.Rate < 0 || rule.Rate > maxRate {
+			return fmt.Errorf("tax rule %d: rate must be between 0 and 100", i+1)
+		}
+	}
+	return nil
+}
+
+// Match returns the rules that apply to the orders shipped to the address
+func (rules Rules) Match(address entities.Address) Rules {
+	var matched Rules
+	for _, rule := range rules {
+		if rule.Country == address.Country && (rule.Region == "" || rule.Region == address.Region) {
+			matched = append(matched, rule)
+		}
+	}
+	return matched
+}
+
+// Taxable reports whether a rule taxes some of the items, wherever they ship;
+// the taxes of such items are unknown until their shipping address is
+func (rules Rules) Taxable(items []entities.ItemWithQty) bool {
+	for _, rule := range rules {
+		for _, item := range items {
+			if !rule.exempts(item.Item) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Apply computes the taxes of the order for its shipping address: the tax of
+// each line, after its share of the discounts, and the tax of each matching
+// rule. The amount due of the order is updated, orders without a shipping
+// address have no tax.
+func (rules Rules) Apply(order *entities.Order) {
+	currency := order.TotalPrice.Currency
+	order.Taxes = nil
+	order.TotalTax = entities.Money{Currency: currency}
+	for i := range order.Items {
+		order.Items[i].Tax = entities.Money{Currency: currency}
+	}
+	if order.ShippingAddress != nil {
+		for _, rule := range rules.Match(*order.ShippingAddress) {
+			line := entities.TaxLine{
+				Name:      rule.label(),
+				Country:   rule.Country,
+				Region:    rule.Region,
+				Rate:      rule.Rate,
+				Taxable:   entities.Money{Currency: currency},
+				Amount:    entities.Money{Currency: currency},
+				Inclusive: rule.Inclusive,
+			}
+			for i := range order.Items {
+				item := &order.Items[i]
+				if rule.exempts(item.Item) {
+					continue
+				}
+				taxable := item.Item.Price.Mul(item.Quantity).Sub(item.Discount)
+				tax := rule.Rate.Of(taxable)
+				if rule.Inclusive {
+					tax = rule.Rate.IncludedIn(taxable)
+				}
+				item.Tax = item.Tax.Add(tax)
+				line.Taxable = line.Taxable.Add(taxable)
+				line.Amount = line.Amount.Add(tax)
+			}
+			if line.Taxable.IsPositive() {
+				order.Taxes = append(order.Taxes, line)
+				order.TotalTax = order.TotalTax.Add(line.Amount)
+			}
+		}
+	}
+	order.UpdateAmountDue()
+}
+
+// label names the rule on the orders
+func (rule Rule) label() string {
+	if rule.Name != "" {
+		return rule.Name
+	}
+	if rule.Region != "" {
+		return rule.Country + "-" + rule.Region
+	}
+	return rule.Country
+}
+
+// exempts reports whether the item is in one of the exempt categories of the rule
+func (rule Rule) exempts(item entities.Item) bool {
+	for _, category := range rule.ExemptCategories {
+		if item.InCategory(category) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package tax
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+)
+
+const testRules = `{"rules": [
+	{"name": "California sales tax", "country": "us", "region": "ca", "rate": 7.25},
+	{"country": "US", "region": "NY", "rate": "8.875"},
+	{"name": "UK VAT", "country": "GB", "rate": 20, "inclusive": true, "exempt_categories": ["Books"]}
+]}`
+
+func testOrder(address *entities.Address, discount int64) *entities.Order {
+	order := &entities.Order{
+		Items: []entities.ItemWithQty{
+			{Item: entities.Item{SKU: "dune", Price: entities.NewMoney(2000, "USD"), Categories: []string{"Books/Science Fiction"}}, Quantity: 2},
+			{Item: entities.Item{SKU: "mug", Price: entities.NewMoney(1000, "USD"), Categories: []string{"Gifts"}}, Quantity: 1},
+		},
+		TotalPrice:      entities.NewMoney(5000, "USD"),
+		TotalDiscount:   entities.NewMoney(discount, "USD"),
+		ShippingAddress: address,
+	}
+	order.AllocateDiscount()
+	order.UpdateAmountDue()
+	return order
+}
+
+func TestApply(t *testing.T) {
+	rules, err := Load(strings.NewReader(testRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		address   *entities.Address
+		discount  int64
+		taxes     int
+		totalTax  int64
+		amountDue int64
+	}{
+		{"no address", nil, 0, 0, 0, 5000},
+		{"no rule", &entities.Address{Country: "FR"}, 0, 0, 0, 5000},
+		{"sales tax", &entities.Address{Country: "US", Region: "CA"}, 0, 1, 363, 5363},
+		{"sales tax rounds half up", &entities.Address{Country: "US", Region: "NY"}, 0, 1, 444, 5444},
+		{"sales tax after discounts", &entities.Address{Country: "US", Region: "CA"}, 1000, 1, 290, 4290},
+		{"other region", &entities.Address{Country: "US", Region: "OR"}, 0, 0, 0, 5000},
+		{"inclusive with exempt books", &entities.Address{Country: "GB"}, 0, 1, 167, 5000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order := testOrder(tt.address, tt.discount)
+			rules.Apply(order)
+			if len(order.Taxes) != tt.taxes || order.TotalTax.Amount != tt.totalTax || order.AmountDue.Amount != tt.amountDue {
+				t.Errorf("got taxes %+v, total tax %v and amount due %v, want %d taxes, %d and %d",
+					order.Taxes, order.TotalTax, order.AmountDue, tt.taxes, tt.totalTax, tt.amountDue)
+			}
+			var lines int64
+			for _, item := range order.Items {
+				lines += item.Tax.Amount
+			}
+			if lines != order.TotalTax.Amount {
+				t.Errorf("the taxes of the lines add up to %d, want %v", lines, order.TotalTax)
+			}
+		})
+	}
+}
+
+func TestApplyCombinesRules(t *testing.T) {
+	rules, err := Load(strings.NewReader(`{"rules": [
+		{"name": "GST", "country": "CA", "rate": 5},
+		{"name": "QST", "country": "CA", "region": "QC", "rate": 9.975, "exempt_categories": ["books"]}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	order := testOrder(&entities.Address{Country: "CA", Region: "QC"}, 0)
+	rules.Apply(order)
+	if len(order.Taxes) != 2 || order.Taxes[0].Amount.Amount != 250 || order.Taxes[1].Amount.Amount != 100 {
+		t.Fatalf("unexpected taxes %+v", order.Taxes)
+	}
+	if order.Taxes[1].Taxable.Amount != 1000 || order.Items[0].Tax.Amount != 200 {
+		t.Errorf("expected the books to be exempt from the QST, got %+v", order.Items)
+	}
+	if order.AmountDue.Amount != 5350 {
+		t.Errorf("got amount due %v, want 53.50", order.AmountDue)
+	}
+}
+
+func TestTaxable(t *testing.T) {
+	rules, err := Load(strings.NewReader(`{"rules": [{"name": "UK VAT", "country": "GB", "rate": 20, "exempt_categories": ["Books"]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	order := testOrder(nil, 0)
+	if !rules.Taxable(order.Items) {
+		t.Error("expected the gifts to be taxable")
+	}
+	if rules.Taxable(order.Items[:1]) {
+		t.Error("expected the exempt books not to be taxable")
+	}
+	if Rules(nil).Taxable(order.Items) {
+		t.Error("expected nothing to be taxable without rules")
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	for name, table := range map[string]string{
+		"not json":          `rules`,
+		"unknown field":     `{"rules": [{"country": "US", "rate": 5, "exempt": ["Books"]}]}`,
+		"missing country":   `{"rules": [{"region": "CA", "rate": 5}]}`,
+		"rate above 100":    `{"rules": [{"country": "US", "rate": 101}]}`,
+		"negative rate":     `{"rules": [{"country": "US", "rate": -1}]}`,
+		"too many decimals": `{"rules": [{"country": "US", "rate": 7.12345}]}`,
+		"rate not a number": `{"rules": [{"country": "US", "rate": "high"}]}`,
+	} {
+		if _, err := Load(strings.NewReader(table)); err == nil {
+			t.Errorf("expected loading rules with %s to fail", name)
+		}
+	}
+	if rules, err := LoadFile(""); err != nil || rules != nil {
+		t.Errorf("expected no rules without a file, got %v, %v", rules, err)
+	}
+}
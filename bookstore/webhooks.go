@@ -0,0 +1,95 @@
+package bookstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+	"github.com/13thuser/bookstore/datastore"
+	"github.com/13thuser/bookstore/payments"
+)
+
+// paymentProviderActor records the refunds the payment providers reported
+const paymentProviderActor entities.UserID = "payment-provider"
+
+// ApplyPaymentEvent updates the order of an event a payment provider sent
+// about its payment, see payments.WebhookEvent; the IDs of the event are the
+// ones the payment gateway gives out. The events already applied change
+// nothing, and those that do not apply to the order as it stands fail with
+// payments.ErrEventIgnored.
+func (s *BookstoreService) ApplyPaymentEvent(ctx context.Context, event payments.WebhookEvent) (entities.Order, error) {
+	order, err := s.Datastore.GetOrder(ctx, event.OrderID)
+	if err != nil {
+		return entities.Order{}, err
+	}
+	if event.Type == payments.EventPaymentSucceeded {
+		return s.confirmAuthorization(ctx, order, event)
+	}
+	if order.PaymentConfirmation != event.AuthorizationID {
+		return entities.Order{}, fmt.Errorf("%w: %s is not the payment of order %s", payments.ErrEventIgnored, event.AuthorizationID, order.ID)
+	}
+	switch event.Type {
+	case payments.EventPaymentFailed:
+		// the provider released the authorization, the order is cancelled and restocked
+		return datastore.ChangeOrderStatus(ctx, s.Datastore, order.UserID, order.ID, entities.OrderStatusCancelled, func(order *entities.Order) error {
+			if order.CurrentStatus() != entities.OrderStatusAuthorized || order.Captured().IsPositive() {
+				return fmt.Errorf("%w: order %s is %s", payments.ErrEventIgnored, order.ID, order.CurrentStatus())
+			}
+			return nil
+		})
+	case payments.EventPaymentRefunded:
+		if _, ok := order.RefundConfirmed(event.RefundID); ok {
+			return order, nil
+		}
+		reason := event.Reason
+		if reason == "" {
+			reason = "refunded by the payment provider"
+		}
+		amount := event.Amount
+		order, refund, err := datastore.BeginRefund(ctx, s.Datastore, order.UserID, order.ID, entities.RefundRequest{Amount: &amount, Reason: reason}, paymentProviderActor)
+		if err != nil {
+			return entities.Order{}, err
+		}
+		return datastore.CompleteRefund(ctx, s.Datastore, order.UserID, order.ID, refund.ID, event.RefundID)
+	case payments.EventPaymentDisputed:
+		return datastore.RecordDispute(ctx, s.Datastore, order.UserID, order.ID, entities.Dispute{
+			ID:        event.DisputeID,
+			Amount:    event.Amount,
+			Reason:    event.Reason,
+			CreatedAt: event.CreatedAt,
+		})
+	}
+	return entities.Order{}, fmt.Errorf("%w: unknown type %q", payments.ErrInvalidWebhook, event.Type)
+}
+
+// confirmAuthorization records the authorization a payment provider confirmed
+// for an order still waiting for its payment, e.g. one that timed out when it
+// was asked; the authorizations of the orders paid or cancelled since are voided
+func (s *BookstoreService) confirmAuthorization(ctx context.Context, order entities.Order, event payments.WebhookEvent) (entities.Order, error) {
+	if order.PaymentConfirmation == event.AuthorizationID {
+		return order, nil
+	}
+	if order.PaymentConfirmation == "" && order.CurrentStatus().CanTransitionTo(entities.OrderStatusAuthorized) {
+		if !event.Amount.SameCurrency(order.AmountDue) || event.Amount.Cmp(order.AmountDue) < 0 {
+			s.voidAuthorization(ctx, order.ID, event.AuthorizationID)
+			return entities.Order{}, fmt.Errorf("%w: only %s of %s was approved, the authorization was voided", payments.ErrEventIgnored, event.Amount, order.AmountDue)
+		}
+		recorded, err := datastore.RecordAuthorization(ctx, s.Datastore, order.UserID, order.ID, event.AuthorizationID, order.AmountDue, nil)
+		if err == nil {
+			return recorded, nil
+		}
+		if !errors.Is(err, entities.ErrInvalidStatusTransition) {
+			return entities.Order{}, err
+		}
+		// confirmed, paid otherwise or cancelled meanwhile
+		if order, err = s.Datastore.GetOrder(ctx, order.ID); err != nil {
+			return entities.Order{}, err
+		}
+		if order.PaymentConfirmation == event.AuthorizationID {
+			return order, nil
+		}
+	}
+	s.voidAuthorization(ctx, order.ID, event.AuthorizationID)
+	return entities.Order{}, fmt.Errorf("%w: order %s is %s, the authorization was voided", payments.ErrEventIgnored, order.ID, order.CurrentStatus())
+}
@@ -0,0 +1,231 @@
+// Command catalog imports and exports the catalog of the sqlite datastore.
+//
+//	catalog import [-db bookstore.db] [-format csv|jsonl] [-dry-run] [-actor name] FILE
+//	catalog onix [-db bookstore.db] [-dry-run] [-actor name] FILE
+//	catalog export [-db bookstore.db] [-format csv|jsonl] [-o FILE]
+//
+// The format of the imported file defaults to its extension, "-" reads the
+// file from the standard input. Imports exit with status 1 when rows failed.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/13thuser/bookstore/bookstore"
+	"github.com/13thuser/bookstore/bookstore/catalogio"
+	"github.com/13thuser/bookstore/bookstore/entities"
+	"github.com/13thuser/bookstore/bookstore/onix"
+	"github.com/13thuser/bookstore/datastore/sqlite"
+)
+
+// Path of the database file, the same variable as the server
+var DEFAULT_SQLITE_PATH = "bookstore.db"
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	var err error
+	switch os.Args[1] {
+	case "import":
+		err = importCommand(os.Args[2:])
+	case "onix":
+		err = onixCommand(os.Args[2:])
+	case "export":
+		err = exportCommand(os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "catalog %s: %s\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: catalog import [-db path] [-format csv|jsonl] [-dry-run] [-actor name] FILE")
+	fmt.Fprintln(os.Stderr, "       catalog onix [-db path] [-dry-run] [-actor name] FILE")
+	fmt.Fprintln(os.Stderr, "       catalog export [-db path] [-format csv|jsonl] [-o FILE]")
+	os.Exit(2)
+}
+
+// errRowsFailed is returned when some rows of an import failed, they are already reported
+var errRowsFailed = errors.New("some rows were not imported")
+
+// importCommand upserts the items of a catalog file
+func importCommand(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	dbPath := flags.String("db", sqlitePath(), "database file of the sqlite datastore")
+	formatName := flags.String("format", "", "format of the file, csv or jsonl, defaults to its extension")
+	dryRun := flags.Bool("dry-run", false, "check the file and report what would change without writing")
+	actor := flags.String("actor", defaultActor(), "user recorded in the audit trail")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		usage()
+	}
+	path := flags.Arg(0)
+
+	if *formatName == "" {
+		*formatName = filepath.Ext(path)
+	}
+	format, err := catalogio.ParseFormat(*formatName)
+	if err != nil {
+		return err
+	}
+	file, err := openInput(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	rows, err := catalogio.Read(file, format)
+	if err != nil {
+		return fmt.Errorf("unable to read %s: %w", path, err)
+	}
+
+	service, closeStore, err := openService(*dbPath)
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+	report, err := service.ImportItems(context.Background(), *actor, rows, *dryRun)
+	if err != nil {
+		return err
+	}
+	return printReport(path, report)
+}
+
+// onixCommand applies the product records of an ONIX 3.0 message
+func onixCommand(args []string) error {
+	flags := flag.NewFlagSet("onix", flag.ExitOnError)
+	dbPath := flags.String("db", sqlitePath(), "database file of the sqlite datastore")
+	dryRun := flags.Bool("dry-run", false, "check the message and report what would change without writing")
+	actor := flags.String("actor", defaultActor(), "user recorded in the audit trail")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		usage()
+	}
+	path := flags.Arg(0)
+
+	file, err := openInput(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	message, err := onix.Parse(file)
+	if err != nil {
+		return fmt.Errorf("unable to read %s: %w", path, err)
+	}
+
+	service, closeStore, err := openService(*dbPath)
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+	report, err := service.IngestONIX(context.Background(), *actor, message.Products, *dryRun)
+	if err != nil {
+		return err
+	}
+	return printReport(path, report)
+}
+
+// openInput opens the file to import, "-" being the standard input
+func openInput(path string) (io.ReadCloser, error) {
+	if path == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return os.Open(path)
+}
+
+// printReport prints the outcome of an import, the rows that failed first
+func printReport(path string, report entities.ImportReport) error {
+	for _, rowErr := range report.Errors {
+		fmt.Fprintf(os.Stderr, "%s:%d: %s\n", path, rowErr.Line, rowErr.Error)
+	}
+	prefix := ""
+	if report.DryRun {
+		prefix = "dry run, nothing written: "
+	}
+	fmt.Printf("%s%d created, %d updated, %d retired, %d unchanged, %d failed\n",
+		prefix, report.Created, report.Updated, report.Retired, report.Unchanged, report.Failed)
+	if report.Failed > 0 {
+		return errRowsFailed
+	}
+	return nil
+}
+
+// exportCommand writes the whole catalog with its stock levels
+func exportCommand(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	dbPath := flags.String("db", sqlitePath(), "database file of the sqlite datastore")
+	formatName := flags.String("format", "", "format of the file, csv or jsonl, defaults to the extension of -o or else csv")
+	output := flags.String("o", "-", "file to write, - for the standard output")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		usage()
+	}
+
+	if *formatName == "" {
+		*formatName = string(catalogio.FormatCSV)
+		if *output != "-" {
+			*formatName = filepath.Ext(*output)
+		}
+	}
+	format, err := catalogio.ParseFormat(*formatName)
+	if err != nil {
+		return err
+	}
+
+	service, closeStore, err := openService(*dbPath)
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+	items, err := service.ExportItems(context.Background())
+	if err != nil {
+		return err
+	}
+
+	if *output == "-" {
+		return catalogio.Write(os.Stdout, format, items)
+	}
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	if err := catalogio.Write(f, format, items); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// openService opens the sqlite datastore and the bookstore service on top of it
+func openService(path string) (*bookstore.BookstoreService, func() error, error) {
+	db, err := sqlite.Open(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to open %s: %w", path, err)
+	}
+	return bookstore.NewBookstoreService(db, nil), db.Close, nil
+}
+
+// sqlitePath reads the database path like the server does
+func sqlitePath() string {
+	if path := os.Getenv("SQLITE_PATH"); path != "" {
+		return path
+	}
+	return DEFAULT_SQLITE_PATH
+}
+
+// defaultActor records the imports made from the command line under the name of the system user
+func defaultActor() string {
+	if user := os.Getenv("USER"); user != "" {
+		return "cli:" + user
+	}
+	return "cli"
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+	"github.com/gorilla/mux"
+)
+
+// ListAddresses lists the address book of the user
+func (s *Server) ListAddresses(w http.ResponseWriter, r *http.Request) {
+	userID, shouldReturn := s.validateRequest(r, w)
+	if shouldReturn {
+		return
+	}
+
+	addresses, err := s.service.ListAddresses(r.Context(), userID)
+	if err != nil {
+		writeServiceError(w, "Failed to list addresses", err)
+		return
+	}
+	response := struct {
+		Addresses []entities.SavedAddress `json:"addresses"`
+	}{Addresses: addresses}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// AddAddress adds an address to the address book of the user
+func (s *Server) AddAddress(w http.ResponseWriter, r *http.Request) {
+	userID, shouldReturn := s.validateRequest(r, w)
+	if shouldReturn {
+		return
+	}
+
+	var address entities.Address
+	if err := json.NewDecoder(r.Body).Decode(&address); err != nil {
+		writeError(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+
+	saved, err := s.service.AddAddress(r.Context(), userID, address)
+	if err != nil {
+		writeServiceError(w, "Failed to add address", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(saved)
+}
+
+// UpdateAddress replaces an address of the address book of the user
+func (s *Server) UpdateAddress(w http.ResponseWriter, r *http.Request) {
+	userID, shouldReturn := s.validateRequest(r, w)
+	if shouldReturn {
+		return
+	}
+
+	var address entities.Address
+	if err := json.NewDecoder(r.Body).Decode(&address); err != nil {
+		writeError(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+
+	saved := entities.SavedAddress{ID: mux.Vars(r)["addressID"], Address: address}
+	updated, err := s.service.UpdateAddress(r.Context(), userID, saved)
+	if err != nil {
+		writeServiceError(w, "Failed to update address", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(updated)
+}
+
+// DeleteAddress removes an address from the address book of the user
+func (s *Server) DeleteAddress(w http.ResponseWriter, r *http.Request) {
+	userID, shouldReturn := s.validateRequest(r, w)
+	if shouldReturn {
+		return
+	}
+
+	if err := s.service.DeleteAddress(r.Context(), userID, mux.Vars(r)["addressID"]); err != nil {
+		writeServiceError(w, "Failed to delete address", err)
+		return
+	}
+	response := struct {
+		Message string `json:"message"`
+	}{Message: "Address deleted"}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// ShippingRates quotes the shipping methods for the cart to the address of the request
+func (s *Server) ShippingRates(w http.ResponseWriter, r *http.Request) {
+	userID, shouldReturn := s.validateRequest(r, w)
+	if shouldReturn {
+		return
+	}
+
+	var req entities.CheckoutRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+
+	rates, err := s.service.ShippingRates(r.Context(), userID, req)
+	if err != nil {
+		writeServiceError(w, "Failed to quote shipping", err)
+		return
+	}
+	response := struct {
+		Rates []entities.ShippingRate `json:"rates"`
+	}{Rates: rates}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/13thuser/bookstore/bookstore/catalogio"
+	"github.com/13thuser/bookstore/bookstore/entities"
+	"github.com/13thuser/bookstore/bookstore/onix"
+	"github.com/13thuser/bookstore/payments"
+	"github.com/gorilla/mux"
+)
+
+// CreateItem adds a new item to the catalog
+func (s *Server) CreateItem(w http.ResponseWriter, r *http.Request) {
+	userID, shouldReturn := s.validateRequest(r, w)
+	if shouldReturn {
+		return
+	}
+
+	var req entities.ItemRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+
+	item := req.Item()
+	created, err := s.service.CreateItem(r.Context(), userID, item, req.Stock)
+	if err != nil {
+		writeServiceError(w, "Failed to create item", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(created)
+}
+
+// UpdateItem replaces the details of an item
+func (s *Server) UpdateItem(w http.ResponseWriter, r *http.Request) {
+	userID, shouldReturn := s.validateRequest(r, w)
+	if shouldReturn {
+		return
+	}
+
+	var req entities.ItemRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+	sku := mux.Vars(r)["sku"]
+	if req.SKU != "" && req.SKU != sku {
+		writeError(w, "The sku of the body does not match the one of the path", http.StatusBadRequest)
+		return
+	}
+
+	req.SKU = sku
+	item := req.Item()
+	updated, err := s.service.UpdateItem(r.Context(), userID, item)
+	if err != nil {
+		writeServiceError(w, "Failed to update item", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(updated)
+}
+
+// RetireItem stops selling an item
+func (s *Server) RetireItem(w http.ResponseWriter, r *http.Request) {
+	userID, shouldReturn := s.validateRequest(r, w)
+	if shouldReturn {
+		return
+	}
+
+	retired, err := s.service.RetireItem(r.Context(), userID, mux.Vars(r)["sku"])
+	if err != nil {
+		writeServiceError(w, "Failed to retire item", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(retired)
+}
+
+// RestockItem adds units of an item to the stock
+func (s *Server) RestockItem(w http.ResponseWriter, r *http.Request) {
+	userID, shouldReturn := s.validateRequest(r, w)
+	if shouldReturn {
+		return
+	}
+
+	var req entities.StockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+
+	restocked, err := s.service.RestockItem(r.Context(), userID, mux.Vars(r)["sku"], req.Quantity)
+	if err != nil {
+		writeServiceError(w, "Failed to restock item", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(restocked)
+}
+
+// maxImportSize is the size of the largest catalog file accepted by the import endpoint
+const maxImportSize = 32 << 20
+
+// ImportItems upserts the items of the CSV or JSON Lines catalog file sent as
+// the body, whose format is given by the format query parameter or else the
+// Content-Type header; with dry_run=true the file is only checked
+func (s *Server) ImportItems(w http.ResponseWriter, r *http.Request) {
+	userID, shouldReturn := s.validateRequest(r, w)
+	if shouldReturn {
+		return
+	}
+
+	formatName := r.URL.Query().Get("format")
+	if formatName == "" {
+		formatName = r.Header.Get("Content-Type")
+	}
+	format, err := catalogio.ParseFormat(formatName)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dryRun, err := parseDryRun(r)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rows, err := catalogio.Read(http.MaxBytesReader(w, r.Body, maxImportSize), format)
+	if err != nil {
+		writeImportReadError(w, "Failed to read the catalog file", err)
+		return
+	}
+
+	report, err := s.service.ImportItems(r.Context(), userID, rows, dryRun)
+	if err != nil {
+		writeServiceError(w, "Failed to import items", err)
+		return
+	}
+	writeImportReport(w, "Catalog file", userID, report)
+}
+
+// IngestONIX applies the ONIX 3.0 message sent as the body to the catalog,
+// with dry_run=true the message is only checked
+func (s *Server) IngestONIX(w http.ResponseWriter, r *http.Request) {
+	userID, shouldReturn := s.validateRequest(r, w)
+	if shouldReturn {
+		return
+	}
+
+	dryRun, err := parseDryRun(r)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	message, err := onix.Parse(http.MaxBytesReader(w, r.Body, maxImportSize))
+	if err != nil {
+		writeImportReadError(w, "Failed to read the ONIX message", err)
+		return
+	}
+
+	report, err := s.service.IngestONIX(r.Context(), userID, message.Products, dryRun)
+	if err != nil {
+		writeServiceError(w, "Failed to ingest the ONIX message", err)
+		return
+	}
+	writeImportReport(w, fmt.Sprintf("ONIX message from %q", message.Sender), userID, report)
+}
+
+// parseDryRun reads the dry_run query parameter of an import
+func parseDryRun(r *http.Request) (bool, error) {
+	value := r.URL.Query().Get("dry_run")
+	if value == "" {
+		return false, nil
+	}
+	dryRun, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, errors.New("dry_run must be true or false")
+	}
+	return dryRun, nil
+}
+
+// writeImportReadError writes the error of an imported body that could not be read
+func writeImportReadError(w http.ResponseWriter, message string, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, fmt.Sprintf("The body is larger than %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	writeError(w, fmt.Sprintf("%s: %s", message, err), http.StatusBadRequest)
+}
+
+// writeImportReport logs the outcome of an import unless it was a dry run and writes its report
+func writeImportReport(w http.ResponseWriter, source string, userID string, report entities.ImportReport) {
+	if !report.DryRun {
+		log.Printf("%s imported by %s: %d created, %d updated, %d retired, %d unchanged, %d failed\n",
+			source, userID, report.Created, report.Updated, report.Retired, report.Unchanged, report.Failed)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(report)
+}
+
+// ExportItems exports the whole catalog with its stock levels as a CSV file,
+// or a JSON Lines one with format=jsonl
+func (s *Server) ExportItems(w http.ResponseWriter, r *http.Request) {
+	format := catalogio.FormatCSV
+	if name := r.URL.Query().Get("format"); name != "" {
+		var err error
+		if format, err = catalogio.ParseFormat(name); err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	items, err := s.service.ExportItems(r.Context())
+	if err != nil {
+		writeServiceError(w, "Failed to export items", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", format.ContentType())
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="catalog.%s"`, format))
+	w.WriteHeader(http.StatusOK)
+	if err := catalogio.Write(w, format, items); err != nil {
+		log.Printf("Failed to export items: %s\n", err)
+	}
+}
+
+// GetCatalogChanges gets the audit trail of an item
+func (s *Server) GetCatalogChanges(w http.ResponseWriter, r *http.Request) {
+	changes, err := s.service.GetCatalogChanges(r.Context(), mux.Vars(r)["sku"])
+	if err != nil {
+		writeServiceError(w, "Failed to get the audit trail", err)
+		return
+	}
+	response := struct {
+		Changes []entities.CatalogChange `json:"changes"`
+	}{Changes: changes}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// CaptureOrder charges part or all of the authorized payment of an order
+func (s *Server) CaptureOrder(w http.ResponseWriter, r *http.Request) {
+	userID, shouldReturn := s.validateRequest(r, w)
+	if shouldReturn {
+		return
+	}
+
+	var req entities.CaptureRequest
+	if r.Body != nil {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			writeError(w, "Failed to parse request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	order, err := s.service.CaptureOrder(r.Context(), userID, mux.Vars(r)["orderID"], req)
+	if err != nil {
+		writeServiceError(w, "Failed to capture order", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(order)
+}
+
+// FulfillOrder moves a paid order along its fulfillment
+func (s *Server) FulfillOrder(w http.ResponseWriter, r *http.Request) {
+	var req entities.FulfillmentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+
+	order, err := s.service.FulfillOrder(r.Context(), mux.Vars(r)["orderID"], req)
+	if err != nil {
+		writeServiceError(w, "Failed to update order status", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(order)
+}
+
+// RefundOrder refunds part or all of the payment of an order
+func (s *Server) RefundOrder(w http.ResponseWriter, r *http.Request) {
+	userID, shouldReturn := s.validateRequest(r, w)
+	if shouldReturn {
+		return
+	}
+
+	var req entities.RefundRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+
+	order, err := s.service.RefundOrder(r.Context(), userID, mux.Vars(r)["orderID"], req)
+	if err != nil {
+		writeServiceError(w, "Failed to refund order", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(order)
+}
+
+// GetUserRoles gets the roles of a user
+func (s *Server) GetUserRoles(w http.ResponseWriter, r *http.Request) {
+	user, err := s.auth.GetUser(mux.Vars(r)["userID"])
+	if err != nil {
+		writeServiceError(w, "Failed to get user", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(user)
+}
+
+// SetUserRoles replaces the roles of a user
+func (s *Server) SetUserRoles(w http.ResponseWriter, r *http.Request) {
+	userID, shouldReturn := s.validateRequest(r, w)
+	if shouldReturn {
+		return
+	}
+
+	var req entities.RolesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+	assigned := entities.User{Roles: make([]entities.Role, 0, len(req.Roles))}
+	for _, role := range req.Roles {
+		if err := role.Validate(); err != nil {
+			writeServiceError(w, "Failed to set roles", err)
+			return
+		}
+		if !assigned.HasRole(role) {
+			assigned.Roles = append(assigned.Roles, role)
+		}
+	}
+	target := mux.Vars(r)["userID"]
+	// Keep at least one admin around, an admin cannot demote themselves
+	if target == userID && !assigned.HasRole(entities.RoleAdmin) {
+		writeError(w, "Admins cannot remove their own admin role", http.StatusConflict)
+		return
+	}
+
+	user, err := s.auth.SetRoles(target, assigned.Roles)
+	if err != nil {
+		writeServiceError(w, "Failed to set roles", err)
+		return
+	}
+	log.Printf("Roles of %s set to %v by %s\n", target, assigned.Roles, userID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(user)
+}
+
+// PaymentProviders reports the health of the payment providers, there are none without a providers file
+func (s *Server) PaymentProviders(w http.ResponseWriter, r *http.Request) {
+	providers := []payments.ProviderHealth{}
+	if s.paymentProviders != nil {
+		providers = s.paymentProviders.Health()
+	}
+	response := struct {
+		Providers []payments.ProviderHealth `json:"providers"`
+	}{Providers: providers}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+	"github.com/gorilla/mux"
+)
+
+// TokenizeCard validates the details of a card of the user and returns its
+// token in the vault, to confirm purchases with, along with its brand and last
+// four digits
+func (s *Server) TokenizeCard(w http.ResponseWriter, r *http.Request) {
+	userID, shouldReturn := s.validateRequest(r, w)
+	if shouldReturn {
+		return
+	}
+
+	var details entities.CreditCardDetails
+	if err := json.NewDecoder(r.Body).Decode(&details); err != nil {
+		writeError(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+
+	card, err := s.vault.Tokenize(userID, details)
+	if err != nil {
+		writeServiceError(w, "Failed to tokenize card", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(card)
+}
+
+// ListPaymentMethods lists the cards the user saved
+func (s *Server) ListPaymentMethods(w http.ResponseWriter, r *http.Request) {
+	userID, shouldReturn := s.validateRequest(r, w)
+	if shouldReturn {
+		return
+	}
+
+	methods, err := s.service.ListPaymentMethods(r.Context(), userID)
+	if err != nil {
+		writeServiceError(w, "Failed to list payment methods", err)
+		return
+	}
+	response := struct {
+		PaymentMethods []entities.PaymentMethod `json:"payment_methods"`
+	}{PaymentMethods: methods}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// AddPaymentMethod saves a card of the user to pay with, given by its token or its details
+func (s *Server) AddPaymentMethod(w http.ResponseWriter, r *http.Request) {
+	userID, shouldReturn := s.validateRequest(r, w)
+	if shouldReturn {
+		return
+	}
+
+	var req entities.PaymentMethodRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+	if (req.CardToken == "") == (req.CreditCardDetails == nil) {
+		writeError(w, "Invalid request, either a card token or credit card details are required", http.StatusBadRequest)
+		return
+	}
+	if req.CreditCardDetails != nil {
+		// the card details go no further than the vault
+		card, err := s.vault.Tokenize(userID, *req.CreditCardDetails)
+		if err != nil {
+			writeServiceError(w, "Failed to add payment method", err)
+			return
+		}
+		req.CardToken = card.Token
+	}
+
+	method, err := s.service.AddPaymentMethod(r.Context(), userID, req.CardToken, req.Default)
+	if err != nil {
+		writeServiceError(w, "Failed to add payment method", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(method)
+}
+
+// DeletePaymentMethod removes a saved card of the user
+func (s *Server) DeletePaymentMethod(w http.ResponseWriter, r *http.Request) {
+	userID, shouldReturn := s.validateRequest(r, w)
+	if shouldReturn {
+		return
+	}
+
+	if err := s.service.DeletePaymentMethod(r.Context(), userID, mux.Vars(r)["paymentMethodID"]); err != nil {
+		writeServiceError(w, "Failed to delete payment method", err)
+		return
+	}
+	response := struct {
+		Message string `json:"message"`
+	}{Message: "Payment method deleted"}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// SetDefaultPaymentMethod makes a saved card of the user the one purchases are paid with by default
+func (s *Server) SetDefaultPaymentMethod(w http.ResponseWriter, r *http.Request) {
+	userID, shouldReturn := s.validateRequest(r, w)
+	if shouldReturn {
+		return
+	}
+
+	method, err := s.service.SetDefaultPaymentMethod(r.Context(), userID, mux.Vars(r)["paymentMethodID"])
+	if err != nil {
+		writeServiceError(w, "Failed to set default payment method", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(method)
+}
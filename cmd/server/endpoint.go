@@ -2,12 +2,17 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"net/http"
+	"strconv"
 
 	"github.com/13thuser/bookstore/bookstore/entities"
 	"github.com/13thuser/bookstore/datastore"
+	"github.com/13thuser/bookstore/payments"
 	"github.com/gorilla/mux"
 )
 
@@ -16,9 +21,15 @@ func (s *Server) WithEndpointsSetup(router *mux.Router, middlewares ...Middlewar
 	// public endpoints
 	router.HandleFunc("/", s.Health).Methods("GET")
 	router.HandleFunc("/health", s.Health).Methods("GET")
+	router.HandleFunc("/register", idempotent(s, s.registerHandler)).Methods("POST")
+	// logging in and refreshing take no idempotency key: their tokens are never
+	// stored to be replayed, and refresh tokens can only be used once anyway
 	router.HandleFunc("/login", s.loginHandler).Methods("POST")
+	router.HandleFunc("/refresh", s.refreshHandler).Methods("POST")
 	router.HandleFunc("/logout", s.logoutHandler).Methods("GET")
 	router.HandleFunc("/listItems", s.listItems).Methods("GET")
+	router.HandleFunc("/items", s.searchItems).Methods("GET")
+	router.HandleFunc("/categories", s.listCategories).Methods("GET")
 	router.HandleFunc("/getItem/{itemID}", s.GetItem).Methods("GET")
 
 	// auth enabled sub-routes
@@ -26,9 +37,45 @@ func (s *Server) WithEndpointsSetup(router *mux.Router, middlewares ...Middlewar
 	router.HandleFunc("/removeFromCart", requireLogin(s, s.RemoveFromCart)).Methods("POST")
 	router.HandleFunc("/getCart", requireLogin(s, s.GetCart)).Methods("GET")
 	router.HandleFunc("/getCartTotalPrice", requireLogin(s, s.GetCartTotalPrice)).Methods("GET")
+	router.HandleFunc("/cart/coupon", requireLogin(s, s.ApplyCoupon)).Methods("POST")
+	router.HandleFunc("/cart/coupon", requireLogin(s, s.RemoveCoupon)).Methods("DELETE")
+	router.HandleFunc("/addresses", requireLogin(s, s.ListAddresses)).Methods("GET")
+	router.HandleFunc("/addresses", requireLogin(s, s.AddAddress)).Methods("POST")
+	router.HandleFunc("/addresses/{addressID}", requireLogin(s, s.UpdateAddress)).Methods("PUT")
+	router.HandleFunc("/addresses/{addressID}", requireLogin(s, s.DeleteAddress)).Methods("DELETE")
+	router.HandleFunc("/shipping/rates", requireLogin(s, s.ShippingRates)).Methods("POST")
 	router.HandleFunc("/checkout", requireLogin(s, s.Checkout)).Methods("POST")
 	router.HandleFunc("/confirmPurchase", requireLogin(s, s.ConfirmPurchase)).Methods("POST")
+	router.HandleFunc("/cards", requireLogin(s, s.TokenizeCard)).Methods("POST")
+	router.HandleFunc("/paymentMethods", requireLogin(s, s.ListPaymentMethods)).Methods("GET")
+	router.HandleFunc("/paymentMethods", requireLogin(s, s.AddPaymentMethod)).Methods("POST")
+	router.HandleFunc("/paymentMethods/{paymentMethodID}", requireLogin(s, s.DeletePaymentMethod)).Methods("DELETE")
+	router.HandleFunc("/paymentMethods/{paymentMethodID}/default", requireLogin(s, s.SetDefaultPaymentMethod)).Methods("POST")
 	router.HandleFunc("/orderHistory", requireLogin(s, s.GetOrderHistory)).Methods("GET")
+	router.HandleFunc("/orders/{orderID}/cancel", requireLogin(s, s.CancelOrder)).Methods("POST")
+	router.HandleFunc("/sessions", requireLogin(s, s.ListSessions)).Methods("GET")
+	router.HandleFunc("/sessions/{sessionID}", requireLogin(s, s.RevokeSession)).Methods("DELETE")
+	router.HandleFunc("/logout/all", requireLogin(s, s.logoutEverywhereHandler)).Methods("POST")
+
+	// admin sub-routes
+	router.HandleFunc("/admin/items", requirePermission(s, entities.PermissionManageCatalog, s.CreateItem)).Methods("POST")
+	router.HandleFunc("/admin/items/import", requirePermission(s, entities.PermissionManageCatalog, s.ImportItems)).Methods("POST")
+	router.HandleFunc("/admin/items/onix", requirePermission(s, entities.PermissionManageCatalog, s.IngestONIX)).Methods("POST")
+	router.HandleFunc("/admin/items/export", requirePermission(s, entities.PermissionManageCatalog, s.ExportItems)).Methods("GET")
+	router.HandleFunc("/admin/items/{sku}", requirePermission(s, entities.PermissionManageCatalog, s.UpdateItem)).Methods("PUT")
+	router.HandleFunc("/admin/items/{sku}", requirePermission(s, entities.PermissionManageCatalog, s.RetireItem)).Methods("DELETE")
+	router.HandleFunc("/admin/items/{sku}/stock", requirePermission(s, entities.PermissionManageCatalog, s.RestockItem)).Methods("POST")
+	router.HandleFunc("/admin/items/{sku}/audit", requirePermission(s, entities.PermissionViewAudit, s.GetCatalogChanges)).Methods("GET")
+	router.HandleFunc("/admin/promotions", requirePermission(s, entities.PermissionManagePromotions, s.ListPromotions)).Methods("GET")
+	router.HandleFunc("/admin/promotions", requirePermission(s, entities.PermissionManagePromotions, s.CreatePromotion)).Methods("POST")
+	router.HandleFunc("/admin/promotions/{promotionID}", requirePermission(s, entities.PermissionManagePromotions, s.UpdatePromotion)).Methods("PUT")
+	router.HandleFunc("/admin/orders/{orderID}/capture", requirePermission(s, entities.PermissionCaptureOrders, s.CaptureOrder)).Methods("POST")
+	router.HandleFunc("/admin/orders/{orderID}/status", requirePermission(s, entities.PermissionFulfillOrders, s.FulfillOrder)).Methods("POST")
+	router.HandleFunc("/admin/orders/{orderID}/refund", requirePermission(s, entities.PermissionRefundOrders, s.RefundOrder)).Methods("POST")
+	router.HandleFunc("/admin/users/{userID}/roles", requirePermission(s, entities.PermissionManageUsers, s.GetUserRoles)).Methods("GET")
+	router.HandleFunc("/admin/users/{userID}/roles", requireRole(s, entities.RoleAdmin, s.SetUserRoles)).Methods("PUT")
+	router.HandleFunc("/admin/payments/providers", requireRole(s, entities.RoleAdmin, s.PaymentProviders)).Methods("GET")
+	router.HandleFunc("/webhooks/payments/{provider}", s.PaymentWebhook).Methods("POST")
 	return router
 }
 
@@ -66,28 +113,72 @@ func (s *Server) loginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if s.devMode && userCreds.UserID == userCreds.Password {
+		s.addDevUser(userCreds.UserID)
+	}
 	user, authenticated := s.auth.Authenticate(userCreds.UserID, userCreds.Password)
 	if !authenticated {
 		writeError(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
-	sessionID, err := s.sessions.AddSession(user.ID, &user)
+	tokens, err := s.sessions.AddSession(user.ID, r.UserAgent())
 	if err != nil {
 		writeError(w, "Unable to create session", http.StatusInternalServerError)
+		return
 	}
 	log.Printf("Logged in as %s\n", user.ID)
-	response := struct {
-		Token string `json:"token"`
-	}{
-		Token: sessionID,
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// addDevUser creates a customer whose password is the username, unless the
+// user already exists, so any username can be used to log in during development
+func (s *Server) addDevUser(userID string) {
+	if _, err := s.auth.GetUser(userID); !errors.Is(err, datastore.ErrUserNotFound) {
+		return
 	}
-	json.NewEncoder(w).Encode(response)
+	if err := s.auth.AddUser(userID, userID, userID); err != nil && !errors.Is(err, datastore.ErrUserExists) {
+		log.Printf("Unable to create development user %s: %s\n", userID, err)
+	}
+}
+
+// registerHandler creates the account of a new customer
+func (s *Server) registerHandler(w http.ResponseWriter, r *http.Request) {
+	var req entities.RegistrationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+	if err := req.Validate(); err != nil {
+		writeServiceError(w, "Failed to register", err)
+		return
+	}
+
+	if err := s.auth.AddUser(req.UserID, req.Name, req.Password); err != nil {
+		writeServiceError(w, "Failed to register", err)
+		return
+	}
+	user, err := s.auth.GetUser(req.UserID)
+	if err != nil {
+		writeServiceError(w, "Failed to register", err)
+		return
+	}
+	log.Printf("Registered %s\n", user.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(user)
 }
 
 // logoutHandler logs out the user
 func (s *Server) logoutHandler(w http.ResponseWriter, r *http.Request) {
 	token := getTokenFromRequest(r)
 	if token != "" {
+		// Give the stock held by the cart back to other users
+		if userID := s.sessions.GetUserID(token); userID != "" {
+			if err := s.service.ReleaseCart(r.Context(), userID); err != nil {
+				log.Printf("Unable to release the cart of %s: %s\n", userID, err)
+			}
+		}
 		s.sessions.RemoveSession(token)
 	}
 	// message logout successfully
@@ -105,7 +196,7 @@ func getTokenFromRequest(r *http.Request) string {
 }
 
 // getUserIDFromRequest gets the user ID from the request
-func getUserIDFromRequest(r *http.Request, sessionStore *datastore.SessionStore) string {
+func getUserIDFromRequest(r *http.Request, sessionStore datastore.SessionRepository) string {
 	token := getTokenFromRequest(r)
 	if token == "" {
 		return ""
@@ -113,8 +204,14 @@ func getUserIDFromRequest(r *http.Request, sessionStore *datastore.SessionStore)
 	return sessionStore.GetUserID(token)
 }
 
-// requireLogin is an interceptor middleware that checks if the user is logged in
+// requireLogin is an interceptor middleware that checks if the user is logged
+// in, the mutating requests are idempotent once it is
 func requireLogin(s *Server, next http.HandlerFunc) http.HandlerFunc {
+	return requireSession(s, idempotent(s, next))
+}
+
+// requireSession is an interceptor middleware that checks if the request has the token of an active session
+func requireSession(s *Server, next http.HandlerFunc) http.HandlerFunc {
 	if s == nil {
 		log.Fatal("Server is nil")
 	}
@@ -133,6 +230,30 @@ func requireLogin(s *Server, next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// requireRole is an interceptor middleware that checks if the logged in user has the role
+func requireRole(s *Server, role entities.Role, next http.HandlerFunc) http.HandlerFunc {
+	return requireUser(s, func(user datastore.User) bool { return user.HasRole(role) }, next)
+}
+
+// requirePermission is an interceptor middleware that checks if a role of the logged in user grants the permission
+func requirePermission(s *Server, permission entities.Permission, next http.HandlerFunc) http.HandlerFunc {
+	return requireUser(s, func(user datastore.User) bool { return user.HasPermission(permission) }, next)
+}
+
+// requireUser is an interceptor middleware that checks if the logged in user
+// is allowed to continue, the mutating requests are idempotent once it is
+func requireUser(s *Server, allowed func(datastore.User) bool, next http.HandlerFunc) http.HandlerFunc {
+	next = idempotent(s, next)
+	return requireSession(s, func(w http.ResponseWriter, r *http.Request) {
+		user, err := s.auth.GetUser(getUserIDFromRequest(r, s.sessions))
+		if err != nil || !allowed(user) {
+			writeError(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	})
+}
+
 // listItems lists the items
 func (s *Server) listItems(w http.ResponseWriter, r *http.Request) {
 	items, err := s.service.ListItems(r.Context())
@@ -150,6 +271,84 @@ func (s *Server) listItems(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+// searchItems searches the catalog with the filters, sort and page of the query string
+func (s *Server) searchItems(w http.ResponseWriter, r *http.Request) {
+	query, err := parseItemQuery(r)
+	if err != nil {
+		writeServiceError(w, "Failed to search items", err)
+		return
+	}
+	page, err := s.service.SearchItems(r.Context(), query)
+	if err != nil {
+		writeServiceError(w, "Failed to search items", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(page)
+}
+
+// parseItemQuery reads a search from the query string: q, min_price and
+// max_price in major units of currency (USD by default), available,
+// category, format, language, title_id, sort, cursor and limit
+func parseItemQuery(r *http.Request) (entities.ItemQuery, error) {
+	values := r.URL.Query()
+	query := entities.ItemQuery{
+		Text:     values.Get("q"),
+		Category: values.Get("category"),
+		Format:   entities.Format(values.Get("format")),
+		Language: values.Get("language"),
+		TitleID:  values.Get("title_id"),
+		Sort:     entities.ItemSort(values.Get("sort")),
+		Cursor:   values.Get("cursor"),
+	}
+	currency := values.Get("currency")
+	if currency == "" {
+		currency = entities.DefaultCurrency
+	}
+	for param, bound := range map[string]**entities.Money{"min_price": &query.MinPrice, "max_price": &query.MaxPrice} {
+		if value := values.Get(param); value != "" {
+			price, err := entities.ParseMoney(value, currency)
+			if err != nil {
+				return entities.ItemQuery{}, fmt.Errorf("%w: %s: %s", entities.ErrInvalidQuery, param, err)
+			}
+			*bound = &price
+		}
+	}
+	if value := values.Get("available"); value != "" {
+		available, err := strconv.ParseBool(value)
+		if err != nil {
+			return entities.ItemQuery{}, fmt.Errorf("%w: available must be true or false", entities.ErrInvalidQuery)
+		}
+		query.Available = available
+	}
+	if value := values.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil {
+			return entities.ItemQuery{}, fmt.Errorf("%w: limit must be a number", entities.ErrInvalidQuery)
+		}
+		query.Limit = limit
+	}
+	return query, nil
+}
+
+// listCategories lists the category tree of the items still sold
+func (s *Server) listCategories(w http.ResponseWriter, r *http.Request) {
+	categories, err := s.service.ListCategories(r.Context())
+	if err != nil {
+		writeServiceError(w, "Failed to list categories", err)
+		return
+	}
+	response := struct {
+		Categories []*entities.CategoryNode `json:"categories"`
+	}{Categories: categories}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
 // GetItem gets an item
 func (s *Server) GetItem(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
@@ -161,7 +360,7 @@ func (s *Server) GetItem(w http.ResponseWriter, r *http.Request) {
 	}
 	item, err := s.service.GetItem(r.Context(), sku)
 	if err != nil {
-		writeError(w, "Failed to get item from datastore", http.StatusInternalServerError)
+		writeServiceError(w, "Failed to get item from datastore", err)
 		return
 	}
 
@@ -257,7 +456,7 @@ func (s *Server) GetCartTotalPrice(w http.ResponseWriter, r *http.Request) {
 
 	// struct to hold the total price
 	resp := struct {
-		TotalPrice float64 `json:"total_price"`
+		TotalPrice entities.Money `json:"total_price"`
 	}{TotalPrice: totalPrice}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -272,10 +471,19 @@ func (s *Server) Checkout(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The body is optional, older clients send none
+	var req entities.CheckoutRequest
+	if r.Body != nil {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			writeError(w, "Failed to parse request body", http.StatusBadRequest)
+			return
+		}
+	}
+
 	// Checkout the order
-	order, err := s.service.Checkout(r.Context(), userID)
+	order, err := s.service.Checkout(r.Context(), userID, req)
 	if err != nil {
-		writeError(w, "Failed to checkout cart", http.StatusInternalServerError)
+		writeServiceError(w, "Failed to checkout cart", err)
 		return
 	}
 
@@ -297,15 +505,28 @@ func (s *Server) ConfirmPurchase(w http.ResponseWriter, r *http.Request) {
 		writeError(w, "Failed to parse request body", http.StatusBadRequest)
 		return
 	}
-	if req.OrderID == "" || req.CreditCardDetails.Number == "" {
+	if req.OrderID == "" {
 		writeError(w, "Invalid request with one or more missing parameters", http.StatusBadRequest)
 		return
 	}
+	if req.CreditCardDetails != nil && (req.CardToken != "" || req.PaymentMethodID != "") {
+		writeError(w, "Invalid request, either credit card details, a card token or a payment method are paid with", http.StatusBadRequest)
+		return
+	}
+	if req.CreditCardDetails != nil {
+		// the card details go no further than the vault
+		card, err := s.vault.Tokenize(userID, *req.CreditCardDetails)
+		if err != nil {
+			writeServiceError(w, "Failed to confirm purchase", err)
+			return
+		}
+		req.CardToken = card.Token
+	}
 
 	// Confirm the purchase
-	order, err := s.service.ConfirmPurchase(r.Context(), userID, req.OrderID, req.CreditCardDetails)
+	order, err := s.service.ConfirmPurchase(r.Context(), userID, req.OrderID, req.PaymentSource)
 	if err != nil {
-		writeError(w, fmt.Sprintf("Failed to confirm purchase: %s", err), http.StatusInternalServerError)
+		writeServiceError(w, "Failed to confirm purchase", err)
 		return
 	}
 
@@ -331,6 +552,25 @@ func (s *Server) GetOrderHistory(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(orderHistory)
 }
 
+// CancelOrder cancels an order nothing was captured of and puts its items back in stock
+func (s *Server) CancelOrder(w http.ResponseWriter, r *http.Request) {
+	userID, shouldReturn := s.validateRequest(r, w)
+	if shouldReturn {
+		return
+	}
+
+	orderID := mux.Vars(r)["orderID"]
+	order, err := s.service.CancelOrder(r.Context(), userID, orderID)
+	if err != nil {
+		writeServiceError(w, "Failed to cancel order", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(order)
+}
+
 // validateRequest validates the request
 func (s *Server) validateRequest(r *http.Request, w http.ResponseWriter) (string, bool) {
 	userID := getUserIDFromRequest(r, s.sessions)
@@ -341,6 +581,91 @@ func (s *Server) validateRequest(r *http.Request, w http.ResponseWriter) (string
 	return userID, false
 }
 
+// statusForError maps the errors of the service to an HTTP status code
+func statusForError(err error) int {
+	switch {
+	case errors.Is(err, datastore.ErrOrderNotFound), errors.Is(err, datastore.ErrItemNotFound),
+		errors.Is(err, datastore.ErrUserNotFound), errors.Is(err, datastore.ErrSessionNotFound),
+		errors.Is(err, datastore.ErrPromotionNotFound), errors.Is(err, datastore.ErrAddressNotFound),
+		errors.Is(err, datastore.ErrPaymentMethodNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, datastore.ErrItemExists), errors.Is(err, datastore.ErrItemRetired), errors.Is(err, datastore.ErrUserExists),
+		errors.Is(err, entities.ErrInvalidStatusTransition), errors.Is(err, datastore.ErrPromotionExists),
+		errors.Is(err, entities.ErrCouponUnavailable), errors.Is(err, entities.ErrRefundNotAllowed),
+		errors.Is(err, entities.ErrCaptureNotAllowed), errors.Is(err, payments.ErrEventIgnored):
+		return http.StatusConflict
+	case errors.Is(err, entities.ErrInvalidItem), errors.Is(err, entities.ErrInvalidRole),
+		errors.Is(err, entities.ErrInvalidUser), errors.Is(err, entities.ErrWeakPassword),
+		errors.Is(err, entities.ErrInvalidQuery), errors.Is(err, entities.ErrInvalidPromotion),
+		errors.Is(err, entities.ErrInvalidAddress), errors.Is(err, entities.ErrInvalidShipping),
+		errors.Is(err, entities.ErrInvalidRefund), errors.Is(err, entities.ErrInvalidCapture),
+		errors.Is(err, entities.ErrInvalidFulfillment),
+		errors.Is(err, entities.ErrInvalidCard), errors.Is(err, payments.ErrInvalidToken),
+		errors.Is(err, payments.ErrInvalidWebhook):
+		return http.StatusBadRequest
+	case errors.Is(err, payments.ErrInvalidSignature):
+		return http.StatusUnauthorized
+	case errors.Is(err, payments.ErrDeclined):
+		return http.StatusPaymentRequired
+	case errors.Is(err, payments.ErrRefundFailed), errors.Is(err, payments.ErrCaptureFailed):
+		return http.StatusBadGateway
+	case errors.Is(err, payments.ErrTimeout):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, payments.ErrUnavailable):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// writeServiceError writes an error response for an error of the service; the
+// details of unexpected errors are logged rather than returned to the client
+func writeServiceError(w http.ResponseWriter, message string, err error) {
+	statusCode := statusForError(err)
+	if statusCode == http.StatusInternalServerError {
+		log.Printf("%s: %s\n", message, err)
+		writeError(w, message, statusCode)
+		return
+	}
+	message = fmt.Sprintf("%s: %s", message, err)
+	if code, retryable := paymentErrorCode(err); code != "" {
+		var circuitOpen *payments.CircuitOpenError
+		if errors.As(err, &circuitOpen) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(circuitOpen.RetryAfter.Seconds()))))
+		}
+		writePaymentError(w, message, code, retryable, statusCode)
+		return
+	}
+	writeError(w, message, statusCode)
+}
+
+// paymentErrorCode returns the code of an error of the payment processors and
+// whether the payment may succeed when retried, unlike declines; the code is
+// empty for the other errors
+func paymentErrorCode(err error) (string, bool) {
+	switch {
+	case errors.Is(err, payments.ErrDeclined):
+		return "payment_declined", false
+	case errors.Is(err, payments.ErrTimeout):
+		return "payment_timeout", true
+	case errors.Is(err, payments.ErrUnavailable):
+		return "payment_unavailable", true
+	}
+	return "", false
+}
+
+// writePaymentError writes the error response of a failed payment, with its code
+func writePaymentError(w http.ResponseWriter, message string, code string, retryable bool, statusCode int) {
+	response := struct {
+		Error     string `json:"error"`
+		Code      string `json:"code"`
+		Retryable bool   `json:"retryable"`
+	}{Error: message, Code: code, Retryable: retryable}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(response)
+}
+
 // writeError writes an error response
 func writeError(w http.ResponseWriter, message string, statusCode int) {
 	response := struct {
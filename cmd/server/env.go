@@ -1,11 +1,106 @@
 package main
 
-import "os"
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/13thuser/bookstore/datastore"
+	"github.com/13thuser/bookstore/payments"
+)
 
 // You may want to read it from the conf
 var DEFAULT_SERVER_PORT = "8080"
 var SERVER_PORT = getServerPort()
 
+// Storage backend, either "memory" or "sqlite"
+var DEFAULT_DATASTORE_BACKEND = "memory"
+var DATASTORE_BACKEND = getEnv("DATASTORE_BACKEND", DEFAULT_DATASTORE_BACKEND)
+
+// Path of the database file used by the sqlite backend
+var DEFAULT_SQLITE_PATH = "bookstore.db"
+var SQLITE_PATH = getEnv("SQLITE_PATH", DEFAULT_SQLITE_PATH)
+
+// Orders left unpaid for longer than the TTL are cancelled by a sweeper running at the given interval
+var DEFAULT_ORDER_PAYMENT_TTL = 30 * time.Minute
+var ORDER_PAYMENT_TTL = getEnvDuration("ORDER_PAYMENT_TTL", DEFAULT_ORDER_PAYMENT_TTL)
+var DEFAULT_ORDER_SWEEP_INTERVAL = time.Minute
+var ORDER_SWEEP_INTERVAL = getEnvDuration("ORDER_SWEEP_INTERVAL", DEFAULT_ORDER_SWEEP_INTERVAL)
+
+// Authorized payments left uncaptured for longer than the TTL are voided by the order sweeper
+var DEFAULT_AUTHORIZATION_TTL = 7 * 24 * time.Hour
+var AUTHORIZATION_TTL = getEnvDuration("AUTHORIZATION_TTL", DEFAULT_AUTHORIZATION_TTL)
+
+// Stock added to a cart stays reserved for that long after the cart was last added to
+var DEFAULT_CART_RESERVATION_TTL = 15 * time.Minute
+var CART_RESERVATION_TTL = getEnvDuration("CART_RESERVATION_TTL", DEFAULT_CART_RESERVATION_TTL)
+
+// Access tokens must be refreshed after SESSION_ACCESS_TTL, sessions end when unused for
+// SESSION_IDLE_TIMEOUT or SESSION_ABSOLUTE_TIMEOUT after the login, whichever comes first
+var DEFAULT_SESSION_ACCESS_TTL = datastore.DefaultSessionPolicy.AccessTTL
+var SESSION_ACCESS_TTL = getEnvDuration("SESSION_ACCESS_TTL", DEFAULT_SESSION_ACCESS_TTL)
+var DEFAULT_SESSION_IDLE_TIMEOUT = datastore.DefaultSessionPolicy.IdleTimeout
+var SESSION_IDLE_TIMEOUT = getEnvDuration("SESSION_IDLE_TIMEOUT", DEFAULT_SESSION_IDLE_TIMEOUT)
+var DEFAULT_SESSION_ABSOLUTE_TIMEOUT = datastore.DefaultSessionPolicy.AbsoluteTimeout
+var SESSION_ABSOLUTE_TIMEOUT = getEnvDuration("SESSION_ABSOLUTE_TIMEOUT", DEFAULT_SESSION_ABSOLUTE_TIMEOUT)
+
+// Responses to the requests made with an Idempotency-Key header are replayed to their retries for that long
+var DEFAULT_IDEMPOTENCY_KEY_TTL = 24 * time.Hour
+var IDEMPOTENCY_KEY_TTL = getEnvDuration("IDEMPOTENCY_KEY_TTL", DEFAULT_IDEMPOTENCY_KEY_TTL)
+
+// Secret keying the fingerprints of the requests made with an Idempotency-Key header; without one
+// a random secret is used, and the retries sent after a restart are taken for other requests
+var DEFAULT_IDEMPOTENCY_SECRET = ""
+var IDEMPOTENCY_SECRET = getEnv("IDEMPOTENCY_SECRET", DEFAULT_IDEMPOTENCY_SECRET)
+
+// JSON file of the tax rules applied at checkout, orders are not taxed without one
+var DEFAULT_TAX_RULES_PATH = ""
+var TAX_RULES_PATH = getEnv("TAX_RULES_PATH", DEFAULT_TAX_RULES_PATH)
+
+// JSON file of the shipping methods offered at checkout, orders ship for free without one
+var DEFAULT_SHIPPING_METHODS_PATH = ""
+var SHIPPING_METHODS_PATH = getEnv("SHIPPING_METHODS_PATH", DEFAULT_SHIPPING_METHODS_PATH)
+
+// JSON file of the payment providers and their routes, payments go to the simulated gateway without one
+var DEFAULT_PAYMENT_PROVIDERS_PATH = ""
+var PAYMENT_PROVIDERS_PATH = getEnv("PAYMENT_PROVIDERS_PATH", DEFAULT_PAYMENT_PROVIDERS_PATH)
+
+// Secret keying the fingerprints of the cards of the vault, which tell the same card apart in the
+// datastore; without one the cards tokenized again after a restart get new tokens
+var DEFAULT_VAULT_SECRET = ""
+var VAULT_SECRET = getEnv("VAULT_SECRET", DEFAULT_VAULT_SECRET)
+
+// Secret signing the webhooks of the payment gateway, sent to /webhooks/payments/gateway; the
+// payment providers of PAYMENT_PROVIDERS_PATH have their own, see webhook_secret_env
+var DEFAULT_PAYMENT_WEBHOOK_SECRET = ""
+var PAYMENT_WEBHOOK_SECRET = getEnv("PAYMENT_WEBHOOK_SECRET", DEFAULT_PAYMENT_WEBHOOK_SECRET)
+
+// Every call to the payment providers is bounded by PAYMENT_CALL_TIMEOUT, the transient failures
+// of authorizations and voids are attempted up to PAYMENT_MAX_ATTEMPTS times, and a provider failing
+// PAYMENT_CIRCUIT_THRESHOLD times in a row is not called for PAYMENT_CIRCUIT_COOLDOWN
+var DEFAULT_PAYMENT_CALL_TIMEOUT = payments.DefaultResiliencePolicy.CallTimeout
+var PAYMENT_CALL_TIMEOUT = getEnvDuration("PAYMENT_CALL_TIMEOUT", DEFAULT_PAYMENT_CALL_TIMEOUT)
+var DEFAULT_PAYMENT_MAX_ATTEMPTS = payments.DefaultResiliencePolicy.MaxAttempts
+var PAYMENT_MAX_ATTEMPTS = getEnvInt("PAYMENT_MAX_ATTEMPTS", DEFAULT_PAYMENT_MAX_ATTEMPTS)
+var DEFAULT_PAYMENT_CIRCUIT_THRESHOLD = payments.DefaultResiliencePolicy.FailureThreshold
+var PAYMENT_CIRCUIT_THRESHOLD = getEnvInt("PAYMENT_CIRCUIT_THRESHOLD", DEFAULT_PAYMENT_CIRCUIT_THRESHOLD)
+var DEFAULT_PAYMENT_CIRCUIT_COOLDOWN = payments.DefaultResiliencePolicy.OpenDuration
+var PAYMENT_CIRCUIT_COOLDOWN = getEnvDuration("PAYMENT_CIRCUIT_COOLDOWN", DEFAULT_PAYMENT_CIRCUIT_COOLDOWN)
+
+// Development mode lets anyone log in with a password equal to the username,
+// creating the account on the fly; never enable it in production
+var DEFAULT_DEV_MODE = false
+var DEV_MODE = getEnvBool("DEV_MODE", DEFAULT_DEV_MODE)
+
+// The administrator is created on startup with this password, which must
+// follow the password policy; without one there is no administrator, except
+// in development mode where it logs in with admin/admin
+const ADMIN_USER = "admin"
+
+var DEFAULT_ADMIN_PASSWORD = ""
+var ADMIN_PASSWORD = getEnv("ADMIN_PASSWORD", DEFAULT_ADMIN_PASSWORD)
+
 // Read the port from the environment variable otherwise use the default value
 func getServerPort() string {
 	port := os.Getenv("SERVER_PORT")
@@ -14,3 +109,54 @@ func getServerPort() string {
 	}
 	return port
 }
+
+// Read the environment variable otherwise use the default value
+func getEnv(key string, defaultValue string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		value = defaultValue
+	}
+	return value
+}
+
+// Read the duration, e.g. "30m", from the environment variable otherwise use the default value
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		log.Printf("Invalid duration %q for %s, using %s\n", value, key, defaultValue)
+		return defaultValue
+	}
+	return d
+}
+
+// Read the positive integer from the environment variable otherwise use the default value
+func getEnvInt(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		log.Printf("Invalid number %q for %s, using %d\n", value, key, defaultValue)
+		return defaultValue
+	}
+	return n
+}
+
+// Read the boolean, e.g. "true" or "1", from the environment variable otherwise use the default value
+func getEnvBool(key string, defaultValue bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid boolean %q for %s, using %t\n", value, key, defaultValue)
+		return defaultValue
+	}
+	return b
+}
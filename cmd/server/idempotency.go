@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/13thuser/bookstore/bookstore"
+	"github.com/13thuser/bookstore/datastore"
+)
+
+const (
+	HEADER_IDEMPOTENCY_KEY     = "Idempotency-Key"
+	HEADER_IDEMPOTENT_REPLAYED = "Idempotent-Replayed"
+	// maxIdempotencyKeyLength is the length of the longest idempotency key accepted
+	maxIdempotencyKeyLength = 255
+)
+
+// idempotent makes the mutating requests sent with an Idempotency-Key header
+// safe to retry: the first request with a key is processed and its response
+// stored for IDEMPOTENCY_KEY_TTL, the retries get that response back. Keys are
+// per user, per client address for the anonymous requests, and cannot be
+// reused for another request, and the responses of server errors are not
+// stored so that the request can be retried. The responses carrying tokens
+// must not be stored, their handlers are not made idempotent.
+func idempotent(s *Server, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(HEADER_IDEMPOTENCY_KEY)
+		if key == "" || r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			writeError(w, fmt.Sprintf("The %s header cannot be longer than %d characters", HEADER_IDEMPOTENCY_KEY, maxIdempotencyKeyLength), http.StatusBadRequest)
+			return
+		}
+		owner := getUserIDFromRequest(r, s.sessions)
+		if owner == "" {
+			owner = anonymousOwner(r)
+		}
+
+		var body []byte
+		if r.Body != nil {
+			var err error
+			body, err = io.ReadAll(http.MaxBytesReader(w, r.Body, maxImportSize))
+			if err != nil {
+				writeImportReadError(w, "Failed to read the request body", err)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		r = r.WithContext(bookstore.WithIdempotencyKey(r.Context(), owner, key))
+		s.processOnce(w, r, body, owner, key, HEADER_IDEMPOTENCY_KEY, next)
+	}
+}
+
+// anonymousOwner returns the owner of the idempotency keys of an anonymous
+// request, its client address; user IDs cannot contain a colon. The clients
+// sharing an address, behind a NAT or a proxy, share their keys too.
+func anonymousOwner(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "anonymous:" + host
+}
+
+// processOnce processes the request with the body the first time the key of
+// the owner is used, storing its response for IDEMPOTENCY_KEY_TTL unless it is
+// a server error, and replays that response to the requests using it again;
+// keyName names the key in the errors
+func (s *Server) processOnce(w http.ResponseWriter, r *http.Request, body []byte, owner string, key string, keyName string, next http.HandlerFunc) {
+	now := time.Now()
+	fingerprint := s.requestFingerprint(r, body)
+	record, claimed, err := s.idempotency.BeginIdempotentRequest(datastore.IdempotencyRecord{
+		UserID:      owner,
+		Key:         key,
+		Fingerprint: fingerprint,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(s.idempotencyTTL),
+	})
+	if err != nil {
+		writeServiceError(w, "Failed to check the idempotency key", err)
+		return
+	}
+	if !claimed {
+		replayIdempotentResponse(w, fingerprint, record, keyName)
+		return
+	}
+
+	recorder := &responseRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+	completed := false
+	defer func() {
+		// a panicking handler leaves the request to be retried
+		if !completed {
+			releaseIdempotencyKey(s, owner, key)
+		}
+	}()
+	next(recorder, r)
+	completed = true
+	if recorder.statusCode >= http.StatusInternalServerError {
+		releaseIdempotencyKey(s, owner, key)
+		return
+	}
+	response := datastore.IdempotentResponse{
+		StatusCode:  recorder.statusCode,
+		ContentType: recorder.Header().Get("Content-Type"),
+		Body:        recorder.body.Bytes(),
+	}
+	if err := s.idempotency.CompleteIdempotentRequest(owner, key, response); err != nil {
+		log.Printf("Unable to store the response to idempotency key %q of %s: %s\n", key, owner, err)
+	}
+}
+
+// replayIdempotentResponse answers a request with the fingerprint whose key,
+// named keyName, was already used
+func replayIdempotentResponse(w http.ResponseWriter, fingerprint string, record datastore.IdempotencyRecord, keyName string) {
+	switch {
+	case !hmac.Equal([]byte(record.Fingerprint), []byte(fingerprint)):
+		writeError(w, fmt.Sprintf("The %s was already used for another request", keyName), http.StatusConflict)
+	case record.Response == nil:
+		w.Header().Set("Retry-After", "1")
+		writeError(w, fmt.Sprintf("A request with this %s is still being processed", keyName), http.StatusConflict)
+	default:
+		if record.Response.ContentType != "" {
+			w.Header().Set("Content-Type", record.Response.ContentType)
+		}
+		w.Header().Set(HEADER_IDEMPOTENT_REPLAYED, "true")
+		w.WriteHeader(record.Response.StatusCode)
+		w.Write(record.Response.Body)
+	}
+}
+
+// releaseIdempotencyKey forgets the key of a request that did not complete
+func releaseIdempotencyKey(s *Server, userID string, key string) {
+	if err := s.idempotency.ReleaseIdempotencyKey(userID, key); err != nil {
+		log.Printf("Unable to release idempotency key %q of %s: %s\n", key, userID, err)
+	}
+}
+
+// requestFingerprint identifies a request by its method, URL and body. It is
+// keyed with the secret of the server: the bodies stored with their keys,
+// such as the passwords of the registrations, cannot be guessed from it.
+func (s *Server) requestFingerprint(r *http.Request, body []byte) string {
+	h := hmac.New(sha256.New, s.idempotencySecret)
+	fmt.Fprintf(h, "%s %s\n", r.Method, r.URL.RequestURI())
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// idempotencySecret returns the secret keying the fingerprints of the
+// requests, IDEMPOTENCY_SECRET or a random one when it is not set
+func idempotencySecret() []byte {
+	if IDEMPOTENCY_SECRET != "" {
+		return []byte(IDEMPOTENCY_SECRET)
+	}
+	secret := make([]byte, sha256.Size)
+	if _, err := rand.Read(secret); err != nil {
+		log.Fatalf("Unable to create the idempotency secret: %s\n", err)
+	}
+	return secret
+}
+
+// responseRecorder writes a response while keeping its status code and body
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode  int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+// WriteHeader writes and keeps the status code of the response
+func (rr *responseRecorder) WriteHeader(statusCode int) {
+	if !rr.wroteHeader {
+		rr.statusCode = statusCode
+		rr.wroteHeader = true
+	}
+	rr.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write writes and keeps the body of the response
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	rr.wroteHeader = true
+	rr.body.Write(b)
+	return rr.ResponseWriter.Write(b)
+}
+
+// runIdempotencySweeper forgets the expired idempotency keys every interval until the context is done
+func (s *Server) runIdempotencySweeper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := s.idempotency.RemoveExpiredIdempotencyKeys(); err != nil {
+				log.Printf("Unable to remove expired idempotency keys: %s\n", err)
+			}
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 
 	"github.com/13thuser/bookstore/bookstore/entities"
+	"github.com/13thuser/bookstore/bookstore/onix"
 	"github.com/13thuser/bookstore/payments"
 )
 
@@ -11,20 +12,81 @@ import (
 type StoreService interface {
 	// ListItems lists all the items
 	ListItems(ctx context.Context) ([]entities.Item, error)
-	// GetItem gets an item by its SKU
-	GetItem(ctx context.Context, sku string) (entities.Item, error)
+	// SearchItems searches the catalog, returning a page of the matching items
+	SearchItems(ctx context.Context, query entities.ItemQuery) (entities.ItemPage, error)
+	// ListCategories lists the category tree of the items still sold
+	ListCategories(ctx context.Context) ([]*entities.CategoryNode, error)
+	// GetItem gets an item by its SKU along with its stock levels and the other formats of its title
+	GetItem(ctx context.Context, sku string) (entities.ItemWithStock, error)
 	// AddToCart adds an item to the cart
 	AddToCart(ctx context.Context, userID string, sku string, quantity int) (entities.Cart, error)
 	// RemoveFromCart removes an item from the cart
 	RemoveFromCart(ctx context.Context, userID string, sku string, quantity int) (entities.Cart, error)
+	// ReleaseCart releases the stock reserved for the cart
+	ReleaseCart(ctx context.Context, userID string) error
 	// GetCart gets the cart
 	GetCart(ctx context.Context, userID string) entities.Cart
 	// GetCartTotalPrice gets the total price of the items in the cart
-	GetCartTotalPrice(ctx context.Context, userID string) float64
-	// Checkout checks out the cart
-	Checkout(ctx context.Context, userID string) (entities.Order, error)
-	// ConfirmOrder confirms the purchase
-	ConfirmPurchase(ctx context.Context, userID string, orderID string, creditCardDetails payments.CreditCardDetails) (entities.Order, error)
+	GetCartTotalPrice(ctx context.Context, userID string) entities.Money
+	// ApplyCoupon applies a coupon code to the cart
+	ApplyCoupon(ctx context.Context, userID string, code string) (entities.Cart, error)
+	// RemoveCoupon removes the coupon applied to the cart
+	RemoveCoupon(ctx context.Context, userID string) (entities.Cart, error)
+	// ListAddresses lists the address book of the user
+	ListAddresses(ctx context.Context, userID string) ([]entities.SavedAddress, error)
+	// AddAddress adds an address to the address book of the user
+	AddAddress(ctx context.Context, userID string, address entities.Address) (entities.SavedAddress, error)
+	// UpdateAddress replaces an address of the address book of the user
+	UpdateAddress(ctx context.Context, userID string, address entities.SavedAddress) (entities.SavedAddress, error)
+	// DeleteAddress removes an address from the address book of the user
+	DeleteAddress(ctx context.Context, userID string, addressID string) error
+	// ListPaymentMethods lists the cards the user saved
+	ListPaymentMethods(ctx context.Context, userID string) ([]entities.PaymentMethod, error)
+	// AddPaymentMethod saves the card of a token of the user to pay with
+	AddPaymentMethod(ctx context.Context, userID string, cardToken string, makeDefault bool) (entities.PaymentMethod, error)
+	// DeletePaymentMethod removes a saved card of the user
+	DeletePaymentMethod(ctx context.Context, userID string, paymentMethodID string) error
+	// SetDefaultPaymentMethod makes a saved card of the user the default one
+	SetDefaultPaymentMethod(ctx context.Context, userID string, paymentMethodID string) (entities.PaymentMethod, error)
+	// ShippingRates quotes the shipping methods for the cart to the address of the request
+	ShippingRates(ctx context.Context, userID string, req entities.CheckoutRequest) ([]entities.ShippingRate, error)
+	// Checkout checks out the cart, shipping the order to the address of the request with the chosen method
+	Checkout(ctx context.Context, userID string, req entities.CheckoutRequest) (entities.Order, error)
+	// ConfirmPurchase authorizes the payment of an order checked out before
+	ConfirmPurchase(ctx context.Context, userID string, orderID string, source entities.PaymentSource) (entities.Order, error)
 	// GetOrderHistory gets the order history
 	GetOrderHistory(ctx context.Context, userID string) []entities.Order
+	// CancelOrder cancels an order nothing was captured of and puts its items back in stock
+	CancelOrder(ctx context.Context, userID string, orderID string) (entities.Order, error)
+
+	// CreateItem adds a new item to the catalog with its initial stock
+	CreateItem(ctx context.Context, actor entities.UserID, item entities.Item, stock int) (entities.ItemWithStock, error)
+	// UpdateItem replaces the details of an item
+	UpdateItem(ctx context.Context, actor entities.UserID, item entities.Item) (entities.ItemWithStock, error)
+	// RetireItem stops selling an item
+	RetireItem(ctx context.Context, actor entities.UserID, sku string) (entities.ItemWithStock, error)
+	// RestockItem adds units of an item to the stock
+	RestockItem(ctx context.Context, actor entities.UserID, sku string, quantity int) (entities.ItemWithStock, error)
+	// ImportItems upserts the rows of a catalog file, only checking them in a dry run
+	ImportItems(ctx context.Context, actor entities.UserID, rows []entities.ImportRow, dryRun bool) (entities.ImportReport, error)
+	// IngestONIX applies the product records of an ONIX message to the catalog, only checking them in a dry run
+	IngestONIX(ctx context.Context, actor entities.UserID, products []onix.Product, dryRun bool) (entities.ImportReport, error)
+	// ExportItems lists every item of the catalog with its stock levels
+	ExportItems(ctx context.Context) ([]entities.ItemWithStock, error)
+	// CreatePromotion adds a promotion
+	CreatePromotion(ctx context.Context, promotion entities.Promotion) (entities.Promotion, error)
+	// UpdatePromotion replaces a promotion
+	UpdatePromotion(ctx context.Context, promotion entities.Promotion) (entities.Promotion, error)
+	// ListPromotions lists the promotions with the number of orders that used them
+	ListPromotions(ctx context.Context) ([]entities.PromotionWithUsage, error)
+	// CaptureOrder charges part or all of the authorized payment of an order of any user
+	CaptureOrder(ctx context.Context, actor entities.UserID, orderID string, req entities.CaptureRequest) (entities.Order, error)
+	// FulfillOrder moves a paid order of any user along its fulfillment
+	FulfillOrder(ctx context.Context, orderID string, req entities.FulfillmentRequest) (entities.Order, error)
+	// RefundOrder refunds part or all of the payment of an order of any user
+	RefundOrder(ctx context.Context, actor entities.UserID, orderID string, req entities.RefundRequest) (entities.Order, error)
+	// ApplyPaymentEvent updates the order of an event a payment provider sent about its payment
+	ApplyPaymentEvent(ctx context.Context, event payments.WebhookEvent) (entities.Order, error)
+	// GetCatalogChanges gets the audit trail of an item
+	GetCatalogChanges(ctx context.Context, sku string) ([]entities.CatalogChange, error)
 }
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+	"github.com/gorilla/mux"
+)
+
+// ApplyCoupon applies a coupon code to the cart
+func (s *Server) ApplyCoupon(w http.ResponseWriter, r *http.Request) {
+	userID, shouldReturn := s.validateRequest(r, w)
+	if shouldReturn {
+		return
+	}
+
+	var req entities.CouponRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+	if req.Code == "" {
+		writeError(w, "Invalid request with one or more missing parameters", http.StatusBadRequest)
+		return
+	}
+
+	cart, err := s.service.ApplyCoupon(r.Context(), userID, req.Code)
+	if err != nil {
+		writeServiceError(w, "Failed to apply coupon", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(cart)
+}
+
+// RemoveCoupon removes the coupon applied to the cart
+func (s *Server) RemoveCoupon(w http.ResponseWriter, r *http.Request) {
+	userID, shouldReturn := s.validateRequest(r, w)
+	if shouldReturn {
+		return
+	}
+
+	cart, err := s.service.RemoveCoupon(r.Context(), userID)
+	if err != nil {
+		writeServiceError(w, "Failed to remove coupon", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(cart)
+}
+
+// CreatePromotion adds a promotion
+func (s *Server) CreatePromotion(w http.ResponseWriter, r *http.Request) {
+	var promotion entities.Promotion
+	if err := json.NewDecoder(r.Body).Decode(&promotion); err != nil {
+		writeError(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+
+	created, err := s.service.CreatePromotion(r.Context(), promotion)
+	if err != nil {
+		writeServiceError(w, "Failed to create promotion", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(created)
+}
+
+// UpdatePromotion replaces a promotion
+func (s *Server) UpdatePromotion(w http.ResponseWriter, r *http.Request) {
+	var promotion entities.Promotion
+	if err := json.NewDecoder(r.Body).Decode(&promotion); err != nil {
+		writeError(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+	id := mux.Vars(r)["promotionID"]
+	if promotion.ID != "" && promotion.ID != id {
+		writeError(w, "The id of the body does not match the one of the path", http.StatusBadRequest)
+		return
+	}
+
+	promotion.ID = id
+	updated, err := s.service.UpdatePromotion(r.Context(), promotion)
+	if err != nil {
+		writeServiceError(w, "Failed to update promotion", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(updated)
+}
+
+// ListPromotions lists the promotions with the number of orders that used them
+func (s *Server) ListPromotions(w http.ResponseWriter, r *http.Request) {
+	promotions, err := s.service.ListPromotions(r.Context())
+	if err != nil {
+		writeServiceError(w, "Failed to list promotions", err)
+		return
+	}
+	response := struct {
+		Promotions []entities.PromotionWithUsage `json:"promotions"`
+	}{Promotions: promotions}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
@@ -10,6 +10,8 @@ import (
 	"time"
 
 	"github.com/13thuser/bookstore/bookstore"
+	"github.com/13thuser/bookstore/bookstore/shipping"
+	"github.com/13thuser/bookstore/bookstore/tax"
 	"github.com/13thuser/bookstore/datastore"
 	"github.com/13thuser/bookstore/payments"
 	"github.com/gorilla/mux"
@@ -20,21 +22,100 @@ type Server struct {
 	server   *http.Server
 	handler  http.Handler
 	service  StoreService
-	auth     *datastore.UserStore
-	sessions *datastore.SessionStore
+	auth     datastore.UserRepository
+	sessions datastore.SessionRepository
+	// vault tokenizes the cards sent to the server, they never reach the service
+	vault *payments.Vault
+	// paymentProviders reports the health of the payment providers, nil without a providers file
+	paymentProviders *payments.Router
+	// gatewayWebhookSecret signs the webhooks of the payment gateway when the providers are not routed
+	gatewayWebhookSecret string
+	idempotency          datastore.IdempotencyRepository
+	// idempotencyTTL is how long the responses to the requests made with an idempotency key are kept
+	idempotencyTTL time.Duration
+	// idempotencySecret keys the fingerprints of the requests made with an idempotency key
+	idempotencySecret []byte
+	closeStores       func() error
+	// devMode enables the development login backdoor, see DEV_MODE
+	devMode bool
+	// jobs run in the background while the server is serving
+	jobs     []func(ctx context.Context)
+	stopJobs context.CancelFunc
 }
 
-// NewServer creates a new server
+// NewServer creates a new server backed by in-memory stores, without taxes nor shipping costs
 func NewServer() *Server {
-	paymentGateway := payments.NewPaymentGateway()
-	storeService := bookstore.NewBookstoreService(datastore.NewDatastore(), paymentGateway)
-	return &Server{
-		server:   nil,
-		handler:  nil,
-		service:  storeService,
-		auth:     datastore.NewUserStore(),
-		sessions: datastore.NewSessionStore(),
+	return newServer(newMemoryStores(), serverOptions{})
+}
+
+// serverOptions configures the service of a server, the zero value charges
+// neither taxes nor shipping through the simulated payment gateway
+type serverOptions struct {
+	// taxRules are applied at checkout
+	taxRules tax.Rules
+	// shippingMethods are offered at checkout, orders ship for free without any
+	shippingMethods shipping.Table
+	// vault tokenizes the cards, a new in-memory one when nil
+	vault *payments.Vault
+	// paymentGateway charges the cards of the vault, the simulated one called
+	// with the payment resilience policy when nil
+	paymentGateway payments.PaymentProcessor
+}
+
+// newServer creates a new server backed by the given stores, configured by the options
+func newServer(st stores, opts serverOptions) *Server {
+	vault := opts.vault
+	if vault == nil {
+		vault = payments.NewVault()
+	}
+	paymentGateway := opts.paymentGateway
+	// the health of the providers is only tracked when they are routed
+	router, _ := paymentGateway.(*payments.Router)
+	if paymentGateway == nil {
+		paymentGateway = payments.NewResilient(payments.NewPaymentGateway(vault), paymentResiliencePolicy())
 	}
+	storeService := bookstore.NewBookstoreService(st.store, paymentGateway)
+	storeService.Cards = vault
+	storeService.TaxRules = opts.taxRules
+	if len(opts.shippingMethods) > 0 {
+		storeService.Shipping = opts.shippingMethods
+	}
+	s := &Server{
+		server:               nil,
+		handler:              nil,
+		service:              storeService,
+		auth:                 st.users,
+		sessions:             st.sessions,
+		vault:                vault,
+		paymentProviders:     router,
+		gatewayWebhookSecret: PAYMENT_WEBHOOK_SECRET,
+		idempotency:          st.idempotency,
+		idempotencyTTL:       IDEMPOTENCY_KEY_TTL,
+		idempotencySecret:    idempotencySecret(),
+		closeStores:          st.close,
+		devMode:              DEV_MODE,
+		jobs: []func(ctx context.Context){
+			func(ctx context.Context) {
+				storeService.RunSweeper(ctx, ORDER_SWEEP_INTERVAL, ORDER_PAYMENT_TTL, AUTHORIZATION_TTL)
+			},
+		},
+	}
+	s.jobs = append(s.jobs, func(ctx context.Context) {
+		s.runSessionSweeper(ctx, ORDER_SWEEP_INTERVAL)
+	}, func(ctx context.Context) {
+		s.runIdempotencySweeper(ctx, ORDER_SWEEP_INTERVAL)
+	})
+	return s
+}
+
+// paymentResiliencePolicy returns the policy of the calls to the payment providers, see PAYMENT_CALL_TIMEOUT
+func paymentResiliencePolicy() payments.ResiliencePolicy {
+	policy := payments.DefaultResiliencePolicy
+	policy.CallTimeout = PAYMENT_CALL_TIMEOUT
+	policy.MaxAttempts = PAYMENT_MAX_ATTEMPTS
+	policy.FailureThreshold = PAYMENT_CIRCUIT_THRESHOLD
+	policy.OpenDuration = PAYMENT_CIRCUIT_COOLDOWN
+	return policy
 }
 
 // init initializes the server
@@ -51,16 +132,54 @@ func (s *Server) Serve(port string) error {
 	if s.server == nil {
 		s.init(port)
 	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stopJobs = cancel
+	for _, job := range s.jobs {
+		go job(ctx)
+	}
 	return s.server.ListenAndServe()
 }
 
 // Shutdown gracefully shuts down the server without interrupting any active connections
 func (s *Server) Shutdown(ctx context.Context) error {
-	return s.server.Shutdown(ctx)
+	if s.stopJobs != nil {
+		s.stopJobs()
+	}
+	if err := s.server.Shutdown(ctx); err != nil {
+		return err
+	}
+	return s.closeStores()
 }
 
 func main() {
-	s := NewServer()
+	st, err := openStores(DATASTORE_BACKEND, SQLITE_PATH)
+	if err != nil {
+		log.Fatalf("unable to open %s datastore: %s\n", DATASTORE_BACKEND, err)
+	}
+	taxRules, err := tax.LoadFile(TAX_RULES_PATH)
+	if err != nil {
+		log.Fatalf("unable to load tax rules: %s\n", err)
+	}
+	shippingMethods, err := shipping.LoadFile(SHIPPING_METHODS_PATH)
+	if err != nil {
+		log.Fatalf("unable to load shipping methods: %s\n", err)
+	}
+	vault, err := payments.OpenVault(st.cards, []byte(VAULT_SECRET))
+	if err != nil {
+		log.Fatalf("unable to open the card vault: %s\n", err)
+	}
+	router, err := payments.LoadFile(PAYMENT_PROVIDERS_PATH, vault, paymentResiliencePolicy())
+	if err != nil {
+		log.Fatalf("unable to load payment providers: %s\n", err)
+	}
+	opts := serverOptions{taxRules: taxRules, shippingMethods: shippingMethods, vault: vault}
+	if router != nil {
+		opts.paymentGateway = router
+	}
+	s := newServer(st, opts)
+	if s.devMode {
+		log.Println("DEV_MODE is enabled, anyone can log in with a password equal to the username")
+	}
 	port := fmt.Sprintf(":%s", SERVER_PORT)
 	fmt.Printf("Server listening on port %s...", SERVER_PORT)
 	go func() {
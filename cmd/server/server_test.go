@@ -2,14 +2,38 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/13thuser/bookstore/bookstore/entities"
+	"github.com/13thuser/bookstore/bookstore/shipping"
+	"github.com/13thuser/bookstore/bookstore/tax"
+	"github.com/13thuser/bookstore/datastore"
+	"github.com/13thuser/bookstore/payments"
+	"golang.org/x/crypto/bcrypt"
 )
 
+func TestMain(m *testing.M) {
+	// The tests log in through the development backdoor and create many users,
+	// use the cheapest hash so they stay fast
+	DEV_MODE = true
+	datastore.PasswordHashCost = bcrypt.MinCost
+	os.Exit(m.Run())
+}
+
+// testCard are the details of a valid test card, for confirming purchases
+const testCard = `{"credit_card_number": "4242 4242 4242 4242", "credit_card_expiration": "12/99", "credit_card_cvv": "123"}`
+
 // testHelperEncodeJson is a helper function to encode a JSON string
 func testHelperEncodeJson(t *testing.T, s interface{}) string {
 	var buf bytes.Buffer
@@ -20,6 +44,67 @@ func testHelperEncodeJson(t *testing.T, s interface{}) string {
 	return buf.String()
 }
 
+// testHelperLogin logs in the user and returns the session token
+func testHelperLogin(t *testing.T, s *Server, username string, password string) string {
+	reqBody := testHelperEncodeJson(t, entities.UserCredentials{UserID: username, Password: password})
+	req, err := http.NewRequest("POST", "/login", bytes.NewBufferString(reqBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("login as %s returned wrong status code: got %v want %v", username, status, http.StatusOK)
+	}
+	var response struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to parse JSON response: %v", err)
+	}
+	return response.Token
+}
+
+// testHelperDo sends an authorized request to the server and returns the recorded response
+func testHelperDo(t *testing.T, s *Server, method string, path string, token string, body string) *httptest.ResponseRecorder {
+	return testHelperDoIdempotent(t, s, method, path, token, "", body)
+}
+
+// testHelperDoIdempotent sends an authorized request with the idempotency key, if any, to the server and returns the recorded response
+func testHelperDoIdempotent(t *testing.T, s *Server, method string, path string, token string, key string, body string) *httptest.ResponseRecorder {
+	var reqBody *bytes.Buffer
+	if body != "" {
+		reqBody = bytes.NewBufferString(body)
+	} else {
+		reqBody = &bytes.Buffer{}
+	}
+	req, err := http.NewRequest(method, path, reqBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	if key != "" {
+		req.Header.Set(HEADER_IDEMPOTENCY_KEY, key)
+	}
+	rr := httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(rr, req)
+	return rr
+}
+
+// testHelperNewServer creates a server backed by the given datastore backend
+func testHelperNewServer(t *testing.T, backend string) *Server {
+	st, err := openStores(backend, filepath.Join(t.TempDir(), "bookstore.db"))
+	if err != nil {
+		t.Fatal(err, "unable to open stores")
+	}
+	s := newServer(st, serverOptions{})
+	s.init("")
+	t.Cleanup(func() { st.close() })
+	return s
+}
+
 func TestHealthEndpoint(t *testing.T) {
 	s := NewServer()
 	s.init("")
@@ -108,8 +193,14 @@ func TestLogoutEndpoint(t *testing.T) {
 }
 
 func TestPurchaseFlow(t *testing.T) {
-	s := NewServer()
-	s.init("")
+	for _, backend := range []string{"memory", "sqlite"} {
+		t.Run(backend, func(t *testing.T) {
+			testPurchaseFlow(t, testHelperNewServer(t, backend))
+		})
+	}
+}
+
+func testPurchaseFlow(t *testing.T, s *Server) {
 
 	reqBody := []byte(`{"username": "testuser", "password": "testuser"}`)
 	req, err := http.NewRequest("POST", "/login", bytes.NewBuffer(reqBody))
@@ -186,6 +277,9 @@ func TestPurchaseFlow(t *testing.T) {
 	if checkoutOrder.TotalItems != 2 {
 		t.Errorf("expected order to have 2 items, got %d", checkoutOrder.TotalItems)
 	}
+	if want := entities.NewMoney(40000, "USD"); checkoutOrder.TotalPrice != want {
+		t.Errorf("expected order total to be %v, got %v", want, checkoutOrder.TotalPrice)
+	}
 	if checkoutOrder.PaymentConfirmation != "" {
 		t.Errorf("expected checkout order to have empty payment confirmation, got %s", checkoutOrder.PaymentConfirmation)
 	}
@@ -193,7 +287,7 @@ func TestPurchaseFlow(t *testing.T) {
 	orderID := checkoutOrder.ID
 
 	// Confirm purchase
-	reqBody = []byte(`{"order_id": "` + orderID + `", "credit_card_details": {"credit_card_number": "123456789", "credit_card_expiration": "12/22", "credit_card_cvv": "123"}}`)
+	reqBody = []byte(`{"order_id": "` + orderID + `", "credit_card_details": ` + testCard + `}`)
 	req, err = http.NewRequest("POST", "/confirmPurchase", bytes.NewBuffer(reqBody))
 	if err != nil {
 		t.Fatal(err)
@@ -219,3 +313,1901 @@ func TestPurchaseFlow(t *testing.T) {
 		t.Errorf("expected purchased order to have payment confirmation, got empty string")
 	}
 }
+
+// TestConcurrentCheckout hammers /addToCart and /checkout from many users at once.
+// Run with -race to also catch unsynchronized access to the stores.
+func TestConcurrentCheckout(t *testing.T) {
+	for _, backend := range []string{"memory", "sqlite"} {
+		t.Run(backend, func(t *testing.T) {
+			testConcurrentCheckout(t, testHelperNewServer(t, backend))
+		})
+	}
+}
+
+func testConcurrentCheckout(t *testing.T, s *Server) {
+
+	const users = 50
+	tokens := make([]string, users)
+	for i := 0; i < users; i++ {
+		username := fmt.Sprintf("stress-user-%d", i)
+		tokens[i] = testHelperLogin(t, s, username, username)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	checkedOut := 0
+	for i := 0; i < users; i++ {
+		wg.Add(1)
+		go func(token string) {
+			defer wg.Done()
+			// item-1 is seeded with a stock of 2
+			rr := testHelperDo(t, s, "POST", "/addToCart", token, `{"sku": "item-1", "quantity": 1}`)
+			if rr.Code != http.StatusOK {
+				return
+			}
+			testHelperDo(t, s, "GET", "/getCart", token, "")
+			rr = testHelperDo(t, s, "POST", "/checkout", token, "")
+			if rr.Code == http.StatusOK {
+				mu.Lock()
+				checkedOut++
+				mu.Unlock()
+			}
+		}(tokens[i])
+	}
+	wg.Wait()
+
+	if checkedOut != 2 {
+		t.Errorf("expected exactly 2 successful checkouts for a stock of 2, got %d", checkedOut)
+	}
+}
+
+func TestCancelOrder(t *testing.T) {
+	for _, backend := range []string{"memory", "sqlite"} {
+		t.Run(backend, func(t *testing.T) {
+			s := testHelperNewServer(t, backend)
+			token := testHelperLogin(t, s, "testuser", "testuser")
+
+			// take all the stock of item-1
+			if rr := testHelperDo(t, s, "POST", "/addToCart", token, `{"sku": "item-1", "quantity": 2}`); rr.Code != http.StatusOK {
+				t.Fatalf("add to cart returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+			}
+			rr := testHelperDo(t, s, "POST", "/checkout", token, "")
+			var order entities.Order
+			if err := json.Unmarshal(rr.Body.Bytes(), &order); err != nil {
+				t.Fatalf("failed to parse JSON response: %v", err)
+			}
+			if order.Status != entities.OrderStatusPendingPayment {
+				t.Errorf("expected new order to be %s, got %s", entities.OrderStatusPendingPayment, order.Status)
+			}
+
+			rr = testHelperDo(t, s, "POST", "/orders/"+order.ID+"/cancel", token, "")
+			if rr.Code != http.StatusOK {
+				t.Fatalf("cancel returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+			}
+			var cancelled entities.Order
+			if err := json.Unmarshal(rr.Body.Bytes(), &cancelled); err != nil {
+				t.Fatalf("failed to parse JSON response: %v", err)
+			}
+			if cancelled.Status != entities.OrderStatusCancelled || len(cancelled.StatusHistory) != 2 {
+				t.Errorf("expected cancelled order with 2 status changes, got %s with %d", cancelled.Status, len(cancelled.StatusHistory))
+			}
+
+			if rr := testHelperDo(t, s, "POST", "/orders/"+order.ID+"/cancel", token, ""); rr.Code != http.StatusConflict {
+				t.Errorf("cancelling twice returned wrong status code: got %v want %v", rr.Code, http.StatusConflict)
+			}
+			if rr := testHelperDo(t, s, "POST", "/orders/unknown/cancel", token, ""); rr.Code != http.StatusNotFound {
+				t.Errorf("cancelling unknown order returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+			}
+			body := `{"order_id": "` + order.ID + `", "credit_card_details": ` + testCard + `}`
+			if rr := testHelperDo(t, s, "POST", "/confirmPurchase", token, body); rr.Code == http.StatusOK {
+				t.Errorf("expected paying a cancelled order to fail")
+			}
+
+			// the stock is back so the items can be bought again
+			testHelperDo(t, s, "POST", "/addToCart", token, `{"sku": "item-1", "quantity": 2}`)
+			if rr := testHelperDo(t, s, "POST", "/checkout", token, ""); rr.Code != http.StatusOK {
+				t.Errorf("checkout after cancel returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+			}
+		})
+	}
+}
+
+func TestReservationReleasedOnLogout(t *testing.T) {
+	s := NewServer()
+	s.init("")
+	token := testHelperLogin(t, s, "testuser", "testuser")
+	other := testHelperLogin(t, s, "otheruser", "otheruser")
+
+	if rr := testHelperDo(t, s, "POST", "/addToCart", token, `{"sku": "item-1", "quantity": 2}`); rr.Code != http.StatusOK {
+		t.Fatalf("add to cart returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	rr := testHelperDo(t, s, "GET", "/getItem/item-1", "", "")
+	var item entities.ItemWithStock
+	if err := json.Unmarshal(rr.Body.Bytes(), &item); err != nil {
+		t.Fatalf("failed to parse JSON response: %v", err)
+	}
+	if item.InStock != 2 || item.Reserved != 2 || item.Available != 0 {
+		t.Errorf("expected 2 in stock, 2 reserved and 0 available, got %+v", item)
+	}
+	if rr := testHelperDo(t, s, "POST", "/addToCart", other, `{"sku": "item-1", "quantity": 1}`); rr.Code == http.StatusOK {
+		t.Errorf("expected adding reserved stock to another cart to fail")
+	}
+
+	testHelperDo(t, s, "GET", "/logout", token, "")
+	if rr := testHelperDo(t, s, "POST", "/addToCart", other, `{"sku": "item-1", "quantity": 1}`); rr.Code != http.StatusOK {
+		t.Errorf("expected stock to be released on logout, got status %v", rr.Code)
+	}
+}
+
+// testHelperLoginWithRoles logs in the user after giving them the roles and returns the session token
+func testHelperLoginWithRoles(t *testing.T, s *Server, username string, roles ...entities.Role) string {
+	token := testHelperLogin(t, s, username, username)
+	if _, err := s.auth.SetRoles(username, roles); err != nil {
+		t.Fatal(err, "unable to set roles")
+	}
+	return token
+}
+
+func TestAdminCatalogManagement(t *testing.T) {
+	for _, backend := range []string{"memory", "sqlite"} {
+		t.Run(backend, func(t *testing.T) {
+			s := testHelperNewServer(t, backend)
+			admin := testHelperLoginWithRoles(t, s, "catalog-admin", entities.RoleStaff)
+			customer := testHelperLogin(t, s, "testuser", "testuser")
+
+			newItem := `{"sku": "book-1", "name": "Book 1", "price": {"amount": 1999, "currency": "USD"}, "stock": 3}`
+			if rr := testHelperDo(t, s, "POST", "/admin/items", customer, newItem); rr.Code != http.StatusForbidden {
+				t.Errorf("customer creating an item returned wrong status code: got %v want %v", rr.Code, http.StatusForbidden)
+			}
+			if rr := testHelperDo(t, s, "POST", "/admin/items", "", newItem); rr.Code != http.StatusUnauthorized {
+				t.Errorf("anonymous creating an item returned wrong status code: got %v want %v", rr.Code, http.StatusUnauthorized)
+			}
+
+			rr := testHelperDo(t, s, "POST", "/admin/items", admin, newItem)
+			if rr.Code != http.StatusCreated {
+				t.Fatalf("create item returned wrong status code: got %v want %v: %s", rr.Code, http.StatusCreated, rr.Body.String())
+			}
+			var created entities.ItemWithStock
+			if err := json.Unmarshal(rr.Body.Bytes(), &created); err != nil {
+				t.Fatalf("failed to parse JSON response: %v", err)
+			}
+			if created.SKU != "book-1" || created.InStock != 3 || created.Price != entities.NewMoney(1999, "USD") {
+				t.Errorf("unexpected created item %+v", created)
+			}
+			if rr := testHelperDo(t, s, "POST", "/admin/items", admin, newItem); rr.Code != http.StatusConflict {
+				t.Errorf("creating a duplicate item returned wrong status code: got %v want %v", rr.Code, http.StatusConflict)
+			}
+			for _, invalid := range []string{
+				`{"sku": "", "name": "No SKU", "price": {"amount": 100, "currency": "USD"}}`,
+				`{"sku": "book-2", "name": "", "price": {"amount": 100, "currency": "USD"}}`,
+				`{"sku": "book-2", "name": "Negative", "price": {"amount": -100, "currency": "USD"}}`,
+				`{"sku": "book 2", "name": "Space", "price": {"amount": 100, "currency": "USD"}}`,
+				`{"sku": "book-2", "name": "Negative stock", "price": {"amount": 100, "currency": "USD"}, "stock": -1}`,
+			} {
+				if rr := testHelperDo(t, s, "POST", "/admin/items", admin, invalid); rr.Code != http.StatusBadRequest {
+					t.Errorf("creating invalid item %s returned wrong status code: got %v want %v", invalid, rr.Code, http.StatusBadRequest)
+				}
+			}
+
+			rr = testHelperDo(t, s, "PUT", "/admin/items/book-1", admin, `{"name": "Book 1, 2nd edition", "price": 24.99}`)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("update item returned wrong status code: got %v want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+			}
+			if rr := testHelperDo(t, s, "PUT", "/admin/items/unknown", admin, `{"name": "Unknown", "price": 1}`); rr.Code != http.StatusNotFound {
+				t.Errorf("updating unknown item returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+			}
+
+			if rr := testHelperDo(t, s, "POST", "/admin/items/book-1/stock", admin, `{"quantity": 0}`); rr.Code != http.StatusBadRequest {
+				t.Errorf("restocking nothing returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+			}
+			rr = testHelperDo(t, s, "POST", "/admin/items/book-1/stock", admin, `{"quantity": 2}`)
+			var restocked entities.ItemWithStock
+			if err := json.Unmarshal(rr.Body.Bytes(), &restocked); err != nil {
+				t.Fatalf("failed to parse JSON response: %v", err)
+			}
+			if restocked.InStock != 5 || restocked.Price != entities.NewMoney(2499, "USD") {
+				t.Errorf("expected 5 units at 24.99 USD after restock, got %+v", restocked)
+			}
+
+			if rr := testHelperDo(t, s, "DELETE", "/admin/items/book-1", admin, ""); rr.Code != http.StatusOK {
+				t.Fatalf("retire item returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+			}
+			rr = testHelperDo(t, s, "GET", "/listItems", "", "")
+			var list entities.ItemsResponse
+			if err := json.Unmarshal(rr.Body.Bytes(), &list); err != nil {
+				t.Fatalf("failed to parse JSON response: %v", err)
+			}
+			for _, item := range list.Items {
+				if item.SKU == "book-1" {
+					t.Errorf("expected retired item to be hidden from the listing")
+				}
+			}
+			if rr := testHelperDo(t, s, "POST", "/addToCart", customer, `{"sku": "book-1", "quantity": 1}`); rr.Code == http.StatusOK {
+				t.Errorf("expected adding a retired item to the cart to fail")
+			}
+
+			rr = testHelperDo(t, s, "GET", "/admin/items/book-1/audit", admin, "")
+			var audit struct {
+				Changes []entities.CatalogChange `json:"changes"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &audit); err != nil {
+				t.Fatalf("failed to parse JSON response: %v", err)
+			}
+			wantActions := []entities.CatalogAction{
+				entities.CatalogActionCreate, entities.CatalogActionUpdate, entities.CatalogActionRestock, entities.CatalogActionRetire,
+			}
+			if len(audit.Changes) != len(wantActions) {
+				t.Fatalf("expected %d audit entries, got %d", len(wantActions), len(audit.Changes))
+			}
+			for i, change := range audit.Changes {
+				if change.Action != wantActions[i] || change.Actor != "catalog-admin" {
+					t.Errorf("expected audit entry %d to be a %s by catalog-admin, got %s by %s", i, wantActions[i], change.Action, change.Actor)
+				}
+			}
+			update := audit.Changes[1]
+			if update.OldPrice == nil || *update.OldPrice != entities.NewMoney(1999, "USD") || *update.NewPrice != entities.NewMoney(2499, "USD") {
+				t.Errorf("expected the update to record the price change, got %+v", update)
+			}
+			restock := audit.Changes[2]
+			if restock.OldStock == nil || *restock.OldStock != 3 || *restock.NewStock != 5 {
+				t.Errorf("expected the restock to record the stock change, got %+v", restock)
+			}
+		})
+	}
+}
+
+func TestRoleAssignment(t *testing.T) {
+	for _, backend := range []string{"memory", "sqlite"} {
+		t.Run(backend, func(t *testing.T) {
+			s := testHelperNewServer(t, backend)
+			admin := testHelperLoginWithRoles(t, s, "boss", entities.RoleCustomer, entities.RoleAdmin)
+			clerk := testHelperLogin(t, s, "clerk", "clerk")
+			restock := `{"quantity": 1}`
+
+			rr := testHelperDo(t, s, "GET", "/admin/users/clerk/roles", admin, "")
+			var user entities.User
+			if err := json.Unmarshal(rr.Body.Bytes(), &user); err != nil {
+				t.Fatalf("failed to parse JSON response: %v", err)
+			}
+			if len(user.Roles) != 1 || user.Roles[0] != entities.RoleCustomer {
+				t.Errorf("expected new users to be customers, got %v", user.Roles)
+			}
+			if rr := testHelperDo(t, s, "POST", "/admin/items/item-1/stock", clerk, restock); rr.Code != http.StatusForbidden {
+				t.Errorf("customer restocking returned wrong status code: got %v want %v", rr.Code, http.StatusForbidden)
+			}
+
+			rr = testHelperDo(t, s, "PUT", "/admin/users/clerk/roles", admin, `{"roles": ["customer", "staff", "staff"]}`)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("set roles returned wrong status code: got %v want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &user); err != nil {
+				t.Fatalf("failed to parse JSON response: %v", err)
+			}
+			if len(user.Roles) != 2 || !user.HasRole(entities.RoleStaff) {
+				t.Errorf("expected clerk to be a customer and staff, got %v", user.Roles)
+			}
+			if rr := testHelperDo(t, s, "POST", "/admin/items/item-1/stock", clerk, restock); rr.Code != http.StatusOK {
+				t.Errorf("staff restocking returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+			}
+			if rr := testHelperDo(t, s, "GET", "/admin/items/item-1/audit", clerk, ""); rr.Code != http.StatusOK {
+				t.Errorf("staff reading the audit trail returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+			}
+			if rr := testHelperDo(t, s, "GET", "/admin/users/clerk/roles", clerk, ""); rr.Code != http.StatusForbidden {
+				t.Errorf("staff reading roles returned wrong status code: got %v want %v", rr.Code, http.StatusForbidden)
+			}
+			if rr := testHelperDo(t, s, "PUT", "/admin/users/clerk/roles", clerk, `{"roles": ["admin"]}`); rr.Code != http.StatusForbidden {
+				t.Errorf("staff promoting themselves returned wrong status code: got %v want %v", rr.Code, http.StatusForbidden)
+			}
+
+			for _, tc := range []struct {
+				path, body string
+				want       int
+			}{
+				{"/admin/users/clerk/roles", `{"roles": ["owner"]}`, http.StatusBadRequest},
+				{"/admin/users/nobody/roles", `{"roles": ["staff"]}`, http.StatusNotFound},
+				{"/admin/users/boss/roles", `{"roles": ["customer"]}`, http.StatusConflict},
+			} {
+				if rr := testHelperDo(t, s, "PUT", tc.path, admin, tc.body); rr.Code != tc.want {
+					t.Errorf("PUT %s %s returned wrong status code: got %v want %v", tc.path, tc.body, rr.Code, tc.want)
+				}
+			}
+
+			if rr := testHelperDo(t, s, "PUT", "/admin/users/clerk/roles", admin, `{"roles": ["customer"]}`); rr.Code != http.StatusOK {
+				t.Fatalf("set roles returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+			}
+			if rr := testHelperDo(t, s, "POST", "/admin/items/item-1/stock", clerk, restock); rr.Code != http.StatusForbidden {
+				t.Errorf("demoted staff restocking returned wrong status code: got %v want %v", rr.Code, http.StatusForbidden)
+			}
+		})
+	}
+}
+
+func TestSeedAdmin(t *testing.T) {
+	defer func(devMode bool, password string) { DEV_MODE, ADMIN_PASSWORD = devMode, password }(DEV_MODE, ADMIN_PASSWORD)
+	for _, backend := range []string{"memory", "sqlite"} {
+		t.Run(backend, func(t *testing.T) {
+			DEV_MODE, ADMIN_PASSWORD = false, ""
+			s := testHelperNewServer(t, backend)
+			if rr := testHelperDo(t, s, "POST", "/login", "", `{"username": "admin", "password": "admin"}`); rr.Code != http.StatusUnauthorized {
+				t.Errorf("login as the development admin outside of dev mode returned wrong status code: got %v want %v", rr.Code, http.StatusUnauthorized)
+			}
+
+			ADMIN_PASSWORD = "admin"
+			if _, err := openStores(backend, filepath.Join(t.TempDir(), "bookstore.db")); !errors.Is(err, entities.ErrWeakPassword) {
+				t.Errorf("opening the stores with a weak admin password returned wrong error: got %v want %v", err, entities.ErrWeakPassword)
+			}
+
+			ADMIN_PASSWORD = "s3cret-enough"
+			s = testHelperNewServer(t, backend)
+			admin := testHelperLogin(t, s, "admin", "s3cret-enough")
+			if rr := testHelperDo(t, s, "PUT", "/admin/users/admin/roles", admin, `{"roles": ["customer", "admin"]}`); rr.Code != http.StatusOK {
+				t.Errorf("seeded admin setting roles returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+			}
+		})
+	}
+}
+
+func TestRegisterEndpoint(t *testing.T) {
+	for _, backend := range []string{"memory", "sqlite"} {
+		t.Run(backend, func(t *testing.T) {
+			s := testHelperNewServer(t, backend)
+			s.devMode = false
+
+			login := `{"username": "reader", "password": "reader"}`
+			if rr := testHelperDo(t, s, "POST", "/login", "", login); rr.Code != http.StatusUnauthorized {
+				t.Errorf("development login outside of dev mode returned wrong status code: got %v want %v", rr.Code, http.StatusUnauthorized)
+			}
+
+			for _, tc := range []struct {
+				body string
+				want int
+			}{
+				{`{"username": "reader", "password": "short1"}`, http.StatusBadRequest},
+				{`{"username": "reader", "password": "nodigitshere"}`, http.StatusBadRequest},
+				{`{"username": "reader1", "password": "READER1"}`, http.StatusBadRequest},
+				{`{"username": "re ader", "password": "s3cret-enough"}`, http.StatusBadRequest},
+				{`{"username": "admin", "password": "s3cret-enough"}`, http.StatusConflict},
+			} {
+				if rr := testHelperDo(t, s, "POST", "/register", "", tc.body); rr.Code != tc.want {
+					t.Errorf("register %s returned wrong status code: got %v want %v", tc.body, rr.Code, tc.want)
+				}
+			}
+
+			rr := testHelperDo(t, s, "POST", "/register", "", `{"username": "reader", "name": "A Reader", "password": "s3cret-enough"}`)
+			if rr.Code != http.StatusCreated {
+				t.Fatalf("register returned wrong status code: got %v want %v: %s", rr.Code, http.StatusCreated, rr.Body.String())
+			}
+			var user entities.User
+			if err := json.Unmarshal(rr.Body.Bytes(), &user); err != nil {
+				t.Fatalf("failed to parse JSON response: %v", err)
+			}
+			if user.ID != "reader" || user.Name != "A Reader" || !user.HasRole(entities.RoleCustomer) || len(user.Roles) != 1 {
+				t.Errorf("expected a new customer, got %+v", user)
+			}
+
+			if rr := testHelperDo(t, s, "POST", "/login", "", `{"username": "reader", "password": "wrong-passw0rd"}`); rr.Code != http.StatusUnauthorized {
+				t.Errorf("login with a wrong password returned wrong status code: got %v want %v", rr.Code, http.StatusUnauthorized)
+			}
+			token := testHelperLogin(t, s, "reader", "s3cret-enough")
+			if rr := testHelperDo(t, s, "GET", "/getCart", token, ""); rr.Code != http.StatusOK {
+				t.Errorf("registered user getting their cart returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+			}
+
+			// retrying a registration with an idempotency key replays it, the keys of other clients are their own
+			register := func(remoteAddr string, body string) *httptest.ResponseRecorder {
+				req := httptest.NewRequest("POST", "/register", strings.NewReader(body))
+				req.RemoteAddr = remoteAddr
+				req.Header.Set(HEADER_IDEMPOTENCY_KEY, "register-1")
+				rr := httptest.NewRecorder()
+				s.server.Handler.ServeHTTP(rr, req)
+				return rr
+			}
+			body := `{"username": "writer", "password": "s3cret-enough"}`
+			first := register("192.0.2.1:1234", body)
+			if first.Code != http.StatusCreated {
+				t.Fatalf("register returned wrong status code: got %v want %v: %s", first.Code, http.StatusCreated, first.Body.String())
+			}
+			if retry := register("192.0.2.1:5678", body); retry.Code != http.StatusCreated || retry.Header().Get(HEADER_IDEMPOTENT_REPLAYED) != "true" {
+				t.Errorf("expected the registration to be replayed, got %v: %s", retry.Code, retry.Body.String())
+			}
+			if other := register("198.51.100.7:1234", body); other.Code != http.StatusConflict || other.Header().Get(HEADER_IDEMPOTENT_REPLAYED) != "" {
+				t.Errorf("expected the key of another client to be processed, got %v: %s", other.Code, other.Body.String())
+			}
+		})
+	}
+}
+
+func TestSessionEndpoints(t *testing.T) {
+	for _, backend := range []string{"memory", "sqlite"} {
+		t.Run(backend, func(t *testing.T) {
+			s := testHelperNewServer(t, backend)
+			login := `{"username": "test", "password": "test"}`
+
+			var laptop, phone entities.SessionTokens
+			for _, tokens := range []*entities.SessionTokens{&laptop, &phone} {
+				rr := testHelperDo(t, s, "POST", "/login", "", login)
+				if rr.Code != http.StatusOK {
+					t.Fatalf("login returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+				}
+				if err := json.Unmarshal(rr.Body.Bytes(), tokens); err != nil {
+					t.Fatalf("failed to parse JSON response: %v", err)
+				}
+			}
+			if laptop.RefreshToken == "" || laptop.ExpiresAt.IsZero() || laptop.SessionID == phone.SessionID {
+				t.Errorf("expected each login to start its own session, got %+v and %+v", laptop, phone)
+			}
+
+			rr := testHelperDo(t, s, "GET", "/sessions", laptop.Token, "")
+			var list struct {
+				Sessions []entities.Session `json:"sessions"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &list); err != nil {
+				t.Fatalf("failed to parse JSON response: %v", err)
+			}
+			if len(list.Sessions) != 2 {
+				t.Fatalf("expected 2 sessions, got %d", len(list.Sessions))
+			}
+			for _, session := range list.Sessions {
+				if session.Current != (session.ID == laptop.SessionID) {
+					t.Errorf("expected only the laptop session to be current, got %+v", session)
+				}
+			}
+
+			rr = testHelperDo(t, s, "POST", "/refresh", "", testHelperEncodeJson(t, entities.RefreshRequest{RefreshToken: laptop.RefreshToken}))
+			if rr.Code != http.StatusOK {
+				t.Fatalf("refresh returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+			}
+			var refreshed entities.SessionTokens
+			if err := json.Unmarshal(rr.Body.Bytes(), &refreshed); err != nil {
+				t.Fatalf("failed to parse JSON response: %v", err)
+			}
+			if rr := testHelperDo(t, s, "GET", "/getCart", laptop.Token, ""); rr.Code != http.StatusUnauthorized {
+				t.Errorf("replaced access token returned wrong status code: got %v want %v", rr.Code, http.StatusUnauthorized)
+			}
+			if rr := testHelperDo(t, s, "GET", "/getCart", refreshed.Token, ""); rr.Code != http.StatusOK {
+				t.Errorf("refreshed access token returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+			}
+			if rr := testHelperDo(t, s, "POST", "/refresh", "", `{"refresh_token": "unknown"}`); rr.Code != http.StatusUnauthorized {
+				t.Errorf("refresh with an unknown token returned wrong status code: got %v want %v", rr.Code, http.StatusUnauthorized)
+			}
+
+			if rr := testHelperDo(t, s, "DELETE", "/sessions/"+phone.SessionID, refreshed.Token, ""); rr.Code != http.StatusOK {
+				t.Errorf("revoke session returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+			}
+			if rr := testHelperDo(t, s, "GET", "/getCart", phone.Token, ""); rr.Code != http.StatusUnauthorized {
+				t.Errorf("revoked session returned wrong status code: got %v want %v", rr.Code, http.StatusUnauthorized)
+			}
+			if rr := testHelperDo(t, s, "DELETE", "/sessions/"+phone.SessionID, refreshed.Token, ""); rr.Code != http.StatusNotFound {
+				t.Errorf("revoking a revoked session returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+			}
+
+			other := testHelperLogin(t, s, "test", "test")
+			if rr := testHelperDo(t, s, "POST", "/logout/all", refreshed.Token, ""); rr.Code != http.StatusOK {
+				t.Errorf("log out everywhere returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+			}
+			for _, token := range []string{refreshed.Token, other} {
+				if rr := testHelperDo(t, s, "GET", "/getCart", token, ""); rr.Code != http.StatusUnauthorized {
+					t.Errorf("session after logging out everywhere returned wrong status code: got %v want %v", rr.Code, http.StatusUnauthorized)
+				}
+			}
+		})
+	}
+}
+
+func TestSearchItemsEndpoint(t *testing.T) {
+	s := testHelperNewServer(t, "memory")
+
+	rr := testHelperDo(t, s, "GET", "/items?q=item&min_price=150&max_price=300.00&sort=-price&limit=1", "", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("search returned wrong status code: got %v want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	var page entities.ItemPage
+	if err := json.Unmarshal(rr.Body.Bytes(), &page); err != nil {
+		t.Fatalf("failed to parse JSON response: %v", err)
+	}
+	if page.Total != 2 || len(page.Items) != 1 || page.Items[0].SKU != "item-3" || page.NextCursor == "" {
+		t.Fatalf("expected the first of 2 pages to hold item-3, got %+v", page)
+	}
+
+	rr = testHelperDo(t, s, "GET", "/items?q=item&min_price=150&max_price=300.00&sort=-price&limit=1&cursor="+page.NextCursor, "", "")
+	var last entities.ItemPage
+	if err := json.Unmarshal(rr.Body.Bytes(), &last); err != nil {
+		t.Fatalf("failed to parse JSON response: %v", err)
+	}
+	if len(last.Items) != 1 || last.Items[0].SKU != "item-2" || last.NextCursor != "" || last.Items[0].Available != 2 {
+		t.Errorf("expected the last page to hold item-2 with 2 units available, got %+v", last)
+	}
+
+	for _, query := range []string{"sort=random", "limit=1000", "limit=ten", "min_price=abc", "available=maybe", "min_price=10&max_price=5", "cursor=nope"} {
+		if rr := testHelperDo(t, s, "GET", "/items?"+query, "", ""); rr.Code != http.StatusBadRequest {
+			t.Errorf("search with %s returned wrong status code: got %v want %v", query, rr.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestBookMetadata(t *testing.T) {
+	for _, backend := range []string{"memory", "sqlite"} {
+		t.Run(backend, func(t *testing.T) {
+			s := testHelperNewServer(t, backend)
+			admin := testHelperLoginWithRoles(t, s, "catalog-admin", entities.RoleStaff)
+
+			books := []string{
+				`{"sku": "dune-hc", "name": "Dune", "isbn": "0-441-17271-7", "title_id": "dune", "format": "hardcover", "authors": ["Frank Herbert"], "publisher": "Chilton", "publication_date": "1965", "language": "EN", "categories": ["Fiction/Science Fiction"], "price": {"amount": 2999, "currency": "USD"}, "stock": 1}`,
+				`{"sku": "dune-eb", "name": "Dune", "title_id": "dune", "format": "ebook", "categories": ["Fiction/Science Fiction"], "price": {"amount": 999, "currency": "USD"}, "stock": 100}`,
+				`{"sku": "emma-pb", "name": "Emma", "title_id": "emma", "format": "paperback", "categories": ["Fiction/Classics", "Romance"], "price": {"amount": 450, "currency": "USD"}, "stock": 2}`,
+			}
+			for _, book := range books {
+				if rr := testHelperDo(t, s, "POST", "/admin/items", admin, book); rr.Code != http.StatusCreated {
+					t.Fatalf("create book returned wrong status code: got %v want %v: %s", rr.Code, http.StatusCreated, rr.Body.String())
+				}
+			}
+			invalid := `{"sku": "bad-isbn", "name": "Bad", "isbn": "0441172718", "price": {"amount": 100, "currency": "USD"}}`
+			if rr := testHelperDo(t, s, "POST", "/admin/items", admin, invalid); rr.Code != http.StatusBadRequest {
+				t.Errorf("creating a book with an invalid ISBN returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+			}
+
+			rr := testHelperDo(t, s, "GET", "/getItem/dune-hc", "", "")
+			var dune entities.ItemWithStock
+			if err := json.Unmarshal(rr.Body.Bytes(), &dune); err != nil {
+				t.Fatalf("failed to parse JSON response: %v", err)
+			}
+			if dune.ISBN != "9780441172719" || dune.Language != "en" || dune.Publisher != "Chilton" || len(dune.Authors) != 1 {
+				t.Errorf("unexpected book metadata %+v", dune.Item)
+			}
+			if len(dune.Formats) != 1 || dune.Formats[0].SKU != "dune-eb" || dune.Formats[0].Format != entities.FormatEbook || dune.Formats[0].Available != 100 {
+				t.Errorf("expected the ebook to be listed as another format, got %+v", dune.Formats)
+			}
+
+			for query, want := range map[string]string{
+				"category=fiction&format=paperback":           "emma-pb",
+				"category=Fiction/Science+Fiction&sort=price": "dune-eb,dune-hc",
+				"q=chilton":                 "dune-hc",
+				"q=9780441172719":           "dune-hc",
+				"title_id=dune&sort=-price": "dune-hc,dune-eb",
+				"language=en":               "dune-hc",
+			} {
+				rr := testHelperDo(t, s, "GET", "/items?"+query, "", "")
+				var page entities.ItemPage
+				if err := json.Unmarshal(rr.Body.Bytes(), &page); err != nil {
+					t.Fatalf("failed to parse JSON response: %v", err)
+				}
+				var got []string
+				for _, item := range page.Items {
+					got = append(got, item.SKU)
+				}
+				if strings.Join(got, ",") != want {
+					t.Errorf("search with %s returned %v, want %s", query, got, want)
+				}
+			}
+			if rr := testHelperDo(t, s, "GET", "/items?format=scroll", "", ""); rr.Code != http.StatusBadRequest {
+				t.Errorf("search with an unknown format returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+			}
+
+			rr = testHelperDo(t, s, "GET", "/categories", "", "")
+			var tree struct {
+				Categories []*entities.CategoryNode `json:"categories"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &tree); err != nil {
+				t.Fatalf("failed to parse JSON response: %v", err)
+			}
+			if len(tree.Categories) != 2 || tree.Categories[0].Name != "Fiction" || tree.Categories[0].Items != 3 || tree.Categories[1].Name != "Romance" {
+				t.Fatalf("unexpected category tree %+v", tree.Categories)
+			}
+			fiction := tree.Categories[0].Children
+			if len(fiction) != 2 || fiction[0].Path != "Fiction/Classics" || fiction[1].Path != "Fiction/Science Fiction" || fiction[1].Items != 2 {
+				t.Errorf("unexpected sub-categories of Fiction %+v", fiction)
+			}
+		})
+	}
+}
+
+func TestCatalogImportExport(t *testing.T) {
+	for _, backend := range []string{"memory", "sqlite"} {
+		t.Run(backend, func(t *testing.T) {
+			s := testHelperNewServer(t, backend)
+			admin := testHelperLoginWithRoles(t, s, "catalog-admin", entities.RoleStaff)
+			customer := testHelperLogin(t, s, "testuser", "testuser")
+
+			feed := "sku,name,price,currency,authors,stock\n" +
+				"item-1,Item 1,100.00,USD,,2\n" +
+				"item-2,Item 2 (revised),250.00,USD,,\n" +
+				"item-3,Item 3,300.00,USD,,10\n" +
+				"dune,Dune,9.99,USD,Frank Herbert,5\n" +
+				"bad,Bad,-1.00,USD,,1\n" +
+				"dune,Dune again,9.99,USD,,5\n"
+			if rr := testHelperDo(t, s, "POST", "/admin/items/import?format=csv", customer, feed); rr.Code != http.StatusForbidden {
+				t.Errorf("customer importing items returned wrong status code: got %v want %v", rr.Code, http.StatusForbidden)
+			}
+
+			importFeed := func(query string) entities.ImportReport {
+				rr := testHelperDo(t, s, "POST", "/admin/items/import?format=csv"+query, admin, feed)
+				if rr.Code != http.StatusOK {
+					t.Fatalf("import returned wrong status code: got %v want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+				}
+				var report entities.ImportReport
+				if err := json.Unmarshal(rr.Body.Bytes(), &report); err != nil {
+					t.Fatalf("failed to parse JSON response: %v", err)
+				}
+				return report
+			}
+
+			dryRun := importFeed("&dry_run=true")
+			if !dryRun.DryRun || dryRun.Created != 1 || dryRun.Updated != 2 || dryRun.Unchanged != 1 || dryRun.Failed != 2 {
+				t.Errorf("unexpected dry run report %+v", dryRun)
+			}
+			if rr := testHelperDo(t, s, "GET", "/getItem/dune", "", ""); rr.Code != http.StatusNotFound {
+				t.Errorf("expected the dry run not to create items, got status %v", rr.Code)
+			}
+
+			report := importFeed("")
+			if report.DryRun || report.Created != 1 || report.Updated != 2 || report.Unchanged != 1 || report.Failed != 2 {
+				t.Errorf("unexpected import report %+v", report)
+			}
+			if len(report.Errors) != 2 || report.Errors[0].Line != 6 || report.Errors[1].Line != 7 || report.Errors[1].SKU != "dune" {
+				t.Errorf("expected lines 6 and 7 to be reported, got %+v", report.Errors)
+			}
+
+			rr := testHelperDo(t, s, "GET", "/getItem/item-2", "", "")
+			var revised entities.ItemWithStock
+			if err := json.Unmarshal(rr.Body.Bytes(), &revised); err != nil {
+				t.Fatalf("failed to parse JSON response: %v", err)
+			}
+			if revised.Name != "Item 2 (revised)" || revised.Price != entities.NewMoney(25000, "USD") || revised.InStock != 2 {
+				t.Errorf("expected item-2 to be renamed and repriced with its stock unchanged, got %+v", revised)
+			}
+			rr = testHelperDo(t, s, "GET", "/admin/items/item-3/audit", admin, "")
+			if !strings.Contains(rr.Body.String(), `"action":"restock","old_stock":2,"new_stock":10`) {
+				t.Errorf("expected the stock level set by the import to be audited, got %s", rr.Body.String())
+			}
+
+			again := importFeed("")
+			if again.Created != 0 || again.Updated != 0 || again.Unchanged != 4 {
+				t.Errorf("expected importing the same feed twice to change nothing, got %+v", again)
+			}
+
+			rr = testHelperDo(t, s, "GET", "/admin/items/export?format=jsonl", admin, "")
+			if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "application/x-ndjson" {
+				t.Fatalf("export returned wrong status code or content type: %v %s", rr.Code, rr.Header().Get("Content-Type"))
+			}
+			lines := strings.Split(strings.TrimSpace(rr.Body.String()), "\n")
+			if len(lines) != 4 || !strings.Contains(lines[0], `"sku":"dune"`) || !strings.Contains(lines[0], `"stock":5`) {
+				t.Errorf("expected the 4 items sorted by SKU with their stock, got %v", lines)
+			}
+
+			rr = testHelperDo(t, s, "GET", "/admin/items/export", admin, "")
+			exported := rr.Body.String()
+			if !strings.HasPrefix(exported, "sku,name,") || !strings.Contains(exported, "\nitem-3,Item 3,,,300.00,USD,") {
+				t.Errorf("unexpected CSV export %s", exported)
+			}
+			rr = testHelperDo(t, s, "POST", "/admin/items/import?format=csv", admin, exported)
+			var roundTrip entities.ImportReport
+			if err := json.Unmarshal(rr.Body.Bytes(), &roundTrip); err != nil {
+				t.Fatalf("failed to parse JSON response: %v", err)
+			}
+			if roundTrip.Unchanged != 4 || roundTrip.Failed != 0 {
+				t.Errorf("expected importing the export to change nothing, got %+v", roundTrip)
+			}
+
+			for query, body := range map[string]string{
+				"":                       "sku,name,price\n",
+				"?format=xml":            "sku,name,price\n",
+				"?format=csv&dry_run=ok": "sku,name,price\n",
+				"?format=csv":            "sku,title,price\n",
+			} {
+				if rr := testHelperDo(t, s, "POST", "/admin/items/import"+query, admin, body); rr.Code != http.StatusBadRequest {
+					t.Errorf("import%s returned wrong status code: got %v want %v", query, rr.Code, http.StatusBadRequest)
+				}
+			}
+		})
+	}
+}
+
+func TestIngestONIX(t *testing.T) {
+	fixture := func(name string) string {
+		data, err := os.ReadFile(filepath.Join("..", "..", "bookstore", "onix", "testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	for _, backend := range []string{"memory", "sqlite"} {
+		t.Run(backend, func(t *testing.T) {
+			s := testHelperNewServer(t, backend)
+			admin := testHelperLoginWithRoles(t, s, "catalog-admin", entities.RoleStaff)
+
+			ingest := func(query string, message string) entities.ImportReport {
+				rr := testHelperDo(t, s, "POST", "/admin/items/onix"+query, admin, message)
+				if rr.Code != http.StatusOK {
+					t.Fatalf("ingest returned wrong status code: got %v want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+				}
+				var report entities.ImportReport
+				if err := json.Unmarshal(rr.Body.Bytes(), &report); err != nil {
+					t.Fatalf("failed to parse JSON response: %v", err)
+				}
+				return report
+			}
+
+			if report := ingest("?dry_run=true", fixture("full.xml")); report.Created != 2 || report.Failed != 1 {
+				t.Errorf("unexpected dry run report %+v", report)
+			}
+			if rr := testHelperDo(t, s, "GET", "/getItem/9780441172719", "", ""); rr.Code != http.StatusNotFound {
+				t.Errorf("expected the dry run not to add items, got status %v", rr.Code)
+			}
+
+			report := ingest("", fixture("full.xml"))
+			if report.Created != 2 || report.Failed != 1 || len(report.Errors) != 1 || report.Errors[0].SKU != "9780441013593" {
+				t.Errorf("unexpected ingest report %+v", report)
+			}
+			rr := testHelperDo(t, s, "GET", "/getItem/9780441172719", "", "")
+			var hardcover entities.ItemWithStock
+			if err := json.Unmarshal(rr.Body.Bytes(), &hardcover); err != nil {
+				t.Fatalf("failed to parse JSON response: %v", err)
+			}
+			if hardcover.InStock != 12 || hardcover.Price != entities.NewMoney(2999, "USD") || !hardcover.InCategory("Fiction/Science Fiction") {
+				t.Errorf("unexpected ingested item %+v", hardcover)
+			}
+			if len(hardcover.Formats) != 1 || hardcover.Formats[0].SKU != "9780593099322" {
+				t.Errorf("expected the ebook to be another format of the title, got %+v", hardcover.Formats)
+			}
+			if again := ingest("", fixture("full.xml")); again.Unchanged != 2 || again.Created != 0 || again.Updated != 0 {
+				t.Errorf("expected ingesting the same message twice to change nothing, got %+v", again)
+			}
+
+			report = ingest("", fixture("delta.xml"))
+			if report.Updated != 1 || report.Retired != 1 || report.Failed != 1 {
+				t.Errorf("unexpected delta report %+v", report)
+			}
+			rr = testHelperDo(t, s, "GET", "/getItem/9780441172719", "", "")
+			var updated entities.ItemWithStock
+			if err := json.Unmarshal(rr.Body.Bytes(), &updated); err != nil {
+				t.Fatalf("failed to parse JSON response: %v", err)
+			}
+			if updated.Price != entities.NewMoney(3499, "USD") || updated.InStock != 0 || updated.Publisher != "Chilton Books" || len(updated.Formats) != 0 {
+				t.Errorf("expected the block update to only change the price and stock and the ebook to be retired, got %+v", updated)
+			}
+			if again := ingest("", fixture("delta.xml")); again.Unchanged != 2 || again.Retired != 0 {
+				t.Errorf("expected replaying the deltas to change nothing, got %+v", again)
+			}
+
+			for _, message := range []string{"", "<catalog/>", "not xml"} {
+				if rr := testHelperDo(t, s, "POST", "/admin/items/onix", admin, message); rr.Code != http.StatusBadRequest {
+					t.Errorf("ingesting %q returned wrong status code: got %v want %v", message, rr.Code, http.StatusBadRequest)
+				}
+			}
+		})
+	}
+}
+
+func TestPromotions(t *testing.T) {
+	for _, backend := range []string{"memory", "sqlite"} {
+		t.Run(backend, func(t *testing.T) {
+			s := testHelperNewServer(t, backend)
+			staff := testHelperLoginWithRoles(t, s, "promotions-admin", entities.RoleStaff)
+			customer := testHelperLogin(t, s, "testuser", "testuser")
+			other := testHelperLogin(t, s, "otheruser", "otheruser")
+
+			book := `{"sku": "dune", "name": "Dune", "categories": ["Fiction/Science Fiction"], "price": {"amount": 2000, "currency": "USD"}, "stock": 10}`
+			if rr := testHelperDo(t, s, "POST", "/admin/items", staff, book); rr.Code != http.StatusCreated {
+				t.Fatalf("create book returned wrong status code: got %v want %v: %s", rr.Code, http.StatusCreated, rr.Body.String())
+			}
+			promotions := []string{
+				`{"id": "fiction-sale", "description": "10% off fiction", "kind": "percentage", "percent": 10, "category": "Fiction"}`,
+				`{"id": "save5", "code": "save5", "kind": "fixed", "amount": {"amount": 500, "currency": "USD"}, "min_spend": {"amount": 3000, "currency": "USD"}, "usage_limit_per_user": 1}`,
+				`{"id": "once", "code": "ONCE", "kind": "percentage", "percent": 50, "usage_limit": 1}`,
+				`{"id": "old", "code": "OLD", "kind": "percentage", "percent": 50, "ends_at": "2020-01-01T00:00:00Z"}`,
+			}
+			for _, promotion := range promotions {
+				if rr := testHelperDo(t, s, "POST", "/admin/promotions", staff, promotion); rr.Code != http.StatusCreated {
+					t.Fatalf("create promotion returned wrong status code: got %v want %v: %s", rr.Code, http.StatusCreated, rr.Body.String())
+				}
+			}
+			if rr := testHelperDo(t, s, "POST", "/admin/promotions", staff, `{"id": "copy", "code": "Save5", "kind": "percentage", "percent": 5}`); rr.Code != http.StatusConflict {
+				t.Errorf("reusing a coupon code returned wrong status code: got %v want %v", rr.Code, http.StatusConflict)
+			}
+			if rr := testHelperDo(t, s, "POST", "/admin/promotions", staff, `{"id": "free", "kind": "percentage", "percent": 150}`); rr.Code != http.StatusBadRequest {
+				t.Errorf("creating an invalid promotion returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+			}
+			if rr := testHelperDo(t, s, "POST", "/admin/promotions", customer, promotions[0]); rr.Code != http.StatusForbidden {
+				t.Errorf("creating a promotion as a customer returned wrong status code: got %v want %v", rr.Code, http.StatusForbidden)
+			}
+
+			cartOf := func(rr *httptest.ResponseRecorder) entities.Cart {
+				t.Helper()
+				var cart entities.Cart
+				if err := json.Unmarshal(rr.Body.Bytes(), &cart); err != nil {
+					t.Fatalf("failed to parse JSON response: %v", err)
+				}
+				return cart
+			}
+			testHelperDo(t, s, "POST", "/addToCart", customer, `{"sku": "dune", "quantity": 2}`)
+			cart := cartOf(testHelperDo(t, s, "GET", "/getCart", customer, ""))
+			if len(cart.Discounts) != 1 || cart.Discounts[0].PromotionID != "fiction-sale" || cart.AmountDue != entities.NewMoney(3600, "USD") {
+				t.Errorf("expected the fiction sale to apply automatically, got %+v due %v", cart.Discounts, cart.AmountDue)
+			}
+
+			for code, want := range map[string]int{"NOPE": http.StatusNotFound, "old": http.StatusConflict} {
+				if rr := testHelperDo(t, s, "POST", "/cart/coupon", customer, `{"code": "`+code+`"}`); rr.Code != want {
+					t.Errorf("applying coupon %s returned wrong status code: got %v want %v", code, rr.Code, want)
+				}
+			}
+			rr := testHelperDo(t, s, "POST", "/cart/coupon", customer, `{"code": "save5"}`)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("apply coupon returned wrong status code: got %v want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+			}
+			cart = cartOf(rr)
+			if cart.Coupon != "SAVE5" || len(cart.Discounts) != 2 || cart.TotalDiscount != entities.NewMoney(900, "USD") || cart.AmountDue != entities.NewMoney(3100, "USD") {
+				t.Errorf("unexpected cart with coupon %q, discounts %+v, total discount %v and due %v", cart.Coupon, cart.Discounts, cart.TotalDiscount, cart.AmountDue)
+			}
+
+			rr = testHelperDo(t, s, "POST", "/checkout", customer, "")
+			var order entities.Order
+			if err := json.Unmarshal(rr.Body.Bytes(), &order); err != nil {
+				t.Fatalf("failed to parse JSON response: %v", err)
+			}
+			if order.Coupon != "SAVE5" || len(order.Discounts) != 2 || order.TotalPrice != entities.NewMoney(4000, "USD") || order.AmountDue != entities.NewMoney(3100, "USD") {
+				t.Errorf("expected the discounts to be persisted on the order, got %+v", order)
+			}
+			body := `{"order_id": "` + order.ID + `", "credit_card_details": ` + testCard + `}`
+			if rr := testHelperDo(t, s, "POST", "/confirmPurchase", customer, body); rr.Code != http.StatusOK {
+				t.Errorf("confirm purchase returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+			}
+			var history struct {
+				Orders []entities.Order `json:"orders"`
+			}
+			json.Unmarshal(testHelperDo(t, s, "GET", "/orderHistory", customer, "").Body.Bytes(), &history)
+			if len(history.Orders) != 1 || history.Orders[0].AmountDue != order.AmountDue || len(history.Orders[0].Discounts) != 2 {
+				t.Errorf("expected the discounts in the order history, got %+v", history.Orders)
+			}
+
+			// the coupon was dropped with the cart and may only be used once per user
+			testHelperDo(t, s, "POST", "/addToCart", customer, `{"sku": "dune", "quantity": 2}`)
+			if cart := cartOf(testHelperDo(t, s, "GET", "/getCart", customer, "")); cart.Coupon != "" {
+				t.Errorf("expected checkout to remove the coupon, got %q", cart.Coupon)
+			}
+			if rr := testHelperDo(t, s, "POST", "/cart/coupon", customer, `{"code": "SAVE5"}`); rr.Code != http.StatusConflict {
+				t.Errorf("reusing a coupon returned wrong status code: got %v want %v", rr.Code, http.StatusConflict)
+			}
+
+			// below the minimum spend the coupon stays on the cart without discount
+			testHelperDo(t, s, "POST", "/addToCart", other, `{"sku": "dune", "quantity": 1}`)
+			cart = cartOf(testHelperDo(t, s, "POST", "/cart/coupon", other, `{"code": "SAVE5"}`))
+			if cart.Coupon != "SAVE5" || len(cart.Discounts) != 1 || cart.AmountDue != entities.NewMoney(1800, "USD") {
+				t.Errorf("expected only the fiction sale below the minimum spend, got %+v due %v", cart.Discounts, cart.AmountDue)
+			}
+
+			// the global limit is freed when the order using the coupon is cancelled
+			testHelperDo(t, s, "POST", "/cart/coupon", customer, `{"code": "ONCE"}`)
+			rr = testHelperDo(t, s, "POST", "/checkout", customer, "")
+			if err := json.Unmarshal(rr.Body.Bytes(), &order); err != nil {
+				t.Fatalf("failed to parse JSON response: %v", err)
+			}
+			if rr := testHelperDo(t, s, "POST", "/cart/coupon", other, `{"code": "ONCE"}`); rr.Code != http.StatusConflict {
+				t.Errorf("using a coupon beyond its limit returned wrong status code: got %v want %v", rr.Code, http.StatusConflict)
+			}
+			testHelperDo(t, s, "POST", "/orders/"+order.ID+"/cancel", customer, "")
+			if rr := testHelperDo(t, s, "POST", "/cart/coupon", other, `{"code": "ONCE"}`); rr.Code != http.StatusOK {
+				t.Errorf("using a coupon of a cancelled order returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+			}
+			cart = cartOf(testHelperDo(t, s, "DELETE", "/cart/coupon", other, ""))
+			if cart.Coupon != "" || len(cart.Discounts) != 1 {
+				t.Errorf("expected the coupon to be removed, got %q with %+v", cart.Coupon, cart.Discounts)
+			}
+
+			// a coupon that ended since it was applied fails the checkout
+			testHelperDo(t, s, "POST", "/cart/coupon", other, `{"code": "ONCE"}`)
+			ended := `{"code": "ONCE", "kind": "percentage", "percent": 50, "ends_at": "2020-01-01T00:00:00Z"}`
+			if rr := testHelperDo(t, s, "PUT", "/admin/promotions/once", staff, ended); rr.Code != http.StatusOK {
+				t.Fatalf("update promotion returned wrong status code: got %v want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+			}
+			if rr := testHelperDo(t, s, "POST", "/checkout", other, ""); rr.Code != http.StatusConflict {
+				t.Errorf("checkout with an ended coupon returned wrong status code: got %v want %v", rr.Code, http.StatusConflict)
+			}
+
+			var list struct {
+				Promotions []entities.PromotionWithUsage `json:"promotions"`
+			}
+			json.Unmarshal(testHelperDo(t, s, "GET", "/admin/promotions", staff, "").Body.Bytes(), &list)
+			redemptions := map[string]int{}
+			for _, promotion := range list.Promotions {
+				redemptions[promotion.ID] = promotion.Redemptions
+			}
+			if len(list.Promotions) != 4 || redemptions["save5"] != 1 || redemptions["fiction-sale"] != 1 || redemptions["once"] != 0 {
+				t.Errorf("unexpected promotion usage %v", redemptions)
+			}
+		})
+	}
+}
+
+func TestCheckoutTaxes(t *testing.T) {
+	rules, err := tax.Load(strings.NewReader(`{"rules": [{"name": "California sales tax", "country": "US", "region": "CA", "rate": 7.25}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, backend := range []string{"memory", "sqlite"} {
+		t.Run(backend, func(t *testing.T) {
+			st, err := openStores(backend, filepath.Join(t.TempDir(), "bookstore.db"))
+			if err != nil {
+				t.Fatal(err, "unable to open stores")
+			}
+			t.Cleanup(func() { st.close() })
+			s := newServer(st, serverOptions{taxRules: rules})
+			s.init("")
+			token := testHelperLogin(t, s, "testuser", "testuser")
+
+			orderOf := func(rr *httptest.ResponseRecorder) entities.Order {
+				t.Helper()
+				if rr.Code != http.StatusOK {
+					t.Fatalf("checkout returned wrong status code: got %v want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+				}
+				var order entities.Order
+				if err := json.Unmarshal(rr.Body.Bytes(), &order); err != nil {
+					t.Fatalf("failed to parse JSON response: %v", err)
+				}
+				return order
+			}
+
+			testHelperDo(t, s, "POST", "/addToCart", token, `{"sku": "item-1", "quantity": 1}`)
+			if rr := testHelperDo(t, s, "POST", "/checkout", token, `{"shipping_address": {"name": "Test User", "country": "US"}}`); rr.Code != http.StatusBadRequest {
+				t.Errorf("checkout to an incomplete address returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+			}
+			if rr := testHelperDo(t, s, "POST", "/checkout", token, ""); rr.Code != http.StatusBadRequest {
+				t.Errorf("checkout of taxable items without an address returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+			}
+			order := orderOf(testHelperDo(t, s, "POST", "/checkout", token, `{"shipping_address": {"name": "Test User", "line1": "1 Main St", "city": "Portland", "region": "OR", "country": "US"}}`))
+			if len(order.Taxes) != 0 || order.AmountDue != entities.NewMoney(10000, "USD") {
+				t.Errorf("expected no tax outside of California, got %+v due %v", order.Taxes, order.AmountDue)
+			}
+			testHelperDo(t, s, "POST", "/orders/"+order.ID+"/cancel", token, "")
+
+			testHelperDo(t, s, "POST", "/addToCart", token, `{"sku": "item-1", "quantity": 1}`)
+			testHelperDo(t, s, "POST", "/addToCart", token, `{"sku": "item-2", "quantity": 1}`)
+			order = orderOf(testHelperDo(t, s, "POST", "/checkout", token, `{"shipping_address": {"name": "Test User", "line1": "1 Market St", "city": "San Francisco", "region": "ca", "country": "us"}}`))
+			if len(order.Taxes) != 1 || order.Taxes[0].Amount != entities.NewMoney(2175, "USD") || order.Taxes[0].Taxable != entities.NewMoney(30000, "USD") {
+				t.Errorf("unexpected tax breakdown %+v", order.Taxes)
+			}
+			if order.TotalTax != entities.NewMoney(2175, "USD") || order.AmountDue != entities.NewMoney(32175, "USD") {
+				t.Errorf("unexpected total tax %v and amount due %v", order.TotalTax, order.AmountDue)
+			}
+			if order.ShippingAddress == nil || order.ShippingAddress.Region != "CA" {
+				t.Errorf("expected the normalized shipping address on the order, got %+v", order.ShippingAddress)
+			}
+
+			body := `{"order_id": "` + order.ID + `", "credit_card_details": ` + testCard + `}`
+			if rr := testHelperDo(t, s, "POST", "/confirmPurchase", token, body); rr.Code != http.StatusOK {
+				t.Fatalf("confirm purchase returned wrong status code: got %v want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+			}
+			var history struct {
+				Orders []entities.Order `json:"orders"`
+			}
+			json.Unmarshal(testHelperDo(t, s, "GET", "/orderHistory", token, "").Body.Bytes(), &history)
+			var confirmed entities.Order
+			for _, o := range history.Orders {
+				if o.ID == order.ID {
+					confirmed = o
+				}
+			}
+			if confirmed.AmountDue != order.AmountDue || len(confirmed.Taxes) != 1 || len(confirmed.Items) != 2 || confirmed.Items[0].Tax.IsZero() {
+				t.Errorf("expected the taxes to be persisted on the order, got %+v", confirmed)
+			}
+		})
+	}
+}
+
+func TestShippingCheckout(t *testing.T) {
+	methods, err := shipping.Load(strings.NewReader(`{"methods": [
+		{"id": "standard", "name": "Standard", "countries": ["US"], "rate": "flat",
+		 "amount": {"amount": 499, "currency": "USD"}, "free_over": {"amount": 25000, "currency": "USD"}},
+		{"id": "express", "name": "Express", "countries": ["US", "CA"], "rate": "weight",
+		 "amount": {"amount": 999, "currency": "USD"}, "per_kg": {"amount": 200, "currency": "USD"}}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, backend := range []string{"memory", "sqlite"} {
+		t.Run(backend, func(t *testing.T) {
+			st, err := openStores(backend, filepath.Join(t.TempDir(), "bookstore.db"))
+			if err != nil {
+				t.Fatal(err, "unable to open stores")
+			}
+			t.Cleanup(func() { st.close() })
+			s := newServer(st, serverOptions{shippingMethods: methods})
+			s.init("")
+			token := testHelperLogin(t, s, "testuser", "testuser")
+			other := testHelperLogin(t, s, "otheruser", "otheruser")
+
+			// address book
+			if rr := testHelperDo(t, s, "POST", "/addresses", token, `{"name": "Test User", "country": "US"}`); rr.Code != http.StatusBadRequest {
+				t.Errorf("adding an incomplete address returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+			}
+			rr := testHelperDo(t, s, "POST", "/addresses", token, `{"name": "Test User", "line1": "1 Main St", "city": "Portland", "region": "or", "country": "us"}`)
+			if rr.Code != http.StatusCreated {
+				t.Fatalf("add address returned wrong status code: got %v want %v: %s", rr.Code, http.StatusCreated, rr.Body.String())
+			}
+			var home entities.SavedAddress
+			if err := json.Unmarshal(rr.Body.Bytes(), &home); err != nil {
+				t.Fatalf("failed to parse JSON response: %v", err)
+			}
+			if home.ID == "" || home.Country != "US" || home.Region != "OR" {
+				t.Errorf("expected the normalized address with its id, got %+v", home)
+			}
+			rr = testHelperDo(t, s, "POST", "/addresses", token, `{"name": "Test User", "line1": "1 Rue Sainte-Catherine", "city": "Montreal", "region": "QC", "country": "CA"}`)
+			var montreal entities.SavedAddress
+			json.Unmarshal(rr.Body.Bytes(), &montreal)
+			if rr := testHelperDo(t, s, "PUT", "/addresses/"+home.ID, other, `{"name": "Other User", "line1": "2 Main St", "city": "Portland", "country": "US"}`); rr.Code != http.StatusNotFound {
+				t.Errorf("updating the address of another user returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+			}
+			var book struct {
+				Addresses []entities.SavedAddress `json:"addresses"`
+			}
+			json.Unmarshal(testHelperDo(t, s, "GET", "/addresses", token, "").Body.Bytes(), &book)
+			if len(book.Addresses) != 2 || book.Addresses[0].ID != home.ID {
+				t.Errorf("expected both addresses in the address book, got %+v", book.Addresses)
+			}
+
+			// rates
+			testHelperDo(t, s, "POST", "/addToCart", token, `{"sku": "item-1", "quantity": 1}`)
+			var quote struct {
+				Rates []entities.ShippingRate `json:"rates"`
+			}
+			rr = testHelperDo(t, s, "POST", "/shipping/rates", token, `{"address_id": "`+home.ID+`"}`)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("shipping rates returned wrong status code: got %v want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+			}
+			json.Unmarshal(rr.Body.Bytes(), &quote)
+			if len(quote.Rates) != 2 || quote.Rates[0].Cost != entities.NewMoney(499, "USD") || quote.Rates[1].Cost != entities.NewMoney(999, "USD") {
+				t.Errorf("unexpected rates %+v", quote.Rates)
+			}
+			if rr := testHelperDo(t, s, "POST", "/shipping/rates", token, `{}`); rr.Code != http.StatusBadRequest {
+				t.Errorf("quoting without an address returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+			}
+
+			// a failed checkout leaves the cart untouched
+			for body, want := range map[string]int{
+				`{"address_id": "` + home.ID + `"}`:                                    http.StatusBadRequest,
+				`{"address_id": "` + montreal.ID + `", "shipping_method": "standard"}`: http.StatusBadRequest,
+				`{"shipping_method": "standard"}`:                                      http.StatusBadRequest,
+				`{"address_id": "unknown", "shipping_method": "standard"}`:             http.StatusNotFound,
+				`{}`: http.StatusBadRequest,
+				"":   http.StatusBadRequest,
+			} {
+				if rr := testHelperDo(t, s, "POST", "/checkout", token, body); rr.Code != want {
+					t.Errorf("checkout with %s returned wrong status code: got %v want %v", body, rr.Code, want)
+				}
+			}
+			rr = testHelperDo(t, s, "POST", "/checkout", token, `{"address_id": "`+home.ID+`", "shipping_method": "standard"}`)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("checkout returned wrong status code: got %v want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+			}
+			var order entities.Order
+			if err := json.Unmarshal(rr.Body.Bytes(), &order); err != nil {
+				t.Fatalf("failed to parse JSON response: %v", err)
+			}
+			if order.Shipping == nil || order.Shipping.Method != "standard" || order.Shipping.Cost != entities.NewMoney(499, "USD") {
+				t.Errorf("expected the shipping method and cost on the order, got %+v", order.Shipping)
+			}
+			if order.ShippingAddress == nil || order.ShippingAddress.City != "Portland" || order.AmountDue != entities.NewMoney(10499, "USD") {
+				t.Errorf("expected the address of the address book and the shipping in the amount due, got %+v due %v", order.ShippingAddress, order.AmountDue)
+			}
+
+			// deleting the address keeps the one of the order
+			if rr := testHelperDo(t, s, "DELETE", "/addresses/"+home.ID, token, ""); rr.Code != http.StatusOK {
+				t.Errorf("delete address returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+			}
+			body := `{"order_id": "` + order.ID + `", "credit_card_details": ` + testCard + `}`
+			if rr := testHelperDo(t, s, "POST", "/confirmPurchase", token, body); rr.Code != http.StatusOK {
+				t.Fatalf("confirm purchase returned wrong status code: got %v want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+			}
+			var history struct {
+				Orders []entities.Order `json:"orders"`
+			}
+			json.Unmarshal(testHelperDo(t, s, "GET", "/orderHistory", token, "").Body.Bytes(), &history)
+			if len(history.Orders) != 1 || history.Orders[0].Shipping == nil || history.Orders[0].AmountDue != order.AmountDue || history.Orders[0].ShippingAddress == nil {
+				t.Errorf("expected the shipping to be persisted on the order, got %+v", history.Orders)
+			}
+		})
+	}
+}
+
+func TestRefundOrder(t *testing.T) {
+	for _, backend := range []string{"memory", "sqlite"} {
+		t.Run(backend, func(t *testing.T) {
+			s := testHelperNewServer(t, backend)
+			staff := testHelperLoginWithRoles(t, s, "refunds-admin", entities.RoleStaff)
+			customer := testHelperLogin(t, s, "testuser", "testuser")
+
+			orderOf := func(rr *httptest.ResponseRecorder) entities.Order {
+				t.Helper()
+				if rr.Code != http.StatusOK {
+					t.Fatalf("got status code %v want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+				}
+				var order entities.Order
+				if err := json.Unmarshal(rr.Body.Bytes(), &order); err != nil {
+					t.Fatalf("failed to parse JSON response: %v", err)
+				}
+				return order
+			}
+			stockOf := func(sku string) int {
+				t.Helper()
+				var item entities.ItemWithStock
+				json.Unmarshal(testHelperDo(t, s, "GET", "/getItem/"+sku, "", "").Body.Bytes(), &item)
+				return item.InStock
+			}
+			buy := func(quantity int, pay bool) entities.Order {
+				t.Helper()
+				testHelperDo(t, s, "POST", "/addToCart", customer, fmt.Sprintf(`{"sku": "item-1", "quantity": %d}`, quantity))
+				order := orderOf(testHelperDo(t, s, "POST", "/checkout", customer, ""))
+				if pay {
+					body := `{"order_id": "` + order.ID + `", "credit_card_details": ` + testCard + `}`
+					orderOf(testHelperDo(t, s, "POST", "/confirmPurchase", customer, body))
+					order = orderOf(testHelperDo(t, s, "POST", "/admin/orders/"+order.ID+"/capture", staff, ""))
+				}
+				return order
+			}
+
+			unpaid := buy(1, false)
+			if rr := testHelperDo(t, s, "POST", "/admin/orders/"+unpaid.ID+"/refund", staff, `{"reason": "oops"}`); rr.Code != http.StatusConflict {
+				t.Errorf("refunding an unpaid order returned wrong status code: got %v want %v", rr.Code, http.StatusConflict)
+			}
+			testHelperDo(t, s, "POST", "/orders/"+unpaid.ID+"/cancel", customer, "")
+
+			order := buy(2, true)
+			path := "/admin/orders/" + order.ID + "/refund"
+			if rr := testHelperDo(t, s, "POST", path, customer, `{"reason": "I changed my mind"}`); rr.Code != http.StatusForbidden {
+				t.Errorf("refunding as a customer returned wrong status code: got %v want %v", rr.Code, http.StatusForbidden)
+			}
+			if rr := testHelperDo(t, s, "POST", "/admin/orders/unknown/refund", staff, `{"reason": "oops"}`); rr.Code != http.StatusNotFound {
+				t.Errorf("refunding an unknown order returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+			}
+			if rr := testHelperDo(t, s, "POST", path, staff, `{"amount": {"amount": 5000, "currency": "USD"}}`); rr.Code != http.StatusBadRequest {
+				t.Errorf("refunding without a reason returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+			}
+			if rr := testHelperDo(t, s, "POST", path, staff, `{"reason": "too much", "amount": {"amount": 20001, "currency": "USD"}}`); rr.Code != http.StatusConflict {
+				t.Errorf("refunding more than was paid returned wrong status code: got %v want %v", rr.Code, http.StatusConflict)
+			}
+
+			before := stockOf("item-1")
+			refunded := orderOf(testHelperDo(t, s, "POST", path, staff, `{"reason": "one copy returned", "amount": {"amount": 10000, "currency": "USD"}, "restock": [{"sku": "item-1", "quantity": 1}]}`))
+			if len(refunded.Refunds) != 1 || refunded.Refunds[0].Status != entities.RefundSucceeded || refunded.Refunds[0].Confirmation == "" || refunded.Refunds[0].By != "refunds-admin" {
+				t.Errorf("unexpected refunds %+v", refunded.Refunds)
+			}
+			if refunded.TotalRefunded != entities.NewMoney(10000, "USD") || refunded.CurrentStatus() != entities.OrderStatusPaid {
+				t.Errorf("expected a partial refund of a paid order, got %v refunded and status %s", refunded.TotalRefunded, refunded.CurrentStatus())
+			}
+			if stock := stockOf("item-1"); stock != before+1 {
+				t.Errorf("expected the returned copy back in stock, got %d want %d", stock, before+1)
+			}
+			if rr := testHelperDo(t, s, "POST", path, staff, `{"reason": "both copies", "restock": [{"sku": "item-1", "quantity": 2}]}`); rr.Code != http.StatusConflict {
+				t.Errorf("restocking more than was ordered returned wrong status code: got %v want %v", rr.Code, http.StatusConflict)
+			}
+
+			// a paid order is not cancelled, its rest is refunded and only the copy that was not returned is restocked
+			if rr := testHelperDo(t, s, "POST", "/orders/"+order.ID+"/cancel", customer, ""); rr.Code != http.StatusConflict {
+				t.Errorf("cancelling a paid order returned wrong status code: got %v want %v", rr.Code, http.StatusConflict)
+			}
+			if stock := stockOf("item-1"); stock != before+1 {
+				t.Errorf("expected cancelling not to restock, got %d want %d", stock, before+1)
+			}
+			rest := orderOf(testHelperDo(t, s, "POST", path, staff, `{"reason": "cancelled", "restock_all": true}`))
+			if rest.TotalRefunded != entities.NewMoney(20000, "USD") || len(rest.Refunds) != 2 || len(rest.Refunds[1].Restocked) != 1 {
+				t.Errorf("expected the rest to be refunded restocking the other copy, got %+v", rest)
+			}
+			if stock := stockOf("item-1"); stock != before+2 {
+				t.Errorf("expected no more restocking, got %d want %d", stock, before+2)
+			}
+			if rr := testHelperDo(t, s, "POST", path, staff, `{"reason": "again"}`); rr.Code != http.StatusConflict {
+				t.Errorf("refunding a refunded order returned wrong status code: got %v want %v", rr.Code, http.StatusConflict)
+			}
+
+			full := orderOf(testHelperDo(t, s, "POST", "/admin/orders/"+buy(1, true).ID+"/refund", staff, `{"reason": "lost in transit"}`))
+			if full.CurrentStatus() != entities.OrderStatusRefunded || full.TotalRefunded != full.AmountDue {
+				t.Errorf("expected a full refund to move the order to refunded, got %+v", full)
+			}
+		})
+	}
+}
+
+func TestAuthorizeAndCapture(t *testing.T) {
+	for _, backend := range []string{"memory", "sqlite"} {
+		t.Run(backend, func(t *testing.T) {
+			st, err := openStores(backend, filepath.Join(t.TempDir(), "bookstore.db"))
+			if err != nil {
+				t.Fatal(err, "unable to open stores")
+			}
+			t.Cleanup(func() { st.close() })
+			gateway := payments.NewFakeGateway()
+			s := newServer(st, serverOptions{paymentGateway: gateway})
+			s.init("")
+			staff := testHelperLoginWithRoles(t, s, "payments-admin", entities.RoleStaff)
+			customer := testHelperLogin(t, s, "testuser", "testuser")
+
+			orderOf := func(rr *httptest.ResponseRecorder) entities.Order {
+				t.Helper()
+				if rr.Code != http.StatusOK {
+					t.Fatalf("got status code %v want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+				}
+				var order entities.Order
+				if err := json.Unmarshal(rr.Body.Bytes(), &order); err != nil {
+					t.Fatalf("failed to parse JSON response: %v", err)
+				}
+				return order
+			}
+			usd := func(amount int64) entities.Money { return entities.NewMoney(amount, "USD") }
+
+			testHelperDo(t, s, "POST", "/addToCart", customer, `{"sku": "item-1", "quantity": 2}`)
+			order := orderOf(testHelperDo(t, s, "POST", "/checkout", customer, ""))
+			confirm := `{"order_id": "` + order.ID + `", "credit_card_details": ` + testCard + `}`
+
+			gateway.Script(payments.OpAuthorize, payments.Decline("insufficient funds"), payments.Timeout(), payments.PartialApprove(usd(10000)))
+			for _, want := range []int{http.StatusPaymentRequired, http.StatusGatewayTimeout, http.StatusPaymentRequired} {
+				if rr := testHelperDo(t, s, "POST", "/confirmPurchase", customer, confirm); rr.Code != want {
+					t.Errorf("confirm purchase returned wrong status code: got %v want %v: %s", rr.Code, want, rr.Body.String())
+				}
+			}
+			if partial, _ := gateway.Authorization("auth-1"); !partial.Voided {
+				t.Errorf("expected the partial approval to be voided, got %+v", partial)
+			}
+
+			order = orderOf(testHelperDo(t, s, "POST", "/confirmPurchase", customer, confirm))
+			if order.CurrentStatus() != entities.OrderStatusAuthorized || order.Authorization == nil || order.Authorization.Amount != usd(20000) {
+				t.Fatalf("expected the order to be authorized for 200.00, got %s and %+v", order.CurrentStatus(), order.Authorization)
+			}
+			if rr := testHelperDo(t, s, "POST", "/confirmPurchase", customer, confirm); rr.Code != http.StatusConflict {
+				t.Errorf("confirming twice returned wrong status code: got %v want %v", rr.Code, http.StatusConflict)
+			}
+			path := "/admin/orders/" + order.ID
+			if rr := testHelperDo(t, s, "POST", path+"/refund", staff, `{"reason": "oops"}`); rr.Code != http.StatusConflict {
+				t.Errorf("refunding an uncaptured order returned wrong status code: got %v want %v", rr.Code, http.StatusConflict)
+			}
+			if rr := testHelperDo(t, s, "POST", path+"/capture", customer, ""); rr.Code != http.StatusForbidden {
+				t.Errorf("capturing as a customer returned wrong status code: got %v want %v", rr.Code, http.StatusForbidden)
+			}
+			if rr := testHelperDo(t, s, "POST", path+"/capture", staff, `{"amount": {"amount": 20001, "currency": "USD"}}`); rr.Code != http.StatusConflict {
+				t.Errorf("capturing more than authorized returned wrong status code: got %v want %v", rr.Code, http.StatusConflict)
+			}
+			gateway.Script(payments.OpCapture, payments.Decline("authorization expired"))
+			if rr := testHelperDo(t, s, "POST", path+"/capture", staff, `{"amount": {"amount": 10000, "currency": "USD"}}`); rr.Code != http.StatusBadGateway {
+				t.Errorf("a declined capture returned wrong status code: got %v want %v", rr.Code, http.StatusBadGateway)
+			}
+
+			// the first shipment, then the last one for less than what is left
+			shipped := orderOf(testHelperDo(t, s, "POST", path+"/capture", staff, `{"amount": {"amount": 10000, "currency": "USD"}}`))
+			if shipped.CurrentStatus() != entities.OrderStatusAuthorized || shipped.Captured() != usd(10000) || len(shipped.Authorization.Captures) != 2 {
+				t.Errorf("expected a partial capture after the failed one, got %s and %+v", shipped.CurrentStatus(), shipped.Authorization)
+			}
+			paid := orderOf(testHelperDo(t, s, "POST", path+"/capture", staff, `{"amount": {"amount": 5000, "currency": "USD"}, "final": true}`))
+			if paid.CurrentStatus() != entities.OrderStatusPaid || paid.Captured() != usd(15000) || !paid.Authorization.Voided {
+				t.Errorf("expected the final capture to pay the order, got %s and %+v", paid.CurrentStatus(), paid.Authorization)
+			}
+			if auth, _ := gateway.Authorization(order.Authorization.ID); auth.Captured != usd(15000) || !auth.Voided {
+				t.Errorf("expected the rest of the authorization to be voided at the gateway, got %+v", auth)
+			}
+			if rr := testHelperDo(t, s, "POST", path+"/capture", staff, ""); rr.Code != http.StatusConflict {
+				t.Errorf("capturing a paid order returned wrong status code: got %v want %v", rr.Code, http.StatusConflict)
+			}
+			if rr := testHelperDo(t, s, "POST", "/orders/"+order.ID+"/cancel", customer, ""); rr.Code != http.StatusConflict {
+				t.Errorf("cancelling a paid order returned wrong status code: got %v want %v", rr.Code, http.StatusConflict)
+			}
+			var history struct {
+				Orders []entities.Order `json:"orders"`
+			}
+			json.Unmarshal(testHelperDo(t, s, "GET", "/orderHistory", customer, "").Body.Bytes(), &history)
+			if len(history.Orders) != 1 || history.Orders[0].CurrentStatus() != entities.OrderStatusPaid || len(history.Orders[0].Refunds) != 0 {
+				t.Errorf("expected the paid order to stay paid without refunds, got %+v", history.Orders)
+			}
+			var item entities.ItemWithStock
+			json.Unmarshal(testHelperDo(t, s, "GET", "/getItem/item-1", "", "").Body.Bytes(), &item)
+			if item.InStock != 0 {
+				t.Errorf("expected the paid order not to be restocked, got %d in stock", item.InStock)
+			}
+
+			// staff move the paid order along its fulfillment, one status after the other
+			status := path + "/status"
+			if rr := testHelperDo(t, s, "POST", status, customer, `{"status": "fulfilled"}`); rr.Code != http.StatusForbidden {
+				t.Errorf("fulfilling as a customer returned wrong status code: got %v want %v", rr.Code, http.StatusForbidden)
+			}
+			if rr := testHelperDo(t, s, "POST", status, staff, `{"status": "cancelled"}`); rr.Code != http.StatusBadRequest {
+				t.Errorf("cancelling through fulfillment returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+			}
+			if rr := testHelperDo(t, s, "POST", status, staff, `{"status": "shipped"}`); rr.Code != http.StatusConflict {
+				t.Errorf("shipping an unfulfilled order returned wrong status code: got %v want %v", rr.Code, http.StatusConflict)
+			}
+			for _, next := range []entities.OrderStatus{entities.OrderStatusFulfilled, entities.OrderStatusShipped, entities.OrderStatusDelivered} {
+				if moved := orderOf(testHelperDo(t, s, "POST", status, staff, `{"status": "`+string(next)+`"}`)); moved.CurrentStatus() != next {
+					t.Errorf("expected the order to be %s, got %s", next, moved.CurrentStatus())
+				}
+			}
+			if rr := testHelperDo(t, s, "POST", "/admin/orders/unknown/status", staff, `{"status": "fulfilled"}`); rr.Code != http.StatusNotFound {
+				t.Errorf("fulfilling an unknown order returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+			}
+
+			// cancelling an authorized order voids its authorization
+			testHelperDo(t, s, "POST", "/addToCart", customer, `{"sku": "item-2", "quantity": 1}`)
+			other := orderOf(testHelperDo(t, s, "POST", "/checkout", customer, ""))
+			other = orderOf(testHelperDo(t, s, "POST", "/confirmPurchase", customer, `{"order_id": "`+other.ID+`", "credit_card_details": `+testCard+`}`))
+			cancelled := orderOf(testHelperDo(t, s, "POST", "/orders/"+other.ID+"/cancel", customer, ""))
+			if cancelled.CurrentStatus() != entities.OrderStatusCancelled || !cancelled.Authorization.Voided {
+				t.Errorf("expected the cancelled order to release its authorization, got %+v", cancelled.Authorization)
+			}
+			if auth, _ := gateway.Authorization(other.Authorization.ID); !auth.Voided || !auth.Captured.IsZero() {
+				t.Errorf("expected the authorization to be voided at the gateway, got %+v", auth)
+			}
+		})
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	for _, backend := range []string{"memory", "sqlite"} {
+		t.Run(backend, func(t *testing.T) {
+			st, err := openStores(backend, filepath.Join(t.TempDir(), "bookstore.db"))
+			if err != nil {
+				t.Fatal(err, "unable to open stores")
+			}
+			t.Cleanup(func() { st.close() })
+			gateway := payments.NewFakeGateway()
+			s := newServer(st, serverOptions{paymentGateway: gateway})
+			s.init("")
+			customer := testHelperLogin(t, s, "testuser", "testuser")
+			other := testHelperLoginWithRoles(t, s, "other-customer")
+
+			testHelperDo(t, s, "POST", "/addToCart", customer, `{"sku": "item-1", "quantity": 1}`)
+			first := testHelperDoIdempotent(t, s, "POST", "/checkout", customer, "checkout-1", "")
+			if first.Code != http.StatusOK {
+				t.Fatalf("checkout returned wrong status code: got %v want %v: %s", first.Code, http.StatusOK, first.Body.String())
+			}
+			retry := testHelperDoIdempotent(t, s, "POST", "/checkout", customer, "checkout-1", "")
+			if retry.Code != http.StatusOK || retry.Body.String() != first.Body.String() || retry.Header().Get(HEADER_IDEMPOTENT_REPLAYED) != "true" {
+				t.Errorf("expected the checkout to be replayed, got %v %q: %s", retry.Code, retry.Header().Get(HEADER_IDEMPOTENT_REPLAYED), retry.Body.String())
+			}
+			if first.Header().Get(HEADER_IDEMPOTENT_REPLAYED) != "" {
+				t.Error("expected the first response not to be marked as replayed")
+			}
+			var history struct {
+				Orders []entities.Order `json:"orders"`
+			}
+			json.Unmarshal(testHelperDo(t, s, "GET", "/orderHistory", customer, "").Body.Bytes(), &history)
+			if len(history.Orders) != 1 {
+				t.Errorf("expected a single order after retrying the checkout, got %d", len(history.Orders))
+			}
+			if rr := testHelperDoIdempotent(t, s, "POST", "/addToCart", customer, "checkout-1", `{"sku": "item-1", "quantity": 1}`); rr.Code != http.StatusConflict {
+				t.Errorf("reusing a key for another request returned wrong status code: got %v want %v", rr.Code, http.StatusConflict)
+			}
+			// keys are per user
+			if rr := testHelperDoIdempotent(t, s, "POST", "/addToCart", other, "checkout-1", `{"sku": "item-2", "quantity": 1}`); rr.Code != http.StatusOK || rr.Header().Get(HEADER_IDEMPOTENT_REPLAYED) != "" {
+				t.Errorf("expected the key of another user to be processed, got %v: %s", rr.Code, rr.Body.String())
+			}
+
+			var order entities.Order
+			if err := json.Unmarshal(first.Body.Bytes(), &order); err != nil {
+				t.Fatalf("failed to parse JSON response: %v", err)
+			}
+			confirm := `{"order_id": "` + order.ID + `", "credit_card_details": ` + testCard + `}`
+			if rr := testHelperDoIdempotent(t, s, "POST", "/confirmPurchase", customer, "confirm-1", `{"order_id": "`+order.ID+`"}`); rr.Code != http.StatusBadRequest {
+				t.Fatalf("confirming without a card returned wrong status code: got %v want %v: %s", rr.Code, http.StatusBadRequest, rr.Body.String())
+			}
+			// a client error is kept, a gateway timeout can be retried with the same key
+			if rr := testHelperDoIdempotent(t, s, "POST", "/confirmPurchase", customer, "confirm-1", confirm); rr.Code != http.StatusConflict {
+				t.Errorf("reusing the key of a rejected request returned wrong status code: got %v want %v", rr.Code, http.StatusConflict)
+			}
+			gateway.Script(payments.OpAuthorize, payments.Timeout())
+			if rr := testHelperDoIdempotent(t, s, "POST", "/confirmPurchase", customer, "confirm-2", confirm); rr.Code != http.StatusGatewayTimeout {
+				t.Fatalf("confirm purchase returned wrong status code: got %v want %v: %s", rr.Code, http.StatusGatewayTimeout, rr.Body.String())
+			}
+			confirmed := testHelperDoIdempotent(t, s, "POST", "/confirmPurchase", customer, "confirm-2", confirm)
+			if confirmed.Code != http.StatusOK || confirmed.Header().Get(HEADER_IDEMPOTENT_REPLAYED) != "" {
+				t.Fatalf("expected the retry after a timeout to be processed, got %v: %s", confirmed.Code, confirmed.Body.String())
+			}
+			replayed := testHelperDoIdempotent(t, s, "POST", "/confirmPurchase", customer, "confirm-2", confirm)
+			if replayed.Code != http.StatusOK || replayed.Body.String() != confirmed.Body.String() {
+				t.Errorf("expected the confirmation to be replayed, got %v: %s", replayed.Code, replayed.Body.String())
+			}
+			if calls := gateway.Calls(payments.OpAuthorize); calls != 2 {
+				t.Errorf("expected the payment to be authorized once after the timeout, got %d calls", calls)
+			}
+		})
+	}
+}
+
+func TestIdempotencySecret(t *testing.T) {
+	defer func(secret string) { IDEMPOTENCY_SECRET = secret }(IDEMPOTENCY_SECRET)
+	path := filepath.Join(t.TempDir(), "bookstore.db")
+	start := func() *Server {
+		t.Helper()
+		st, err := openStores("sqlite", path)
+		if err != nil {
+			t.Fatal(err, "unable to open stores")
+		}
+		s := newServer(st, serverOptions{})
+		s.init("")
+		t.Cleanup(func() { st.close() })
+		return s
+	}
+
+	// the fingerprints are keyed with a random secret, the retries after a restart are other requests
+	IDEMPOTENCY_SECRET = ""
+	register := `{"username": "reader", "password": "s3cret-enough"}`
+	if rr := testHelperDoIdempotent(t, start(), "POST", "/register", "", "register-1", register); rr.Code != http.StatusCreated {
+		t.Fatalf("register returned wrong status code: got %v want %v: %s", rr.Code, http.StatusCreated, rr.Body.String())
+	}
+	if rr := testHelperDoIdempotent(t, start(), "POST", "/register", "", "register-1", register); rr.Code != http.StatusConflict {
+		t.Errorf("retrying after a restart without a secret returned wrong status code: got %v want %v", rr.Code, http.StatusConflict)
+	}
+
+	IDEMPOTENCY_SECRET = "idempotency-secret"
+	register = `{"username": "writer", "password": "s3cret-enough"}`
+	if rr := testHelperDoIdempotent(t, start(), "POST", "/register", "", "register-2", register); rr.Code != http.StatusCreated {
+		t.Fatalf("register returned wrong status code: got %v want %v: %s", rr.Code, http.StatusCreated, rr.Body.String())
+	}
+	if rr := testHelperDoIdempotent(t, start(), "POST", "/register", "", "register-2", register); rr.Code != http.StatusCreated || rr.Header().Get(HEADER_IDEMPOTENT_REPLAYED) != "true" {
+		t.Errorf("expected the registration to be replayed after a restart with the secret, got %v: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestCardTokenization(t *testing.T) {
+	for _, backend := range []string{"memory", "sqlite"} {
+		t.Run(backend, func(t *testing.T) {
+			st, err := openStores(backend, filepath.Join(t.TempDir(), "bookstore.db"))
+			if err != nil {
+				t.Fatal(err, "unable to open stores")
+			}
+			t.Cleanup(func() { st.close() })
+			gateway := payments.NewFakeGateway()
+			s := newServer(st, serverOptions{paymentGateway: gateway})
+			s.init("")
+			customer := testHelperLogin(t, s, "testuser", "testuser")
+			other := testHelperLoginWithRoles(t, s, "other-customer")
+
+			for _, details := range []string{
+				`{"credit_card_number": "4242 4242 4242 4241", "credit_card_expiration": "12/99", "credit_card_cvv": "123"}`,
+				`{"credit_card_number": "4242 4242 4242 4242", "credit_card_expiration": "01/20", "credit_card_cvv": "123"}`,
+				`{"credit_card_number": "4242 4242 4242 4242", "credit_card_expiration": "12/99", "credit_card_cvv": "12"}`,
+			} {
+				if rr := testHelperDo(t, s, "POST", "/cards", customer, details); rr.Code != http.StatusBadRequest {
+					t.Errorf("tokenizing an invalid card returned wrong status code: got %v want %v: %s", rr.Code, http.StatusBadRequest, rr.Body.String())
+				}
+			}
+			rr := testHelperDo(t, s, "POST", "/cards", customer, testCard)
+			if rr.Code != http.StatusCreated {
+				t.Fatalf("tokenizing a card returned wrong status code: got %v want %v: %s", rr.Code, http.StatusCreated, rr.Body.String())
+			}
+			if strings.Contains(rr.Body.String(), "4242424242424242") || strings.Contains(rr.Body.String(), "cvv") {
+				t.Errorf("expected the card number and CVV not to be returned, got %s", rr.Body.String())
+			}
+			var card entities.PaymentCard
+			if err := json.Unmarshal(rr.Body.Bytes(), &card); err != nil {
+				t.Fatalf("failed to parse JSON response: %v", err)
+			}
+			if card.Token == "" || card.Brand != entities.CardBrandVisa || card.Last4 != "4242" {
+				t.Fatalf("expected a token for a visa ending in 4242, got %+v", card)
+			}
+
+			testHelperDo(t, s, "POST", "/addToCart", customer, `{"sku": "item-1", "quantity": 1}`)
+			var order entities.Order
+			json.Unmarshal(testHelperDo(t, s, "POST", "/checkout", customer, "").Body.Bytes(), &order)
+			for _, body := range []string{
+				`{"order_id": "` + order.ID + `"}`,
+				`{"order_id": "` + order.ID + `", "card_token": "` + card.Token + `", "credit_card_details": ` + testCard + `}`,
+				`{"order_id": "` + order.ID + `", "card_token": "tok_unknown"}`,
+			} {
+				if rr := testHelperDo(t, s, "POST", "/confirmPurchase", customer, body); rr.Code != http.StatusBadRequest {
+					t.Errorf("confirm purchase returned wrong status code: got %v want %v: %s", rr.Code, http.StatusBadRequest, rr.Body.String())
+				}
+			}
+			if rr := testHelperDo(t, s, "POST", "/confirmPurchase", other, `{"card_token": "`+card.Token+`"}`); rr.Code != http.StatusBadRequest {
+				t.Errorf("paying with the token of another user returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+			}
+
+			rr = testHelperDo(t, s, "POST", "/confirmPurchase", customer, `{"order_id": "`+order.ID+`", "card_token": "`+card.Token+`"}`)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("confirm purchase returned wrong status code: got %v want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+			}
+			json.Unmarshal(rr.Body.Bytes(), &order)
+			if c := order.Authorization.Card; c == nil || c.Brand != entities.CardBrandVisa || c.Last4 != "4242" || c.Token != "" {
+				t.Errorf("expected the order to be paid with the visa ending in 4242, got %+v", c)
+			}
+			if auth, _ := gateway.Authorization(order.Authorization.ID); auth.CardToken != card.Token {
+				t.Errorf("expected the gateway to be sent the token of the card, got %q", auth.CardToken)
+			}
+		})
+	}
+}
+
+func TestPaymentMethods(t *testing.T) {
+	for _, backend := range []string{"memory", "sqlite"} {
+		t.Run(backend, func(t *testing.T) {
+			st, err := openStores(backend, filepath.Join(t.TempDir(), "bookstore.db"))
+			if err != nil {
+				t.Fatal(err, "unable to open stores")
+			}
+			t.Cleanup(func() { st.close() })
+			gateway := payments.NewFakeGateway()
+			s := newServer(st, serverOptions{paymentGateway: gateway})
+			s.init("")
+			customer := testHelperLogin(t, s, "testuser", "testuser")
+			other := testHelperLoginWithRoles(t, s, "other-customer")
+
+			methodOf := func(rr *httptest.ResponseRecorder, want int) entities.PaymentMethod {
+				t.Helper()
+				if rr.Code != want {
+					t.Fatalf("got status code %v want %v: %s", rr.Code, want, rr.Body.String())
+				}
+				var method entities.PaymentMethod
+				if err := json.Unmarshal(rr.Body.Bytes(), &method); err != nil {
+					t.Fatalf("failed to parse JSON response: %v", err)
+				}
+				return method
+			}
+			confirm := func(sku string, body string) entities.Order {
+				t.Helper()
+				testHelperDo(t, s, "POST", "/addToCart", customer, `{"sku": "`+sku+`", "quantity": 1}`)
+				var order entities.Order
+				json.Unmarshal(testHelperDo(t, s, "POST", "/checkout", customer, "").Body.Bytes(), &order)
+				rr := testHelperDo(t, s, "POST", "/confirmPurchase", customer, `{"order_id": "`+order.ID+`"`+body+`}`)
+				if rr.Code != http.StatusOK {
+					t.Fatalf("confirm purchase returned wrong status code: got %v want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+				}
+				json.Unmarshal(rr.Body.Bytes(), &order)
+				return order
+			}
+
+			if rr := testHelperDo(t, s, "POST", "/paymentMethods", customer, `{"credit_card_details": {"credit_card_number": "4242424242424241", "credit_card_expiration": "12/99", "credit_card_cvv": "123"}}`); rr.Code != http.StatusBadRequest {
+				t.Errorf("saving an invalid card returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+			}
+			visa := methodOf(testHelperDo(t, s, "POST", "/paymentMethods", customer, `{"credit_card_details": `+testCard+`}`), http.StatusCreated)
+			if !visa.Default || visa.Brand != entities.CardBrandVisa || visa.Last4 != "4242" || visa.ExpiryYear != 2099 {
+				t.Errorf("expected the visa to be saved as the default card, got %+v", visa)
+			}
+			if again := methodOf(testHelperDo(t, s, "POST", "/paymentMethods", customer, `{"credit_card_details": `+testCard+`}`), http.StatusCreated); again.ID != visa.ID {
+				t.Errorf("expected saving a card again to return its payment method, got %+v", again)
+			}
+			rr := testHelperDo(t, s, "POST", "/cards", customer, `{"credit_card_number": "5555 5555 5555 4444", "credit_card_expiration": "01/99", "credit_card_cvv": "321"}`)
+			var card entities.PaymentCard
+			json.Unmarshal(rr.Body.Bytes(), &card)
+			mastercard := methodOf(testHelperDo(t, s, "POST", "/paymentMethods", customer, `{"card_token": "`+card.Token+`"}`), http.StatusCreated)
+			if mastercard.Default || mastercard.Brand != entities.CardBrandMastercard {
+				t.Errorf("expected the mastercard to be saved besides the default card, got %+v", mastercard)
+			}
+			if rr := testHelperDo(t, s, "POST", "/paymentMethods", other, `{"card_token": "`+card.Token+`"}`); rr.Code != http.StatusBadRequest {
+				t.Errorf("saving the token of another user returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+			}
+
+			var list struct {
+				PaymentMethods []entities.PaymentMethod `json:"payment_methods"`
+			}
+			json.Unmarshal(testHelperDo(t, s, "GET", "/paymentMethods", customer, "").Body.Bytes(), &list)
+			if len(list.PaymentMethods) != 2 || list.PaymentMethods[0].ID != visa.ID || list.PaymentMethods[1].ID != mastercard.ID {
+				t.Errorf("expected both cards oldest first, got %+v", list.PaymentMethods)
+			}
+
+			// without a card the purchase is paid with the default one
+			if order := confirm("item-1", ""); order.Authorization.Card.Last4 != "4242" {
+				t.Errorf("expected the order to be paid with the default card, got %+v", order.Authorization.Card)
+			}
+			if order := confirm("item-2", `, "payment_method_id": "`+mastercard.ID+`"`); order.Authorization.Card.Last4 != "4444" {
+				t.Errorf("expected the order to be paid with the saved mastercard, got %+v", order.Authorization.Card)
+			}
+			if rr := testHelperDo(t, s, "POST", "/confirmPurchase", other, `{"order_id": "x", "payment_method_id": "`+visa.ID+`"}`); rr.Code != http.StatusNotFound {
+				t.Errorf("paying with the card of another user returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+			}
+			if rr := testHelperDo(t, s, "POST", "/confirmPurchase", customer, `{"payment_method_id": "`+visa.ID+`"}`); rr.Code != http.StatusBadRequest {
+				t.Errorf("confirming without an order returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+			}
+
+			if method := methodOf(testHelperDo(t, s, "POST", "/paymentMethods/"+mastercard.ID+"/default", customer, ""), http.StatusOK); !method.Default {
+				t.Errorf("expected the mastercard to be the default card, got %+v", method)
+			}
+			if rr := testHelperDo(t, s, "DELETE", "/paymentMethods/"+mastercard.ID, customer, ""); rr.Code != http.StatusOK {
+				t.Errorf("deleting a card returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+			}
+			if rr := testHelperDo(t, s, "DELETE", "/paymentMethods/"+mastercard.ID, customer, ""); rr.Code != http.StatusNotFound {
+				t.Errorf("deleting a card twice returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+			}
+			if order := confirm("item-3", ""); order.Authorization.Card.Last4 != "4242" {
+				t.Errorf("expected the visa to be the default card again, got %+v", order.Authorization.Card)
+			}
+			if calls := gateway.Calls(payments.OpAuthorize); calls != 3 {
+				t.Errorf("expected 3 authorizations, got %d", calls)
+			}
+		})
+	}
+}
+
+func TestPaymentMethodsOutliveRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bookstore.db")
+	start := func() *Server {
+		t.Helper()
+		st, err := openStores("sqlite", path)
+		if err != nil {
+			t.Fatal(err, "unable to open stores")
+		}
+		vault, err := payments.OpenVault(st.cards, []byte("vault-secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := newServer(st, serverOptions{vault: vault})
+		s.init("")
+		return s
+	}
+
+	s := start()
+	customer := testHelperLogin(t, s, "testuser", "testuser")
+	rr := testHelperDo(t, s, "POST", "/paymentMethods", customer, `{"credit_card_details": `+testCard+`}`)
+	var method entities.PaymentMethod
+	if err := json.Unmarshal(rr.Body.Bytes(), &method); err != nil || rr.Code != http.StatusCreated {
+		t.Fatalf("saving a card returned %v: %s", rr.Code, rr.Body.String())
+	}
+	if err := s.closeStores(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = start()
+	t.Cleanup(func() { s.closeStores() })
+	customer = testHelperLogin(t, s, "testuser", "testuser")
+	testHelperDo(t, s, "POST", "/addToCart", customer, `{"sku": "item-1", "quantity": 1}`)
+	var order entities.Order
+	json.Unmarshal(testHelperDo(t, s, "POST", "/checkout", customer, "").Body.Bytes(), &order)
+	rr = testHelperDo(t, s, "POST", "/confirmPurchase", customer, `{"order_id": "`+order.ID+`", "payment_method_id": "`+method.ID+`"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("paying with a card saved before the restart returned wrong status code: got %v want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	json.Unmarshal(rr.Body.Bytes(), &order)
+	if order.Authorization == nil || order.Authorization.Card.Last4 != "4242" {
+		t.Errorf("expected the order to be paid with the saved card, got %+v", order.Authorization)
+	}
+	// the same card keeps its token
+	var card entities.PaymentCard
+	json.Unmarshal(testHelperDo(t, s, "POST", "/cards", customer, testCard).Body.Bytes(), &card)
+	if card.Token != method.Token {
+		t.Errorf("expected the card to keep its token %s, got %s", method.Token, card.Token)
+	}
+}
+
+func TestPaymentProviders(t *testing.T) {
+	for _, backend := range []string{"memory", "sqlite"} {
+		t.Run(backend, func(t *testing.T) {
+			st, err := openStores(backend, filepath.Join(t.TempDir(), "bookstore.db"))
+			if err != nil {
+				t.Fatal(err, "unable to open stores")
+			}
+			t.Cleanup(func() { st.close() })
+			primary, backup := payments.NewFakeGateway(), payments.NewFakeGateway()
+			router := payments.NewRouter()
+			if err := router.Register("primary", primary); err != nil {
+				t.Fatal(err)
+			}
+			if err := router.Register("backup", backup); err != nil {
+				t.Fatal(err)
+			}
+			s := newServer(st, serverOptions{paymentGateway: router})
+			s.init("")
+			admin := testHelperLoginWithRoles(t, s, "providers-admin", entities.RoleAdmin)
+			customer := testHelperLogin(t, s, "testuser", "testuser")
+
+			testHelperDo(t, s, "POST", "/addToCart", customer, `{"sku": "item-1", "quantity": 1}`)
+			rr := testHelperDo(t, s, "POST", "/checkout", customer, "")
+			var order entities.Order
+			if err := json.Unmarshal(rr.Body.Bytes(), &order); err != nil {
+				t.Fatalf("failed to parse JSON response: %v", err)
+			}
+			primary.Script(payments.OpAuthorize, payments.Unavailable())
+			rr = testHelperDo(t, s, "POST", "/confirmPurchase", customer, `{"order_id": "`+order.ID+`", "credit_card_details": `+testCard+`}`)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("confirm purchase returned wrong status code: got %v want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &order); err != nil {
+				t.Fatalf("failed to parse JSON response: %v", err)
+			}
+			if order.Authorization == nil || !strings.HasPrefix(order.Authorization.ID, "backup:") {
+				t.Fatalf("expected the backup to authorize the order, got %+v", order.Authorization)
+			}
+			if rr := testHelperDo(t, s, "POST", "/admin/orders/"+order.ID+"/capture", admin, ""); rr.Code != http.StatusOK {
+				t.Errorf("capture returned wrong status code: got %v want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+			}
+			if auth, _ := backup.Authorization(strings.TrimPrefix(order.Authorization.ID, "backup:")); auth.Captured != order.Authorization.Amount {
+				t.Errorf("expected the backup to capture the order, got %+v", auth)
+			}
+
+			if rr := testHelperDo(t, s, "GET", "/admin/payments/providers", customer, ""); rr.Code != http.StatusForbidden {
+				t.Errorf("providers as a customer returned wrong status code: got %v want %v", rr.Code, http.StatusForbidden)
+			}
+			rr = testHelperDo(t, s, "GET", "/admin/payments/providers", admin, "")
+			var response struct {
+				Providers []payments.ProviderHealth `json:"providers"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+				t.Fatalf("failed to parse JSON response: %v", err)
+			}
+			if len(response.Providers) != 2 || response.Providers[0].Failures != 1 || response.Providers[1].Calls != 2 {
+				t.Errorf("expected the failure of the primary and the calls of the backup, got %+v", response.Providers)
+			}
+		})
+	}
+}
+
+func TestPaymentResilience(t *testing.T) {
+	for _, backend := range []string{"memory", "sqlite"} {
+		t.Run(backend, func(t *testing.T) {
+			st, err := openStores(backend, filepath.Join(t.TempDir(), "bookstore.db"))
+			if err != nil {
+				t.Fatal(err, "unable to open stores")
+			}
+			t.Cleanup(func() { st.close() })
+			gateway := payments.NewFakeGateway()
+			policy := payments.ResiliencePolicy{CallTimeout: 20 * time.Millisecond, MaxAttempts: 3, BaseBackoff: time.Millisecond, FailureThreshold: 3, OpenDuration: time.Minute}
+			s := newServer(st, serverOptions{paymentGateway: payments.NewResilient(gateway, policy)})
+			s.init("")
+			customer := testHelperLogin(t, s, "testuser", "testuser")
+
+			type paymentError struct {
+				Error     string `json:"error"`
+				Code      string `json:"code"`
+				Retryable bool   `json:"retryable"`
+			}
+			confirm := func(sku string, want int) (*httptest.ResponseRecorder, paymentError) {
+				t.Helper()
+				testHelperDo(t, s, "POST", "/addToCart", customer, `{"sku": "`+sku+`", "quantity": 1}`)
+				var order entities.Order
+				if err := json.Unmarshal(testHelperDo(t, s, "POST", "/checkout", customer, "").Body.Bytes(), &order); err != nil {
+					t.Fatalf("failed to parse JSON response: %v", err)
+				}
+				rr := testHelperDo(t, s, "POST", "/confirmPurchase", customer, `{"order_id": "`+order.ID+`", "credit_card_details": `+testCard+`}`)
+				if rr.Code != want {
+					t.Fatalf("confirm purchase returned wrong status code: got %v want %v: %s", rr.Code, want, rr.Body.String())
+				}
+				var response paymentError
+				json.Unmarshal(rr.Body.Bytes(), &response)
+				return rr, response
+			}
+
+			gateway.Script(payments.OpAuthorize, payments.Unavailable(), payments.Hang())
+			confirm("item-1", http.StatusOK)
+			if calls := gateway.Calls(payments.OpAuthorize); calls != 3 {
+				t.Errorf("expected the authorization to be retried twice, got %d calls", calls)
+			}
+
+			gateway.Script(payments.OpAuthorize, payments.Decline("insufficient funds"))
+			if _, response := confirm("item-2", http.StatusPaymentRequired); response.Code != "payment_declined" || response.Retryable {
+				t.Errorf("expected a decline not to be retryable, got %+v", response)
+			}
+
+			gateway.Script(payments.OpAuthorize, payments.Hang(), payments.Hang(), payments.Hang())
+			if _, response := confirm("item-3", http.StatusGatewayTimeout); response.Code != "payment_timeout" || !response.Retryable {
+				t.Errorf("expected a timeout to be retryable, got %+v", response)
+			}
+			rr, response := confirm("item-3", http.StatusServiceUnavailable)
+			if response.Code != "payment_unavailable" || !response.Retryable || rr.Header().Get("Retry-After") != "60" {
+				t.Errorf("expected the open circuit to answer with a delay, got %+v and Retry-After %q", response, rr.Header().Get("Retry-After"))
+			}
+			if calls := gateway.Calls(payments.OpAuthorize); calls != 7 {
+				t.Errorf("expected the open circuit not to call the gateway, got %d calls", calls)
+			}
+		})
+	}
+}
+
+func TestPaymentWebhooks(t *testing.T) {
+	for _, backend := range []string{"memory", "sqlite"} {
+		t.Run(backend, func(t *testing.T) {
+			ctx := context.Background()
+			st, err := openStores(backend, filepath.Join(t.TempDir(), "bookstore.db"))
+			if err != nil {
+				t.Fatal(err, "unable to open stores")
+			}
+			t.Cleanup(func() { st.close() })
+			gateway := payments.NewFakeGateway()
+			s := newServer(st, serverOptions{paymentGateway: gateway})
+			s.gatewayWebhookSecret = "whsec_test"
+			s.init("")
+			ts := httptest.NewServer(s.server.Handler)
+			t.Cleanup(ts.Close)
+			url := ts.URL + "/webhooks/payments/" + GATEWAY_WEBHOOK_PROVIDER
+			simulator := payments.NewWebhookSimulator("whsec_test")
+			staff := testHelperLoginWithRoles(t, s, "webhooks-admin", entities.RoleStaff)
+			customer := testHelperLogin(t, s, "testuser", "testuser")
+
+			send := func(event payments.WebhookEvent, want int) {
+				t.Helper()
+				if status, err := simulator.Send(ctx, url, event); err != nil || status != want {
+					t.Fatalf("webhook %s returned wrong status code: got %v want %v (%v)", event.Type, status, want, err)
+				}
+			}
+			stored := func(orderID string) entities.Order {
+				t.Helper()
+				order, err := st.store.GetOrder(ctx, orderID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return order
+			}
+			checkout := func(sku string) entities.Order {
+				t.Helper()
+				testHelperDo(t, s, "POST", "/addToCart", customer, `{"sku": "`+sku+`", "quantity": 1}`)
+				var order entities.Order
+				if err := json.Unmarshal(testHelperDo(t, s, "POST", "/checkout", customer, "").Body.Bytes(), &order); err != nil {
+					t.Fatalf("failed to parse JSON response: %v", err)
+				}
+				return order
+			}
+
+			// the gateway authorized the payment after the purchase timed out
+			order := checkout("item-1")
+			gateway.Script(payments.OpAuthorize, payments.Timeout())
+			confirm := `{"order_id": "` + order.ID + `", "credit_card_details": ` + testCard + `}`
+			if rr := testHelperDo(t, s, "POST", "/confirmPurchase", customer, confirm); rr.Code != http.StatusGatewayTimeout {
+				t.Fatalf("confirm purchase returned wrong status code: got %v want %v", rr.Code, http.StatusGatewayTimeout)
+			}
+			late, err := gateway.Authorize(ctx, payments.PaymentRequest{ID: order.ID, Amount: order.AmountDue})
+			if err != nil {
+				t.Fatal(err)
+			}
+			succeeded := simulator.Event(payments.EventPaymentSucceeded, order.ID, late.ID, late.Amount)
+			send(succeeded, http.StatusOK)
+			if order = stored(order.ID); order.CurrentStatus() != entities.OrderStatusAuthorized || order.Authorization.ID != late.ID {
+				t.Fatalf("expected the late authorization to be recorded, got %s and %+v", order.CurrentStatus(), order.Authorization)
+			}
+			req, err := simulator.Request(url, succeeded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := ts.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || resp.Header.Get(HEADER_IDEMPOTENT_REPLAYED) != "true" {
+				t.Errorf("expected the event sent again to be replayed, got %v", resp.StatusCode)
+			}
+			// another authorization of an authorized order is released
+			other, _ := gateway.Authorize(ctx, payments.PaymentRequest{ID: order.ID, Amount: order.AmountDue})
+			send(simulator.Event(payments.EventPaymentSucceeded, order.ID, other.ID, other.Amount), http.StatusOK)
+			if auth, _ := gateway.Authorization(other.ID); !auth.Voided {
+				t.Errorf("expected the other authorization to be voided, got %+v", auth)
+			}
+
+			// refunds made at the provider and disputes
+			if rr := testHelperDo(t, s, "POST", "/admin/orders/"+order.ID+"/capture", staff, ""); rr.Code != http.StatusOK {
+				t.Fatalf("capture returned wrong status code: got %v want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+			}
+			refunded := simulator.Event(payments.EventPaymentRefunded, order.ID, late.ID, entities.NewMoney(500, "USD"))
+			send(refunded, http.StatusOK)
+			refunded.ID = "evt-resent"
+			send(refunded, http.StatusOK)
+			send(simulator.Event(payments.EventPaymentDisputed, order.ID, late.ID, entities.NewMoney(1000, "USD")), http.StatusOK)
+			order = stored(order.ID)
+			if order.TotalRefunded != entities.NewMoney(500, "USD") || len(order.Refunds) != 1 || order.Refunds[0].Confirmation != refunded.RefundID {
+				t.Errorf("expected the refund to be recorded once, got %s and %+v", order.TotalRefunded, order.Refunds)
+			}
+			if len(order.Disputes) != 1 || order.Disputes[0].Amount != entities.NewMoney(1000, "USD") {
+				t.Errorf("expected the dispute to be recorded, got %+v", order.Disputes)
+			}
+
+			// a reversed authorization cancels its order
+			stock, _ := st.store.GetStock(ctx, "item-2")
+			reversed := checkout("item-2")
+			rr := testHelperDo(t, s, "POST", "/confirmPurchase", customer, `{"order_id": "`+reversed.ID+`", "credit_card_details": `+testCard+`}`)
+			if err := json.Unmarshal(rr.Body.Bytes(), &reversed); err != nil {
+				t.Fatalf("failed to parse JSON response: %v", err)
+			}
+			send(simulator.Event(payments.EventPaymentFailed, reversed.ID, "auth-unknown", reversed.AmountDue), http.StatusOK)
+			if stored := stored(reversed.ID); stored.CurrentStatus() != entities.OrderStatusAuthorized {
+				t.Errorf("expected the failure of another authorization to be ignored, got %s", stored.CurrentStatus())
+			}
+			send(simulator.Event(payments.EventPaymentFailed, reversed.ID, reversed.Authorization.ID, reversed.AmountDue), http.StatusOK)
+			if stored := stored(reversed.ID); stored.CurrentStatus() != entities.OrderStatusCancelled {
+				t.Errorf("expected the order to be cancelled, got %s", stored.CurrentStatus())
+			}
+			if after, _ := st.store.GetStock(ctx, "item-2"); after != stock {
+				t.Errorf("expected the order to be restocked, got %d want %d", after, stock)
+			}
+
+			// unsigned webhooks and unknown orders and providers
+			forged := payments.NewWebhookSimulator("whsec_forged")
+			if status, _ := forged.Send(ctx, url, forged.Event(payments.EventPaymentFailed, order.ID, late.ID, late.Amount)); status != http.StatusUnauthorized {
+				t.Errorf("forged webhook returned wrong status code: got %v want %v", status, http.StatusUnauthorized)
+			}
+			send(simulator.Event(payments.EventPaymentSucceeded, "order-unknown", late.ID, late.Amount), http.StatusNotFound)
+			if status, _ := simulator.Send(ctx, ts.URL+"/webhooks/payments/other", simulator.Event(payments.EventPaymentFailed, order.ID, late.ID, late.Amount)); status != http.StatusNotFound {
+				t.Errorf("webhook of an unknown provider returned wrong status code: got %v want %v", status, http.StatusNotFound)
+			}
+		})
+	}
+}
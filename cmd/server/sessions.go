@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+	"github.com/gorilla/mux"
+)
+
+// refreshHandler issues new tokens for a session in exchange for its refresh token
+func (s *Server) refreshHandler(w http.ResponseWriter, r *http.Request) {
+	var req entities.RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		writeError(w, "Invalid request with one or more missing parameters", http.StatusBadRequest)
+		return
+	}
+
+	tokens, err := s.sessions.RefreshSession(req.RefreshToken)
+	if err != nil {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// ListSessions lists the active sessions of the user, flagging the one making the request
+func (s *Server) ListSessions(w http.ResponseWriter, r *http.Request) {
+	current, ok := s.sessions.GetSession(getTokenFromRequest(r))
+	if !ok {
+		writeError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	sessions, err := s.sessions.ListSessions(current.UserID)
+	if err != nil {
+		writeServiceError(w, "Failed to list sessions", err)
+		return
+	}
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == current.ID
+	}
+	response := struct {
+		Sessions []entities.Session `json:"sessions"`
+	}{Sessions: sessions}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// RevokeSession ends a session of the user, e.g. one on a lost device
+func (s *Server) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	userID, shouldReturn := s.validateRequest(r, w)
+	if shouldReturn {
+		return
+	}
+
+	if err := s.sessions.RevokeSession(userID, mux.Vars(r)["sessionID"]); err != nil {
+		writeServiceError(w, "Failed to revoke session", err)
+		return
+	}
+	response := struct {
+		Message string `json:"message"`
+	}{Message: "Session revoked"}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// logoutEverywhereHandler ends all the sessions of the user
+func (s *Server) logoutEverywhereHandler(w http.ResponseWriter, r *http.Request) {
+	userID, shouldReturn := s.validateRequest(r, w)
+	if shouldReturn {
+		return
+	}
+
+	// Give the stock held by the cart back to other users
+	if err := s.service.ReleaseCart(r.Context(), userID); err != nil {
+		log.Printf("Unable to release the cart of %s: %s\n", userID, err)
+	}
+	revoked, err := s.sessions.RevokeAllSessions(userID)
+	if err != nil {
+		writeServiceError(w, "Failed to log out", err)
+		return
+	}
+	response := struct {
+		Message  string `json:"message"`
+		Sessions int    `json:"sessions"`
+	}{Message: "Logged out everywhere", Sessions: revoked}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// runSessionSweeper forgets the expired sessions every interval until the context is done
+func (s *Server) runSessionSweeper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := s.sessions.RemoveExpiredSessions(); err != nil {
+				log.Printf("Unable to remove expired sessions: %s\n", err)
+			}
+		}
+	}
+}
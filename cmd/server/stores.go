@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+	"github.com/13thuser/bookstore/datastore"
+	"github.com/13thuser/bookstore/datastore/sqlite"
+)
+
+// stores groups the repositories backing the server
+type stores struct {
+	store    datastore.Store
+	users    datastore.UserRepository
+	sessions datastore.SessionRepository
+	// idempotency stores the responses to the requests made with an idempotency key
+	idempotency datastore.IdempotencyRepository
+	// cards keeps the cards of the tokens of the vault
+	cards datastore.CardVaultRepository
+	close func() error
+}
+
+// newMemoryStores creates in-memory stores, lost when the server stops
+func newMemoryStores() stores {
+	return stores{
+		store:       datastore.NewDatastore(),
+		users:       datastore.NewUserStore(),
+		sessions:    datastore.NewSessionStore(),
+		idempotency: datastore.NewIdempotencyStore(),
+		cards:       datastore.NewCardVaultStore(),
+		close:       func() error { return nil },
+	}
+}
+
+// openStores opens the stores of the given backend, sqlitePath is only used by the sqlite backend
+func openStores(backend string, sqlitePath string) (stores, error) {
+	st, err := openBackend(backend, sqlitePath)
+	if err != nil {
+		return stores{}, err
+	}
+	if err := seedAdmin(st.users); err != nil {
+		st.close()
+		return stores{}, err
+	}
+	st.store.SetReservationTTL(CART_RESERVATION_TTL)
+	st.sessions.SetSessionPolicy(datastore.SessionPolicy{
+		AccessTTL:       SESSION_ACCESS_TTL,
+		IdleTimeout:     SESSION_IDLE_TIMEOUT,
+		AbsoluteTimeout: SESSION_ABSOLUTE_TIMEOUT,
+	})
+	return st, nil
+}
+
+// openBackend opens the stores of the given backend with their default settings
+func openBackend(backend string, sqlitePath string) (stores, error) {
+	switch backend {
+	case "memory":
+		return newMemoryStores(), nil
+	case "sqlite":
+		db, err := sqlite.Open(sqlitePath)
+		if err != nil {
+			return stores{}, err
+		}
+		if err := seedSQLite(db); err != nil {
+			db.Close()
+			return stores{}, err
+		}
+		return stores{store: db, users: db, sessions: db, idempotency: db, cards: db, close: db.Close}, nil
+	default:
+		return stores{}, fmt.Errorf("unknown datastore backend %q", backend)
+	}
+}
+
+// seedSQLite seeds a freshly created database with the same data as the in-memory stores
+// TODO: Remove this
+func seedSQLite(db *sqlite.Store) error {
+	ctx := context.Background()
+	items, err := db.ListItems(ctx)
+	if err != nil {
+		return err
+	}
+	if len(items) > 0 {
+		return nil
+	}
+	return datastore.SeedItems(ctx, db)
+}
+
+// seedAdmin creates the first administrator with ADMIN_PASSWORD, or admin/admin
+// in development mode, unless it already exists
+func seedAdmin(users datastore.UserRepository) error {
+	password := ADMIN_PASSWORD
+	if password == "" {
+		if !DEV_MODE {
+			return nil
+		}
+		password = ADMIN_USER
+	} else if err := entities.ValidatePassword(ADMIN_USER, password); err != nil {
+		return fmt.Errorf("invalid ADMIN_PASSWORD: %w", err)
+	}
+	return datastore.SeedAdmin(users, ADMIN_USER, password)
+}
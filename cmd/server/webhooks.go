@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/13thuser/bookstore/payments"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// GATEWAY_WEBHOOK_PROVIDER names the payment gateway in the webhook URL when the providers are not routed
+	GATEWAY_WEBHOOK_PROVIDER = "gateway"
+	// maxWebhookSize is the size of the largest webhook body accepted
+	maxWebhookSize = 1 << 20
+)
+
+// PaymentWebhook receives the events a payment provider sends about its
+// payments, signed with its webhook secret, and updates their orders. Each
+// event is applied once: the provider sending it again gets the first answer.
+// The events that do not apply to their order as it stands are acknowledged
+// and logged, so that the provider does not send them again.
+func (s *Server) PaymentWebhook(w http.ResponseWriter, r *http.Request) {
+	provider := mux.Vars(r)["provider"]
+	secret := s.webhookSecret(provider)
+	if secret == "" {
+		writeError(w, fmt.Sprintf("No webhooks from payment provider %q", provider), http.StatusNotFound)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookSize))
+	if err != nil {
+		writeImportReadError(w, "Failed to read the request body", err)
+		return
+	}
+	event, err := payments.ParseWebhook(secret, r.Header.Get(payments.WebhookSignatureHeader), body, time.Now())
+	if err != nil {
+		writeServiceError(w, "Invalid webhook", err)
+		return
+	}
+	if s.paymentProviders != nil {
+		// the orders keep the IDs of the router
+		event.AuthorizationID = s.paymentProviders.ProviderID(provider, event.AuthorizationID)
+		if event.RefundID != "" {
+			event.RefundID = s.paymentProviders.ProviderID(provider, event.RefundID)
+		}
+	}
+
+	s.processOnce(w, r, body, "webhook:"+provider, event.ID, "event ID", func(w http.ResponseWriter, r *http.Request) {
+		message := "Event processed"
+		if _, err := s.service.ApplyPaymentEvent(r.Context(), event); err != nil {
+			status := statusForError(err)
+			if !errors.Is(err, payments.ErrEventIgnored) && status != http.StatusConflict && status != http.StatusBadRequest {
+				writeServiceError(w, "Failed to process event", err)
+				return
+			}
+			log.Printf("Payment event %s of %s ignored: %s\n", event.ID, provider, err)
+			message = fmt.Sprintf("Event ignored: %s", err)
+		}
+		response := struct {
+			Message string `json:"message"`
+		}{Message: message}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(response)
+	})
+}
+
+// webhookSecret returns the secret signing the webhooks of the payment
+// provider, empty when the provider sends none
+func (s *Server) webhookSecret(provider string) string {
+	if s.paymentProviders != nil {
+		return s.paymentProviders.WebhookSecret(provider)
+	}
+	if provider == GATEWAY_WEBHOOK_PROVIDER {
+		return s.gatewayWebhookSecret
+	}
+	return ""
+}
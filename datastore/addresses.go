@@ -0,0 +1,94 @@
+package datastore
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+)
+
+// NewAddressID creates a new ID for an address of an address book
+func NewAddressID() (string, error) {
+	id, err := newID()
+	if err != nil {
+		return "", fmt.Errorf("unable to create new address id")
+	}
+	return id, nil
+}
+
+// newID creates a new random ID, short enough to be typed in a URL
+func newID() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// CreateAddress adds an address to the address book of the user and returns it with its new ID
+func (ds *Datastore) CreateAddress(ctx context.Context, userID UserID, address entities.Address) (entities.SavedAddress, error) {
+	id, err := NewAddressID()
+	if err != nil {
+		return entities.SavedAddress{}, err
+	}
+	saved := entities.SavedAddress{ID: id, Address: address}
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.addresses[userID] = append(ds.addresses[userID], saved)
+	return saved, nil
+}
+
+// UpdateAddress replaces an address of the address book of the user
+func (ds *Datastore) UpdateAddress(ctx context.Context, userID UserID, address entities.SavedAddress) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	i, err := ds.findAddress(userID, address.ID)
+	if err != nil {
+		return err
+	}
+	ds.addresses[userID][i] = address
+	return nil
+}
+
+// DeleteAddress removes an address from the address book of the user
+func (ds *Datastore) DeleteAddress(ctx context.Context, userID UserID, addressID string) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	i, err := ds.findAddress(userID, addressID)
+	if err != nil {
+		return err
+	}
+	addresses := ds.addresses[userID]
+	ds.addresses[userID] = append(addresses[:i:i], addresses[i+1:]...)
+	return nil
+}
+
+// GetAddress gets an address of the address book of the user by its ID
+func (ds *Datastore) GetAddress(ctx context.Context, userID UserID, addressID string) (entities.SavedAddress, error) {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	i, err := ds.findAddress(userID, addressID)
+	if err != nil {
+		return entities.SavedAddress{}, err
+	}
+	return ds.addresses[userID][i], nil
+}
+
+// ListAddresses lists the address book of the user, oldest first
+func (ds *Datastore) ListAddresses(ctx context.Context, userID UserID) ([]entities.SavedAddress, error) {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	return append([]entities.SavedAddress{}, ds.addresses[userID]...), nil
+}
+
+// findAddress returns the index of an address in the address book of the user; mu must be held
+func (ds *Datastore) findAddress(userID UserID, addressID string) (int, error) {
+	for i, address := range ds.addresses[userID] {
+		if address.ID == addressID {
+			return i, nil
+		}
+	}
+	return 0, ErrAddressNotFound
+}
@@ -0,0 +1,61 @@
+package datastore_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+	"github.com/13thuser/bookstore/datastore"
+)
+
+func TestAddressBook(t *testing.T) {
+	ctx := context.Background()
+	for backend, store := range testHelperStores(t) {
+		t.Run(backend, func(t *testing.T) {
+			home, err := store.CreateAddress(ctx, "user", entities.Address{Name: "Home", Line1: "1 Main St", City: "Portland", Country: "US"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			work, err := store.CreateAddress(ctx, "user", entities.Address{Name: "Work", Line1: "2 Market St", City: "Seattle", Country: "US"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if home.ID == "" || home.ID == work.ID {
+				t.Fatalf("expected distinct address ids, got %q and %q", home.ID, work.ID)
+			}
+
+			addresses, err := store.ListAddresses(ctx, "user")
+			if err != nil || len(addresses) != 2 || addresses[0] != home || addresses[1] != work {
+				t.Fatalf("expected both addresses oldest first, got %+v (%v)", addresses, err)
+			}
+			if others, _ := store.ListAddresses(ctx, "other"); len(others) != 0 {
+				t.Errorf("expected an empty address book for another user, got %+v", others)
+			}
+			if _, err := store.GetAddress(ctx, "other", home.ID); !errors.Is(err, datastore.ErrAddressNotFound) {
+				t.Errorf("expected the address of another user to be not found, got %v", err)
+			}
+
+			home.City = "Salem"
+			if err := store.UpdateAddress(ctx, "user", home); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := store.GetAddress(ctx, "user", home.ID); err != nil || got != home {
+				t.Errorf("expected the updated address, got %+v (%v)", got, err)
+			}
+			if err := store.UpdateAddress(ctx, "other", home); !errors.Is(err, datastore.ErrAddressNotFound) {
+				t.Errorf("expected updating the address of another user to fail, got %v", err)
+			}
+
+			if err := store.DeleteAddress(ctx, "user", home.ID); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.DeleteAddress(ctx, "user", home.ID); !errors.Is(err, datastore.ErrAddressNotFound) {
+				t.Errorf("expected deleting twice to fail, got %v", err)
+			}
+			if addresses, _ := store.ListAddresses(ctx, "user"); len(addresses) != 1 || addresses[0] != work {
+				t.Errorf("expected the work address only, got %+v", addresses)
+			}
+		})
+	}
+}
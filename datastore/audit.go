@@ -0,0 +1,28 @@
+package datastore
+
+import (
+	"context"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+)
+
+// RecordCatalogChange appends a change to the audit trail of the catalog
+func (ds *Datastore) RecordCatalogChange(ctx context.Context, change entities.CatalogChange) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.catalogChanges = append(ds.catalogChanges, change)
+	return nil
+}
+
+// ListCatalogChanges lists the changes made to an item, oldest first
+func (ds *Datastore) ListCatalogChanges(ctx context.Context, sku SKU) ([]entities.CatalogChange, error) {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	changes := make([]entities.CatalogChange, 0)
+	for _, change := range ds.catalogChanges {
+		if change.SKU == sku {
+			changes = append(changes, change)
+		}
+	}
+	return changes, nil
+}
@@ -5,6 +5,9 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"fmt"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/13thuser/bookstore/bookstore/entities"
 )
@@ -19,42 +22,164 @@ type Cart = entities.Cart
 type ItemWithQty = entities.ItemWithQty
 type ItemQuantity = int
 type Order = entities.Order
+type Money = entities.Money
 
 // Datastore defines the structure of the datastore
+//
+// Locking: a user's cart is guarded by that user's cart lock, everything else
+// (items, inventory, reservations and orders) by mu. When both are needed the
+// cart lock is always taken first.
 type Datastore struct {
-	inventory map[SKU]ItemQuantity
-	items     map[SKU]Item
-	orders    map[UserID][]*Order
+	mu             sync.RWMutex
+	inventory      map[SKU]ItemQuantity
+	items          map[SKU]Item
+	orders         map[UserID][]*Order
+	reservations   map[SKU]map[UserID]reservation
+	reservationTTL time.Duration
+	catalogChanges []entities.CatalogChange
+	promotions     map[string]entities.Promotion
+	addresses      map[UserID][]entities.SavedAddress
+	paymentMethods map[UserID][]entities.PaymentMethod
+	// index is the search index of the items, kept in sync under mu
+	index *SearchIndex
+
+	cartsMu   sync.Mutex
 	carts     map[UserID]*Cart
+	cartLocks map[UserID]*sync.Mutex
 }
 
 // NewDatastore creates a new datastore
 func NewDatastore() *Datastore {
 	db := &Datastore{
-		inventory: make(map[SKU]ItemQuantity),
-		items:     make(map[SKU]Item),
-		orders:    make(map[UserID][]*Order),
-		carts:     make(map[UserID]*Cart),
+		inventory:      make(map[SKU]ItemQuantity),
+		items:          make(map[SKU]Item),
+		orders:         make(map[UserID][]*Order),
+		promotions:     make(map[string]entities.Promotion),
+		addresses:      make(map[UserID][]entities.SavedAddress),
+		paymentMethods: make(map[UserID][]entities.PaymentMethod),
+		carts:          make(map[UserID]*Cart),
+		cartLocks:      make(map[UserID]*sync.Mutex),
+
+		reservations:   make(map[SKU]map[UserID]reservation),
+		reservationTTL: DefaultReservationTTL,
+		index:          NewSearchIndex(),
 	}
 	// TODO: Remove this
 	db.seedItemData()
 	return db
 }
 
+// lockCart acquires the cart lock of the user and returns the user's cart,
+// creating an empty one if needed. The returned function releases the lock.
+func (ds *Datastore) lockCart(userID UserID) (*Cart, func()) {
+	ds.cartsMu.Lock()
+	lock, ok := ds.cartLocks[userID]
+	if !ok {
+		lock = &sync.Mutex{}
+		ds.cartLocks[userID] = lock
+	}
+	ds.cartsMu.Unlock()
+
+	lock.Lock()
+	ds.cartsMu.Lock()
+	cart, ok := ds.carts[userID]
+	if !ok {
+		cart = entities.NewCart(userID)
+		ds.carts[userID] = cart
+	}
+	ds.cartsMu.Unlock()
+	return cart, lock.Unlock
+}
+
+// resetCart replaces the cart of the user with an empty one; the caller must hold the cart lock
+func (ds *Datastore) resetCart(userID UserID) {
+	ds.cartsMu.Lock()
+	defer ds.cartsMu.Unlock()
+	ds.carts[userID] = entities.NewCart(userID)
+}
+
 // AddItem adds an item to the datastore
 func (ds *Datastore) AddItem(ctx context.Context, item Item, quantity int) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
 	// If no item exists, add the item to the inventory
 	if _, ok := ds.items[item.SKU]; !ok {
-		ds.items[item.SKU] = item
+		ds.putItem(stampCreatedAt(item))
 	}
 	ds.inventory[item.SKU] += quantity
 	return nil
 }
 
+// CreateItem adds a new item to the datastore, failing if the SKU is already taken
+func (ds *Datastore) CreateItem(ctx context.Context, item Item, quantity int) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if _, ok := ds.items[item.SKU]; ok {
+		return ErrItemExists
+	}
+	ds.putItem(stampCreatedAt(item))
+	ds.inventory[item.SKU] = quantity
+	return nil
+}
+
+// putItem stores and indexes the new version of an item; the caller must hold mu
+func (ds *Datastore) putItem(item Item) {
+	ds.items[item.SKU] = item
+	ds.index.Put(item)
+}
+
+// stampCreatedAt sets when an item being added to the catalog was created, unless it is already known
+func stampCreatedAt(item Item) Item {
+	if item.CreatedAt.IsZero() {
+		item.CreatedAt = time.Now().UTC()
+	}
+	return item
+}
+
+// UpdateItem replaces the details of an existing item and returns its previous version
+func (ds *Datastore) UpdateItem(ctx context.Context, item Item) (Item, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	previous, ok := ds.items[item.SKU]
+	if !ok {
+		return Item{}, ErrItemNotFound
+	}
+	item.Retired = previous.Retired
+	item.CreatedAt = previous.CreatedAt
+	ds.putItem(item)
+	return previous, nil
+}
+
+// RetireItem marks an item as no longer sold and returns it
+func (ds *Datastore) RetireItem(ctx context.Context, sku SKU) (Item, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	item, ok := ds.items[sku]
+	if !ok {
+		return Item{}, ErrItemNotFound
+	}
+	item.Retired = true
+	ds.putItem(item)
+	return item, nil
+}
+
+// AddStock adds quantity units of the item to the stock and returns the new stock
+func (ds *Datastore) AddStock(ctx context.Context, sku SKU, quantity int) (int, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if _, ok := ds.items[sku]; !ok {
+		return 0, ErrItemNotFound
+	}
+	ds.inventory[sku] += quantity
+	return ds.inventory[sku], nil
+}
+
 // RemoveItem removes an item from the datastore
 func (ds *Datastore) RemoveItem(ctx context.Context, item Item, quantity int) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
 	if _, ok := ds.items[item.SKU]; !ok {
-		return fmt.Errorf("item not found in the datastore")
+		return ErrItemNotFound
 	}
 	if ds.inventory[item.SKU] < quantity {
 		return fmt.Errorf("insufficient stock")
@@ -63,8 +188,20 @@ func (ds *Datastore) RemoveItem(ctx context.Context, item Item, quantity int) er
 	return nil
 }
 
+// GetStock retrieves the number of units in stock for the item
+func (ds *Datastore) GetStock(ctx context.Context, sku SKU) (int, error) {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	if _, ok := ds.items[sku]; !ok {
+		return 0, ErrItemNotFound
+	}
+	return ds.inventory[sku], nil
+}
+
 // ListItems lists all the items from the datastore
 func (ds *Datastore) ListItems(ctx context.Context) ([]Item, error) {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
 	var items []Item
 	for _, item := range ds.items {
 		items = append(items, item)
@@ -72,73 +209,106 @@ func (ds *Datastore) ListItems(ctx context.Context) ([]Item, error) {
 	return items, nil
 }
 
+// SearchItems searches the items of the catalog that are still sold
+func (ds *Datastore) SearchItems(ctx context.Context, query entities.ItemQuery) (entities.ItemPage, error) {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	now := time.Now()
+	items := make([]entities.ItemWithStock, 0, len(ds.items))
+	for sku, item := range ds.items {
+		inStock := ds.inventory[sku]
+		reserved := ds.reservedStock(sku, "", now)
+		items = append(items, entities.NewItemWithStock(item, inStock, reserved))
+	}
+	return SearchCatalog(ds.index, items, query)
+}
+
 // GetItem retrieves an item from the datastore based on the item ID
 func (ds *Datastore) GetItem(ctx context.Context, id string) (Item, error) {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
 	if item, ok := ds.items[id]; ok {
 		return item, nil
 	}
-	return Item{}, fmt.Errorf("item not found in the datastore")
+	return Item{}, ErrItemNotFound
 }
 
 // AddToCart adds an item to the cart in the datastore
+// The units in the cart are reserved so other carts cannot claim them until
+// the reservation expires or the cart is checked out.
 func (ds *Datastore) AddToCart(ctx context.Context, userID string, itemID string, quantity int) (Cart, error) {
-	if _, ok := ds.carts[userID]; !ok {
-		ds.carts[userID] = entities.NewCart(userID)
+	cart, unlock := ds.lockCart(userID)
+	defer unlock()
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	item, ok := ds.items[itemID]
+	if !ok {
+		return Cart{}, ErrItemNotFound
 	}
-	item, err := ds.GetItem(ctx, itemID)
-	if err != nil {
-		return Cart{}, err
+	if item.Retired {
+		return Cart{}, ErrItemRetired
 	}
-	if ds.inventory[item.SKU] < quantity {
+	now := time.Now()
+	reserve := cart.Items[item.SKU].Quantity + quantity
+	if ds.inventory[item.SKU]-ds.reservedStock(item.SKU, userID, now) < reserve {
 		return Cart{}, fmt.Errorf("insufficient stock for item %s", item.SKU)
 	}
-	cart := ds.carts[userID]
+	if err := cart.CheckCurrency(item.Price); err != nil {
+		return Cart{}, err
+	}
 	cart.AddToCart(&item, quantity)
-	return *cart, nil
+	ds.setReservation(item.SKU, userID, reserve, now.Add(ds.reservationTTL))
+	return cart.Clone(), nil
 }
 
-// RemoveFromCart removes an item from the cart in the datastore
+// RemoveFromCart removes an item from the cart in the datastore, releasing the units reserved for it
 func (ds *Datastore) RemoveFromCart(ctx context.Context, userID string, itemID string, quantity int) (Cart, error) {
-	if _, ok := ds.carts[userID]; !ok {
-		return Cart{}, fmt.Errorf("cart not found in the datastore")
-	}
 	item, err := ds.GetItem(ctx, itemID)
 	if err != nil {
 		return Cart{}, err
 	}
-	cart := ds.carts[userID]
+	cart, unlock := ds.lockCart(userID)
+	defer unlock()
 	if err := cart.RemoveFromCart(item, quantity); err != nil {
 		return Cart{}, err
 	}
-	return *cart, nil
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if r, ok := ds.reservations[item.SKU][userID]; ok && r.Quantity > cart.Items[item.SKU].Quantity {
+		ds.setReservation(item.SKU, userID, cart.Items[item.SKU].Quantity, r.ExpiresAt)
+	}
+	return cart.Clone(), nil
 }
 
 // GetCart retrieves the cart from the datastore based on the user ID
 func (ds *Datastore) GetCart(ctx context.Context, userID string) Cart {
-	cart, ok := ds.carts[userID]
-	if !ok {
-		cart = entities.NewCart(userID)
-		ds.carts[userID] = cart
-	}
-	return *cart
+	cart, unlock := ds.lockCart(userID)
+	defer unlock()
+	return cart.Clone()
 }
 
 // GetCartTotalPrice retrieves the total price of the items in the cart from the datastore
-func (ds *Datastore) GetCartTotalPrice(ctx context.Context, userID string) float64 {
-	cart, ok := ds.carts[userID]
-	if !ok {
-		cart = entities.NewCart(userID)
-		ds.carts[userID] = cart
-	}
+func (ds *Datastore) GetCartTotalPrice(ctx context.Context, userID string) Money {
+	cart, unlock := ds.lockCart(userID)
+	defer unlock()
 	return cart.TotalPrice
 }
 
+// SetCartCoupon sets the coupon code applied to the cart of the user, "" removes it
+func (ds *Datastore) SetCartCoupon(ctx context.Context, userID string, code string) (Cart, error) {
+	cart, unlock := ds.lockCart(userID)
+	defer unlock()
+	cart.Coupon = code
+	return cart.Clone(), nil
+}
+
 // GetOrderHistory retrieves the order history from the datastore based on the user ID
 func (ds *Datastore) GetOrderHistory(ctx context.Context, userID string) []Order {
-	if _, ok := ds.orders[userID]; !ok {
-		ds.orders[userID] = make([]*Order, 0)
-	}
-	orders := make([]Order, len(ds.orders[userID]))
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	orders := make([]Order, 0, len(ds.orders[userID]))
 	for _, order := range ds.orders[userID] {
 		orders = append(orders, *order)
 	}
@@ -146,8 +316,8 @@ func (ds *Datastore) GetOrderHistory(ctx context.Context, userID string) []Order
 }
 
 // Checkout checks out the cart in the datastore
-func (ds *Datastore) Checkout(ctx context.Context, userID string) (Order, error) {
-	return ds.ConfirmOrder(ctx, userID)
+func (ds *Datastore) Checkout(ctx context.Context, userID string, finalize OrderFinalizer) (Order, error) {
+	return ds.ConfirmOrder(ctx, userID, finalize)
 	// return cart for the current user
 	// cart, ok := ds.carts[userID]
 	// if !ok {
@@ -163,65 +333,46 @@ func (ds *Datastore) Checkout(ctx context.Context, userID string) (Order, error)
 }
 
 // ConfirmOrder confirms the purchase in the datastore
-func (ds *Datastore) ConfirmOrder(ctx context.Context, userID string) (Order, error) {
-	cart, ok := ds.carts[userID]
-	if !ok {
-		return Order{}, fmt.Errorf("cart not found in the datastore")
-	}
-	if len(cart.Items) == 0 {
-		return Order{}, fmt.Errorf("cart is empty")
-	}
-	// DoubleCheck for inventory
-	for k, v := range cart.Items {
-		if ds.inventory[k] < v.Quantity {
-			return Order{}, fmt.Errorf("insufficient stock for item %s", k)
-		}
-	}
-	// Update inventory
-	for k, v := range cart.Items {
-		ds.inventory[k] -= v.Quantity
-	}
-
-	newOrder, err := newOrderFromCart(userID, cart)
-	if err != nil {
-		return Order{}, fmt.Errorf("unable to create new order for user %s", userID)
-	}
-	// Append element at the front of the slice to show the latest order first
-	ds.orders[userID] = append([]*Order{&newOrder}, ds.orders[userID]...)
-	// Clear the cart
-	ds.carts[userID] = entities.NewCart(userID)
-	return newOrder, nil
+// The check and decrement of stock, the creation of the order and the clearing
+// of the cart run as a single unit of work, see CheckoutCart.
+func (ds *Datastore) ConfirmOrder(ctx context.Context, userID string, finalize OrderFinalizer) (Order, error) {
+	return CheckoutCart(ctx, ds, userID, finalize)
 }
 
 // ConfirmPayment confirms the purchase in the datastore
 func (ds *Datastore) ConfirmPayment(ctx context.Context, userID string, orderID OrderID, paymentConfirmationID string) (Order, error) {
-	order, err := ds.findOrderByOrderID(userID, orderID)
-	if err != nil {
-		return Order{}, fmt.Errorf("order %v not found in the datastore", orderID)
-	}
-	if order.PaymentConfirmation != "" {
-		return *order, fmt.Errorf("order %v already confirmed", orderID)
+	return RecordPayment(ctx, ds, userID, orderID, paymentConfirmationID)
+}
+
+// ListOrdersByStatus lists the orders of all the users that are in the status
+func (ds *Datastore) ListOrdersByStatus(ctx context.Context, status entities.OrderStatus) ([]Order, error) {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	var orders []Order
+	for _, userOrders := range ds.orders {
+		for _, order := range userOrders {
+			if order.CurrentStatus() == status {
+				orders = append(orders, *order)
+			}
+		}
 	}
-	order.PaymentConfirmation = paymentConfirmationID
-	return *order, nil
+	return orders, nil
 }
 
-// findOrderByOrderID finds an order from the datastore based on the user ID and order ID
+// findOrderByOrderID finds an order from the datastore based on the user ID and order ID; the caller must hold mu
 func (ds *Datastore) findOrderByOrderID(userID string, orderID OrderID) (*Order, error) {
-	orders, ok := ds.orders[userID]
-	if !ok {
-		return nil, fmt.Errorf("order not found in the datastore")
-	}
-	for _, o := range orders {
+	for _, o := range ds.orders[userID] {
 		if o.ID == orderID {
 			return o, nil
 		}
 	}
-	return nil, fmt.Errorf("order not found in the datastore")
+	return nil, ErrOrderNotFound
 }
 
 // FindOrder finds an order from the datastore based on the user ID and order ID
 func (ds *Datastore) FindOrder(ctx context.Context, userID string, orderID OrderID) (Order, error) {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
 	order, err := ds.findOrderByOrderID(userID, orderID)
 	if err != nil {
 		return Order{}, err
@@ -229,6 +380,20 @@ func (ds *Datastore) FindOrder(ctx context.Context, userID string, orderID Order
 	return *order, nil
 }
 
+// GetOrder gets an order of any user by its ID
+func (ds *Datastore) GetOrder(ctx context.Context, orderID OrderID) (Order, error) {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	for _, userOrders := range ds.orders {
+		for _, order := range userOrders {
+			if order.ID == orderID {
+				return *order, nil
+			}
+		}
+	}
+	return Order{}, ErrOrderNotFound
+}
+
 // createNeworderID creates a new order ID
 func createNewOrderID() (OrderID, error) {
 	b := make([]byte, 32)
@@ -238,18 +403,27 @@ func createNewOrderID() (OrderID, error) {
 	return base64.URLEncoding.EncodeToString(b), nil
 }
 
-// newOrderFromCart creates a new order
-func newOrderFromCart(userID UserID, cart *Cart) (Order, error) {
+// NewOrderFromCart creates a new order from the cart of the user
+func NewOrderFromCart(userID UserID, cart *Cart) (Order, error) {
 	rawOrderId, err := createNewOrderID()
 	if err != nil {
 		return Order{}, fmt.Errorf("unable to create new order id for user %s", userID)
 	}
 	orderId := fmt.Sprintf("order-%s", rawOrderId)
+	now := time.Now()
 	order := Order{
-		ID:         orderId,
-		UserID:     userID,
-		TotalItems: cart.TotalItems,
-		TotalPrice: cart.TotalPrice,
+		ID:            orderId,
+		UserID:        userID,
+		TotalItems:    cart.TotalItems,
+		TotalPrice:    cart.TotalPrice,
+		Coupon:        cart.Coupon,
+		Discounts:     cart.Discounts,
+		TotalDiscount: cart.TotalDiscount,
+		Status:        entities.OrderStatusPendingPayment,
+		CreatedAt:     now,
+		StatusHistory: []entities.OrderStatusChange{
+			{Status: entities.OrderStatusPendingPayment, At: now},
+		},
 	}
 	for _, v := range cart.Items {
 		order.Items = append(order.Items, ItemWithQty{
@@ -257,5 +431,8 @@ func newOrderFromCart(userID UserID, cart *Cart) (Order, error) {
 			Quantity: v.Quantity,
 		})
 	}
+	sort.Slice(order.Items, func(i, j int) bool { return order.Items[i].Item.SKU < order.Items[j].Item.SKU })
+	order.AllocateDiscount()
+	order.UpdateAmountDue()
 	return order, nil
 }
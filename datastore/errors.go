@@ -0,0 +1,31 @@
+package datastore
+
+import "errors"
+
+// Errors returned by the repositories, callers should match them with errors.Is
+var (
+	// ErrOrderNotFound is returned when an order does not exist for the user
+	ErrOrderNotFound = errors.New("order not found in the datastore")
+	// ErrItemNotFound is returned when an item is not in the catalog
+	ErrItemNotFound = errors.New("item not found in the datastore")
+	// ErrItemExists is returned when creating an item whose SKU is already in the catalog
+	ErrItemExists = errors.New("item already exists in the datastore")
+	// ErrItemRetired is returned when adding to a cart an item that is no longer sold
+	ErrItemRetired = errors.New("item is no longer sold")
+	// ErrUserNotFound is returned when a user does not exist
+	ErrUserNotFound = errors.New("user not found")
+	// ErrUserExists is returned when adding a user whose ID is already taken
+	ErrUserExists = errors.New("user already exists")
+	// ErrSessionNotFound is returned when a session does not exist for the user
+	ErrSessionNotFound = errors.New("session not found")
+	// ErrInvalidRefreshToken is returned when a refresh token is unknown, expired or already used
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	// ErrPromotionNotFound is returned when a promotion or coupon code does not exist
+	ErrPromotionNotFound = errors.New("promotion not found")
+	// ErrPromotionExists is returned when the ID or the coupon code of a promotion is already taken
+	ErrPromotionExists = errors.New("promotion already exists")
+	// ErrAddressNotFound is returned when an address is not in the address book of the user
+	ErrAddressNotFound = errors.New("address not found")
+	// ErrPaymentMethodNotFound is returned when a payment method is not saved for the user
+	ErrPaymentMethodNotFound = errors.New("payment method not found")
+)
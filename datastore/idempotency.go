@@ -0,0 +1,93 @@
+package datastore
+
+import (
+	"sync"
+	"time"
+)
+
+// IdempotentResponse defines the response stored for a request made with an idempotency key
+type IdempotentResponse struct {
+	StatusCode  int
+	ContentType string
+	Body        []byte
+}
+
+// IdempotencyRecord defines the request a user made with an idempotency key
+type IdempotencyRecord struct {
+	UserID UserID
+	Key    string
+	// Fingerprint identifies the request, a key cannot be reused for another one
+	Fingerprint string
+	// Response is nil while the request is being processed
+	Response  *IdempotentResponse
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// idempotencyID returns the ID of the key of the user in an IdempotencyStore
+func idempotencyID(userID UserID, key string) string {
+	return userID + "\x00" + key
+}
+
+// IdempotencyStore is the in-memory implementation of IdempotencyRepository
+type IdempotencyStore struct {
+	mu      sync.Mutex
+	records map[string]IdempotencyRecord
+}
+
+// NewIdempotencyStore creates a new idempotency store
+func NewIdempotencyStore() *IdempotencyStore {
+	return &IdempotencyStore{
+		records: make(map[string]IdempotencyRecord),
+	}
+}
+
+// BeginIdempotentRequest claims the key of the record for its request, see IdempotencyRepository
+func (s *IdempotencyStore) BeginIdempotentRequest(record IdempotencyRecord) (IdempotencyRecord, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := idempotencyID(record.UserID, record.Key)
+	if existing, ok := s.records[id]; ok && record.CreatedAt.Before(existing.ExpiresAt) {
+		return existing, false, nil
+	}
+	record.Response = nil
+	s.records[id] = record
+	return record, true, nil
+}
+
+// CompleteIdempotentRequest stores the response to the request of a claimed key
+func (s *IdempotencyStore) CompleteIdempotentRequest(userID UserID, key string, response IdempotentResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := idempotencyID(userID, key)
+	record, ok := s.records[id]
+	if !ok {
+		return nil
+	}
+	record.Response = &response
+	s.records[id] = record
+	return nil
+}
+
+// ReleaseIdempotencyKey forgets a claimed key, so that its request can be retried
+func (s *IdempotencyStore) ReleaseIdempotencyKey(userID UserID, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, idempotencyID(userID, key))
+	return nil
+}
+
+// RemoveExpiredIdempotencyKeys forgets the expired keys and returns how many there were
+func (s *IdempotencyStore) RemoveExpiredIdempotencyKeys() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	removed := 0
+	for id, record := range s.records {
+		if !now.Before(record.ExpiresAt) {
+			delete(s.records, id)
+			removed++
+		}
+	}
+	return removed, nil
+}
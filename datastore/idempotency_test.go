@@ -0,0 +1,76 @@
+package datastore_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/13thuser/bookstore/datastore"
+	"github.com/13thuser/bookstore/datastore/sqlite"
+)
+
+// testHelperIdempotencyStores returns a fresh idempotency store of every backend
+func testHelperIdempotencyStores(t *testing.T) map[string]datastore.IdempotencyRepository {
+	db, err := sqlite.Open(filepath.Join(t.TempDir(), "bookstore.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return map[string]datastore.IdempotencyRepository{
+		"memory": datastore.NewIdempotencyStore(),
+		"sqlite": db,
+	}
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	for backend, keys := range testHelperIdempotencyStores(t) {
+		t.Run(backend, func(t *testing.T) {
+			now := time.Now()
+			record := datastore.IdempotencyRecord{UserID: "user", Key: "key-1", Fingerprint: "checkout", CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+			if _, claimed, err := keys.BeginIdempotentRequest(record); err != nil || !claimed {
+				t.Fatalf("expected to claim a new key, got %v (%v)", claimed, err)
+			}
+			existing, claimed, err := keys.BeginIdempotentRequest(record)
+			if err != nil || claimed || existing.Fingerprint != "checkout" || existing.Response != nil {
+				t.Errorf("expected the key to be in progress, got %v and %+v (%v)", claimed, existing, err)
+			}
+			other := record
+			other.UserID = "other"
+			if _, claimed, err := keys.BeginIdempotentRequest(other); err != nil || !claimed {
+				t.Errorf("expected keys to be per user, got %v (%v)", claimed, err)
+			}
+
+			response := datastore.IdempotentResponse{StatusCode: 200, ContentType: "application/json", Body: []byte(`{"id":"order-1"}`)}
+			if err := keys.CompleteIdempotentRequest("user", "key-1", response); err != nil {
+				t.Fatal(err)
+			}
+			existing, claimed, err = keys.BeginIdempotentRequest(record)
+			if err != nil || claimed || existing.Response == nil || existing.Response.StatusCode != 200 || string(existing.Response.Body) != `{"id":"order-1"}` {
+				t.Errorf("expected the stored response, got %v and %+v (%v)", claimed, existing.Response, err)
+			}
+
+			if err := keys.ReleaseIdempotencyKey("other", "key-1"); err != nil {
+				t.Fatal(err)
+			}
+			if _, claimed, err := keys.BeginIdempotentRequest(other); err != nil || !claimed {
+				t.Errorf("expected a released key to be claimed again, got %v (%v)", claimed, err)
+			}
+
+			// an expired key is claimed by the next request and swept
+			later := record
+			later.Fingerprint = "confirm"
+			later.CreatedAt = now.Add(2 * time.Hour)
+			later.ExpiresAt = now.Add(3 * time.Hour)
+			if _, claimed, err := keys.BeginIdempotentRequest(later); err != nil || !claimed {
+				t.Errorf("expected to claim an expired key, got %v (%v)", claimed, err)
+			}
+			expired := datastore.IdempotencyRecord{UserID: "user", Key: "key-2", CreatedAt: now.Add(-2 * time.Hour), ExpiresAt: now.Add(-time.Hour)}
+			if _, claimed, err := keys.BeginIdempotentRequest(expired); err != nil || !claimed {
+				t.Fatalf("expected to claim a new key, got %v (%v)", claimed, err)
+			}
+			if n, err := keys.RemoveExpiredIdempotencyKeys(); err != nil || n != 1 {
+				t.Errorf("expected to remove the expired key, got %d (%v)", n, err)
+			}
+		})
+	}
+}
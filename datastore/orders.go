@@ -0,0 +1,284 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+)
+
+// ChangeOrderStatus moves an order of the user to status in a unit of work.
+// check, if not nil, runs first and may reject the change based on the order
+// as currently stored. Cancelling an order puts its items back in stock and
+// releases what was not captured of its authorization, see Order.ReleaseAuthorization.
+func ChangeOrderStatus(ctx context.Context, t Transactor, userID UserID, orderID OrderID, status entities.OrderStatus, check func(order *Order) error) (Order, error) {
+	var order Order
+	err := RunInTx(ctx, t, userID, func(tx Tx) error {
+		var err error
+		order, err = tx.FindOrder(ctx, orderID)
+		if err != nil {
+			return err
+		}
+		if check != nil {
+			if err := check(&order); err != nil {
+				return err
+			}
+		}
+		// the units already restocked by refunds are not restocked again
+		restock := make([]entities.RestockLine, 0, len(order.Items))
+		for _, item := range order.Items {
+			restock = append(restock, entities.RestockLine{SKU: item.Item.SKU, Quantity: order.Restockable(item.Item.SKU)})
+		}
+		if err := order.TransitionTo(status, time.Now()); err != nil {
+			return err
+		}
+		if status == entities.OrderStatusCancelled {
+			if err := order.ReleaseAuthorization(); err != nil {
+				return err
+			}
+			if err := incrementStock(ctx, tx, restock); err != nil {
+				return err
+			}
+		}
+		return tx.UpdateOrder(ctx, order)
+	})
+	if err != nil {
+		return Order{}, err
+	}
+	return order, nil
+}
+
+// RecordPayment marks an order of the user as paid with the payment confirmation
+func RecordPayment(ctx context.Context, t Transactor, userID UserID, orderID OrderID, paymentConfirmationID string) (Order, error) {
+	return ChangeOrderStatus(ctx, t, userID, orderID, entities.OrderStatusPaid, func(order *Order) error {
+		if order.PaymentConfirmation != "" {
+			return fmt.Errorf("order %v already confirmed", orderID)
+		}
+		order.PaymentConfirmation = paymentConfirmationID
+		return nil
+	})
+}
+
+// RecordAuthorization marks an order of the user as authorized with the
+// authorization of its payment by the payment gateway
+func RecordAuthorization(ctx context.Context, t Transactor, userID UserID, orderID OrderID, authorizationID string, amount entities.Money, card *entities.PaymentCard) (Order, error) {
+	return ChangeOrderStatus(ctx, t, userID, orderID, entities.OrderStatusAuthorized, func(order *Order) error {
+		if order.PaymentConfirmation != "" {
+			return fmt.Errorf("%w: order %v already confirmed", entities.ErrInvalidStatusTransition, orderID)
+		}
+		order.PaymentConfirmation = authorizationID
+		order.Authorization = &entities.Authorization{ID: authorizationID, Amount: amount, Card: card, CreatedAt: time.Now()}
+		return nil
+	})
+}
+
+// BeginCapture records a pending capture of an order of the user for the
+// request, see Order.AddCapture. Like refunds, it must then be settled with
+// CompleteCapture or FailCapture once the payment gateway answered.
+func BeginCapture(ctx context.Context, t Transactor, userID UserID, orderID OrderID, req entities.CaptureRequest, by UserID) (Order, entities.Capture, error) {
+	id, err := newID()
+	if err != nil {
+		return Order{}, entities.Capture{}, fmt.Errorf("unable to create new capture id")
+	}
+	var order Order
+	var capture entities.Capture
+	err = RunInTx(ctx, t, userID, func(tx Tx) error {
+		var err error
+		order, err = tx.FindOrder(ctx, orderID)
+		if err != nil {
+			return err
+		}
+		capture, err = order.AddCapture(req, id, by, time.Now())
+		if err != nil {
+			return err
+		}
+		return tx.UpdateOrder(ctx, order)
+	})
+	if err != nil {
+		return Order{}, entities.Capture{}, err
+	}
+	return order, capture, nil
+}
+
+// CompleteCapture marks a pending capture of an order of the user as succeeded
+// with the confirmation of the payment gateway
+func CompleteCapture(ctx context.Context, t Transactor, userID UserID, orderID OrderID, captureID string, confirmation string) (Order, error) {
+	return updateOrder(ctx, t, userID, orderID, func(order *Order) error {
+		_, err := order.CompleteCapture(captureID, confirmation, time.Now())
+		return err
+	})
+}
+
+// FailCapture marks a pending capture of an order of the user as declined by the payment gateway
+func FailCapture(ctx context.Context, t Transactor, userID UserID, orderID OrderID, captureID string, failure error) (Order, error) {
+	return updateOrder(ctx, t, userID, orderID, func(order *Order) error {
+		return order.FailCapture(captureID, failure.Error())
+	})
+}
+
+// RecordDispute adds a dispute of the payment of an order of the user, once
+func RecordDispute(ctx context.Context, t Transactor, userID UserID, orderID OrderID, dispute entities.Dispute) (Order, error) {
+	return updateOrder(ctx, t, userID, orderID, func(order *Order) error {
+		if _, ok := order.Dispute(dispute.ID); !ok {
+			order.Disputes = append(order.Disputes, dispute)
+		}
+		return nil
+	})
+}
+
+// updateOrder applies change to an order of the user in a unit of work
+func updateOrder(ctx context.Context, t Transactor, userID UserID, orderID OrderID, change func(order *Order) error) (Order, error) {
+	var order Order
+	err := RunInTx(ctx, t, userID, func(tx Tx) error {
+		var err error
+		order, err = tx.FindOrder(ctx, orderID)
+		if err != nil {
+			return err
+		}
+		if err := change(&order); err != nil {
+			return err
+		}
+		return tx.UpdateOrder(ctx, order)
+	})
+	if err != nil {
+		return Order{}, err
+	}
+	return order, nil
+}
+
+// BeginRefund records a pending refund of an order of the user for the
+// request, see Order.AddRefund. Recording it before asking the payment gateway
+// keeps concurrent refunds from giving back more than was paid; it must then
+// be settled with CompleteRefund or FailRefund.
+func BeginRefund(ctx context.Context, t Transactor, userID UserID, orderID OrderID, req entities.RefundRequest, by UserID) (Order, entities.Refund, error) {
+	id, err := newID()
+	if err != nil {
+		return Order{}, entities.Refund{}, fmt.Errorf("unable to create new refund id")
+	}
+	var order Order
+	var refund entities.Refund
+	err = RunInTx(ctx, t, userID, func(tx Tx) error {
+		var err error
+		order, err = tx.FindOrder(ctx, orderID)
+		if err != nil {
+			return err
+		}
+		refund, err = order.AddRefund(req, id, by, time.Now())
+		if err != nil {
+			return err
+		}
+		return tx.UpdateOrder(ctx, order)
+	})
+	if err != nil {
+		return Order{}, entities.Refund{}, err
+	}
+	return order, refund, nil
+}
+
+// CompleteRefund marks a pending refund of an order of the user as succeeded
+// with the confirmation of the payment gateway and puts its units back in stock
+func CompleteRefund(ctx context.Context, t Transactor, userID UserID, orderID OrderID, refundID string, confirmation string) (Order, error) {
+	var order Order
+	err := RunInTx(ctx, t, userID, func(tx Tx) error {
+		var err error
+		order, err = tx.FindOrder(ctx, orderID)
+		if err != nil {
+			return err
+		}
+		refund, err := order.CompleteRefund(refundID, confirmation, time.Now())
+		if err != nil {
+			return err
+		}
+		if err := incrementStock(ctx, tx, refund.Restocked); err != nil {
+			return err
+		}
+		return tx.UpdateOrder(ctx, order)
+	})
+	if err != nil {
+		return Order{}, err
+	}
+	return order, nil
+}
+
+// FailRefund marks a pending refund of an order of the user as declined by the payment gateway
+func FailRefund(ctx context.Context, t Transactor, userID UserID, orderID OrderID, refundID string, failure error) (Order, error) {
+	return updateOrder(ctx, t, userID, orderID, func(order *Order) error {
+		return order.FailRefund(refundID, failure.Error())
+	})
+}
+
+// incrementStock puts the units of the lines back in stock
+func incrementStock(ctx context.Context, tx Tx, lines []entities.RestockLine) error {
+	for _, line := range lines {
+		if line.Quantity == 0 {
+			continue
+		}
+		if err := tx.IncrementStock(ctx, line.SKU, line.Quantity); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExpireOrders cancels the orders still waiting for payment that were created
+// before the cutoff, putting their items back in stock, and returns them
+func ExpireOrders(ctx context.Context, store Store, createdBefore time.Time) ([]Order, error) {
+	pending, err := store.ListOrdersByStatus(ctx, entities.OrderStatusPendingPayment)
+	if err != nil {
+		return nil, err
+	}
+	var expired []Order
+	for _, order := range pending {
+		if !order.CreatedAt.Before(createdBefore) {
+			continue
+		}
+		cancelled, err := ChangeOrderStatus(ctx, store, order.UserID, order.ID, entities.OrderStatusCancelled, func(current *Order) error {
+			// The order may have been paid since it was listed
+			if current.CurrentStatus() != entities.OrderStatusPendingPayment {
+				return fmt.Errorf("order %v is no longer pending payment", current.ID)
+			}
+			return nil
+		})
+		if err != nil {
+			continue
+		}
+		expired = append(expired, cancelled)
+	}
+	return expired, nil
+}
+
+// ExpireAuthorizations closes the authorizations of the orders authorized
+// before the cutoff that are still waiting to be captured, and returns the
+// orders: the ones partly captured move to paid, the others are cancelled and
+// their items put back in stock. What was not captured must then be voided
+// with the payment gateway.
+func ExpireAuthorizations(ctx context.Context, store Store, authorizedBefore time.Time) ([]Order, error) {
+	authorized, err := store.ListOrdersByStatus(ctx, entities.OrderStatusAuthorized)
+	if err != nil {
+		return nil, err
+	}
+	var expired []Order
+	for _, order := range authorized {
+		if order.Authorization == nil || !order.Authorization.CreatedAt.Before(authorizedBefore) {
+			continue
+		}
+		partlyCaptured := order.Captured().IsPositive()
+		status := entities.OrderStatusCancelled
+		if partlyCaptured {
+			status = entities.OrderStatusPaid
+		}
+		closed, err := ChangeOrderStatus(ctx, store, order.UserID, order.ID, status, func(current *Order) error {
+			// The order may have been captured or cancelled since it was listed
+			if current.CurrentStatus() != entities.OrderStatusAuthorized || current.Captured().IsPositive() != partlyCaptured {
+				return fmt.Errorf("order %v changed since it was listed", current.ID)
+			}
+			return current.ReleaseAuthorization()
+		})
+		if err != nil {
+			continue
+		}
+		expired = append(expired, closed)
+	}
+	return expired, nil
+}
@@ -0,0 +1,109 @@
+package datastore_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+	"github.com/13thuser/bookstore/datastore"
+)
+
+func TestExpireOrders(t *testing.T) {
+	ctx := context.Background()
+	for backend, store := range testHelperStores(t) {
+		t.Run(backend, func(t *testing.T) {
+			for _, user := range []string{"unpaid", "paid"} {
+				if _, err := store.AddToCart(ctx, user, "item-1", 1); err != nil {
+					t.Fatal(err)
+				}
+			}
+			unpaid, err := store.Checkout(ctx, "unpaid", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			paid, err := store.Checkout(ctx, "paid", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.ConfirmPayment(ctx, "paid", paid.ID, "confirmation"); err != nil {
+				t.Fatal(err)
+			}
+
+			// nothing is old enough yet
+			expired, err := datastore.ExpireOrders(ctx, store, time.Now().Add(-time.Hour))
+			if err != nil || len(expired) != 0 {
+				t.Fatalf("expected no expired order, got %d (%v)", len(expired), err)
+			}
+
+			expired, err = datastore.ExpireOrders(ctx, store, time.Now().Add(time.Second))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(expired) != 1 || expired[0].ID != unpaid.ID {
+				t.Fatalf("expected only the unpaid order to expire, got %v", expired)
+			}
+			order, _ := store.FindOrder(ctx, "unpaid", unpaid.ID)
+			if order.Status != entities.OrderStatusCancelled {
+				t.Errorf("expected unpaid order to be cancelled, got %s", order.Status)
+			}
+			order, _ = store.FindOrder(ctx, "paid", paid.ID)
+			if order.Status != entities.OrderStatusPaid {
+				t.Errorf("expected paid order to stay paid, got %s", order.Status)
+			}
+			if stock, _ := store.GetStock(ctx, "item-1"); stock != 1 {
+				t.Errorf("expected the expired order to be restocked, got a stock of %d", stock)
+			}
+		})
+	}
+}
+
+func TestExpireAuthorizations(t *testing.T) {
+	ctx := context.Background()
+	for backend, store := range testHelperStores(t) {
+		t.Run(backend, func(t *testing.T) {
+			orders := make(map[string]datastore.Order)
+			for _, user := range []string{"uncaptured", "partly-captured"} {
+				if _, err := store.AddToCart(ctx, user, "item-1", 1); err != nil {
+					t.Fatal(err)
+				}
+				order, err := store.Checkout(ctx, user, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if order, err = datastore.RecordAuthorization(ctx, store, user, order.ID, "auth-"+user, order.AmountDue, nil); err != nil {
+					t.Fatal(err)
+				}
+				orders[user] = order
+			}
+			partial := orders["partly-captured"]
+			_, capture, err := datastore.BeginCapture(ctx, store, partial.UserID, partial.ID, entities.CaptureRequest{Amount: &entities.Money{Amount: 100, Currency: "USD"}}, "admin")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := datastore.CompleteCapture(ctx, store, partial.UserID, partial.ID, capture.ID, "confirmation"); err != nil {
+				t.Fatal(err)
+			}
+
+			expired, err := datastore.ExpireAuthorizations(ctx, store, time.Now().Add(-time.Hour))
+			if err != nil || len(expired) != 0 {
+				t.Fatalf("expected no expired authorization, got %d (%v)", len(expired), err)
+			}
+			expired, err = datastore.ExpireAuthorizations(ctx, store, time.Now().Add(time.Second))
+			if err != nil || len(expired) != 2 {
+				t.Fatalf("expected both authorizations to expire, got %d (%v)", len(expired), err)
+			}
+			order, _ := store.FindOrder(ctx, "uncaptured", orders["uncaptured"].ID)
+			if order.Status != entities.OrderStatusCancelled || !order.Authorization.Voided {
+				t.Errorf("expected the uncaptured order to be cancelled and voided, got %s and %+v", order.Status, order.Authorization)
+			}
+			order, _ = store.FindOrder(ctx, "partly-captured", partial.ID)
+			if order.Status != entities.OrderStatusPaid || !order.Authorization.Voided || order.Captured() != entities.NewMoney(100, "USD") {
+				t.Errorf("expected the partly captured order to be paid what was captured, got %s and %+v", order.Status, order.Authorization)
+			}
+			if stock, _ := store.GetStock(ctx, "item-1"); stock != 1 {
+				t.Errorf("expected only the cancelled order to be restocked, got a stock of %d", stock)
+			}
+		})
+	}
+}
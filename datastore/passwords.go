@@ -0,0 +1,27 @@
+package datastore
+
+import "golang.org/x/crypto/bcrypt"
+
+// PasswordHashCost is the bcrypt cost used to hash new passwords
+var PasswordHashCost = bcrypt.DefaultCost
+
+// HashPassword hashes the password with a random salt for storage
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), PasswordHashCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// CheckPassword reports whether the password matches the stored hash
+func CheckPassword(hash string, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// IsPasswordHash reports whether the stored password is already hashed rather
+// than a plaintext password from before passwords were hashed
+func IsPasswordHash(stored string) bool {
+	_, err := bcrypt.Cost([]byte(stored))
+	return err == nil
+}
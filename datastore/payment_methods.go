@@ -0,0 +1,99 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+)
+
+// NewPaymentMethodID creates a new ID for a saved payment method
+func NewPaymentMethodID() (string, error) {
+	id, err := newID()
+	if err != nil {
+		return "", fmt.Errorf("unable to create new payment method id")
+	}
+	return id, nil
+}
+
+// CreatePaymentMethod saves a card of the user and returns it with its new ID,
+// as the default payment method when asked or when it is the first one
+func (ds *Datastore) CreatePaymentMethod(ctx context.Context, userID UserID, card entities.PaymentCard, makeDefault bool) (entities.PaymentMethod, error) {
+	id, err := NewPaymentMethodID()
+	if err != nil {
+		return entities.PaymentMethod{}, err
+	}
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	methods := ds.paymentMethods[userID]
+	method := entities.PaymentMethod{ID: id, PaymentCard: card, Default: makeDefault || len(methods) == 0, CreatedAt: time.Now()}
+	if method.Default {
+		for i := range methods {
+			methods[i].Default = false
+		}
+	}
+	ds.paymentMethods[userID] = append(methods, method)
+	return method, nil
+}
+
+// DeletePaymentMethod removes a payment method of the user, the oldest one left becomes the default when it was
+func (ds *Datastore) DeletePaymentMethod(ctx context.Context, userID UserID, paymentMethodID string) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	i, err := ds.findPaymentMethod(userID, paymentMethodID)
+	if err != nil {
+		return err
+	}
+	methods := ds.paymentMethods[userID]
+	wasDefault := methods[i].Default
+	methods = append(methods[:i:i], methods[i+1:]...)
+	if wasDefault && len(methods) > 0 {
+		methods[0].Default = true
+	}
+	ds.paymentMethods[userID] = methods
+	return nil
+}
+
+// SetDefaultPaymentMethod makes a payment method of the user the default one
+func (ds *Datastore) SetDefaultPaymentMethod(ctx context.Context, userID UserID, paymentMethodID string) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	i, err := ds.findPaymentMethod(userID, paymentMethodID)
+	if err != nil {
+		return err
+	}
+	methods := ds.paymentMethods[userID]
+	for j := range methods {
+		methods[j].Default = j == i
+	}
+	return nil
+}
+
+// GetPaymentMethod gets a payment method of the user by its ID
+func (ds *Datastore) GetPaymentMethod(ctx context.Context, userID UserID, paymentMethodID string) (entities.PaymentMethod, error) {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	i, err := ds.findPaymentMethod(userID, paymentMethodID)
+	if err != nil {
+		return entities.PaymentMethod{}, err
+	}
+	return ds.paymentMethods[userID][i], nil
+}
+
+// ListPaymentMethods lists the payment methods of the user, oldest first
+func (ds *Datastore) ListPaymentMethods(ctx context.Context, userID UserID) ([]entities.PaymentMethod, error) {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	return append([]entities.PaymentMethod{}, ds.paymentMethods[userID]...), nil
+}
+
+// findPaymentMethod returns the index of a payment method of the user; mu must be held
+func (ds *Datastore) findPaymentMethod(userID UserID, paymentMethodID string) (int, error) {
+	for i, method := range ds.paymentMethods[userID] {
+		if method.ID == paymentMethodID {
+			return i, nil
+		}
+	}
+	return 0, ErrPaymentMethodNotFound
+}
@@ -0,0 +1,75 @@
+package datastore_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+	"github.com/13thuser/bookstore/datastore"
+)
+
+func TestPaymentMethods(t *testing.T) {
+	ctx := context.Background()
+	for backend, store := range testHelperStores(t) {
+		t.Run(backend, func(t *testing.T) {
+			defaults := func() []string {
+				t.Helper()
+				methods, err := store.ListPaymentMethods(ctx, "user")
+				if err != nil {
+					t.Fatal(err)
+				}
+				var ids []string
+				for _, method := range methods {
+					if method.Default {
+						ids = append(ids, method.ID)
+					}
+				}
+				return ids
+			}
+			visa, err := store.CreatePaymentMethod(ctx, "user", entities.PaymentCard{Token: "tok_visa", Brand: entities.CardBrandVisa, Last4: "4242", ExpiryMonth: 12, ExpiryYear: 2030}, false)
+			if err != nil || !visa.Default {
+				t.Fatalf("expected the first card to be the default one, got %+v (%v)", visa, err)
+			}
+			amex, err := store.CreatePaymentMethod(ctx, "user", entities.PaymentCard{Token: "tok_amex", Brand: entities.CardBrandAmex, Last4: "0005", ExpiryMonth: 1, ExpiryYear: 2031}, false)
+			if err != nil || amex.Default {
+				t.Fatalf("expected the second card not to be the default one, got %+v (%v)", amex, err)
+			}
+			methods, err := store.ListPaymentMethods(ctx, "user")
+			if err != nil || len(methods) != 2 || methods[0].ID != visa.ID || methods[1].PaymentCard != amex.PaymentCard {
+				t.Fatalf("expected both cards oldest first, got %+v (%v)", methods, err)
+			}
+			if _, err := store.GetPaymentMethod(ctx, "other", visa.ID); !errors.Is(err, datastore.ErrPaymentMethodNotFound) {
+				t.Errorf("expected the card of another user to be not found, got %v", err)
+			}
+
+			if err := store.SetDefaultPaymentMethod(ctx, "user", amex.ID); err != nil {
+				t.Fatal(err)
+			}
+			if ids := defaults(); len(ids) != 1 || ids[0] != amex.ID {
+				t.Errorf("expected the amex to be the only default, got %v", ids)
+			}
+			mastercard, err := store.CreatePaymentMethod(ctx, "user", entities.PaymentCard{Token: "tok_mc", Brand: entities.CardBrandMastercard, Last4: "4444"}, true)
+			if err != nil || !mastercard.Default {
+				t.Fatalf("expected the new card to be the default one, got %+v (%v)", mastercard, err)
+			}
+			if ids := defaults(); len(ids) != 1 || ids[0] != mastercard.ID {
+				t.Errorf("expected the mastercard to be the only default, got %v", ids)
+			}
+
+			// the oldest card left takes over from a deleted default
+			if err := store.DeletePaymentMethod(ctx, "user", mastercard.ID); err != nil {
+				t.Fatal(err)
+			}
+			if ids := defaults(); len(ids) != 1 || ids[0] != visa.ID {
+				t.Errorf("expected the visa to become the default, got %v", ids)
+			}
+			if err := store.DeletePaymentMethod(ctx, "user", mastercard.ID); !errors.Is(err, datastore.ErrPaymentMethodNotFound) {
+				t.Errorf("expected deleting twice to fail with ErrPaymentMethodNotFound, got %v", err)
+			}
+			if err := store.SetDefaultPaymentMethod(ctx, "other", visa.ID); !errors.Is(err, datastore.ErrPaymentMethodNotFound) {
+				t.Errorf("expected the card of another user to be not found, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+)
+
+// PriceCart applies the promotions to the cart: first the promotions without
+// a coupon code that are available to its user, then the promotion of its
+// coupon. If the coupon is unknown or no longer available the cart is priced
+// without it and an error wrapping entities.ErrCouponUnavailable is returned.
+func PriceCart(ctx context.Context, r PromotionReader, cart *Cart, now time.Time) error {
+	promotions, err := r.ListPromotions(ctx)
+	if err != nil {
+		return err
+	}
+	var discounts []entities.Discount
+	var coupon *entities.Promotion
+	for i, promotion := range promotions {
+		if promotion.Code != "" {
+			if promotion.Code == cart.Coupon {
+				coupon = &promotions[i]
+			}
+			continue
+		}
+		err := CheckPromotionAvailable(ctx, r, promotion, cart.UserID, now)
+		if errors.Is(err, entities.ErrCouponUnavailable) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		discounts = appendDiscount(discounts, promotion, cart)
+	}
+
+	var couponErr error
+	switch {
+	case cart.Coupon == "":
+	case coupon == nil:
+		couponErr = fmt.Errorf("%w: coupon %s does not exist", entities.ErrCouponUnavailable, cart.Coupon)
+	default:
+		couponErr = CheckPromotionAvailable(ctx, r, *coupon, cart.UserID, now)
+		if couponErr != nil && !errors.Is(couponErr, entities.ErrCouponUnavailable) {
+			return couponErr
+		}
+		if couponErr == nil {
+			discounts = appendDiscount(discounts, *coupon, cart)
+		}
+	}
+	cart.ApplyDiscounts(discounts)
+	return couponErr
+}
+
+// CheckPromotionAvailable returns an error wrapping entities.ErrCouponUnavailable
+// if the promotion cannot be used by the user at the time
+func CheckPromotionAvailable(ctx context.Context, r PromotionReader, promotion entities.Promotion, userID UserID, now time.Time) error {
+	var total, byUser int
+	if promotion.UsageLimit > 0 || promotion.UsageLimitPerUser > 0 {
+		var err error
+		total, byUser, err = r.CountRedemptions(ctx, promotion.ID, userID)
+		if err != nil {
+			return err
+		}
+	}
+	return promotion.CheckAvailable(now, total, byUser)
+}
+
+// appendDiscount appends the discount of the promotion to the discounts if the cart is eligible for it
+func appendDiscount(discounts []entities.Discount, promotion entities.Promotion, cart *Cart) []entities.Discount {
+	amount, ok := promotion.Discount(cart)
+	if !ok {
+		return discounts
+	}
+	return append(discounts, entities.Discount{
+		PromotionID: promotion.ID,
+		Code:        promotion.Code,
+		Description: promotion.Description,
+		Amount:      amount,
+	})
+}
+
+// CreatePromotion adds a promotion, failing with ErrPromotionExists if its ID or code is taken
+func (ds *Datastore) CreatePromotion(ctx context.Context, promotion entities.Promotion) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if _, ok := ds.promotions[promotion.ID]; ok {
+		return ErrPromotionExists
+	}
+	if ds.codeTaken(promotion) {
+		return ErrPromotionExists
+	}
+	ds.promotions[promotion.ID] = promotion
+	return nil
+}
+
+// UpdatePromotion replaces an existing promotion, failing with ErrPromotionExists if its new code is taken
+func (ds *Datastore) UpdatePromotion(ctx context.Context, promotion entities.Promotion) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if _, ok := ds.promotions[promotion.ID]; !ok {
+		return ErrPromotionNotFound
+	}
+	if ds.codeTaken(promotion) {
+		return ErrPromotionExists
+	}
+	ds.promotions[promotion.ID] = promotion
+	return nil
+}
+
+// codeTaken reports whether another promotion uses the coupon code of the promotion
+func (ds *Datastore) codeTaken(promotion entities.Promotion) bool {
+	if promotion.Code == "" {
+		return false
+	}
+	for _, other := range ds.promotions {
+		if other.Code == promotion.Code && other.ID != promotion.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// GetPromotion gets a promotion by its ID
+func (ds *Datastore) GetPromotion(ctx context.Context, id string) (entities.Promotion, error) {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	promotion, ok := ds.promotions[id]
+	if !ok {
+		return entities.Promotion{}, ErrPromotionNotFound
+	}
+	return promotion, nil
+}
+
+// FindPromotionByCode finds the promotion of a coupon code
+func (ds *Datastore) FindPromotionByCode(ctx context.Context, code string) (entities.Promotion, error) {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	for _, promotion := range ds.promotions {
+		if code != "" && promotion.Code == code {
+			return promotion, nil
+		}
+	}
+	return entities.Promotion{}, ErrPromotionNotFound
+}
+
+// ListPromotions lists all the promotions, ordered by ID
+func (ds *Datastore) ListPromotions(ctx context.Context) ([]entities.Promotion, error) {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	return ds.listPromotions(), nil
+}
+
+// listPromotions lists all the promotions, ordered by ID; mu must be held
+func (ds *Datastore) listPromotions() []entities.Promotion {
+	promotions := make([]entities.Promotion, 0, len(ds.promotions))
+	for _, promotion := range ds.promotions {
+		promotions = append(promotions, promotion)
+	}
+	sort.Slice(promotions, func(i, j int) bool { return promotions[i].ID < promotions[j].ID })
+	return promotions
+}
+
+// CountRedemptions counts the orders that were not cancelled and used the promotion, overall and for the user
+func (ds *Datastore) CountRedemptions(ctx context.Context, promotionID string, userID UserID) (int, int, error) {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	total, byUser := ds.countRedemptions(promotionID, userID)
+	return total, byUser, nil
+}
+
+// countRedemptions counts the orders that were not cancelled and used the promotion; mu must be held
+func (ds *Datastore) countRedemptions(promotionID string, userID UserID) (int, int) {
+	total, byUser := 0, 0
+	for _, orders := range ds.orders {
+		for _, order := range orders {
+			if order.CurrentStatus() == entities.OrderStatusCancelled || !order.UsedPromotion(promotionID) {
+				continue
+			}
+			total++
+			if order.UserID == userID {
+				byUser++
+			}
+		}
+	}
+	return total, byUser
+}
@@ -0,0 +1,225 @@
+package datastore
+
+import (
+	"context"
+	"time"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+)
+
+// The repository interfaces below describe what the service layer needs from a
+// storage backend. Datastore, UserStore and SessionStore are the in-memory
+// implementations; the sqlite sub-package provides a file-backed one.
+
+// CatalogRepository stores the items offered by the bookstore
+type CatalogRepository interface {
+	// AddItem adds an item to the catalog along with its initial stock, or adds to the stock of an existing item
+	AddItem(ctx context.Context, item Item, quantity int) error
+	// CreateItem adds a new item to the catalog along with its initial stock, failing with ErrItemExists if the SKU is taken
+	CreateItem(ctx context.Context, item Item, quantity int) error
+	// UpdateItem replaces the details of an existing item and returns its previous version
+	UpdateItem(ctx context.Context, item Item) (Item, error)
+	// RetireItem marks an item as no longer sold and returns it
+	RetireItem(ctx context.Context, sku SKU) (Item, error)
+	// ListItems lists all the items of the catalog
+	ListItems(ctx context.Context) ([]Item, error)
+	// SearchItems searches the items of the catalog that are still sold, see SearchCatalog
+	SearchItems(ctx context.Context, query entities.ItemQuery) (entities.ItemPage, error)
+	// GetItem gets an item by its SKU
+	GetItem(ctx context.Context, id string) (Item, error)
+}
+
+// InventoryRepository stores the stock level of the items
+type InventoryRepository interface {
+	// RemoveItem removes quantity units of the item from the stock
+	RemoveItem(ctx context.Context, item Item, quantity int) error
+	// GetStock gets the number of units in stock for the item, including the reserved ones
+	GetStock(ctx context.Context, sku SKU) (int, error)
+	// AddStock adds quantity units of the item to the stock and returns the new stock
+	AddStock(ctx context.Context, sku SKU, quantity int) (int, error)
+	// GetReservedStock gets the number of units of the item currently reserved by carts
+	GetReservedStock(ctx context.Context, sku SKU) (int, error)
+	// SetReservationTTL sets how long stock stays reserved for a cart after it was last added to
+	SetReservationTTL(ttl time.Duration)
+	// ReleaseReservations releases all the stock reserved for the cart of the user
+	ReleaseReservations(ctx context.Context, userID UserID) error
+	// ReleaseExpiredReservations forgets the expired reservations and returns how many there were
+	ReleaseExpiredReservations(ctx context.Context) (int, error)
+}
+
+// CartRepository stores the carts of the users
+type CartRepository interface {
+	// AddToCart adds an item to the cart of the user and reserves its units
+	AddToCart(ctx context.Context, userID string, itemID string, quantity int) (Cart, error)
+	// RemoveFromCart removes an item from the cart of the user and releases its units
+	RemoveFromCart(ctx context.Context, userID string, itemID string, quantity int) (Cart, error)
+	// GetCart gets the cart of the user
+	GetCart(ctx context.Context, userID string) Cart
+	// GetCartTotalPrice gets the total price of the items in the cart of the user
+	GetCartTotalPrice(ctx context.Context, userID string) Money
+	// SetCartCoupon sets the coupon code applied to the cart of the user, "" removes it
+	SetCartCoupon(ctx context.Context, userID string, code string) (Cart, error)
+}
+
+// OrderRepository stores the orders of the users
+type OrderRepository interface {
+	// Checkout checks out the cart of the user, see ConfirmOrder
+	Checkout(ctx context.Context, userID string, finalize OrderFinalizer) (Order, error)
+	// ConfirmOrder turns the cart of the user into an order completed by finalize, if not nil, and decrements the stock
+	ConfirmOrder(ctx context.Context, userID string, finalize OrderFinalizer) (Order, error)
+	// ConfirmPayment records the payment confirmation on the order
+	ConfirmPayment(ctx context.Context, userID string, orderID OrderID, paymentConfirmationID string) (Order, error)
+	// ListOrdersByStatus lists the orders of all the users that are in the status
+	ListOrdersByStatus(ctx context.Context, status entities.OrderStatus) ([]Order, error)
+	// FindOrder finds an order of the user by its ID
+	FindOrder(ctx context.Context, userID string, orderID OrderID) (Order, error)
+	// GetOrder gets an order of any user by its ID
+	GetOrder(ctx context.Context, orderID OrderID) (Order, error)
+	// GetOrderHistory gets the orders of the user, latest first
+	GetOrderHistory(ctx context.Context, userID string) []Order
+}
+
+// UserRepository stores the users and their credentials
+type UserRepository interface {
+	// Authenticate authenticates a user
+	Authenticate(userID UserID, password string) (User, bool)
+	// AddUser adds a user with the customer role
+	AddUser(userID UserID, userName string, password string) error
+	// GetUser gets a user by its ID
+	GetUser(userID UserID) (User, error)
+	// SetRoles replaces the roles of a user and returns the updated user
+	SetRoles(userID UserID, roles []entities.Role) (User, error)
+}
+
+// SessionRepository stores the sessions of the logged in users; only the
+// hashes of the tokens are stored
+type SessionRepository interface {
+	// SetSessionPolicy sets how long sessions and their tokens are valid
+	SetSessionPolicy(policy SessionPolicy)
+	// AddSession starts a new session for the user and returns its tokens
+	AddSession(userID UserID, userAgent string) (entities.SessionTokens, error)
+	// GetSession gets the active session of the access token and marks it as seen
+	GetSession(tokenID TokenID) (Session, bool)
+	// GetUserID gets the user ID of the active session of the access token, or "" if there is none
+	GetUserID(tokenID TokenID) UserID
+	// RefreshSession rotates the tokens of the session of the refresh token,
+	// reusing a rotated refresh token revokes the session
+	RefreshSession(refreshToken string) (entities.SessionTokens, error)
+	// RemoveSession ends the session of the access token
+	RemoveSession(tokenID TokenID)
+	// ListSessions lists the active sessions of the user, latest first
+	ListSessions(userID UserID) ([]Session, error)
+	// RevokeSession ends a session of the user
+	RevokeSession(userID UserID, sessionID string) error
+	// RevokeAllSessions ends all the sessions of the user and returns how many there were
+	RevokeAllSessions(userID UserID) (int, error)
+	// RemoveExpiredSessions forgets the expired sessions and returns how many there were
+	RemoveExpiredSessions() (int, error)
+}
+
+// IdempotencyRepository stores the responses to the requests made with an
+// idempotency key, so that retrying a request does not repeat its effects
+type IdempotencyRepository interface {
+	// BeginIdempotentRequest claims the key of the record for its request. When
+	// the user already used the key and it has not expired, the stored record
+	// is returned instead and the key is not claimed.
+	BeginIdempotentRequest(record IdempotencyRecord) (IdempotencyRecord, bool, error)
+	// CompleteIdempotentRequest stores the response to the request of a claimed key
+	CompleteIdempotentRequest(userID UserID, key string, response IdempotentResponse) error
+	// ReleaseIdempotencyKey forgets a claimed key, so that its request can be retried
+	ReleaseIdempotencyKey(userID UserID, key string) error
+	// RemoveExpiredIdempotencyKeys forgets the expired keys and returns how many there were
+	RemoveExpiredIdempotencyKeys() (int, error)
+}
+
+// CardVaultRepository stores the tokens of the tokenization vault with the
+// brand, last four digits and expiry of their card, see payments.Vault
+type CardVaultRepository interface {
+	// SaveVaultCard keeps the card of a token, replacing the one kept with the token
+	SaveVaultCard(card entities.VaultCard) error
+	// ListVaultCards lists the cards kept
+	ListVaultCards() ([]entities.VaultCard, error)
+}
+
+// AuditRepository stores the trail of changes made by administrators
+type AuditRepository interface {
+	// RecordCatalogChange appends a change to the audit trail of the catalog
+	RecordCatalogChange(ctx context.Context, change entities.CatalogChange) error
+	// ListCatalogChanges lists the changes made to an item, oldest first
+	ListCatalogChanges(ctx context.Context, sku SKU) ([]entities.CatalogChange, error)
+}
+
+// PromotionReader reads the promotions and how often they were used; both the
+// stores and their units of work implement it, see PriceCart
+type PromotionReader interface {
+	// ListPromotions lists all the promotions, ordered by ID
+	ListPromotions(ctx context.Context) ([]entities.Promotion, error)
+	// CountRedemptions counts the orders that were not cancelled and used the
+	// promotion, overall and for the user
+	CountRedemptions(ctx context.Context, promotionID string, userID UserID) (int, int, error)
+}
+
+// PromotionRepository stores the promotions and their coupon codes
+type PromotionRepository interface {
+	PromotionReader
+	// CreatePromotion adds a promotion, failing with ErrPromotionExists if its ID or code is taken
+	CreatePromotion(ctx context.Context, promotion entities.Promotion) error
+	// UpdatePromotion replaces an existing promotion, failing with ErrPromotionExists if its new code is taken
+	UpdatePromotion(ctx context.Context, promotion entities.Promotion) error
+	// GetPromotion gets a promotion by its ID
+	GetPromotion(ctx context.Context, id string) (entities.Promotion, error)
+	// FindPromotionByCode finds the promotion of a coupon code
+	FindPromotionByCode(ctx context.Context, code string) (entities.Promotion, error)
+}
+
+// AddressRepository stores the address books of the users
+type AddressRepository interface {
+	// CreateAddress adds an address to the address book of the user and returns it with its new ID
+	CreateAddress(ctx context.Context, userID UserID, address entities.Address) (entities.SavedAddress, error)
+	// UpdateAddress replaces an address of the address book of the user
+	UpdateAddress(ctx context.Context, userID UserID, address entities.SavedAddress) error
+	// DeleteAddress removes an address from the address book of the user
+	DeleteAddress(ctx context.Context, userID UserID, addressID string) error
+	// GetAddress gets an address of the address book of the user by its ID
+	GetAddress(ctx context.Context, userID UserID, addressID string) (entities.SavedAddress, error)
+	// ListAddresses lists the address book of the user, oldest first
+	ListAddresses(ctx context.Context, userID UserID) ([]entities.SavedAddress, error)
+}
+
+// PaymentMethodRepository stores the cards the users saved to pay with
+type PaymentMethodRepository interface {
+	// CreatePaymentMethod saves a card of the user and returns it with its new
+	// ID, as the default payment method when asked or when it is the first one
+	CreatePaymentMethod(ctx context.Context, userID UserID, card entities.PaymentCard, makeDefault bool) (entities.PaymentMethod, error)
+	// DeletePaymentMethod removes a payment method of the user, the oldest one
+	// left becomes the default when it was
+	DeletePaymentMethod(ctx context.Context, userID UserID, paymentMethodID string) error
+	// SetDefaultPaymentMethod makes a payment method of the user the default one
+	SetDefaultPaymentMethod(ctx context.Context, userID UserID, paymentMethodID string) error
+	// GetPaymentMethod gets a payment method of the user by its ID
+	GetPaymentMethod(ctx context.Context, userID UserID, paymentMethodID string) (entities.PaymentMethod, error)
+	// ListPaymentMethods lists the payment methods of the user, oldest first
+	ListPaymentMethods(ctx context.Context, userID UserID) ([]entities.PaymentMethod, error)
+}
+
+// Store groups the repositories used by the bookstore service
+type Store interface {
+	CatalogRepository
+	InventoryRepository
+	CartRepository
+	OrderRepository
+	AuditRepository
+	PromotionRepository
+	AddressRepository
+	PaymentMethodRepository
+	Transactor
+}
+
+// Ensure the in-memory stores implement the repository interfaces
+var (
+	_ Store                 = (*Datastore)(nil)
+	_ UserRepository        = (*UserStore)(nil)
+	_ SessionRepository     = (*SessionStore)(nil)
+	_ IdempotencyRepository = (*IdempotencyStore)(nil)
+	_ CardVaultRepository   = (*CardVaultStore)(nil)
+)
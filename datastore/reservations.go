@@ -0,0 +1,92 @@
+package datastore
+
+import (
+	"context"
+	"time"
+)
+
+// DefaultReservationTTL is how long stock stays reserved for a cart that is not touched
+const DefaultReservationTTL = 15 * time.Minute
+
+// reservation holds units of an item for the cart of a user until it expires
+type reservation struct {
+	Quantity  int
+	ExpiresAt time.Time
+}
+
+// SetReservationTTL sets how long stock stays reserved for a cart after it was last added to
+func (ds *Datastore) SetReservationTTL(ttl time.Duration) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.reservationTTL = ttl
+}
+
+// GetReservedStock retrieves the number of units of the item currently reserved by carts
+func (ds *Datastore) GetReservedStock(ctx context.Context, sku SKU) (int, error) {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	return ds.reservedStock(sku, "", time.Now()), nil
+}
+
+// ReleaseReservations releases all the stock reserved for the cart of the user
+func (ds *Datastore) ReleaseReservations(ctx context.Context, userID UserID) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	for sku := range ds.reservations {
+		ds.setReservation(sku, userID, 0, time.Time{})
+	}
+	return nil
+}
+
+// ReleaseExpiredReservations forgets the reservations that have expired and returns how many there were
+func (ds *Datastore) ReleaseExpiredReservations(ctx context.Context) (int, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	now := time.Now()
+	released := 0
+	for sku, bySKU := range ds.reservations {
+		for userID, r := range bySKU {
+			if !r.ExpiresAt.After(now) {
+				ds.setReservation(sku, userID, 0, time.Time{})
+				released++
+			}
+		}
+	}
+	return released, nil
+}
+
+// reservedStock returns the units of the item reserved by active reservations,
+// leaving out the ones of excludeUserID; the caller must hold mu
+func (ds *Datastore) reservedStock(sku SKU, excludeUserID UserID, now time.Time) int {
+	reserved := 0
+	for userID, r := range ds.reservations[sku] {
+		if userID != excludeUserID && r.ExpiresAt.After(now) {
+			reserved += r.Quantity
+		}
+	}
+	return reserved
+}
+
+// activeReservation returns the units of the item reserved by the user; the caller must hold mu
+func (ds *Datastore) activeReservation(sku SKU, userID UserID, now time.Time) int {
+	if r, ok := ds.reservations[sku][userID]; ok && r.ExpiresAt.After(now) {
+		return r.Quantity
+	}
+	return 0
+}
+
+// setReservation replaces the reservation of the user for the item, a zero
+// quantity removes it; the caller must hold mu
+func (ds *Datastore) setReservation(sku SKU, userID UserID, quantity int, expiresAt time.Time) {
+	if quantity <= 0 {
+		delete(ds.reservations[sku], userID)
+		if len(ds.reservations[sku]) == 0 {
+			delete(ds.reservations, sku)
+		}
+		return
+	}
+	if ds.reservations[sku] == nil {
+		ds.reservations[sku] = make(map[UserID]reservation)
+	}
+	ds.reservations[sku][userID] = reservation{Quantity: quantity, ExpiresAt: expiresAt}
+}
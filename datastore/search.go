@@ -0,0 +1,261 @@
+package datastore
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+)
+
+// SearchIndex is an in-process inverted index of the words of the catalog;
+// the stores keep it in sync as items are added and updated
+type SearchIndex struct {
+	mu sync.RWMutex
+	// postings lists the items containing each word
+	postings map[string]map[SKU]struct{}
+	// words lists the words indexed for each item, to unindex it on update
+	words map[SKU][]string
+}
+
+// NewSearchIndex creates an empty search index
+func NewSearchIndex() *SearchIndex {
+	return &SearchIndex{
+		postings: make(map[string]map[SKU]struct{}),
+		words:    make(map[SKU][]string),
+	}
+}
+
+// Put indexes the item, replacing its previous version
+func (ix *SearchIndex) Put(item Item) {
+	text := []string{item.SKU, item.Name, item.Description, item.ISBN, item.Publisher}
+	text = append(text, item.Authors...)
+	text = append(text, item.Categories...)
+	words := tokenize(strings.Join(text, " "))
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.remove(item.SKU)
+	for _, word := range words {
+		if ix.postings[word] == nil {
+			ix.postings[word] = make(map[SKU]struct{})
+		}
+		ix.postings[word][item.SKU] = struct{}{}
+	}
+	ix.words[item.SKU] = words
+}
+
+// Reset replaces the whole index with the items
+func (ix *SearchIndex) Reset(items []Item) {
+	fresh := NewSearchIndex()
+	for _, item := range items {
+		fresh.Put(item)
+	}
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.postings, ix.words = fresh.postings, fresh.words
+}
+
+// Remove unindexes the item
+func (ix *SearchIndex) Remove(sku SKU) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.remove(sku)
+}
+
+// remove unindexes the item, the caller holds the lock
+func (ix *SearchIndex) remove(sku SKU) {
+	for _, word := range ix.words[sku] {
+		delete(ix.postings[word], sku)
+		if len(ix.postings[word]) == 0 {
+			delete(ix.postings, word)
+		}
+	}
+	delete(ix.words, sku)
+}
+
+// Match returns the items containing all the words of the text, or nil if
+// the text has no words to match
+func (ix *SearchIndex) Match(text string) map[SKU]struct{} {
+	words := tokenize(text)
+	if len(words) == 0 {
+		return nil
+	}
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	matches := make(map[SKU]struct{})
+	// Start from the rarest word so the intersections stay small
+	sort.Slice(words, func(i, j int) bool { return len(ix.postings[words[i]]) < len(ix.postings[words[j]]) })
+	for sku := range ix.postings[words[0]] {
+		matches[sku] = struct{}{}
+	}
+	for _, word := range words[1:] {
+		for sku := range matches {
+			if _, ok := ix.postings[word][sku]; !ok {
+				delete(matches, sku)
+			}
+		}
+	}
+	return matches
+}
+
+// tokenize splits the text into its distinct lower case words
+func tokenize(text string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	seen := make(map[string]bool, len(fields))
+	words := fields[:0]
+	for _, field := range fields {
+		if !seen[field] {
+			seen[field] = true
+			words = append(words, field)
+		}
+	}
+	return words
+}
+
+// searchCursor is the position of the last item of a page in the sort order
+type searchCursor struct {
+	Sort      entities.ItemSort `json:"o"`
+	Name      string            `json:"n"`
+	Price     entities.Money    `json:"p"`
+	CreatedAt time.Time         `json:"t"`
+	SKU       SKU               `json:"k"`
+}
+
+// cursorOf returns the position of the item in the sort order
+func cursorOf(item entities.ItemWithStock, order entities.ItemSort) searchCursor {
+	return searchCursor{Sort: order, Name: item.Name, Price: item.Price, CreatedAt: item.CreatedAt, SKU: item.SKU}
+}
+
+// encode encodes the cursor as an opaque string
+func (c searchCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeSearchCursor decodes a cursor returned by a previous page of the same sort
+func decodeSearchCursor(s string, order entities.ItemSort) (searchCursor, error) {
+	var c searchCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil {
+		err = json.Unmarshal(data, &c)
+	}
+	if err != nil || c.Sort != order {
+		return searchCursor{}, fmt.Errorf("%w: invalid cursor", entities.ErrInvalidQuery)
+	}
+	return c, nil
+}
+
+// compare orders two positions for the sort, ties are broken by SKU so the order is stable
+func (c searchCursor) compare(other searchCursor) int {
+	var cmp int
+	switch c.Sort {
+	case entities.ItemSortName:
+		cmp = strings.Compare(strings.ToLower(c.Name), strings.ToLower(other.Name))
+	case entities.ItemSortNameDesc:
+		cmp = strings.Compare(strings.ToLower(other.Name), strings.ToLower(c.Name))
+	case entities.ItemSortPrice:
+		cmp = comparePrices(c.Price, other.Price)
+	case entities.ItemSortPriceDesc:
+		cmp = comparePrices(other.Price, c.Price)
+	case entities.ItemSortNewest:
+		switch {
+		case c.CreatedAt.After(other.CreatedAt):
+			cmp = -1
+		case c.CreatedAt.Before(other.CreatedAt):
+			cmp = 1
+		}
+	}
+	if cmp != 0 {
+		return cmp
+	}
+	return strings.Compare(c.SKU, other.SKU)
+}
+
+// comparePrices orders prices by currency, then by amount
+func comparePrices(a, b entities.Money) int {
+	if !a.SameCurrency(b) {
+		return strings.Compare(a.Currency, b.Currency)
+	}
+	return a.Cmp(b)
+}
+
+// matchesBookFilters reports whether the item matches the category, format, language and title of the query
+func matchesBookFilters(item Item, query entities.ItemQuery) bool {
+	switch {
+	case query.Category != "" && !item.InCategory(query.Category):
+		return false
+	case query.Format != "" && item.Format != query.Format:
+		return false
+	case query.Language != "" && !strings.EqualFold(item.Language, query.Language):
+		return false
+	case query.TitleID != "" && item.TitleID != query.TitleID:
+		return false
+	}
+	return true
+}
+
+// SearchCatalog runs the query on the items, whose stock levels are already
+// known: it keeps the items matching the text in the index and the filters,
+// sorts them and returns the page after the cursor. Retired items are left out.
+func SearchCatalog(index *SearchIndex, items []entities.ItemWithStock, query entities.ItemQuery) (entities.ItemPage, error) {
+	if err := query.Validate(); err != nil {
+		return entities.ItemPage{}, err
+	}
+	var after *searchCursor
+	if query.Cursor != "" {
+		c, err := decodeSearchCursor(query.Cursor, query.Sort)
+		if err != nil {
+			return entities.ItemPage{}, err
+		}
+		after = &c
+	}
+	matches := index.Match(query.Text)
+
+	found := make([]entities.ItemWithStock, 0)
+	for _, item := range items {
+		if item.Retired || (query.Available && item.Available <= 0) {
+			continue
+		}
+		if matches != nil {
+			if _, ok := matches[item.SKU]; !ok {
+				continue
+			}
+		}
+		if !matchesBookFilters(item.Item, query) {
+			continue
+		}
+		if query.MinPrice != nil && (!item.Price.SameCurrency(*query.MinPrice) || item.Price.Cmp(*query.MinPrice) < 0) {
+			continue
+		}
+		if query.MaxPrice != nil && (!item.Price.SameCurrency(*query.MaxPrice) || item.Price.Cmp(*query.MaxPrice) > 0) {
+			continue
+		}
+		found = append(found, item)
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return cursorOf(found[i], query.Sort).compare(cursorOf(found[j], query.Sort)) < 0
+	})
+
+	start := 0
+	if after != nil {
+		start = sort.Search(len(found), func(i int) bool {
+			return cursorOf(found[i], query.Sort).compare(*after) > 0
+		})
+	}
+	end := start + query.Limit
+	if end > len(found) {
+		end = len(found)
+	}
+	page := entities.ItemPage{Items: found[start:end], Total: len(found)}
+	if end < len(found) {
+		page.NextCursor = cursorOf(found[end-1], query.Sort).encode()
+	}
+	return page, nil
+}
@@ -0,0 +1,184 @@
+package datastore_test
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+	"github.com/13thuser/bookstore/datastore"
+	"github.com/13thuser/bookstore/datastore/sqlite"
+)
+
+// testHelperSearch runs the query and fails the test on error
+func testHelperSearch(t *testing.T, store datastore.Store, query entities.ItemQuery) entities.ItemPage {
+	page, err := store.SearchItems(context.Background(), query)
+	if err != nil {
+		t.Fatalf("search %+v failed: %v", query, err)
+	}
+	return page
+}
+
+// skus returns the SKUs of the items of the page in order
+func skus(page entities.ItemPage) []string {
+	result := make([]string, len(page.Items))
+	for i, item := range page.Items {
+		result[i] = item.SKU
+	}
+	return result
+}
+
+func TestSearchItems(t *testing.T) {
+	ctx := context.Background()
+	for backend, store := range testHelperStores(t) {
+		t.Run(backend, func(t *testing.T) {
+			books := []datastore.Item{
+				{SKU: "dune", Name: "Dune", Authors: []string{"Frank Herbert"}, Description: "Spice, sand and politics on Arrakis.", Price: entities.MustParseMoney("9.99", "USD")},
+				{SKU: "dune-messiah", Name: "Dune Messiah", Authors: []string{"Frank Herbert"}, Price: entities.MustParseMoney("8.99", "USD")},
+				{SKU: "emma", Name: "Emma", Authors: []string{"Jane Austen"}, Description: "A comedy of manners.", Price: entities.MustParseMoney("4.50", "USD")},
+				{SKU: "hyperion", Name: "Hyperion", Authors: []string{"Dan Simmons"}, Description: "Pilgrims travel to the Time Tombs, sand everywhere.", Price: entities.MustParseMoney("12.00", "USD")},
+			}
+			for _, book := range books {
+				if err := store.CreateItem(ctx, book, 1); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := store.AddToCart(ctx, "user", "hyperion", 1); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, tc := range []struct {
+				query entities.ItemQuery
+				want  []string
+			}{
+				{entities.ItemQuery{Text: "herbert"}, []string{"dune", "dune-messiah"}},
+				{entities.ItemQuery{Text: "DUNE  messiah!"}, []string{"dune-messiah"}},
+				{entities.ItemQuery{Text: "sand"}, []string{"dune", "hyperion"}},
+				{entities.ItemQuery{Text: "austen comedy"}, []string{"emma"}},
+				{entities.ItemQuery{Text: "tolkien"}, []string{}},
+				{entities.ItemQuery{Text: "sand", Available: true}, []string{"dune"}},
+				{entities.ItemQuery{Text: "herbert", Sort: entities.ItemSortPrice}, []string{"dune-messiah", "dune"}},
+				{entities.ItemQuery{Text: "herbert", Sort: entities.ItemSortNameDesc}, []string{"dune-messiah", "dune"}},
+				{entities.ItemQuery{Sort: entities.ItemSortNewest, Limit: 2}, []string{"hyperion", "emma"}},
+				{entities.ItemQuery{Sort: entities.ItemSortPriceDesc, Limit: 2}, []string{"item-3", "item-2"}},
+			} {
+				if got := skus(testHelperSearch(t, store, tc.query)); fmt.Sprint(got) != fmt.Sprint(tc.want) {
+					t.Errorf("search %+v: expected %v, got %v", tc.query, tc.want, got)
+				}
+			}
+
+			min, max := entities.MustParseMoney("5", "USD"), entities.MustParseMoney("10", "USD")
+			page := testHelperSearch(t, store, entities.ItemQuery{MinPrice: &min, MaxPrice: &max})
+			if got := skus(page); fmt.Sprint(got) != "[dune dune-messiah]" || page.Total != 2 {
+				t.Errorf("expected the items between 5 and 10 USD, got %v (total %d)", got, page.Total)
+			}
+			eur := entities.MustParseMoney("5", "EUR")
+			if page := testHelperSearch(t, store, entities.ItemQuery{MinPrice: &eur}); page.Total != 0 {
+				t.Errorf("expected no item priced in EUR, got %v", skus(page))
+			}
+
+			// the index follows the updates and retired items are not sold anymore
+			update := books[0]
+			update.Name, update.Authors, update.Description = "Children of Dune", nil, ""
+			if _, err := store.UpdateItem(ctx, update); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.RetireItem(ctx, "emma"); err != nil {
+				t.Fatal(err)
+			}
+			for text, want := range map[string]string{"herbert": "[dune-messiah]", "children": "[dune]", "austen": "[]"} {
+				if got := skus(testHelperSearch(t, store, entities.ItemQuery{Text: text})); fmt.Sprint(got) != want {
+					t.Errorf("search %q after updates: expected %s, got %v", text, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestSearchItemsPagination(t *testing.T) {
+	ctx := context.Background()
+	for backend, store := range testHelperStores(t) {
+		t.Run(backend, func(t *testing.T) {
+			for i := 0; i < 25; i++ {
+				// a few items share a price so the pages rely on the SKU to break ties
+				item := datastore.Item{SKU: fmt.Sprintf("book-%02d", i), Name: fmt.Sprintf("Book %d", i), Price: entities.NewMoney(int64(100*(i%5)), "USD")}
+				if err := store.CreateItem(ctx, item, 1); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for _, order := range []entities.ItemSort{entities.ItemSortName, entities.ItemSortPrice, entities.ItemSortPriceDesc, entities.ItemSortNewest} {
+				query := entities.ItemQuery{Text: "book", Sort: order, Limit: 10}
+				var all []string
+				pages := 0
+				for {
+					page := testHelperSearch(t, store, query)
+					pages++
+					if page.Total != 25 {
+						t.Errorf("sort %s: expected a total of 25, got %d", order, page.Total)
+					}
+					all = append(all, skus(page)...)
+					if page.NextCursor == "" {
+						break
+					}
+					query.Cursor = page.NextCursor
+				}
+				seen := make(map[string]bool)
+				for _, sku := range all {
+					if seen[sku] {
+						t.Errorf("sort %s: %s is on more than one page", order, sku)
+					}
+					seen[sku] = true
+				}
+				if len(all) != 25 || pages != 3 {
+					t.Errorf("sort %s: expected 25 items on 3 pages, got %d on %d", order, len(all), pages)
+				}
+			}
+
+			if _, err := store.SearchItems(ctx, entities.ItemQuery{Sort: entities.ItemSortPrice, Cursor: "garbage"}); err == nil {
+				t.Error("expected an invalid cursor to be rejected")
+			}
+			first := testHelperSearch(t, store, entities.ItemQuery{Sort: entities.ItemSortPrice, Limit: 1})
+			if _, err := store.SearchItems(ctx, entities.ItemQuery{Sort: entities.ItemSortName, Cursor: first.NextCursor}); err == nil {
+				t.Error("expected the cursor of another sort to be rejected")
+			}
+		})
+	}
+}
+
+func TestSearchItemsChangedByAnotherProcess(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "bookstore.db")
+	server, err := sqlite.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	if page := testHelperSearch(t, server, entities.ItemQuery{Text: "dune"}); page.Total != 0 {
+		t.Fatalf("expected an empty catalog, got %v", skus(page))
+	}
+
+	// the catalog command imports into the same database file
+	importer, err := sqlite.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := importer.CreateItem(ctx, datastore.Item{SKU: "dune", Name: "Dune", Price: entities.MustParseMoney("9.99", "USD")}, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := importer.UpdateItem(ctx, datastore.Item{SKU: "dune", Name: "Dune", Authors: []string{"Frank Herbert"}, Price: entities.MustParseMoney("9.99", "USD")}); err != nil {
+		t.Fatal(err)
+	}
+	importer.Close()
+
+	if got := skus(testHelperSearch(t, server, entities.ItemQuery{Text: "herbert"})); len(got) != 1 || got[0] != "dune" {
+		t.Errorf("expected the imported item to be found, got %v", got)
+	}
+	if err := server.CreateItem(ctx, datastore.Item{SKU: "emma", Name: "Emma", Price: entities.MustParseMoney("4.50", "USD")}, 1); err != nil {
+		t.Fatal(err)
+	}
+	if got := skus(testHelperSearch(t, server, entities.ItemQuery{Text: "emma"})); len(got) != 1 || got[0] != "emma" {
+		t.Errorf("expected the item added by the server to be found, got %v", got)
+	}
+}
@@ -1,45 +1,44 @@
 package datastore
 
-import "context"
+import (
+	"context"
+	"errors"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+)
 
 // This is the seedData function that is used to seed the datastore with some initial data
 
-// seedData seeds the datastore with some initial data
-func (ds *Datastore) seedItemData() {
+// SeedItems seeds the catalog with some initial items
+func SeedItems(ctx context.Context, catalog CatalogRepository) error {
 	// Add some items to the inventory
-	ds.AddItem(context.Background(), Item{
-		SKU:   "item-1",
-		Name:  "Item 1",
-		Price: 100.00,
-	}, 2)
-	ds.AddItem(context.Background(), Item{
-		SKU:   "item-2",
-		Name:  "Item 2",
-		Price: 200.00,
-	}, 2)
-	ds.AddItem(context.Background(), Item{
-		SKU:   "item-3",
-		Name:  "Item 3",
-		Price: 300.00,
-	}, 2)
+	items := []Item{
+		{SKU: "item-1", Name: "Item 1", Price: entities.MustParseMoney("100.00", "USD")},
+		{SKU: "item-2", Name: "Item 2", Price: entities.MustParseMoney("200.00", "USD")},
+		{SKU: "item-3", Name: "Item 3", Price: entities.MustParseMoney("300.00", "USD")},
+	}
+	for _, item := range items {
+		if err := catalog.AddItem(ctx, item, 2); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// seedData seeds the datastore with some initial data
-func (us *UserStore) seedData() {
-	us.AddUser("test", "Test User", "test")
-	us.AddUser("admin", "Admin User", "admin")
+// SeedAdmin creates the administrator with the password, unless the user
+// already exists; the password is not checked against the password policy
+func SeedAdmin(users UserRepository, userID UserID, password string) error {
+	if _, err := users.GetUser(userID); !errors.Is(err, ErrUserNotFound) {
+		return err
+	}
+	if err := users.AddUser(userID, "Admin User", password); err != nil {
+		return err
+	}
+	_, err := users.SetRoles(userID, []entities.Role{entities.RoleCustomer, entities.RoleAdmin})
+	return err
 }
 
 // seedData seeds the datastore with some initial data
-func (us *SessionStore) seedData() {
-	us.sessions["test"] = "test"
-	us.users["test"] = User{
-		ID:   "test",
-		Name: "Test User",
-	}
-	us.sessions["admin"] = "admin"
-	us.users["admin"] = User{
-		ID:   "admin",
-		Name: "Admin User",
-	}
+func (ds *Datastore) seedItemData() {
+	SeedItems(context.Background(), ds)
 }
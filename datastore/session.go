@@ -2,32 +2,47 @@ package datastore
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
 )
 
 // TokenID defines the type for the session ID
 type TokenID = string
 
-// SessionStore defines the structure of the session store
-type SessionStore struct {
-	sessions map[TokenID]UserID
-	users    map[UserID]User
+// Session defines the structure of a session
+type Session = entities.Session
+
+// SessionPolicy defines how long sessions and their tokens are valid
+type SessionPolicy struct {
+	// AccessTTL is how long an access token is valid before it must be refreshed
+	AccessTTL time.Duration
+	// IdleTimeout ends sessions that have not been used for that long
+	IdleTimeout time.Duration
+	// AbsoluteTimeout ends sessions that long after the login, refreshing does not extend it
+	AbsoluteTimeout time.Duration
 }
 
-// NewSessionStore creates a new session store
-func NewSessionStore() *SessionStore {
-	ss := &SessionStore{
-		sessions: make(map[TokenID]UserID),
-		users:    make(map[UserID]User),
-	}
-	// TODO: Remove this
-	ss.seedData()
-	return ss
+// DefaultSessionPolicy is the session policy of new session stores
+var DefaultSessionPolicy = SessionPolicy{
+	AccessTTL:       15 * time.Minute,
+	IdleTimeout:     24 * time.Hour,
+	AbsoluteTimeout: 7 * 24 * time.Hour,
 }
 
-// createNewSessionID creates a new session ID
-func (s *SessionStore) createNewSessionID() (TokenID, error) {
+// Active reports whether the session has neither been idle for too long nor reached its absolute expiry
+func (p SessionPolicy) Active(session Session, now time.Time) bool {
+	return now.Before(session.ExpiresAt) && now.Before(session.LastSeenAt.Add(p.IdleTimeout))
+}
+
+// newSessionToken creates a new random token
+func newSessionToken() (string, error) {
 	b := make([]byte, 32)
 	if _, err := rand.Read(b); err != nil {
 		return "", fmt.Errorf("unable to create session")
@@ -35,31 +50,233 @@ func (s *SessionStore) createNewSessionID() (TokenID, error) {
 	return base64.URLEncoding.EncodeToString(b), nil
 }
 
+// HashSessionToken hashes a token for storage, so that a leaked store does not leak usable tokens
+func HashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewSession starts a session of the user and issues its tokens
+func (p SessionPolicy) NewSession(userID UserID, userAgent string, now time.Time) (Session, entities.SessionTokens, error) {
+	id, err := newSessionToken()
+	if err != nil {
+		return Session{}, entities.SessionTokens{}, err
+	}
+	session := Session{
+		ID:        id[:16],
+		UserID:    userID,
+		UserAgent: userAgent,
+		CreatedAt: now,
+		ExpiresAt: now.Add(p.AbsoluteTimeout),
+	}
+	tokens, err := p.RotateTokens(&session, now)
+	return session, tokens, err
+}
+
+// RotateTokens issues new tokens for the session and marks it as seen
+func (p SessionPolicy) RotateTokens(session *Session, now time.Time) (entities.SessionTokens, error) {
+	access, err := newSessionToken()
+	if err != nil {
+		return entities.SessionTokens{}, err
+	}
+	refresh, err := newSessionToken()
+	if err != nil {
+		return entities.SessionTokens{}, err
+	}
+	session.LastSeenAt = now
+	session.AccessExpiresAt = now.Add(p.AccessTTL)
+	if session.AccessExpiresAt.After(session.ExpiresAt) {
+		session.AccessExpiresAt = session.ExpiresAt
+	}
+	return entities.SessionTokens{
+		SessionID:    session.ID,
+		Token:        access,
+		RefreshToken: refresh,
+		ExpiresAt:    session.AccessExpiresAt,
+	}, nil
+}
+
+// sessionRecord holds a session along with the hashes of its tokens
+type sessionRecord struct {
+	// seq orders the sessions created within the same clock tick
+	seq         int
+	session     Session
+	accessHash  string
+	refreshHash string
+	// previousRefreshHash is the refresh token replaced by the last rotation,
+	// seeing it again means it was stolen and the session is revoked
+	previousRefreshHash string
+}
+
+// SessionStore defines the structure of the session store
+type SessionStore struct {
+	mu       sync.RWMutex
+	policy   SessionPolicy
+	sessions map[string]*sessionRecord
+	// byAccess and byRefresh index the sessions by the hashes of their tokens
+	byAccess  map[string]*sessionRecord
+	byRefresh map[string]*sessionRecord
+	seq       int
+}
+
 // NewSessionStore creates a new session store
-func (s *SessionStore) AddSession(userID string, user *User) (TokenID, error) {
-	if prevSessionID, ok := s.sessions[userID]; ok {
-		return prevSessionID, fmt.Errorf("session already exists for the user")
+func NewSessionStore() *SessionStore {
+	return &SessionStore{
+		policy:    DefaultSessionPolicy,
+		sessions:  make(map[string]*sessionRecord),
+		byAccess:  make(map[string]*sessionRecord),
+		byRefresh: make(map[string]*sessionRecord),
 	}
-	sessionID, err := s.createNewSessionID()
+}
+
+// SetSessionPolicy sets how long sessions and their tokens are valid
+func (s *SessionStore) SetSessionPolicy(policy SessionPolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.policy = policy
+}
+
+// AddSession starts a new session for the user and returns its tokens
+func (s *SessionStore) AddSession(userID UserID, userAgent string) (entities.SessionTokens, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, tokens, err := s.policy.NewSession(userID, userAgent, time.Now())
 	if err != nil {
-		return "", err
+		return entities.SessionTokens{}, err
+	}
+	s.seq++
+	record := &sessionRecord{seq: s.seq, session: session}
+	s.sessions[session.ID] = record
+	s.index(record, tokens)
+	return tokens, nil
+}
+
+// index indexes the session by the hashes of its new tokens
+func (s *SessionStore) index(record *sessionRecord, tokens entities.SessionTokens) {
+	delete(s.byAccess, record.accessHash)
+	delete(s.byRefresh, record.previousRefreshHash)
+	record.previousRefreshHash = record.refreshHash
+	record.accessHash = HashSessionToken(tokens.Token)
+	record.refreshHash = HashSessionToken(tokens.RefreshToken)
+	s.byAccess[record.accessHash] = record
+	s.byRefresh[record.refreshHash] = record
+}
 
+// remove forgets the session and its tokens
+func (s *SessionStore) remove(record *sessionRecord) {
+	delete(s.sessions, record.session.ID)
+	delete(s.byAccess, record.accessHash)
+	delete(s.byRefresh, record.refreshHash)
+	delete(s.byRefresh, record.previousRefreshHash)
+}
+
+// GetSession gets the active session of the access token and marks it as seen
+func (s *SessionStore) GetSession(tokenID TokenID) (Session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, ok := s.byAccess[HashSessionToken(tokenID)]
+	now := time.Now()
+	if !ok || !now.Before(record.session.AccessExpiresAt) || !s.policy.Active(record.session, now) {
+		return Session{}, false
 	}
-	s.sessions[sessionID] = user.ID
-	return sessionID, nil
+	record.session.LastSeenAt = now
+	return record.session, true
+}
+
+// GetUserID gets the user ID of the active session of the access token
+func (s *SessionStore) GetUserID(tokenID TokenID) UserID {
+	session, _ := s.GetSession(tokenID)
+	return session.UserID
 }
 
-// RemoveSession removes a session from the session store based on the user ID
-func (s *SessionStore) RemoveSession(userID string) {
-	// check if user exists
-	_, ok := s.sessions[userID]
+// RefreshSession issues new tokens for the session of the refresh token; the
+// refresh token can only be used once
+func (s *SessionStore) RefreshSession(refreshToken string) (entities.SessionTokens, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hash := HashSessionToken(refreshToken)
+	record, ok := s.byRefresh[hash]
 	if !ok {
-		return
+		return entities.SessionTokens{}, ErrInvalidRefreshToken
+	}
+	now := time.Now()
+	if hash != record.refreshHash || !s.policy.Active(record.session, now) {
+		s.remove(record)
+		return entities.SessionTokens{}, ErrInvalidRefreshToken
+	}
+	tokens, err := s.policy.RotateTokens(&record.session, now)
+	if err != nil {
+		return entities.SessionTokens{}, err
 	}
-	delete(s.sessions, userID)
+	s.index(record, tokens)
+	return tokens, nil
 }
 
-// GetUserID retrieves a session from the session store based on the user ID
-func (s *SessionStore) GetUserID(tokenID string) UserID {
-	return s.sessions[tokenID]
+// RemoveSession ends the session of the access token
+func (s *SessionStore) RemoveSession(tokenID TokenID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if record, ok := s.byAccess[HashSessionToken(tokenID)]; ok {
+		s.remove(record)
+	}
+}
+
+// ListSessions lists the active sessions of the user, latest first
+func (s *SessionStore) ListSessions(userID UserID) ([]Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := time.Now()
+	records := []*sessionRecord{}
+	for _, record := range s.sessions {
+		if record.session.UserID == userID && s.policy.Active(record.session, now) {
+			records = append(records, record)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].seq > records[j].seq })
+	sessions := make([]Session, len(records))
+	for i, record := range records {
+		sessions[i] = record.session
+	}
+	return sessions, nil
+}
+
+// RevokeSession ends a session of the user
+func (s *SessionStore) RevokeSession(userID UserID, sessionID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, ok := s.sessions[sessionID]
+	if !ok || record.session.UserID != userID {
+		return ErrSessionNotFound
+	}
+	s.remove(record)
+	return nil
+}
+
+// RevokeAllSessions ends all the sessions of the user and returns how many there were
+func (s *SessionStore) RevokeAllSessions(userID UserID) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	revoked := 0
+	for _, record := range s.sessions {
+		if record.session.UserID == userID {
+			s.remove(record)
+			revoked++
+		}
+	}
+	return revoked, nil
+}
+
+// RemoveExpiredSessions forgets the expired sessions and returns how many there were
+func (s *SessionStore) RemoveExpiredSessions() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	removed := 0
+	for _, record := range s.sessions {
+		if !s.policy.Active(record.session, now) {
+			s.remove(record)
+			removed++
+		}
+	}
+	return removed, nil
 }
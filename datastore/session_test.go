@@ -0,0 +1,162 @@
+package datastore_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/13thuser/bookstore/datastore"
+	"github.com/13thuser/bookstore/datastore/sqlite"
+)
+
+// testHelperSessionStores returns a fresh session store of every backend
+func testHelperSessionStores(t *testing.T) map[string]datastore.SessionRepository {
+	db, err := sqlite.Open(filepath.Join(t.TempDir(), "bookstore.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return map[string]datastore.SessionRepository{
+		"memory": datastore.NewSessionStore(),
+		"sqlite": db,
+	}
+}
+
+func TestSessionsPerDevice(t *testing.T) {
+	for backend, sessions := range testHelperSessionStores(t) {
+		t.Run(backend, func(t *testing.T) {
+			laptop, err := sessions.AddSession("user", "laptop")
+			if err != nil {
+				t.Fatal(err)
+			}
+			phone, err := sessions.AddSession("user", "phone")
+			if err != nil {
+				t.Fatal(err)
+			}
+			other, err := sessions.AddSession("other", "laptop")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, token := range []string{laptop.Token, phone.Token} {
+				if userID := sessions.GetUserID(token); userID != "user" {
+					t.Errorf("expected the token to belong to user, got %q", userID)
+				}
+			}
+			if userID := sessions.GetUserID(laptop.RefreshToken); userID != "" {
+				t.Errorf("expected a refresh token not to be usable as an access token, got %q", userID)
+			}
+
+			list, err := sessions.ListSessions("user")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(list) != 2 || list[0].ID != phone.SessionID || list[0].UserAgent != "phone" {
+				t.Errorf("expected the phone and laptop sessions, latest first, got %+v", list)
+			}
+
+			if err := sessions.RevokeSession("user", other.SessionID); err != datastore.ErrSessionNotFound {
+				t.Errorf("expected revoking the session of another user to fail with ErrSessionNotFound, got %v", err)
+			}
+			if err := sessions.RevokeSession("user", phone.SessionID); err != nil {
+				t.Fatal(err)
+			}
+			if userID := sessions.GetUserID(phone.Token); userID != "" {
+				t.Errorf("expected the revoked session to be gone, got %q", userID)
+			}
+			if _, err := sessions.RefreshSession(phone.RefreshToken); err == nil {
+				t.Error("expected the refresh token of the revoked session to be rejected")
+			}
+
+			sessions.RemoveSession(laptop.Token)
+			if userID := sessions.GetUserID(laptop.Token); userID != "" {
+				t.Errorf("expected the removed session to be gone, got %q", userID)
+			}
+			if n, err := sessions.RevokeAllSessions("other"); err != nil || n != 1 {
+				t.Errorf("expected to revoke the only session of other, got %d (%v)", n, err)
+			}
+			if userID := sessions.GetUserID(other.Token); userID != "" {
+				t.Errorf("expected the sessions of other to be gone, got %q", userID)
+			}
+		})
+	}
+}
+
+func TestSessionRefreshRotatesTokens(t *testing.T) {
+	for backend, sessions := range testHelperSessionStores(t) {
+		t.Run(backend, func(t *testing.T) {
+			first, err := sessions.AddSession("user", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			second, err := sessions.RefreshSession(first.RefreshToken)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if second.SessionID != first.SessionID || second.Token == first.Token || second.RefreshToken == first.RefreshToken {
+				t.Errorf("expected new tokens for the same session, got %+v after %+v", second, first)
+			}
+			if userID := sessions.GetUserID(first.Token); userID != "" {
+				t.Errorf("expected the previous access token to be replaced, got %q", userID)
+			}
+			if userID := sessions.GetUserID(second.Token); userID != "user" {
+				t.Errorf("expected the new access token to belong to user, got %q", userID)
+			}
+
+			// Replaying a rotated refresh token means it leaked, the session is revoked
+			if _, err := sessions.RefreshSession(first.RefreshToken); err != datastore.ErrInvalidRefreshToken {
+				t.Errorf("expected the rotated refresh token to be rejected, got %v", err)
+			}
+			if userID := sessions.GetUserID(second.Token); userID != "" {
+				t.Errorf("expected the session to be revoked after a refresh token replay, got %q", userID)
+			}
+			if _, err := sessions.RefreshSession(second.RefreshToken); err != datastore.ErrInvalidRefreshToken {
+				t.Errorf("expected the refresh token of the revoked session to be rejected, got %v", err)
+			}
+		})
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	for backend, sessions := range testHelperSessionStores(t) {
+		t.Run(backend, func(t *testing.T) {
+			// access tokens expire as soon as they are issued
+			sessions.SetSessionPolicy(datastore.SessionPolicy{AccessTTL: 0, IdleTimeout: time.Hour, AbsoluteTimeout: time.Hour})
+			tokens, err := sessions.AddSession("user", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if userID := sessions.GetUserID(tokens.Token); userID != "" {
+				t.Errorf("expected the expired access token to be rejected, got %q", userID)
+			}
+			if _, err := sessions.RefreshSession(tokens.RefreshToken); err != nil {
+				t.Errorf("expected the session to be refreshable once its access token expired: %v", err)
+			}
+
+			// sessions expire as soon as they are used
+			sessions.SetSessionPolicy(datastore.SessionPolicy{AccessTTL: time.Hour, IdleTimeout: 0, AbsoluteTimeout: time.Hour})
+			idle, err := sessions.AddSession("user", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if userID := sessions.GetUserID(idle.Token); userID != "" {
+				t.Errorf("expected the idle session to be rejected, got %q", userID)
+			}
+			if list, _ := sessions.ListSessions("user"); len(list) != 0 {
+				t.Errorf("expected no active session, got %d", len(list))
+			}
+			if n, err := sessions.RemoveExpiredSessions(); err != nil || n != 2 {
+				t.Errorf("expected the 2 idle sessions to be removed, got %d (%v)", n, err)
+			}
+
+			// refreshing does not extend the absolute expiry
+			sessions.SetSessionPolicy(datastore.SessionPolicy{AccessTTL: time.Hour, IdleTimeout: time.Hour, AbsoluteTimeout: 0})
+			ended, err := sessions.AddSession("user", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := sessions.RefreshSession(ended.RefreshToken); err != datastore.ErrInvalidRefreshToken {
+				t.Errorf("expected the ended session not to be refreshable, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+	"github.com/13thuser/bookstore/datastore"
+)
+
+// CreateAddress adds an address to the address book of the user and returns it with its new ID
+func (s *Store) CreateAddress(ctx context.Context, userID UserID, address entities.Address) (entities.SavedAddress, error) {
+	id, err := datastore.NewAddressID()
+	if err != nil {
+		return entities.SavedAddress{}, err
+	}
+	data, err := json.Marshal(address)
+	if err != nil {
+		return entities.SavedAddress{}, err
+	}
+	if _, err := s.db.ExecContext(ctx, `INSERT INTO addresses (id, user_id, data) VALUES (?, ?, ?)`, id, userID, data); err != nil {
+		return entities.SavedAddress{}, err
+	}
+	return entities.SavedAddress{ID: id, Address: address}, nil
+}
+
+// UpdateAddress replaces an address of the address book of the user
+func (s *Store) UpdateAddress(ctx context.Context, userID UserID, address entities.SavedAddress) error {
+	data, err := json.Marshal(address.Address)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.ExecContext(ctx, `UPDATE addresses SET data = ? WHERE id = ? AND user_id = ?`, data, address.ID, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return datastore.ErrAddressNotFound
+	}
+	return nil
+}
+
+// DeleteAddress removes an address from the address book of the user
+func (s *Store) DeleteAddress(ctx context.Context, userID UserID, addressID string) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM addresses WHERE id = ? AND user_id = ?`, addressID, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return datastore.ErrAddressNotFound
+	}
+	return nil
+}
+
+// GetAddress gets an address of the address book of the user by its ID
+func (s *Store) GetAddress(ctx context.Context, userID UserID, addressID string) (entities.SavedAddress, error) {
+	var data []byte
+	err := s.db.QueryRowContext(ctx, `SELECT data FROM addresses WHERE id = ? AND user_id = ?`, addressID, userID).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return entities.SavedAddress{}, datastore.ErrAddressNotFound
+	}
+	if err != nil {
+		return entities.SavedAddress{}, err
+	}
+	saved := entities.SavedAddress{ID: addressID}
+	if err := json.Unmarshal(data, &saved.Address); err != nil {
+		return entities.SavedAddress{}, err
+	}
+	return saved, nil
+}
+
+// ListAddresses lists the address book of the user, oldest first
+func (s *Store) ListAddresses(ctx context.Context, userID UserID) ([]entities.SavedAddress, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, data FROM addresses WHERE user_id = ? ORDER BY rowid`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	addresses := make([]entities.SavedAddress, 0)
+	for rows.Next() {
+		var saved entities.SavedAddress
+		var data []byte
+		if err := rows.Scan(&saved.ID, &data); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &saved.Address); err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, saved)
+	}
+	return addresses, rows.Err()
+}
@@ -0,0 +1,40 @@
+package sqlite
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+)
+
+// RecordCatalogChange appends a change to the audit trail of the catalog
+func (s *Store) RecordCatalogChange(ctx context.Context, change entities.CatalogChange) error {
+	data, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `INSERT INTO catalog_changes (sku, data) VALUES (?, ?)`, change.SKU, data)
+	return err
+}
+
+// ListCatalogChanges lists the changes made to an item, oldest first
+func (s *Store) ListCatalogChanges(ctx context.Context, sku SKU) ([]entities.CatalogChange, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT data FROM catalog_changes WHERE sku = ? ORDER BY seq`, sku)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	changes := make([]entities.CatalogChange, 0)
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var change entities.CatalogChange
+		if err := json.Unmarshal(data, &change); err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	return changes, rows.Err()
+}
@@ -0,0 +1,71 @@
+package sqlite
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/13thuser/bookstore/datastore"
+)
+
+// BeginIdempotentRequest claims the key of the record for its request, see datastore.IdempotencyRepository
+func (s *Store) BeginIdempotentRequest(record datastore.IdempotencyRecord) (datastore.IdempotencyRecord, bool, error) {
+	if _, err := s.db.Exec(`DELETE FROM idempotency_keys WHERE user_id = ? AND key = ? AND expires_at <= ?`,
+		record.UserID, record.Key, record.CreatedAt.UnixMilli()); err != nil {
+		return datastore.IdempotencyRecord{}, false, err
+	}
+	res, err := s.db.Exec(`INSERT INTO idempotency_keys (user_id, key, fingerprint, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?) ON CONFLICT (user_id, key) DO NOTHING`,
+		record.UserID, record.Key, record.Fingerprint, record.CreatedAt.UnixMilli(), record.ExpiresAt.UnixMilli())
+	if err != nil {
+		return datastore.IdempotencyRecord{}, false, err
+	}
+	claimed, err := res.RowsAffected()
+	if err != nil {
+		return datastore.IdempotencyRecord{}, false, err
+	}
+	if claimed == 1 {
+		record.Response = nil
+		return record, true, nil
+	}
+
+	existing := datastore.IdempotencyRecord{UserID: record.UserID, Key: record.Key}
+	var statusCode sql.NullInt64
+	var contentType string
+	var body []byte
+	var createdAt, expiresAt int64
+	err = s.db.QueryRow(`SELECT fingerprint, status_code, content_type, body, created_at, expires_at
+		FROM idempotency_keys WHERE user_id = ? AND key = ?`, record.UserID, record.Key).
+		Scan(&existing.Fingerprint, &statusCode, &contentType, &body, &createdAt, &expiresAt)
+	if err != nil {
+		return datastore.IdempotencyRecord{}, false, err
+	}
+	if statusCode.Valid {
+		existing.Response = &datastore.IdempotentResponse{StatusCode: int(statusCode.Int64), ContentType: contentType, Body: body}
+	}
+	existing.CreatedAt = time.UnixMilli(createdAt)
+	existing.ExpiresAt = time.UnixMilli(expiresAt)
+	return existing, false, nil
+}
+
+// CompleteIdempotentRequest stores the response to the request of a claimed key
+func (s *Store) CompleteIdempotentRequest(userID UserID, key string, response datastore.IdempotentResponse) error {
+	_, err := s.db.Exec(`UPDATE idempotency_keys SET status_code = ?, content_type = ?, body = ? WHERE user_id = ? AND key = ?`,
+		response.StatusCode, response.ContentType, response.Body, userID, key)
+	return err
+}
+
+// ReleaseIdempotencyKey forgets a claimed key, so that its request can be retried
+func (s *Store) ReleaseIdempotencyKey(userID UserID, key string) error {
+	_, err := s.db.Exec(`DELETE FROM idempotency_keys WHERE user_id = ? AND key = ?`, userID, key)
+	return err
+}
+
+// RemoveExpiredIdempotencyKeys forgets the expired keys and returns how many there were
+func (s *Store) RemoveExpiredIdempotencyKeys() (int, error) {
+	res, err := s.db.Exec(`DELETE FROM idempotency_keys WHERE expires_at <= ?`, time.Now().UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	removed, err := res.RowsAffected()
+	return int(removed), err
+}
@@ -0,0 +1,176 @@
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// migrations holds the schema changes in the order they must be applied; the
+// version of a migration is its index plus one. Never edit an existing entry,
+// append a new one instead.
+//
+// Items and orders are stored as JSON documents so the entity structs can grow
+// without a migration for every new field.
+var migrations = []string{
+	// 1: initial schema
+	`CREATE TABLE items (
+		sku  TEXT PRIMARY KEY,
+		data TEXT NOT NULL
+	);
+	CREATE TABLE inventory (
+		sku      TEXT PRIMARY KEY REFERENCES items(sku),
+		quantity INTEGER NOT NULL
+	);
+	CREATE TABLE cart_items (
+		user_id  TEXT NOT NULL,
+		sku      TEXT NOT NULL REFERENCES items(sku),
+		quantity INTEGER NOT NULL,
+		PRIMARY KEY (user_id, sku)
+	);
+	CREATE TABLE orders (
+		seq     INTEGER PRIMARY KEY AUTOINCREMENT,
+		id      TEXT NOT NULL UNIQUE,
+		user_id TEXT NOT NULL,
+		data    TEXT NOT NULL
+	);
+	CREATE INDEX orders_user_id ON orders (user_id);
+	CREATE TABLE users (
+		id       TEXT PRIMARY KEY,
+		name     TEXT NOT NULL,
+		password TEXT NOT NULL
+	);
+	CREATE TABLE sessions (
+		token   TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL
+	);`,
+	// 2: order status, orders created before it are paid once they have a payment confirmation
+	`ALTER TABLE orders ADD COLUMN status TEXT NOT NULL DEFAULT 'pending_payment';
+	UPDATE orders SET status = 'paid' WHERE COALESCE(json_extract(data, '$.payment_confirmation'), '') != '';
+	CREATE INDEX orders_status ON orders (status);`,
+	// 3: stock reserved by carts, expires_at is in unix milliseconds
+	`CREATE TABLE reservations (
+		user_id    TEXT NOT NULL,
+		sku        TEXT NOT NULL REFERENCES items(sku),
+		quantity   INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL,
+		PRIMARY KEY (user_id, sku)
+	);
+	CREATE INDEX reservations_sku ON reservations (sku, expires_at);`,
+	// 4: audit trail of the catalog
+	`CREATE TABLE catalog_changes (
+		seq  INTEGER PRIMARY KEY AUTOINCREMENT,
+		sku  TEXT NOT NULL,
+		data TEXT NOT NULL
+	);
+	CREATE INDEX catalog_changes_sku ON catalog_changes (sku);`,
+	// 5: roles of the users as a JSON array, the seeded admin user becomes an admin
+	`ALTER TABLE users ADD COLUMN roles TEXT NOT NULL DEFAULT '["customer"]';
+	UPDATE users SET roles = '["customer","admin"]' WHERE id = 'admin' AND name = 'Admin User';`,
+	// 6: expiring sessions with refresh tokens, tokens are stored hashed so the
+	// sessions of the previous schema cannot be kept and users log in again
+	`DROP TABLE sessions;
+	CREATE TABLE sessions (
+		id                    TEXT PRIMARY KEY,
+		user_id               TEXT NOT NULL,
+		user_agent            TEXT NOT NULL DEFAULT '',
+		access_hash           TEXT NOT NULL UNIQUE,
+		refresh_hash          TEXT NOT NULL UNIQUE,
+		previous_refresh_hash TEXT,
+		created_at            INTEGER NOT NULL,
+		last_seen_at          INTEGER NOT NULL,
+		access_expires_at     INTEGER NOT NULL,
+		expires_at            INTEGER NOT NULL
+	);
+	CREATE INDEX sessions_user_id ON sessions (user_id);
+	CREATE INDEX sessions_previous_refresh_hash ON sessions (previous_refresh_hash);`,
+	// 7: promotions and the coupons applied to the carts, the orders placed
+	// before promotions existed are due their total price
+	`CREATE TABLE promotions (
+		id   TEXT PRIMARY KEY,
+		code TEXT UNIQUE,
+		data TEXT NOT NULL
+	);
+	CREATE TABLE cart_coupons (
+		user_id TEXT PRIMARY KEY,
+		code    TEXT NOT NULL
+	);
+	UPDATE orders SET data = json_set(data, '$.amount_due', json(json_extract(data, '$.TotalPrice')))
+		WHERE json_extract(data, '$.TotalPrice') IS NOT NULL;`,
+	// 8: address books of the users
+	`CREATE TABLE addresses (
+		id      TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		data    TEXT NOT NULL
+	);
+	CREATE INDEX addresses_user_id ON addresses (user_id);`,
+	// 9: responses to the requests made with an idempotency key, the
+	// status code is NULL while the request is being processed
+	`CREATE TABLE idempotency_keys (
+		user_id      TEXT NOT NULL,
+		key          TEXT NOT NULL,
+		fingerprint  TEXT NOT NULL,
+		status_code  INTEGER,
+		content_type TEXT NOT NULL DEFAULT '',
+		body         BLOB,
+		created_at   INTEGER NOT NULL,
+		expires_at   INTEGER NOT NULL,
+		PRIMARY KEY (user_id, key)
+	);
+	CREATE INDEX idempotency_keys_expires_at ON idempotency_keys (expires_at);`,
+	// 10: the cards the users saved to pay with, as tokens of the vault
+	`CREATE TABLE payment_methods (
+		id         TEXT PRIMARY KEY,
+		user_id    TEXT NOT NULL,
+		data       TEXT NOT NULL,
+		is_default INTEGER NOT NULL DEFAULT 0,
+		created_at INTEGER NOT NULL
+	);
+	CREATE INDEX payment_methods_user_id ON payment_methods (user_id);`,
+	// 11: the cards of the tokens of the vault, without their CVV
+	`CREATE TABLE vault_cards (
+		token       TEXT PRIMARY KEY,
+		user_id     TEXT NOT NULL,
+		fingerprint TEXT NOT NULL UNIQUE,
+		data        TEXT NOT NULL
+	);`,
+	// 12: the idempotency keys fingerprinted before the fingerprints were
+	// keyed, they were hashes of the bodies of the requests, passwords included
+	`DELETE FROM idempotency_keys;`,
+	// 13: the cards of the vault were kept with their number and an unkeyed
+	// fingerprint, only their token and brand, last four digits and expiry are
+	// kept; tokenizing them again gives new tokens
+	`UPDATE vault_cards SET fingerprint = 'legacy:' || token, data = json_remove(data, '$.details', '$.fingerprint');`,
+}
+
+// migrate applies the pending migrations, each one in its own transaction
+func migrate(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`); err != nil {
+		return fmt.Errorf("unable to create migrations table: %w", err)
+	}
+	var current int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return fmt.Errorf("unable to read schema version: %w", err)
+	}
+	for i := current; i < len(migrations); i++ {
+		version := i + 1
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d failed: %w", version, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version) VALUES (?)`, version); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d failed: %w", version, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migration %d failed: %w", version, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+	"github.com/13thuser/bookstore/datastore"
+)
+
+// CreatePaymentMethod saves a card of the user and returns it with its new ID,
+// as the default payment method when asked or when it is the first one
+func (s *Store) CreatePaymentMethod(ctx context.Context, userID UserID, card entities.PaymentCard, makeDefault bool) (entities.PaymentMethod, error) {
+	id, err := datastore.NewPaymentMethodID()
+	if err != nil {
+		return entities.PaymentMethod{}, err
+	}
+	data, err := json.Marshal(card)
+	if err != nil {
+		return entities.PaymentMethod{}, err
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return entities.PaymentMethod{}, err
+	}
+	defer tx.Rollback()
+	method := entities.PaymentMethod{ID: id, PaymentCard: card, Default: makeDefault, CreatedAt: time.Now()}
+	if !method.Default {
+		var saved int
+		if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM payment_methods WHERE user_id = ?`, userID).Scan(&saved); err != nil {
+			return entities.PaymentMethod{}, err
+		}
+		method.Default = saved == 0
+	}
+	if method.Default {
+		if _, err := tx.ExecContext(ctx, `UPDATE payment_methods SET is_default = 0 WHERE user_id = ?`, userID); err != nil {
+			return entities.PaymentMethod{}, err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO payment_methods (id, user_id, data, is_default, created_at) VALUES (?, ?, ?, ?, ?)`,
+		id, userID, data, method.Default, method.CreatedAt.UnixMilli()); err != nil {
+		return entities.PaymentMethod{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return entities.PaymentMethod{}, err
+	}
+	return method, nil
+}
+
+// DeletePaymentMethod removes a payment method of the user, the oldest one left becomes the default when it was
+func (s *Store) DeletePaymentMethod(ctx context.Context, userID UserID, paymentMethodID string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	method, err := getPaymentMethod(ctx, tx, userID, paymentMethodID)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM payment_methods WHERE id = ? AND user_id = ?`, paymentMethodID, userID); err != nil {
+		return err
+	}
+	if method.Default {
+		if _, err := tx.ExecContext(ctx, `UPDATE payment_methods SET is_default = 1
+			WHERE id = (SELECT id FROM payment_methods WHERE user_id = ? ORDER BY rowid LIMIT 1)`, userID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// SetDefaultPaymentMethod makes a payment method of the user the default one
+func (s *Store) SetDefaultPaymentMethod(ctx context.Context, userID UserID, paymentMethodID string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := getPaymentMethod(ctx, tx, userID, paymentMethodID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE payment_methods SET is_default = (id = ?) WHERE user_id = ?`, paymentMethodID, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetPaymentMethod gets a payment method of the user by its ID
+func (s *Store) GetPaymentMethod(ctx context.Context, userID UserID, paymentMethodID string) (entities.PaymentMethod, error) {
+	return getPaymentMethod(ctx, s.db, userID, paymentMethodID)
+}
+
+// ListPaymentMethods lists the payment methods of the user, oldest first
+func (s *Store) ListPaymentMethods(ctx context.Context, userID UserID) ([]entities.PaymentMethod, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, data, is_default, created_at FROM payment_methods WHERE user_id = ? ORDER BY rowid`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	methods := make([]entities.PaymentMethod, 0)
+	for rows.Next() {
+		method, err := scanPaymentMethod(rows)
+		if err != nil {
+			return nil, err
+		}
+		methods = append(methods, method)
+	}
+	return methods, rows.Err()
+}
+
+// getPaymentMethod gets a payment method of the user by its ID
+func getPaymentMethod(ctx context.Context, q querier, userID UserID, paymentMethodID string) (entities.PaymentMethod, error) {
+	row := q.QueryRowContext(ctx, `SELECT id, data, is_default, created_at FROM payment_methods WHERE id = ? AND user_id = ?`, paymentMethodID, userID)
+	method, err := scanPaymentMethod(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return entities.PaymentMethod{}, datastore.ErrPaymentMethodNotFound
+	}
+	return method, err
+}
+
+// scanPaymentMethod scans the id, data, is_default and created_at columns of a payment method
+func scanPaymentMethod(row interface{ Scan(...interface{}) error }) (entities.PaymentMethod, error) {
+	var method entities.PaymentMethod
+	var data []byte
+	var createdAt int64
+	if err := row.Scan(&method.ID, &data, &method.Default, &createdAt); err != nil {
+		return entities.PaymentMethod{}, err
+	}
+	if err := json.Unmarshal(data, &method.PaymentCard); err != nil {
+		return entities.PaymentMethod{}, err
+	}
+	method.CreatedAt = time.UnixMilli(createdAt)
+	return method, nil
+}
@@ -0,0 +1,123 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+	"github.com/13thuser/bookstore/datastore"
+)
+
+// CreatePromotion adds a promotion, failing with ErrPromotionExists if its ID or code is taken
+func (s *Store) CreatePromotion(ctx context.Context, promotion entities.Promotion) error {
+	data, err := json.Marshal(promotion)
+	if err != nil {
+		return err
+	}
+	// promotions without a code have a NULL code, which is never a duplicate
+	res, err := s.db.ExecContext(ctx, `INSERT OR IGNORE INTO promotions (id, code, data) VALUES (?, NULLIF(?, ''), ?)`,
+		promotion.ID, promotion.Code, data)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return datastore.ErrPromotionExists
+	}
+	return nil
+}
+
+// UpdatePromotion replaces an existing promotion, failing with ErrPromotionExists if its new code is taken
+func (s *Store) UpdatePromotion(ctx context.Context, promotion entities.Promotion) error {
+	data, err := json.Marshal(promotion)
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := getPromotion(ctx, tx, `id = ?`, promotion.ID); err != nil {
+		return err
+	}
+	res, err := tx.ExecContext(ctx, `UPDATE OR IGNORE promotions SET code = NULLIF(?, ''), data = ? WHERE id = ?`,
+		promotion.Code, data, promotion.ID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return datastore.ErrPromotionExists
+	}
+	return tx.Commit()
+}
+
+// GetPromotion gets a promotion by its ID
+func (s *Store) GetPromotion(ctx context.Context, id string) (entities.Promotion, error) {
+	return getPromotion(ctx, s.db, `id = ?`, id)
+}
+
+// FindPromotionByCode finds the promotion of a coupon code
+func (s *Store) FindPromotionByCode(ctx context.Context, code string) (entities.Promotion, error) {
+	return getPromotion(ctx, s.db, `code = ?`, code)
+}
+
+// ListPromotions lists all the promotions, ordered by ID
+func (s *Store) ListPromotions(ctx context.Context) ([]entities.Promotion, error) {
+	return listPromotions(ctx, s.db)
+}
+
+// CountRedemptions counts the orders that were not cancelled and used the promotion, overall and for the user
+func (s *Store) CountRedemptions(ctx context.Context, promotionID string, userID UserID) (int, int, error) {
+	return countRedemptions(ctx, s.db, promotionID, userID)
+}
+
+// getPromotion gets the promotion matching the condition on the promotions table
+func getPromotion(ctx context.Context, q querier, condition string, arg string) (entities.Promotion, error) {
+	var data []byte
+	err := q.QueryRowContext(ctx, `SELECT data FROM promotions WHERE `+condition, arg).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return entities.Promotion{}, datastore.ErrPromotionNotFound
+	}
+	if err != nil {
+		return entities.Promotion{}, err
+	}
+	var promotion entities.Promotion
+	if err := json.Unmarshal(data, &promotion); err != nil {
+		return entities.Promotion{}, err
+	}
+	return promotion, nil
+}
+
+// listPromotions lists all the promotions, ordered by ID
+func listPromotions(ctx context.Context, q querier) ([]entities.Promotion, error) {
+	rows, err := q.QueryContext(ctx, `SELECT data FROM promotions ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	promotions := make([]entities.Promotion, 0)
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var promotion entities.Promotion
+		if err := json.Unmarshal(data, &promotion); err != nil {
+			return nil, err
+		}
+		promotions = append(promotions, promotion)
+	}
+	return promotions, rows.Err()
+}
+
+// countRedemptions counts the orders that were not cancelled and used the promotion, overall and for the user
+func countRedemptions(ctx context.Context, q querier, promotionID string, userID UserID) (int, int, error) {
+	var total, byUser int
+	err := q.QueryRowContext(ctx, `SELECT COUNT(*), COALESCE(SUM(o.user_id = ?), 0) FROM orders o
+		WHERE o.status != ? AND EXISTS (SELECT 1 FROM json_each(o.data, '$.discounts') d
+			WHERE json_extract(d.value, '$.promotion_id') = ?)`,
+		userID, entities.OrderStatusCancelled, promotionID).Scan(&total, &byUser)
+	return total, byUser, err
+}
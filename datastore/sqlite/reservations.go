@@ -0,0 +1,40 @@
+package sqlite
+
+import (
+	"context"
+	"time"
+)
+
+// SetReservationTTL sets how long stock stays reserved for a cart after it was last added to
+func (s *Store) SetReservationTTL(ttl time.Duration) {
+	s.reservationTTL = ttl
+}
+
+// GetReservedStock retrieves the number of units of the item currently reserved by carts
+func (s *Store) GetReservedStock(ctx context.Context, sku SKU) (int, error) {
+	return reservedStock(ctx, s.db, sku, "", time.Now())
+}
+
+// ReleaseReservations releases all the stock reserved for the cart of the user
+func (s *Store) ReleaseReservations(ctx context.Context, userID UserID) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM reservations WHERE user_id = ?`, userID)
+	return err
+}
+
+// ReleaseExpiredReservations deletes the reservations that have expired and returns how many there were
+func (s *Store) ReleaseExpiredReservations(ctx context.Context) (int, error) {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM reservations WHERE expires_at <= ?`, time.Now().UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// reservedStock returns the units of the item reserved by active reservations, leaving out the ones of excludeUserID
+func reservedStock(ctx context.Context, q querier, sku SKU, excludeUserID UserID, now time.Time) (int, error) {
+	var reserved int
+	err := q.QueryRowContext(ctx, `SELECT COALESCE(SUM(quantity), 0) FROM reservations
+		WHERE sku = ? AND user_id != ? AND expires_at > ?`, sku, excludeUserID, now.UnixMilli()).Scan(&reserved)
+	return reserved, err
+}
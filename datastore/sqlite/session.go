@@ -0,0 +1,181 @@
+package sqlite
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+	"github.com/13thuser/bookstore/datastore"
+)
+
+// sessionColumns are the columns scanned by scanSession
+const sessionColumns = `id, user_id, user_agent, created_at, last_seen_at, access_expires_at, expires_at`
+
+// SetSessionPolicy sets how long sessions and their tokens are valid
+func (s *Store) SetSessionPolicy(policy datastore.SessionPolicy) {
+	s.sessionPolicy = policy
+}
+
+// AddSession starts a new session for the user and returns its tokens
+func (s *Store) AddSession(userID UserID, userAgent string) (entities.SessionTokens, error) {
+	session, tokens, err := s.sessionPolicy.NewSession(userID, userAgent, time.Now())
+	if err != nil {
+		return entities.SessionTokens{}, err
+	}
+	_, err = s.db.Exec(`INSERT INTO sessions (id, user_id, user_agent, access_hash, refresh_hash,
+		created_at, last_seen_at, access_expires_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		session.ID, session.UserID, session.UserAgent,
+		datastore.HashSessionToken(tokens.Token), datastore.HashSessionToken(tokens.RefreshToken),
+		session.CreatedAt.UnixMilli(), session.LastSeenAt.UnixMilli(),
+		session.AccessExpiresAt.UnixMilli(), session.ExpiresAt.UnixMilli())
+	if err != nil {
+		return entities.SessionTokens{}, err
+	}
+	return tokens, nil
+}
+
+// GetSession gets the active session of the access token and marks it as seen
+func (s *Store) GetSession(tokenID datastore.TokenID) (datastore.Session, bool) {
+	session, err := scanSession(s.db.QueryRow(`SELECT `+sessionColumns+` FROM sessions WHERE access_hash = ?`,
+		datastore.HashSessionToken(tokenID)))
+	now := time.Now()
+	if err != nil || !now.Before(session.AccessExpiresAt) || !s.sessionPolicy.Active(session, now) {
+		return datastore.Session{}, false
+	}
+	session.LastSeenAt = now
+	if _, err := s.db.Exec(`UPDATE sessions SET last_seen_at = ? WHERE id = ?`, now.UnixMilli(), session.ID); err != nil {
+		return datastore.Session{}, false
+	}
+	return session, true
+}
+
+// GetUserID gets the user ID of the active session of the access token
+func (s *Store) GetUserID(tokenID datastore.TokenID) datastore.UserID {
+	session, _ := s.GetSession(tokenID)
+	return session.UserID
+}
+
+// RefreshSession issues new tokens for the session of the refresh token; the
+// refresh token can only be used once
+func (s *Store) RefreshSession(refreshToken string) (entities.SessionTokens, error) {
+	hash := datastore.HashSessionToken(refreshToken)
+	tx, err := s.db.Begin()
+	if err != nil {
+		return entities.SessionTokens{}, err
+	}
+	defer tx.Rollback()
+
+	var currentHash string
+	row := tx.QueryRow(`SELECT `+sessionColumns+`, refresh_hash FROM sessions
+		WHERE refresh_hash = ? OR previous_refresh_hash = ?`, hash, hash)
+	session, err := scanSession(row, &currentHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return entities.SessionTokens{}, datastore.ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return entities.SessionTokens{}, err
+	}
+	now := time.Now()
+	if hash != currentHash || !s.sessionPolicy.Active(session, now) {
+		if _, err := tx.Exec(`DELETE FROM sessions WHERE id = ?`, session.ID); err != nil {
+			return entities.SessionTokens{}, err
+		}
+		if err := tx.Commit(); err != nil {
+			return entities.SessionTokens{}, err
+		}
+		return entities.SessionTokens{}, datastore.ErrInvalidRefreshToken
+	}
+
+	tokens, err := s.sessionPolicy.RotateTokens(&session, now)
+	if err != nil {
+		return entities.SessionTokens{}, err
+	}
+	_, err = tx.Exec(`UPDATE sessions SET access_hash = ?, refresh_hash = ?, previous_refresh_hash = ?,
+		last_seen_at = ?, access_expires_at = ? WHERE id = ?`,
+		datastore.HashSessionToken(tokens.Token), datastore.HashSessionToken(tokens.RefreshToken), currentHash,
+		session.LastSeenAt.UnixMilli(), session.AccessExpiresAt.UnixMilli(), session.ID)
+	if err != nil {
+		return entities.SessionTokens{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return entities.SessionTokens{}, err
+	}
+	return tokens, nil
+}
+
+// RemoveSession ends the session of the access token
+func (s *Store) RemoveSession(tokenID datastore.TokenID) {
+	s.db.Exec(`DELETE FROM sessions WHERE access_hash = ?`, datastore.HashSessionToken(tokenID))
+}
+
+// ListSessions lists the active sessions of the user, latest first
+func (s *Store) ListSessions(userID UserID) ([]datastore.Session, error) {
+	rows, err := s.db.Query(`SELECT `+sessionColumns+` FROM sessions WHERE user_id = ? ORDER BY created_at DESC, rowid DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	now := time.Now()
+	sessions := []datastore.Session{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		if s.sessionPolicy.Active(session, now) {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions, rows.Err()
+}
+
+// RevokeSession ends a session of the user
+func (s *Store) RevokeSession(userID UserID, sessionID string) error {
+	res, err := s.db.Exec(`DELETE FROM sessions WHERE id = ? AND user_id = ?`, sessionID, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return datastore.ErrSessionNotFound
+	}
+	return nil
+}
+
+// RevokeAllSessions ends all the sessions of the user and returns how many there were
+func (s *Store) RevokeAllSessions(userID UserID) (int, error) {
+	res, err := s.db.Exec(`DELETE FROM sessions WHERE user_id = ?`, userID)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// RemoveExpiredSessions deletes the expired sessions and returns how many there were
+func (s *Store) RemoveExpiredSessions() (int, error) {
+	now := time.Now()
+	res, err := s.db.Exec(`DELETE FROM sessions WHERE expires_at <= ? OR last_seen_at <= ?`,
+		now.UnixMilli(), now.Add(-s.sessionPolicy.IdleTimeout).UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// scanSession scans the session columns of a row, followed by the extra destinations
+func scanSession(row interface{ Scan(...interface{}) error }, extra ...interface{}) (datastore.Session, error) {
+	var session datastore.Session
+	var createdAt, lastSeenAt, accessExpiresAt, expiresAt int64
+	dest := append([]interface{}{&session.ID, &session.UserID, &session.UserAgent,
+		&createdAt, &lastSeenAt, &accessExpiresAt, &expiresAt}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return datastore.Session{}, err
+	}
+	session.CreatedAt = time.UnixMilli(createdAt)
+	session.LastSeenAt = time.UnixMilli(lastSeenAt)
+	session.AccessExpiresAt = time.UnixMilli(accessExpiresAt)
+	session.ExpiresAt = time.UnixMilli(expiresAt)
+	return session, nil
+}
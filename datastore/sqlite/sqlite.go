@@ -0,0 +1,68 @@
+// Package sqlite implements the datastore repositories on top of a SQLite database file.
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/13thuser/bookstore/datastore"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Store is a SQLite backed implementation of the datastore repositories
+type Store struct {
+	db             *sql.DB
+	reservationTTL time.Duration
+	sessionPolicy  datastore.SessionPolicy
+	// index is the search index of the items, updated once their changes are
+	// committed, and rebuilt when other processes changed the database
+	index *datastore.SearchIndex
+	// indexMu guards indexVersion, the data version of the database the last
+	// time the index was built, see SearchItems
+	indexMu      sync.Mutex
+	indexVersion int64
+	indexed      bool
+}
+
+// Ensure the SQLite store implements the repository interfaces
+var (
+	_ datastore.Store                 = (*Store)(nil)
+	_ datastore.UserRepository        = (*Store)(nil)
+	_ datastore.SessionRepository     = (*Store)(nil)
+	_ datastore.IdempotencyRepository = (*Store)(nil)
+	_ datastore.CardVaultRepository   = (*Store)(nil)
+)
+
+// Open opens the SQLite database at path, creating it if needed, and applies
+// any pending schema migrations
+func Open(path string) (*Store, error) {
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_foreign_keys=on&_busy_timeout=5000", path))
+	if err != nil {
+		return nil, fmt.Errorf("unable to open database %s: %w", path, err)
+	}
+	// SQLite allows a single writer; funnel everything through one connection
+	// so concurrent requests queue up instead of failing with "database is locked"
+	db.SetMaxOpenConns(1)
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := hashPlaintextPasswords(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to hash stored passwords: %w", err)
+	}
+	s := &Store{
+		db:             db,
+		reservationTTL: datastore.DefaultReservationTTL,
+		sessionPolicy:  datastore.DefaultSessionPolicy,
+		index:          datastore.NewSearchIndex(),
+	}
+	return s, nil
+}
+
+// Close closes the underlying database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
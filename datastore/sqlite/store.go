@@ -0,0 +1,563 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+	"github.com/13thuser/bookstore/datastore"
+)
+
+type (
+	UserID  = datastore.UserID
+	SKU     = datastore.SKU
+	OrderID = datastore.OrderID
+	Item    = datastore.Item
+	Cart    = datastore.Cart
+	Order   = datastore.Order
+)
+
+// querier is the subset of methods shared by *sql.DB and *sql.Tx
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// AddItem adds an item to the catalog, or adds to its stock if it already exists
+func (s *Store) AddItem(ctx context.Context, item Item, quantity int) error {
+	data, err := json.Marshal(stampCreatedAt(item))
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// If no item exists, add the item to the inventory
+	if _, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO items (sku, data) VALUES (?, ?)`, item.SKU, data); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO inventory (sku, quantity) VALUES (?, ?)
+		ON CONFLICT (sku) DO UPDATE SET quantity = quantity + excluded.quantity`, item.SKU, quantity); err != nil {
+		return err
+	}
+	stored, err := getItem(ctx, tx, item.SKU)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.index.Put(stored)
+	return nil
+}
+
+// CreateItem adds a new item to the catalog, failing if the SKU is already taken
+func (s *Store) CreateItem(ctx context.Context, item Item, quantity int) error {
+	item = stampCreatedAt(item)
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO items (sku, data) VALUES (?, ?)`, item.SKU, data)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return datastore.ErrItemExists
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT OR REPLACE INTO inventory (sku, quantity) VALUES (?, ?)`, item.SKU, quantity); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.index.Put(item)
+	return nil
+}
+
+// stampCreatedAt sets when an item being added to the catalog was created, unless it is already known
+func stampCreatedAt(item Item) Item {
+	if item.CreatedAt.IsZero() {
+		item.CreatedAt = time.Now().UTC()
+	}
+	return item
+}
+
+// UpdateItem replaces the details of an existing item and returns its previous version
+func (s *Store) UpdateItem(ctx context.Context, item Item) (Item, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Item{}, err
+	}
+	defer tx.Rollback()
+	previous, err := getItem(ctx, tx, item.SKU)
+	if err != nil {
+		return Item{}, err
+	}
+	item.Retired = previous.Retired
+	item.CreatedAt = previous.CreatedAt
+	if err := putItem(ctx, tx, item); err != nil {
+		return Item{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Item{}, err
+	}
+	s.index.Put(item)
+	return previous, nil
+}
+
+// RetireItem marks an item as no longer sold and returns it
+func (s *Store) RetireItem(ctx context.Context, sku SKU) (Item, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Item{}, err
+	}
+	defer tx.Rollback()
+	item, err := getItem(ctx, tx, sku)
+	if err != nil {
+		return Item{}, err
+	}
+	item.Retired = true
+	if err := putItem(ctx, tx, item); err != nil {
+		return Item{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Item{}, err
+	}
+	s.index.Put(item)
+	return item, nil
+}
+
+// AddStock adds quantity units of the item to the stock and returns the new stock
+func (s *Store) AddStock(ctx context.Context, sku SKU, quantity int) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `UPDATE inventory SET quantity = quantity + ? WHERE sku = ?`, quantity, sku); err != nil {
+		return 0, err
+	}
+	stock, err := getStock(ctx, tx, sku)
+	if err != nil {
+		return 0, err
+	}
+	return stock, tx.Commit()
+}
+
+// RemoveItem removes quantity units of the item from the stock
+func (s *Store) RemoveItem(ctx context.Context, item Item, quantity int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stock, err := getStock(ctx, tx, item.SKU)
+	if err != nil {
+		return err
+	}
+	if stock < quantity {
+		return fmt.Errorf("insufficient stock")
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE inventory SET quantity = quantity - ? WHERE sku = ?`, quantity, item.SKU); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetStock retrieves the number of units in stock for the item
+func (s *Store) GetStock(ctx context.Context, sku SKU) (int, error) {
+	return getStock(ctx, s.db, sku)
+}
+
+// ListItems lists all the items of the catalog
+func (s *Store) ListItems(ctx context.Context) ([]Item, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT data FROM items ORDER BY sku`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Item
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var item Item
+		if err := json.Unmarshal(data, &item); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// SearchItems searches the items of the catalog that are still sold. The
+// items changed by other processes, such as the catalog command, are not in
+// the index of the store: it is rebuilt from the items read whenever the data
+// version of the database shows that another connection wrote to it.
+func (s *Store) SearchItems(ctx context.Context, query entities.ItemQuery) (entities.ItemPage, error) {
+	// Reading in a transaction holds the only connection, so the changes of
+	// the store are indexed after the index is rebuilt, never before
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return entities.ItemPage{}, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.QueryContext(ctx, `SELECT items.data, COALESCE(inventory.quantity, 0),
+		(SELECT COALESCE(SUM(quantity), 0) FROM reservations WHERE reservations.sku = items.sku AND expires_at > ?)
+		FROM items LEFT JOIN inventory ON inventory.sku = items.sku`, time.Now().UnixMilli())
+	if err != nil {
+		return entities.ItemPage{}, err
+	}
+	defer rows.Close()
+	var items []entities.ItemWithStock
+	for rows.Next() {
+		var data []byte
+		var inStock, reserved int
+		if err := rows.Scan(&data, &inStock, &reserved); err != nil {
+			return entities.ItemPage{}, err
+		}
+		var item Item
+		if err := json.Unmarshal(data, &item); err != nil {
+			return entities.ItemPage{}, err
+		}
+		items = append(items, entities.NewItemWithStock(item, inStock, reserved))
+	}
+	if err := rows.Err(); err != nil {
+		return entities.ItemPage{}, err
+	}
+	var version int64
+	if err := tx.QueryRowContext(ctx, `PRAGMA data_version`).Scan(&version); err != nil {
+		return entities.ItemPage{}, err
+	}
+	s.indexMu.Lock()
+	if !s.indexed || version != s.indexVersion {
+		catalog := make([]Item, len(items))
+		for i, item := range items {
+			catalog[i] = item.Item
+		}
+		s.index.Reset(catalog)
+		s.indexVersion, s.indexed = version, true
+	}
+	s.indexMu.Unlock()
+	if err := tx.Commit(); err != nil {
+		return entities.ItemPage{}, err
+	}
+	return datastore.SearchCatalog(s.index, items, query)
+}
+
+// GetItem retrieves an item based on the item ID
+func (s *Store) GetItem(ctx context.Context, id string) (Item, error) {
+	return getItem(ctx, s.db, id)
+}
+
+// AddToCart adds an item to the cart of the user and reserves its units
+func (s *Store) AddToCart(ctx context.Context, userID string, itemID string, quantity int) (Cart, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Cart{}, err
+	}
+	defer tx.Rollback()
+	item, err := getItem(ctx, tx, itemID)
+	if err != nil {
+		return Cart{}, err
+	}
+	if item.Retired {
+		return Cart{}, datastore.ErrItemRetired
+	}
+	stock, err := getStock(ctx, tx, item.SKU)
+	if err != nil {
+		return Cart{}, err
+	}
+	now := time.Now()
+	reserved, err := reservedStock(ctx, tx, item.SKU, userID, now)
+	if err != nil {
+		return Cart{}, err
+	}
+	cart, err := getCart(ctx, tx, userID)
+	if err != nil {
+		return Cart{}, err
+	}
+	reserve := cart.Items[item.SKU].Quantity + quantity
+	if stock-reserved < reserve {
+		return Cart{}, fmt.Errorf("insufficient stock for item %s", item.SKU)
+	}
+	if err := cart.CheckCurrency(item.Price); err != nil {
+		return Cart{}, err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO cart_items (user_id, sku, quantity) VALUES (?, ?, ?)
+		ON CONFLICT (user_id, sku) DO UPDATE SET quantity = quantity + excluded.quantity`, userID, item.SKU, quantity); err != nil {
+		return Cart{}, err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT OR REPLACE INTO reservations (user_id, sku, quantity, expires_at) VALUES (?, ?, ?, ?)`,
+		userID, item.SKU, reserve, now.Add(s.reservationTTL).UnixMilli()); err != nil {
+		return Cart{}, err
+	}
+	cart, err = getCart(ctx, tx, userID)
+	if err != nil {
+		return Cart{}, err
+	}
+	return cart, tx.Commit()
+}
+
+// RemoveFromCart removes an item from the cart of the user and releases its units
+func (s *Store) RemoveFromCart(ctx context.Context, userID string, itemID string, quantity int) (Cart, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Cart{}, err
+	}
+	defer tx.Rollback()
+	item, err := getItem(ctx, tx, itemID)
+	if err != nil {
+		return Cart{}, err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE cart_items SET quantity = quantity - ? WHERE user_id = ? AND sku = ?`, quantity, userID, item.SKU); err != nil {
+		return Cart{}, err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM cart_items WHERE user_id = ? AND sku = ? AND quantity <= 0`, userID, item.SKU); err != nil {
+		return Cart{}, err
+	}
+	cart, err := getCart(ctx, tx, userID)
+	if err != nil {
+		return Cart{}, err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE reservations SET quantity = MIN(quantity, ?) WHERE user_id = ? AND sku = ?`,
+		cart.Items[item.SKU].Quantity, userID, item.SKU); err != nil {
+		return Cart{}, err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM reservations WHERE user_id = ? AND sku = ? AND quantity <= 0`, userID, item.SKU); err != nil {
+		return Cart{}, err
+	}
+	return cart, tx.Commit()
+}
+
+// GetCart retrieves the cart of the user
+func (s *Store) GetCart(ctx context.Context, userID string) Cart {
+	cart, err := getCart(ctx, s.db, userID)
+	if err != nil {
+		return *entities.NewCart(userID)
+	}
+	return cart
+}
+
+// GetCartTotalPrice retrieves the total price of the items in the cart of the user
+func (s *Store) GetCartTotalPrice(ctx context.Context, userID string) entities.Money {
+	return s.GetCart(ctx, userID).TotalPrice
+}
+
+// SetCartCoupon sets the coupon code applied to the cart of the user, "" removes it
+func (s *Store) SetCartCoupon(ctx context.Context, userID string, code string) (Cart, error) {
+	var err error
+	if code == "" {
+		_, err = s.db.ExecContext(ctx, `DELETE FROM cart_coupons WHERE user_id = ?`, userID)
+	} else {
+		_, err = s.db.ExecContext(ctx, `INSERT INTO cart_coupons (user_id, code) VALUES (?, ?)
+			ON CONFLICT (user_id) DO UPDATE SET code = excluded.code`, userID, code)
+	}
+	if err != nil {
+		return Cart{}, err
+	}
+	return getCart(ctx, s.db, userID)
+}
+
+// GetOrderHistory retrieves the orders of the user, latest first
+func (s *Store) GetOrderHistory(ctx context.Context, userID string) []Order {
+	orders := make([]Order, 0)
+	rows, err := s.db.QueryContext(ctx, `SELECT data FROM orders WHERE user_id = ? ORDER BY seq DESC`, userID)
+	if err != nil {
+		return orders
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return orders
+		}
+		var order Order
+		if err := json.Unmarshal(data, &order); err != nil {
+			return orders
+		}
+		orders = append(orders, order)
+	}
+	return orders
+}
+
+// Checkout checks out the cart of the user
+func (s *Store) Checkout(ctx context.Context, userID string, finalize datastore.OrderFinalizer) (Order, error) {
+	return s.ConfirmOrder(ctx, userID, finalize)
+}
+
+// ConfirmOrder turns the cart of the user into an order, see datastore.CheckoutCart
+func (s *Store) ConfirmOrder(ctx context.Context, userID string, finalize datastore.OrderFinalizer) (Order, error) {
+	return datastore.CheckoutCart(ctx, s, userID, finalize)
+}
+
+// ConfirmPayment records the payment confirmation on the order
+func (s *Store) ConfirmPayment(ctx context.Context, userID string, orderID OrderID, paymentConfirmationID string) (Order, error) {
+	return datastore.RecordPayment(ctx, s, userID, orderID, paymentConfirmationID)
+}
+
+// ListOrdersByStatus lists the orders of all the users that are in the status
+func (s *Store) ListOrdersByStatus(ctx context.Context, status entities.OrderStatus) ([]Order, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT data FROM orders WHERE status = ? ORDER BY seq`, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var orders []Order
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var order Order
+		if err := json.Unmarshal(data, &order); err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+	return orders, rows.Err()
+}
+
+// FindOrder finds an order of the user by its ID
+func (s *Store) FindOrder(ctx context.Context, userID string, orderID OrderID) (Order, error) {
+	return findOrder(ctx, s.db, userID, orderID)
+}
+
+// GetOrder gets an order of any user by its ID
+func (s *Store) GetOrder(ctx context.Context, orderID OrderID) (Order, error) {
+	var data []byte
+	err := s.db.QueryRowContext(ctx, `SELECT data FROM orders WHERE id = ?`, orderID).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Order{}, datastore.ErrOrderNotFound
+	}
+	if err != nil {
+		return Order{}, err
+	}
+	var order Order
+	if err := json.Unmarshal(data, &order); err != nil {
+		return Order{}, err
+	}
+	return order, nil
+}
+
+// getItem retrieves an item by its SKU
+func getItem(ctx context.Context, q querier, sku SKU) (Item, error) {
+	var data []byte
+	err := q.QueryRowContext(ctx, `SELECT data FROM items WHERE sku = ?`, sku).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Item{}, datastore.ErrItemNotFound
+	}
+	if err != nil {
+		return Item{}, err
+	}
+	var item Item
+	if err := json.Unmarshal(data, &item); err != nil {
+		return Item{}, err
+	}
+	return item, nil
+}
+
+// putItem stores the new version of an existing item
+func putItem(ctx context.Context, q querier, item Item) error {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	_, err = q.ExecContext(ctx, `UPDATE items SET data = ? WHERE sku = ?`, data, item.SKU)
+	return err
+}
+
+// getStock retrieves the stock of an item
+func getStock(ctx context.Context, q querier, sku SKU) (int, error) {
+	var quantity int
+	err := q.QueryRowContext(ctx, `SELECT quantity FROM inventory WHERE sku = ?`, sku).Scan(&quantity)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, datastore.ErrItemNotFound
+	}
+	return quantity, err
+}
+
+// getCart rebuilds the cart of the user from its rows
+func getCart(ctx context.Context, q querier, userID UserID) (Cart, error) {
+	cart := entities.NewCart(userID)
+	// read before the items, the rows hold the only connection until closed
+	if err := q.QueryRowContext(ctx, `SELECT code FROM cart_coupons WHERE user_id = ?`, userID).Scan(&cart.Coupon); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return Cart{}, err
+	}
+	rows, err := q.QueryContext(ctx, `SELECT i.data, c.quantity FROM cart_items c
+		JOIN items i ON i.sku = c.sku WHERE c.user_id = ? ORDER BY c.sku`, userID)
+	if err != nil {
+		return Cart{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var data []byte
+		var quantity int
+		if err := rows.Scan(&data, &quantity); err != nil {
+			return Cart{}, err
+		}
+		var item Item
+		if err := json.Unmarshal(data, &item); err != nil {
+			return Cart{}, err
+		}
+		cart.AddToCart(&item, quantity)
+	}
+	return *cart, rows.Err()
+}
+
+// findOrder finds an order of the user by its ID
+func findOrder(ctx context.Context, q querier, userID UserID, orderID OrderID) (Order, error) {
+	var data []byte
+	err := q.QueryRowContext(ctx, `SELECT data FROM orders WHERE user_id = ? AND id = ?`, userID, orderID).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Order{}, datastore.ErrOrderNotFound
+	}
+	if err != nil {
+		return Order{}, err
+	}
+	var order Order
+	if err := json.Unmarshal(data, &order); err != nil {
+		return Order{}, err
+	}
+	return order, nil
+}
+
+// insertOrder stores a new order
+func insertOrder(ctx context.Context, q querier, order Order) error {
+	data, err := json.Marshal(order)
+	if err != nil {
+		return err
+	}
+	_, err = q.ExecContext(ctx, `INSERT INTO orders (id, user_id, status, data) VALUES (?, ?, ?, ?)`, order.ID, order.UserID, order.CurrentStatus(), data)
+	return err
+}
+
+// updateOrder stores the new version of an existing order
+func updateOrder(ctx context.Context, q querier, order Order) error {
+	data, err := json.Marshal(order)
+	if err != nil {
+		return err
+	}
+	res, err := q.ExecContext(ctx, `UPDATE orders SET status = ?, data = ? WHERE id = ? AND user_id = ?`, order.CurrentStatus(), data, order.ID, order.UserID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return datastore.ErrOrderNotFound
+	}
+	return nil
+}
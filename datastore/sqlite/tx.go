@@ -0,0 +1,121 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+	"github.com/13thuser/bookstore/datastore"
+)
+
+// sqlTx is the SQLite unit of work, a thin wrapper around a database transaction
+type sqlTx struct {
+	tx     *sql.Tx
+	userID UserID
+}
+
+// Begin starts a unit of work over the cart of the user
+func (s *Store) Begin(ctx context.Context, userID UserID) (datastore.Tx, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlTx{tx: tx, userID: userID}, nil
+}
+
+// Cart gets the cart of the user as seen by the unit of work
+func (t *sqlTx) Cart(ctx context.Context) (Cart, error) {
+	return getCart(ctx, t.tx, t.userID)
+}
+
+// DecrementStock removes quantity units of the item from the stock, see datastore.Tx
+func (t *sqlTx) DecrementStock(ctx context.Context, sku SKU, quantity int) error {
+	item, err := getItem(ctx, t.tx, sku)
+	if err != nil {
+		return err
+	}
+	if item.Retired {
+		return fmt.Errorf("%w: %s", datastore.ErrItemRetired, sku)
+	}
+	res, err := t.tx.ExecContext(ctx, `UPDATE inventory SET quantity = quantity - ?
+		WHERE sku = ? AND quantity - (SELECT COALESCE(SUM(quantity), 0) FROM reservations
+			WHERE sku = inventory.sku AND user_id != ? AND expires_at > ?) >= ?`,
+		quantity, sku, t.userID, time.Now().UnixMilli(), quantity)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return fmt.Errorf("insufficient stock for item %s", sku)
+	}
+	return nil
+}
+
+// IncrementStock puts quantity units of the item back in stock
+func (t *sqlTx) IncrementStock(ctx context.Context, sku SKU, quantity int) error {
+	res, err := t.tx.ExecContext(ctx, `UPDATE inventory SET quantity = quantity + ? WHERE sku = ?`, quantity, sku)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return datastore.ErrItemNotFound
+	}
+	return nil
+}
+
+// InsertOrder stores a new order
+func (t *sqlTx) InsertOrder(ctx context.Context, order Order) error {
+	return insertOrder(ctx, t.tx, order)
+}
+
+// FindOrder finds an order of the user by its ID
+func (t *sqlTx) FindOrder(ctx context.Context, orderID OrderID) (Order, error) {
+	return findOrder(ctx, t.tx, t.userID, orderID)
+}
+
+// UpdateOrder stores the new version of an existing order of the user
+func (t *sqlTx) UpdateOrder(ctx context.Context, order Order) error {
+	if order.UserID != t.userID {
+		return datastore.ErrOrderNotFound
+	}
+	return updateOrder(ctx, t.tx, order)
+}
+
+// ClearCart empties the cart of the user and removes its coupon
+func (t *sqlTx) ClearCart(ctx context.Context) error {
+	if _, err := t.tx.ExecContext(ctx, `DELETE FROM cart_items WHERE user_id = ?`, t.userID); err != nil {
+		return err
+	}
+	_, err := t.tx.ExecContext(ctx, `DELETE FROM cart_coupons WHERE user_id = ?`, t.userID)
+	return err
+}
+
+// ListPromotions lists all the promotions, ordered by ID
+func (t *sqlTx) ListPromotions(ctx context.Context) ([]entities.Promotion, error) {
+	return listPromotions(ctx, t.tx)
+}
+
+// CountRedemptions counts the orders that were not cancelled and used the promotion, overall and for the user
+func (t *sqlTx) CountRedemptions(ctx context.Context, promotionID string, userID UserID) (int, int, error) {
+	return countRedemptions(ctx, t.tx, promotionID, userID)
+}
+
+// ReleaseReservations releases the stock reserved for the cart of the user
+func (t *sqlTx) ReleaseReservations(ctx context.Context) error {
+	_, err := t.tx.ExecContext(ctx, `DELETE FROM reservations WHERE user_id = ?`, t.userID)
+	return err
+}
+
+// Commit commits the transaction
+func (t *sqlTx) Commit() error {
+	return t.tx.Commit()
+}
+
+// Rollback rolls back the transaction, it is a no-op after Commit
+func (t *sqlTx) Rollback() error {
+	if err := t.tx.Rollback(); err != nil && err != sql.ErrTxDone {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+	"github.com/13thuser/bookstore/datastore"
+)
+
+// Authenticate authenticates a user
+func (s *Store) Authenticate(userID UserID, password string) (datastore.User, bool) {
+	var hash string
+	err := s.db.QueryRowContext(context.Background(), `SELECT password FROM users WHERE id = ?`, userID).Scan(&hash)
+	if err != nil || !datastore.CheckPassword(hash, password) {
+		return datastore.User{}, false
+	}
+	user, err := s.GetUser(userID)
+	return user, err == nil
+}
+
+// AddUser adds a user with the customer role
+func (s *Store) AddUser(userID UserID, userName string, password string) error {
+	hash, err := datastore.HashPassword(password)
+	if err != nil {
+		return fmt.Errorf("unable to hash password: %w", err)
+	}
+	res, err := s.db.Exec(`INSERT OR IGNORE INTO users (id, name, password) VALUES (?, ?, ?)`, userID, userName, hash)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return datastore.ErrUserExists
+	}
+	return nil
+}
+
+// hashPlaintextPasswords hashes the passwords stored in plaintext before passwords were hashed
+func hashPlaintextPasswords(db *sql.DB) error {
+	rows, err := db.Query(`SELECT id, password FROM users`)
+	if err != nil {
+		return err
+	}
+	plaintext := make(map[string]string)
+	for rows.Next() {
+		var id, password string
+		if err := rows.Scan(&id, &password); err != nil {
+			rows.Close()
+			return err
+		}
+		if !datastore.IsPasswordHash(password) {
+			plaintext[id] = password
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for id, password := range plaintext {
+		hash, err := datastore.HashPassword(password)
+		if err != nil {
+			return fmt.Errorf("unable to hash the password of user %s: %w", id, err)
+		}
+		if _, err := db.Exec(`UPDATE users SET password = ? WHERE id = ? AND password = ?`, hash, id, password); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetUser retrieves a user based on the user ID
+func (s *Store) GetUser(userID UserID) (datastore.User, error) {
+	var user datastore.User
+	var roles string
+	err := s.db.QueryRow(`SELECT id, name, roles FROM users WHERE id = ?`, userID).Scan(&user.ID, &user.Name, &roles)
+	if errors.Is(err, sql.ErrNoRows) {
+		return datastore.User{}, datastore.ErrUserNotFound
+	}
+	if err != nil {
+		return datastore.User{}, err
+	}
+	if err := json.Unmarshal([]byte(roles), &user.Roles); err != nil {
+		return datastore.User{}, fmt.Errorf("unable to decode the roles of user %s: %w", userID, err)
+	}
+	return user, nil
+}
+
+// SetRoles replaces the roles of a user
+func (s *Store) SetRoles(userID UserID, roles []entities.Role) (datastore.User, error) {
+	if roles == nil {
+		roles = []entities.Role{}
+	}
+	data, err := json.Marshal(roles)
+	if err != nil {
+		return datastore.User{}, err
+	}
+	res, err := s.db.Exec(`UPDATE users SET roles = ? WHERE id = ?`, string(data), userID)
+	if err != nil {
+		return datastore.User{}, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return datastore.User{}, datastore.ErrUserNotFound
+	}
+	return s.GetUser(userID)
+}
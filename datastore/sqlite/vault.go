@@ -0,0 +1,43 @@
+package sqlite
+
+import (
+	"encoding/json"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+)
+
+// SaveVaultCard keeps the card of a token, replacing the one kept with the token
+func (s *Store) SaveVaultCard(card entities.VaultCard) error {
+	data, err := json.Marshal(card)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO vault_cards (token, user_id, fingerprint, data) VALUES (?, ?, ?, ?)
+		ON CONFLICT (token) DO UPDATE SET data = excluded.data`,
+		card.Token, card.UserID, card.Fingerprint, data)
+	return err
+}
+
+// ListVaultCards lists the cards kept
+func (s *Store) ListVaultCards() ([]entities.VaultCard, error) {
+	rows, err := s.db.Query(`SELECT fingerprint, data FROM vault_cards ORDER BY rowid`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cards := make([]entities.VaultCard, 0)
+	for rows.Next() {
+		var fingerprint string
+		var data []byte
+		if err := rows.Scan(&fingerprint, &data); err != nil {
+			return nil, err
+		}
+		var card entities.VaultCard
+		if err := json.Unmarshal(data, &card); err != nil {
+			return nil, err
+		}
+		card.Fingerprint = fingerprint
+		cards = append(cards, card)
+	}
+	return cards, rows.Err()
+}
@@ -0,0 +1,310 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+)
+
+// Tx is a unit of work over the cart of a single user and the shared stock and
+// orders. Changes made through a Tx only become visible on Commit, and are all
+// discarded on Rollback.
+type Tx interface {
+	// Cart gets the cart of the user the unit of work was started for
+	Cart(ctx context.Context) (Cart, error)
+	// DecrementStock removes quantity units of the item from the stock; units
+	// reserved by the carts of other users cannot be taken and retired items
+	// fail with ErrItemRetired
+	DecrementStock(ctx context.Context, sku SKU, quantity int) error
+	// IncrementStock puts quantity units of the item back in stock
+	IncrementStock(ctx context.Context, sku SKU, quantity int) error
+	// InsertOrder stores a new order
+	InsertOrder(ctx context.Context, order Order) error
+	// FindOrder finds an order of the user by its ID
+	FindOrder(ctx context.Context, orderID OrderID) (Order, error)
+	// UpdateOrder stores the new version of an existing order of the user
+	UpdateOrder(ctx context.Context, order Order) error
+	// ClearCart empties the cart of the user
+	ClearCart(ctx context.Context) error
+	// ReleaseReservations releases the stock reserved for the cart of the user
+	ReleaseReservations(ctx context.Context) error
+	// PromotionReader reads the promotions as seen by the unit of work
+	PromotionReader
+	// Commit applies all the changes of the unit of work
+	Commit() error
+	// Rollback discards all the changes of the unit of work, it is a no-op after Commit
+	Rollback() error
+}
+
+// Transactor starts units of work
+type Transactor interface {
+	// Begin starts a unit of work over the cart of the user
+	Begin(ctx context.Context, userID UserID) (Tx, error)
+}
+
+// RunInTx runs fn in a unit of work, committing it if fn succeeds and rolling it back otherwise
+func RunInTx(ctx context.Context, t Transactor, userID UserID, fn func(tx Tx) error) error {
+	tx, err := t.Begin(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return nil
+}
+
+// OrderFinalizer completes an order made from a cart before it is stored, e.g.
+// with its shipping address and taxes; an error aborts the checkout
+type OrderFinalizer func(order *Order) error
+
+// CheckoutCart turns the cart of the user into an order. Pricing the cart with
+// the promotions, decrementing the stock, creating the order, clearing the cart
+// and converting its reservations happen in a single unit of work, so checkout
+// either fully succeeds or leaves everything untouched and the usage limits of
+// the promotions hold.
+func CheckoutCart(ctx context.Context, t Transactor, userID UserID, finalize OrderFinalizer) (Order, error) {
+	var order Order
+	err := RunInTx(ctx, t, userID, func(tx Tx) error {
+		cart, err := tx.Cart(ctx)
+		if err != nil {
+			return err
+		}
+		if len(cart.Items) == 0 {
+			return fmt.Errorf("cart is empty")
+		}
+		if err := PriceCart(ctx, tx, &cart, time.Now()); err != nil {
+			return err
+		}
+		order, err = NewOrderFromCart(userID, &cart)
+		if err != nil {
+			return fmt.Errorf("unable to create new order for user %s", userID)
+		}
+		if finalize != nil {
+			if err := finalize(&order); err != nil {
+				return err
+			}
+		}
+		for sku, cartItem := range cart.Items {
+			if err := tx.DecrementStock(ctx, sku, cartItem.Quantity); err != nil {
+				return err
+			}
+		}
+		if err := tx.InsertOrder(ctx, order); err != nil {
+			return err
+		}
+		if err := tx.ClearCart(ctx); err != nil {
+			return err
+		}
+		// The reserved units now left the stock for good
+		return tx.ReleaseReservations(ctx)
+	})
+	if err != nil {
+		return Order{}, err
+	}
+	return order, nil
+}
+
+// memTx is the in-memory unit of work. It holds the cart lock of the user and
+// the datastore lock for its whole lifetime and stages the changes until Commit.
+type memTx struct {
+	ds           *Datastore
+	userID       UserID
+	cart         *Cart
+	unlock       func()
+	done         bool
+	stock        map[SKU]int
+	orders       []Order
+	orderUpdates map[OrderID]Order
+	clearCart    bool
+	release      bool
+}
+
+// Begin starts a unit of work over the cart of the user
+func (ds *Datastore) Begin(ctx context.Context, userID UserID) (Tx, error) {
+	cart, unlockCart := ds.lockCart(userID)
+	ds.mu.Lock()
+	return &memTx{
+		ds:     ds,
+		userID: userID,
+		cart:   cart,
+		unlock: func() {
+			ds.mu.Unlock()
+			unlockCart()
+		},
+		stock:        make(map[SKU]int),
+		orderUpdates: make(map[OrderID]Order),
+	}, nil
+}
+
+// Cart gets the cart of the user as seen by the unit of work
+func (tx *memTx) Cart(ctx context.Context) (Cart, error) {
+	if tx.done {
+		return Cart{}, errTxDone
+	}
+	if tx.clearCart {
+		return *entities.NewCart(tx.userID), nil
+	}
+	return tx.cart.Clone(), nil
+}
+
+// DecrementStock stages removing quantity units of the item from the stock
+func (tx *memTx) DecrementStock(ctx context.Context, sku SKU, quantity int) error {
+	if tx.done {
+		return errTxDone
+	}
+	if tx.ds.items[sku].Retired {
+		return fmt.Errorf("%w: %s", ErrItemRetired, sku)
+	}
+	stock, ok := tx.stock[sku]
+	if !ok {
+		stock = tx.ds.inventory[sku]
+	}
+	if stock-tx.ds.reservedStock(sku, tx.userID, time.Now()) < quantity {
+		return fmt.Errorf("insufficient stock for item %s", sku)
+	}
+	tx.stock[sku] = stock - quantity
+	return nil
+}
+
+// IncrementStock stages putting quantity units of the item back in stock
+func (tx *memTx) IncrementStock(ctx context.Context, sku SKU, quantity int) error {
+	if tx.done {
+		return errTxDone
+	}
+	if _, ok := tx.ds.items[sku]; !ok {
+		return ErrItemNotFound
+	}
+	stock, ok := tx.stock[sku]
+	if !ok {
+		stock = tx.ds.inventory[sku]
+	}
+	tx.stock[sku] = stock + quantity
+	return nil
+}
+
+// InsertOrder stages a new order
+func (tx *memTx) InsertOrder(ctx context.Context, order Order) error {
+	if tx.done {
+		return errTxDone
+	}
+	tx.orders = append(tx.orders, order)
+	return nil
+}
+
+// FindOrder finds an order of the user as seen by the unit of work
+func (tx *memTx) FindOrder(ctx context.Context, orderID OrderID) (Order, error) {
+	if tx.done {
+		return Order{}, errTxDone
+	}
+	if order, ok := tx.orderUpdates[orderID]; ok {
+		return order, nil
+	}
+	for _, order := range tx.orders {
+		if order.ID == orderID {
+			return order, nil
+		}
+	}
+	order, err := tx.ds.findOrderByOrderID(tx.userID, orderID)
+	if err != nil {
+		return Order{}, err
+	}
+	return *order, nil
+}
+
+// UpdateOrder stages the new version of an existing order of the user
+func (tx *memTx) UpdateOrder(ctx context.Context, order Order) error {
+	if _, err := tx.FindOrder(ctx, order.ID); err != nil {
+		return err
+	}
+	tx.orderUpdates[order.ID] = order
+	return nil
+}
+
+// ListPromotions lists all the promotions, ordered by ID
+func (tx *memTx) ListPromotions(ctx context.Context) ([]entities.Promotion, error) {
+	if tx.done {
+		return nil, errTxDone
+	}
+	return tx.ds.listPromotions(), nil
+}
+
+// CountRedemptions counts the committed orders that were not cancelled and used the promotion
+func (tx *memTx) CountRedemptions(ctx context.Context, promotionID string, userID UserID) (int, int, error) {
+	if tx.done {
+		return 0, 0, errTxDone
+	}
+	total, byUser := tx.ds.countRedemptions(promotionID, userID)
+	return total, byUser, nil
+}
+
+// ClearCart stages emptying the cart of the user
+func (tx *memTx) ClearCart(ctx context.Context) error {
+	if tx.done {
+		return errTxDone
+	}
+	tx.clearCart = true
+	return nil
+}
+
+// ReleaseReservations stages releasing the stock reserved for the cart of the user
+func (tx *memTx) ReleaseReservations(ctx context.Context) error {
+	if tx.done {
+		return errTxDone
+	}
+	tx.release = true
+	return nil
+}
+
+// Commit applies the staged changes and releases the locks
+func (tx *memTx) Commit() error {
+	if tx.done {
+		return errTxDone
+	}
+	for sku, stock := range tx.stock {
+		tx.ds.inventory[sku] = stock
+	}
+	for i := range tx.orders {
+		order := tx.orders[i]
+		// Prepend the order to show the latest order first
+		tx.ds.orders[order.UserID] = append([]*Order{&order}, tx.ds.orders[order.UserID]...)
+	}
+	for orderID, order := range tx.orderUpdates {
+		stored, _ := tx.ds.findOrderByOrderID(tx.userID, orderID)
+		*stored = order
+	}
+	if tx.clearCart {
+		tx.ds.resetCart(tx.userID)
+	}
+	if tx.release {
+		for sku := range tx.ds.reservations {
+			tx.ds.setReservation(sku, tx.userID, 0, time.Time{})
+		}
+	}
+	tx.finish()
+	return nil
+}
+
+// Rollback discards the staged changes and releases the locks
+func (tx *memTx) Rollback() error {
+	if !tx.done {
+		tx.finish()
+	}
+	return nil
+}
+
+// finish marks the unit of work as done and releases its locks
+func (tx *memTx) finish() {
+	tx.done = true
+	tx.unlock()
+}
+
+// errTxDone is returned when using a unit of work that was already committed or rolled back
+var errTxDone = fmt.Errorf("unit of work already committed or rolled back")
@@ -0,0 +1,223 @@
+package datastore_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/13thuser/bookstore/datastore"
+	"github.com/13thuser/bookstore/datastore/sqlite"
+)
+
+// faultyTransactor starts units of work that fail at the given step
+type faultyTransactor struct {
+	datastore.Transactor
+	failAt string
+}
+
+func (ft faultyTransactor) Begin(ctx context.Context, userID datastore.UserID) (datastore.Tx, error) {
+	tx, err := ft.Transactor.Begin(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return &faultyTx{Tx: tx, failAt: ft.failAt}, nil
+}
+
+// faultyTx is a unit of work that fails at the given step instead of running it
+type faultyTx struct {
+	datastore.Tx
+	failAt string
+}
+
+func (tx *faultyTx) fail(step string) error {
+	if tx.failAt == step {
+		return fmt.Errorf("injected failure at %s", step)
+	}
+	return nil
+}
+
+func (tx *faultyTx) DecrementStock(ctx context.Context, sku datastore.SKU, quantity int) error {
+	if err := tx.fail("decrement stock"); err != nil {
+		return err
+	}
+	return tx.Tx.DecrementStock(ctx, sku, quantity)
+}
+
+func (tx *faultyTx) InsertOrder(ctx context.Context, order datastore.Order) error {
+	if err := tx.fail("insert order"); err != nil {
+		return err
+	}
+	return tx.Tx.InsertOrder(ctx, order)
+}
+
+func (tx *faultyTx) ClearCart(ctx context.Context) error {
+	if err := tx.fail("clear cart"); err != nil {
+		return err
+	}
+	return tx.Tx.ClearCart(ctx)
+}
+
+func (tx *faultyTx) Commit() error {
+	if err := tx.fail("commit"); err != nil {
+		return err
+	}
+	return tx.Tx.Commit()
+}
+
+// testHelperStores returns a fresh store of every backend
+func testHelperStores(t *testing.T) map[string]datastore.Store {
+	db, err := sqlite.Open(filepath.Join(t.TempDir(), "bookstore.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := datastore.SeedItems(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	return map[string]datastore.Store{
+		"memory": datastore.NewDatastore(),
+		"sqlite": db,
+	}
+}
+
+func TestCheckoutCartRollsBackOnFailure(t *testing.T) {
+	ctx := context.Background()
+	for _, step := range []string{"decrement stock", "insert order", "clear cart", "commit"} {
+		for backend, store := range testHelperStores(t) {
+			t.Run(fmt.Sprintf("%s/%s", backend, step), func(t *testing.T) {
+				if _, err := store.AddToCart(ctx, "user", "item-1", 1); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := store.AddToCart(ctx, "user", "item-2", 2); err != nil {
+					t.Fatal(err)
+				}
+
+				_, err := datastore.CheckoutCart(ctx, faultyTransactor{Transactor: store, failAt: step}, "user", nil)
+				if err == nil {
+					t.Fatalf("expected checkout to fail at %s", step)
+				}
+
+				for sku, want := range map[string]int{"item-1": 2, "item-2": 2} {
+					if stock, _ := store.GetStock(ctx, sku); stock != want {
+						t.Errorf("expected stock of %s to be %d after rollback, got %d", sku, want, stock)
+					}
+				}
+				if cart := store.GetCart(ctx, "user"); cart.TotalItems != 3 {
+					t.Errorf("expected cart to keep its 3 items after rollback, got %d", cart.TotalItems)
+				}
+				if orders := store.GetOrderHistory(ctx, "user"); len(orders) != 0 {
+					t.Errorf("expected no order after rollback, got %d", len(orders))
+				}
+
+				// the store must still be usable once the failed unit of work is gone
+				order, err := store.Checkout(ctx, "user", nil)
+				if err != nil {
+					t.Fatalf("expected checkout to succeed after rollback: %v", err)
+				}
+				if order.TotalItems != 3 {
+					t.Errorf("expected order to have 3 items, got %d", order.TotalItems)
+				}
+				if stock, _ := store.GetStock(ctx, "item-2"); stock != 0 {
+					t.Errorf("expected stock of item-2 to be 0 after checkout, got %d", stock)
+				}
+			})
+		}
+	}
+}
+
+func TestCheckoutCartRejectsRetiredItems(t *testing.T) {
+	ctx := context.Background()
+	for backend, store := range testHelperStores(t) {
+		t.Run(backend, func(t *testing.T) {
+			if _, err := store.AddToCart(ctx, "user", "item-1", 1); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.AddToCart(ctx, "user", "item-2", 1); err != nil {
+				t.Fatal(err)
+			}
+			// retired while in the cart
+			if _, err := store.RetireItem(ctx, "item-2"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.Checkout(ctx, "user", nil); !errors.Is(err, datastore.ErrItemRetired) {
+				t.Fatalf("expected checkout to reject the retired item, got %v", err)
+			}
+			for sku, want := range map[string]int{"item-1": 2, "item-2": 2} {
+				if stock, _ := store.GetStock(ctx, sku); stock != want {
+					t.Errorf("expected stock of %s to be %d, got %d", sku, want, stock)
+				}
+			}
+			if orders := store.GetOrderHistory(ctx, "user"); len(orders) != 0 {
+				t.Errorf("expected no order, got %d", len(orders))
+			}
+		})
+	}
+}
+
+func TestReservations(t *testing.T) {
+	ctx := context.Background()
+	for backend, store := range testHelperStores(t) {
+		t.Run(backend, func(t *testing.T) {
+			if _, err := store.AddToCart(ctx, "user", "item-1", 2); err != nil {
+				t.Fatal(err)
+			}
+			if reserved, _ := store.GetReservedStock(ctx, "item-1"); reserved != 2 {
+				t.Errorf("expected 2 reserved units, got %d", reserved)
+			}
+			if _, err := store.AddToCart(ctx, "other", "item-1", 1); err == nil {
+				t.Fatal("expected adding reserved stock to another cart to fail")
+			}
+
+			if _, err := store.RemoveFromCart(ctx, "user", "item-1", 1); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.AddToCart(ctx, "other", "item-1", 1); err != nil {
+				t.Fatalf("expected the released unit to be available: %v", err)
+			}
+			if _, err := store.Checkout(ctx, "user", nil); err != nil {
+				t.Fatalf("expected checkout of reserved stock to succeed: %v", err)
+			}
+			if _, err := store.Checkout(ctx, "other", nil); err != nil {
+				t.Fatalf("expected checkout of reserved stock to succeed: %v", err)
+			}
+			if reserved, _ := store.GetReservedStock(ctx, "item-1"); reserved != 0 {
+				t.Errorf("expected checkout to convert the reservations, got %d reserved units", reserved)
+			}
+			if stock, _ := store.GetStock(ctx, "item-1"); stock != 0 {
+				t.Errorf("expected stock of item-1 to be 0, got %d", stock)
+			}
+		})
+	}
+}
+
+func TestExpiredReservationsAreNotHonoured(t *testing.T) {
+	ctx := context.Background()
+	for backend, store := range testHelperStores(t) {
+		t.Run(backend, func(t *testing.T) {
+			// reservations expire as soon as they are made
+			store.SetReservationTTL(0)
+			if _, err := store.AddToCart(ctx, "user", "item-1", 2); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.AddToCart(ctx, "other", "item-1", 1); err != nil {
+				t.Fatalf("expected expired reservation to leave the stock available: %v", err)
+			}
+			store.SetReservationTTL(time.Hour)
+			if _, err := store.Checkout(ctx, "other", nil); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.Checkout(ctx, "user", nil); err == nil {
+				t.Fatal("expected checkout to fail with insufficient stock")
+			}
+			if stock, _ := store.GetStock(ctx, "item-1"); stock != 1 {
+				t.Errorf("expected stock of item-1 to be 1, got %d", stock)
+			}
+			if n, err := store.ReleaseExpiredReservations(ctx); err != nil || n != 1 {
+				t.Errorf("expected the expired reservation to be released, got %d (%v)", n, err)
+			}
+		})
+	}
+}
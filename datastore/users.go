@@ -1,62 +1,66 @@
 package datastore
 
-import "fmt"
+import (
+	"fmt"
+	"sync"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+)
 
 // userWithCredentials defines the structure of the user with credentials
 type userWithCredentials struct {
-	User     User
-	Password string
+	User User
+	// PasswordHash is the salted hash of the password, never the password itself
+	PasswordHash string
 }
 
 // UserStore defines the structure of the session store
 type UserStore struct {
+	mu sync.RWMutex
 	// Ideally you want these credentials to be stored in a secure and different from sessions store
 	users map[UserID]userWithCredentials
 }
 
 // NewUserStore creates a new session store
 func NewUserStore() *UserStore {
-	us := &UserStore{
+	return &UserStore{
 		users: make(map[UserID]userWithCredentials),
 	}
-	// TODO: Remove this
-	us.seedData()
-	return us
 }
 
 // Authenticate authenticates a user
 func (cs *UserStore) Authenticate(userID UserID, password string) (User, bool) {
-	// TODO: remove this as this is only for developement
-	if userID == password {
-		uc := userWithCredentials{
-			User:     User{ID: userID, Name: userID},
-			Password: password,
-		}
-		cs.users[userID] = uc
-		return uc.User, true
-	}
-
+	cs.mu.RLock()
 	creds, ok := cs.users[userID]
-	if ok && creds.Password == password {
+	cs.mu.RUnlock()
+	// Hashing is slow on purpose, compare outside of the lock
+	if ok && CheckPassword(creds.PasswordHash, password) {
 		return creds.User, true
 	}
 	return User{}, false
 }
 
-// AddUser adds a user to the session store
+// AddUser adds a user with the customer role to the user store
 func (cs *UserStore) AddUser(userID UserID, userName string, password string) error {
+	hash, err := HashPassword(password)
+	if err != nil {
+		return fmt.Errorf("unable to hash password: %w", err)
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
 	// check if user exists
 	_, ok := cs.users[userID]
 	if ok {
-		return fmt.Errorf("user already exists")
+		return ErrUserExists
 	}
 	user := User{
-		ID:   userID,
-		Name: userName,
+		ID:    userID,
+		Name:  userName,
+		Roles: []entities.Role{entities.RoleCustomer},
 	}
 	creds := userWithCredentials{
-		User:     user,
-		Password: password,
+		User:         user,
+		PasswordHash: hash,
 	}
 	cs.users[userID] = creds
 	return nil
@@ -64,9 +68,24 @@ func (cs *UserStore) AddUser(userID UserID, userName string, password string) er
 
 // GetUser retrieves a user from the session store based on the user ID\
 func (cs *UserStore) GetUser(userID UserID) (User, error) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
 	creds, ok := cs.users[userID]
 	if !ok {
-		return User{}, fmt.Errorf("user not found")
+		return User{}, ErrUserNotFound
 	}
 	return creds.User, nil
 }
+
+// SetRoles replaces the roles of a user
+func (cs *UserStore) SetRoles(userID UserID, roles []entities.Role) (User, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	creds, ok := cs.users[userID]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	creds.User.Roles = append([]entities.Role{}, roles...)
+	cs.users[userID] = creds
+	return creds.User, nil
+}
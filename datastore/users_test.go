@@ -0,0 +1,85 @@
+package datastore_test
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/13thuser/bookstore/datastore"
+	"github.com/13thuser/bookstore/datastore/sqlite"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPasswordsAreHashed(t *testing.T) {
+	datastore.PasswordHashCost = bcrypt.MinCost
+	db, err := sqlite.Open(filepath.Join(t.TempDir(), "bookstore.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	for backend, users := range map[string]datastore.UserRepository{"memory": datastore.NewUserStore(), "sqlite": db} {
+		t.Run(backend, func(t *testing.T) {
+			if err := users.AddUser("reader", "A Reader", "s3cret-enough"); err != nil {
+				t.Fatal(err)
+			}
+			if err := users.AddUser("reader", "Another Reader", "s3cret-enough"); err != datastore.ErrUserExists {
+				t.Errorf("expected adding an existing user to fail with ErrUserExists, got %v", err)
+			}
+			if _, ok := users.Authenticate("reader", "s3cret-enough"); !ok {
+				t.Error("expected the right password to authenticate")
+			}
+			for _, password := range []string{"wrong", "reader", ""} {
+				if _, ok := users.Authenticate("reader", password); ok {
+					t.Errorf("expected password %q not to authenticate", password)
+				}
+			}
+			if _, ok := users.Authenticate("nobody", "nobody"); ok {
+				t.Error("expected an unknown user not to authenticate")
+			}
+		})
+	}
+}
+
+func TestSQLitePlaintextPasswordsAreHashedOnOpen(t *testing.T) {
+	datastore.PasswordHashCost = bcrypt.MinCost
+	path := filepath.Join(t.TempDir(), "bookstore.db")
+	db, err := sqlite.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// Store a password the way it was stored before passwords were hashed
+	raw, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := raw.Exec(`INSERT INTO users (id, name, password) VALUES ('legacy', 'Legacy', 'legacy-passw0rd')`); err != nil {
+		t.Fatal(err)
+	}
+	raw.Close()
+
+	db, err = sqlite.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, ok := db.Authenticate("legacy", "legacy-passw0rd"); !ok {
+		t.Error("expected the legacy password to still authenticate")
+	}
+
+	raw, err = sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	var stored string
+	if err := raw.QueryRow(`SELECT password FROM users WHERE id = 'legacy'`).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stored, "$2") || stored == "legacy-passw0rd" {
+		t.Errorf("expected the stored password to be a bcrypt hash, got %q", stored)
+	}
+}
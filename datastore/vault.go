@@ -0,0 +1,44 @@
+package datastore
+
+import (
+	"sync"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+)
+
+// CardVaultStore is the in-memory implementation of CardVaultRepository
+type CardVaultStore struct {
+	mu    sync.RWMutex
+	cards map[string]entities.VaultCard
+	// tokens lists the tokens in the order they were first kept
+	tokens []string
+}
+
+// NewCardVaultStore creates a new card vault store
+func NewCardVaultStore() *CardVaultStore {
+	return &CardVaultStore{
+		cards: make(map[string]entities.VaultCard),
+	}
+}
+
+// SaveVaultCard keeps the card of a token, replacing the one kept with the token
+func (s *CardVaultStore) SaveVaultCard(card entities.VaultCard) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.cards[card.Token]; !ok {
+		s.tokens = append(s.tokens, card.Token)
+	}
+	s.cards[card.Token] = card
+	return nil
+}
+
+// ListVaultCards lists the cards kept
+func (s *CardVaultStore) ListVaultCards() ([]entities.VaultCard, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	cards := make([]entities.VaultCard, 0, len(s.tokens))
+	for _, token := range s.tokens {
+		cards = append(cards, s.cards[token])
+	}
+	return cards, nil
+}
@@ -0,0 +1,61 @@
+package datastore_test
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/13thuser/bookstore/datastore/sqlite"
+)
+
+func TestSQLiteVaultCardsForgetTheirNumbers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bookstore.db")
+	db, err := sqlite.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// Store a card the way it was kept before the vault only kept its token
+	raw, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := raw.Exec(`INSERT INTO vault_cards (token, user_id, fingerprint, data) VALUES ('tok_legacy', 'reader', 'unkeyed',
+		'{"token": "tok_legacy", "user_id": "reader", "fingerprint": "unkeyed",
+		  "details": {"credit_card_number": "4242424242424242", "credit_card_expiration": "12/99"},
+		  "card": {"token": "tok_legacy", "brand": "visa", "last4": "4242", "expiry_month": 12, "expiry_year": 2099}}')`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := raw.Exec(`DELETE FROM schema_migrations WHERE version = 13`); err != nil {
+		t.Fatal(err)
+	}
+	raw.Close()
+
+	db, err = sqlite.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	cards, err := db.ListVaultCards()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cards) != 1 || cards[0].Token != "tok_legacy" || cards[0].Card.Last4 != "4242" || cards[0].Fingerprint == "unkeyed" {
+		t.Errorf("expected the token to be kept with its card under a new fingerprint, got %+v", cards)
+	}
+
+	raw, err = sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	var data string
+	if err := raw.QueryRow(`SELECT data FROM vault_cards WHERE token = 'tok_legacy'`).Scan(&data); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(data, "4242424242424242") || strings.Contains(data, "unkeyed") {
+		t.Errorf("expected the number and fingerprint of the card to be forgotten, got %s", data)
+	}
+}
@@ -2,4 +2,8 @@ module github.com/13thuser/bookstore
 
 go 1.19
 
-require github.com/gorilla/mux v1.8.1
+require (
+	github.com/gorilla/mux v1.8.1
+	github.com/mattn/go-sqlite3 v1.14.22
+	golang.org/x/crypto v0.24.0
+)
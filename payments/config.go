@@ -0,0 +1,111 @@
+package payments
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ProviderType names a PaymentProcessor implementation of a providers file
+type ProviderType string
+
+const (
+	// ProviderGateway is the simulated PaymentGateway, charging the cards of the vault
+	ProviderGateway ProviderType = "gateway"
+	// ProviderFake is a FakeGateway approving every call, for local testing
+	ProviderFake ProviderType = "fake"
+)
+
+// providerConfig is a provider as written in a providers file
+type providerConfig struct {
+	Name string       `json:"name"`
+	Type ProviderType `json:"type"`
+	// APIKeyEnv names the environment variable holding the API key of the provider
+	APIKeyEnv string `json:"api_key_env,omitempty"`
+	// WebhookSecretEnv names the environment variable holding the secret signing the webhooks of the provider
+	WebhookSecretEnv string `json:"webhook_secret_env,omitempty"`
+}
+
+// Load reads the payment providers and their routes from JSON, e.g.
+//
+//	{"providers": [
+//	   {"name": "primary", "type": "gateway", "api_key_env": "PRIMARY_API_KEY", "webhook_secret_env": "PRIMARY_WEBHOOK_SECRET"},
+//	   {"name": "europe", "type": "gateway", "api_key_env": "EUROPE_API_KEY"},
+//	   {"name": "backup", "type": "fake"}],
+//	 "routes": [
+//	   {"currencies": ["EUR", "GBP"], "providers": ["europe", "primary"]},
+//	   {"brands": ["amex"], "min_amount": {"amount": 100000, "currency": "USD"}, "providers": ["primary"]}]}
+//
+// The payments no route matches go to the providers in the order they are
+// listed, see Router. The gateways charge the cards of the vault, every
+// provider is called through a Resilient processor with the policy, and the
+// providers with a webhook secret send webhooks signed with it, see ParseWebhook.
+func Load(r io.Reader, vault *Vault, policy ResiliencePolicy) (*Router, error) {
+	var file struct {
+		Providers []providerConfig `json:"providers"`
+		Routes    []Route          `json:"routes"`
+	}
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&file); err != nil {
+		return nil, fmt.Errorf("unable to read payment providers: %w", err)
+	}
+	if len(file.Providers) == 0 {
+		return nil, fmt.Errorf("no payment providers")
+	}
+	router := NewRouter()
+	for i, config := range file.Providers {
+		processor, err := config.processor(vault)
+		if err != nil {
+			return nil, fmt.Errorf("payment provider %d: %w", i+1, err)
+		}
+		if err := router.Register(config.Name, NewResilient(processor, policy)); err != nil {
+			return nil, fmt.Errorf("payment provider %d: %w", i+1, err)
+		}
+		if config.WebhookSecretEnv != "" {
+			secret := os.Getenv(config.WebhookSecretEnv)
+			if secret == "" {
+				return nil, fmt.Errorf("payment provider %d: the webhook secret variable %s is not set", i+1, config.WebhookSecretEnv)
+			}
+			router.SetWebhookSecret(config.Name, secret)
+		}
+	}
+	for i, route := range file.Routes {
+		if err := router.AddRoute(route); err != nil {
+			return nil, fmt.Errorf("payment route %d: %w", i+1, err)
+		}
+	}
+	return router, nil
+}
+
+// LoadFile reads the payment providers from a JSON file, an empty path gives no router
+func LoadFile(path string, vault *Vault, policy ResiliencePolicy) (*Router, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Load(f, vault, policy)
+}
+
+// processor checks the configuration and returns its payment processor
+func (c providerConfig) processor(vault *Vault) (PaymentProcessor, error) {
+	switch c.Type {
+	case ProviderGateway:
+		apiKey := PAYMENT_GATEWAY_API_KEY
+		if c.APIKeyEnv != "" {
+			apiKey = os.Getenv(c.APIKeyEnv)
+			if apiKey == "" {
+				return nil, fmt.Errorf("the API key variable %s is not set", c.APIKeyEnv)
+			}
+		}
+		return &PaymentGateway{APIKey: apiKey, Vault: vault}, nil
+	case ProviderFake:
+		return NewFakeGateway(), nil
+	}
+	return nil, fmt.Errorf("unknown payment provider type %q", c.Type)
+}
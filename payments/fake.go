@@ -0,0 +1,301 @@
+package payments
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+)
+
+// Operation names a call to a payment processor
+type Operation string
+
+const (
+	OpAuthorize Operation = "authorize"
+	OpCapture   Operation = "capture"
+	OpVoid      Operation = "void"
+	OpRefund    Operation = "refund"
+)
+
+// OutcomeKind defines how a FakeGateway answers a call
+type OutcomeKind string
+
+const (
+	OutcomeApprove OutcomeKind = "approve"
+	OutcomeDecline OutcomeKind = "decline"
+	OutcomeTimeout OutcomeKind = "timeout"
+	// OutcomeUnavailable fails as a gateway that cannot be reached
+	OutcomeUnavailable OutcomeKind = "unavailable"
+	// OutcomeHang does not answer until the context of the call is done
+	OutcomeHang OutcomeKind = "hang"
+	// OutcomePartial approves part of an authorization, the other operations approve in full
+	OutcomePartial OutcomeKind = "partial"
+)
+
+// Outcome is a scripted answer of a FakeGateway
+type Outcome struct {
+	Kind OutcomeKind
+	// Amount is what a partial approval approves
+	Amount entities.Money
+	// Reason is given with declines
+	Reason string
+}
+
+// Approve returns the outcome approving a call
+func Approve() Outcome {
+	return Outcome{Kind: OutcomeApprove}
+}
+
+// Decline returns the outcome declining a call for the reason
+func Decline(reason string) Outcome {
+	return Outcome{Kind: OutcomeDecline, Reason: reason}
+}
+
+// Timeout returns the outcome of a call the gateway did not answer
+func Timeout() Outcome {
+	return Outcome{Kind: OutcomeTimeout}
+}
+
+// Unavailable returns the outcome of a call the gateway could not be reached for
+func Unavailable() Outcome {
+	return Outcome{Kind: OutcomeUnavailable}
+}
+
+// Hang returns the outcome of a call the gateway answers too late, once the caller gave up
+func Hang() Outcome {
+	return Outcome{Kind: OutcomeHang}
+}
+
+// PartialApprove returns the outcome approving only amount of an authorization
+func PartialApprove(amount entities.Money) Outcome {
+	return Outcome{Kind: OutcomePartial, Amount: amount}
+}
+
+// FakeAuthorization is the state of an authorization at a FakeGateway
+type FakeAuthorization struct {
+	PaymentID string
+	CardToken string
+	Amount    entities.Money
+	Captured  entities.Money
+	Refunded  entities.Money
+	Voided    bool
+}
+
+// FakeGateway is a deterministic PaymentProcessor for tests and development.
+// It keeps the books of its authorizations, refusing to capture more than
+// was authorized or to refund more than was captured, and answers each call
+// with the next outcome scripted for its operation, approving once there is
+// none left; it does not look at the cards. An authorization sent again with
+// the same idempotency key gets the first answer without holding the amount
+// twice. Its IDs are sequential, e.g. "auth-1", "capture-2".
+type FakeGateway struct {
+	mu             sync.Mutex
+	script         map[Operation][]Outcome
+	authorizations map[string]*FakeAuthorization
+	// idempotent lists the authorizations by the idempotency key of their request
+	idempotent map[string]idempotentAuthorization
+	calls      map[Operation]int
+	sequence   int
+}
+
+// idempotentAuthorization is the answer of a FakeGateway to an authorization with an idempotency key
+type idempotentAuthorization struct {
+	payment       PaymentRequest
+	authorization Authorization
+}
+
+// NewFakeGateway creates a fake gateway approving every call until scripted otherwise
+func NewFakeGateway() *FakeGateway {
+	return &FakeGateway{
+		script:         make(map[Operation][]Outcome),
+		authorizations: make(map[string]*FakeAuthorization),
+		idempotent:     make(map[string]idempotentAuthorization),
+		calls:          make(map[Operation]int),
+	}
+}
+
+// Script queues the outcomes of the next calls of the operation
+func (g *FakeGateway) Script(op Operation, outcomes ...Outcome) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.script[op] = append(g.script[op], outcomes...)
+}
+
+// Calls returns how many times the operation was called
+func (g *FakeGateway) Calls(op Operation) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.calls[op]
+}
+
+// Authorization returns the state of an authorization of the gateway
+func (g *FakeGateway) Authorization(id string) (FakeAuthorization, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	auth, ok := g.authorizations[id]
+	if !ok {
+		return FakeAuthorization{}, false
+	}
+	return *auth, true
+}
+
+// Authorize holds the amount of the payment unless scripted otherwise
+func (g *FakeGateway) Authorize(ctx context.Context, payment PaymentRequest) (Authorization, error) {
+	if err := g.hang(ctx, OpAuthorize); err != nil {
+		return Authorization{}, err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if previous, ok := g.idempotent[payment.IdempotencyKey]; ok && payment.IdempotencyKey != "" {
+		g.calls[OpAuthorize]++
+		if previous.payment != payment {
+			return Authorization{}, fmt.Errorf("%w: idempotency key %s was used for another payment", ErrDeclined, payment.IdempotencyKey)
+		}
+		return previous.authorization, nil
+	}
+	outcome := g.next(OpAuthorize)
+	if err := outcome.err(OpAuthorize, ErrDeclined); err != nil {
+		return Authorization{}, err
+	}
+	if !payment.Amount.IsPositive() {
+		return Authorization{}, fmt.Errorf("%w: nothing to authorize", ErrDeclined)
+	}
+	amount := payment.Amount
+	if outcome.Kind == OutcomePartial && outcome.Amount.SameCurrency(amount) && outcome.Amount.Cmp(amount) < 0 {
+		amount = outcome.Amount
+		amount.Currency = payment.Amount.Currency
+	}
+	id := g.newID("auth-")
+	g.authorizations[id] = &FakeAuthorization{
+		PaymentID: payment.ID,
+		CardToken: payment.CardToken,
+		Amount:    amount,
+		Captured:  entities.Money{Currency: amount.Currency},
+		Refunded:  entities.Money{Currency: amount.Currency},
+	}
+	authorization := Authorization{ID: id, Amount: amount}
+	if payment.IdempotencyKey != "" {
+		g.idempotent[payment.IdempotencyKey] = idempotentAuthorization{payment: payment, authorization: authorization}
+	}
+	return authorization, nil
+}
+
+// Capture captures amount of the authorization unless scripted otherwise
+func (g *FakeGateway) Capture(ctx context.Context, authorizationID string, amount entities.Money) (string, error) {
+	if err := g.hang(ctx, OpCapture); err != nil {
+		return "", err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err := g.next(OpCapture).err(OpCapture, ErrCaptureFailed); err != nil {
+		return "", err
+	}
+	auth, ok := g.authorizations[authorizationID]
+	switch {
+	case !ok:
+		return "", fmt.Errorf("%w: unknown authorization %s", ErrCaptureFailed, authorizationID)
+	case auth.Voided:
+		return "", fmt.Errorf("%w: authorization %s was voided", ErrCaptureFailed, authorizationID)
+	case !amount.IsPositive() || !amount.SameCurrency(auth.Amount):
+		return "", fmt.Errorf("%w: invalid amount %s", ErrCaptureFailed, amount)
+	case auth.Captured.Add(amount).Cmp(auth.Amount) > 0:
+		return "", fmt.Errorf("%w: only %s is left to capture", ErrCaptureFailed, auth.Amount.Sub(auth.Captured))
+	}
+	auth.Captured = auth.Captured.Add(amount)
+	return g.newID("capture-"), nil
+}
+
+// Void releases what was not captured of the authorization unless scripted otherwise
+func (g *FakeGateway) Void(ctx context.Context, authorizationID string) error {
+	if err := g.hang(ctx, OpVoid); err != nil {
+		return err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err := g.next(OpVoid).err(OpVoid, ErrVoidFailed); err != nil {
+		return err
+	}
+	auth, ok := g.authorizations[authorizationID]
+	switch {
+	case !ok:
+		return fmt.Errorf("%w: unknown authorization %s", ErrVoidFailed, authorizationID)
+	case auth.Voided:
+		return fmt.Errorf("%w: authorization %s was already voided", ErrVoidFailed, authorizationID)
+	}
+	auth.Voided = true
+	return nil
+}
+
+// Refund gives back amount of what was captured of the authorization unless scripted otherwise
+func (g *FakeGateway) Refund(ctx context.Context, confirmationID string, amount entities.Money) (string, error) {
+	if err := g.hang(ctx, OpRefund); err != nil {
+		return "", err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err := g.next(OpRefund).err(OpRefund, ErrRefundFailed); err != nil {
+		return "", err
+	}
+	auth, ok := g.authorizations[confirmationID]
+	switch {
+	case !ok:
+		return "", fmt.Errorf("%w: unknown payment %s", ErrRefundFailed, confirmationID)
+	case !amount.IsPositive() || !amount.SameCurrency(auth.Captured):
+		return "", fmt.Errorf("%w: invalid amount %s", ErrRefundFailed, amount)
+	case auth.Refunded.Add(amount).Cmp(auth.Captured) > 0:
+		return "", fmt.Errorf("%w: only %s is left to refund", ErrRefundFailed, auth.Captured.Sub(auth.Refunded))
+	}
+	auth.Refunded = auth.Refunded.Add(amount)
+	return g.newID("refund-"), nil
+}
+
+// hang blocks until ctx is done when the next outcome of the operation is a
+// hang, counting the call; mu must not be held
+func (g *FakeGateway) hang(ctx context.Context, op Operation) error {
+	g.mu.Lock()
+	queue := g.script[op]
+	if len(queue) == 0 || queue[0].Kind != OutcomeHang {
+		g.mu.Unlock()
+		return nil
+	}
+	g.script[op] = queue[1:]
+	g.calls[op]++
+	g.mu.Unlock()
+	<-ctx.Done()
+	return fmt.Errorf("%w: %s got no answer: %v", ErrTimeout, op, ctx.Err())
+}
+
+// next counts a call of the operation and returns its outcome; the caller must hold mu
+func (g *FakeGateway) next(op Operation) Outcome {
+	g.calls[op]++
+	queue := g.script[op]
+	if len(queue) == 0 {
+		return Approve()
+	}
+	g.script[op] = queue[1:]
+	return queue[0]
+}
+
+// newID returns the next ID of the gateway with the prefix; the caller must hold mu
+func (g *FakeGateway) newID(prefix string) string {
+	g.sequence++
+	return fmt.Sprintf("%s%d", prefix, g.sequence)
+}
+
+// err returns the error of a declined, timed out or unsent call of the operation,
+// declines wrap declined
+func (o Outcome) err(op Operation, declined error) error {
+	switch o.Kind {
+	case OutcomeDecline:
+		if o.Reason == "" {
+			return fmt.Errorf("%w: %s declined", declined, op)
+		}
+		return fmt.Errorf("%w: %s", declined, o.Reason)
+	case OutcomeTimeout:
+		return fmt.Errorf("%w: %s got no answer", ErrTimeout, op)
+	case OutcomeUnavailable:
+		return fmt.Errorf("%w: %s could not be sent", ErrUnavailable, op)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package payments
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+)
+
+func TestFakeGatewayScript(t *testing.T) {
+	ctx := context.Background()
+	g := NewFakeGateway()
+	payment := PaymentRequest{ID: "order-1", UserID: "testuser", Amount: entities.NewMoney(5000, "USD")}
+	g.Script(OpAuthorize, Decline("insufficient funds"), Timeout(), PartialApprove(entities.NewMoney(3000, "USD")))
+
+	if _, err := g.Authorize(ctx, payment); !errors.Is(err, ErrDeclined) {
+		t.Errorf("expected a decline, got %v", err)
+	}
+	if _, err := g.Authorize(ctx, payment); !errors.Is(err, ErrTimeout) {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+	partial, err := g.Authorize(ctx, payment)
+	if err != nil || partial.Amount != entities.NewMoney(3000, "USD") {
+		t.Errorf("expected a partial approval of 30.00, got %+v and %v", partial, err)
+	}
+	full, err := g.Authorize(ctx, payment)
+	if err != nil || full.Amount != payment.Amount || full.ID != "auth-2" {
+		t.Errorf("expected the script to be over and approve in full, got %+v and %v", full, err)
+	}
+	if calls := g.Calls(OpAuthorize); calls != 4 {
+		t.Errorf("expected 4 authorizations, got %d", calls)
+	}
+}
+
+func TestFakeGatewayBooks(t *testing.T) {
+	ctx := context.Background()
+	g := NewFakeGateway()
+	usd := func(amount int64) entities.Money { return entities.NewMoney(amount, "USD") }
+	auth, _ := g.Authorize(ctx, PaymentRequest{ID: "order-1", Amount: usd(5000)})
+
+	if _, err := g.Refund(ctx, auth.ID, usd(100)); !errors.Is(err, ErrRefundFailed) {
+		t.Errorf("expected refunding before any capture to fail, got %v", err)
+	}
+	if _, err := g.Capture(ctx, auth.ID, usd(3000)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.Capture(ctx, auth.ID, usd(2001)); !errors.Is(err, ErrCaptureFailed) {
+		t.Errorf("expected capturing more than authorized to fail, got %v", err)
+	}
+	g.Script(OpCapture, Decline(""))
+	if _, err := g.Capture(ctx, auth.ID, usd(1000)); !errors.Is(err, ErrCaptureFailed) {
+		t.Errorf("expected the scripted decline, got %v", err)
+	}
+	if _, err := g.Refund(ctx, auth.ID, usd(3000)); err != nil {
+		t.Errorf("expected refunding what was captured to succeed, got %v", err)
+	}
+	if err := g.Void(ctx, auth.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.Capture(ctx, auth.ID, usd(1000)); !errors.Is(err, ErrCaptureFailed) {
+		t.Errorf("expected capturing a voided authorization to fail, got %v", err)
+	}
+	if err := g.Void(ctx, auth.ID); !errors.Is(err, ErrVoidFailed) {
+		t.Errorf("expected voiding twice to fail, got %v", err)
+	}
+	state, ok := g.Authorization(auth.ID)
+	if !ok || state.Captured != usd(3000) || state.Refunded != usd(3000) || !state.Voided {
+		t.Errorf("unexpected authorization %+v", state)
+	}
+}
@@ -2,6 +2,10 @@ package payments
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
 
 	"github.com/13thuser/bookstore/bookstore/entities"
 )
@@ -13,40 +17,130 @@ const PAYMENT_GATEWAY_API_KEY = "my-api-key"
 type PaymentRequest struct {
 	ID     string
 	UserID string
-	Amount float64
+	Amount entities.Money
+	// CardToken is the token of the card in the vault of the gateway
+	CardToken string
+	// CardBrand is the brand of the card, for routing the payment
+	CardBrand entities.CardBrand
+	// IdempotencyKey identifies the attempt to pay: the gateway processes the
+	// requests sent again with the same key once, answering them like the first
+	IdempotencyKey string
 }
 
 // CreditCardDetails represents a credit card
 type CreditCardDetails = entities.CreditCardDetails
 
-// PaymentProcessor defines an interface for processing payments
+// Authorization represents an amount held on a card until it is captured or voided
+type Authorization struct {
+	ID string
+	// Amount is what the issuer approved, less than requested when the authorization was partially approved
+	Amount entities.Money
+}
+
+// Errors returned by the payment processors
+var (
+	// ErrDeclined is returned when the issuer declines an authorization
+	ErrDeclined = errors.New("payment declined")
+	// ErrTimeout is returned when the payment gateway did not answer in time
+	ErrTimeout = errors.New("payment gateway timeout")
+	// ErrUnavailable is returned when the payment gateway cannot be reached or fails to process a request
+	ErrUnavailable = errors.New("payment gateway unavailable")
+	// ErrCaptureFailed is returned when the payment gateway declines a capture
+	ErrCaptureFailed = errors.New("capture failed")
+	// ErrVoidFailed is returned when the payment gateway cannot void an authorization
+	ErrVoidFailed = errors.New("void failed")
+	// ErrRefundFailed is returned when the payment gateway declines a refund
+	ErrRefundFailed = errors.New("refund failed")
+)
+
+// IsTransient tells if an error of a payment processor may not happen again
+// when retried, e.g. with another provider, unlike declines
+func IsTransient(err error) bool {
+	return errors.Is(err, ErrTimeout) || errors.Is(err, ErrUnavailable)
+}
+
+// PaymentProcessor defines an interface for processing payments in two
+// phases: the amount is authorized first, then captured or voided
 type PaymentProcessor interface {
-	ProcessPayment(ctx context.Context, payment PaymentRequest, cardDetails CreditCardDetails) (string, error)
+	// Authorize holds the amount of the payment on the card of its token
+	Authorize(ctx context.Context, payment PaymentRequest) (Authorization, error)
+	// Capture charges amount of the authorization, which may be captured in
+	// several parts, and returns the confirmation ID of the capture
+	Capture(ctx context.Context, authorizationID string, amount entities.Money) (string, error)
+	// Void releases what was not captured of the authorization
+	Void(ctx context.Context, authorizationID string) error
+	// Refund gives back amount of the payment with the confirmation ID, which may
+	// be refunded in several parts, and returns the confirmation ID of the refund
+	Refund(ctx context.Context, confirmationID string, amount entities.Money) (string, error)
 }
 
 // PaymentGateway represents a payment gateway
 type PaymentGateway struct {
 	APIKey string
+	// Vault keeps the cards of the tokens of the payments
+	Vault *Vault
 }
 
-// NewPaymentGateway creates a new payment gateway
-func NewPaymentGateway() PaymentProcessor {
+// NewPaymentGateway creates a new payment gateway charging the cards of the vault
+func NewPaymentGateway(vault *Vault) PaymentProcessor {
 	return &PaymentGateway{
 		APIKey: PAYMENT_GATEWAY_API_KEY,
+		Vault:  vault,
+	}
+}
+
+// Authorize authorizes a payment
+func (pg *PaymentGateway) Authorize(ctx context.Context, payment PaymentRequest) (Authorization, error) {
+	if _, err := pg.Vault.Detokenize(payment.CardToken); err != nil {
+		return Authorization{}, fmt.Errorf("%w: %v", ErrDeclined, err)
+	}
+	// Simulate the authorization, the whole amount is always approved; a real
+	// gateway would be sent the card and payment.IdempotencyKey with the request
+	id, err := randomID("auth-")
+	if err != nil {
+		return Authorization{}, fmt.Errorf("%w: %v", ErrDeclined, err)
 	}
+	return Authorization{ID: id, Amount: payment.Amount}, nil
 }
 
-// ProcessPayment processes a payment
-func (pg *PaymentGateway) ProcessPayment(ctx context.Context, payment PaymentRequest, cardDetails CreditCardDetails) (string, error) {
-	// NOTE: One important thing is to have idempotency keys for the payment processing
-	// to avoid processing the same payment multiple times. So, maybe, internally create
-	// a unique idempotency key for each payment and use it in the payment processing
-	// and associate it with the orderID. Ideally we would like to do it with in the service
+// Capture captures part or all of an authorization
+func (pg *PaymentGateway) Capture(ctx context.Context, authorizationID string, amount entities.Money) (string, error) {
+	if authorizationID == "" || !amount.IsPositive() {
+		return "", fmt.Errorf("%w: nothing to capture", ErrCaptureFailed)
+	}
+	id, err := randomID("capture-")
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrCaptureFailed, err)
+	}
+	return id, nil
+}
+
+// Void voids what is left of an authorization
+func (pg *PaymentGateway) Void(ctx context.Context, authorizationID string) error {
+	if authorizationID == "" {
+		return fmt.Errorf("%w: nothing to void", ErrVoidFailed)
+	}
+	return nil
+}
 
-	// generate random string
-	idempotencyKey := payment.ID
-	confirmationID := idempotencyKey
+// Refund refunds part or all of a payment
+func (pg *PaymentGateway) Refund(ctx context.Context, confirmationID string, amount entities.Money) (string, error) {
+	if confirmationID == "" || !amount.IsPositive() {
+		return "", fmt.Errorf("%w: nothing to refund", ErrRefundFailed)
+	}
+	// Simulate refund processing, every refund gets its own confirmation
+	id, err := randomID("refund-")
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrRefundFailed, err)
+	}
+	return id, nil
+}
 
-	// Simulate payment processing, return true if successful, false otherwise
-	return confirmationID, nil
+// randomID returns the prefix followed by 8 random bytes in hex
+func randomID(prefix string) (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return prefix + hex.EncodeToString(b), nil
 }
@@ -0,0 +1,268 @@
+package payments
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+)
+
+// ResiliencePolicy defines how a Resilient processor calls the processor it wraps
+type ResiliencePolicy struct {
+	// CallTimeout bounds each attempt, the deadline of the context of the request still applies
+	CallTimeout time.Duration
+	// MaxAttempts is how many times a call is attempted at most, retries included
+	MaxAttempts int
+	// BaseBackoff is the longest wait before the first retry, it doubles with
+	// each retry up to MaxBackoff and the actual wait is drawn at random below it
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	// FailureThreshold is how many transient errors in a row open the circuit
+	FailureThreshold int
+	// OpenDuration is how long an open circuit fails the calls before one is let through
+	OpenDuration time.Duration
+}
+
+// DefaultResiliencePolicy is the policy of the payment processors of the server
+var DefaultResiliencePolicy = ResiliencePolicy{
+	CallTimeout:      10 * time.Second,
+	MaxAttempts:      3,
+	BaseBackoff:      100 * time.Millisecond,
+	MaxBackoff:       2 * time.Second,
+	FailureThreshold: 5,
+	OpenDuration:     30 * time.Second,
+}
+
+// CircuitState defines whether a Resilient processor lets the calls through
+type CircuitState string
+
+const (
+	// CircuitClosed lets every call through
+	CircuitClosed CircuitState = "closed"
+	// CircuitOpen fails every call without making it
+	CircuitOpen CircuitState = "open"
+	// CircuitHalfOpen lets a single call through to find out if the processor recovered
+	CircuitHalfOpen CircuitState = "half-open"
+)
+
+// CircuitOpenError is returned without calling the processor while the
+// circuit is open; it is an ErrUnavailable, so the payment may be retried
+// later or with another provider
+type CircuitOpenError struct {
+	// RetryAfter is how long the circuit stays open
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("%s: circuit open, retry in %s", ErrUnavailable, e.RetryAfter.Round(time.Second))
+}
+
+func (e *CircuitOpenError) Unwrap() error {
+	return ErrUnavailable
+}
+
+// Resilient is a PaymentProcessor guarding the calls to another one: each
+// attempt is bounded by the CallTimeout of its policy, and the calls failing
+// with transient errors are retried after a jittered backoff when retrying
+// them cannot charge twice, i.e. the authorizations with an idempotency key
+// and the voids. Captures and refunds are not retried: they carry no
+// idempotency key and stay pending or failed in the order for staff to retry.
+//
+// A circuit breaker opens after FailureThreshold transient errors in a row and
+// fails the calls with a CircuitOpenError for OpenDuration, then lets a
+// single call through: the circuit closes again if it is answered, declines
+// included, and opens again otherwise.
+//
+// The wrapped processor is expected to give up once the context of the call is
+// done; its context errors are returned as ErrTimeout.
+type Resilient struct {
+	processor PaymentProcessor
+	policy    ResiliencePolicy
+
+	mu       sync.Mutex
+	state    CircuitState
+	failures int
+	openedAt time.Time
+	// probing is set while the single call of a half-open circuit is made
+	probing bool
+	now     func() time.Time
+	// backoff returns the wait before the retry following the attempt, counted from 1
+	backoff func(attempt int) time.Duration
+}
+
+// NewResilient wraps the processor with the policy, the zero fields of the
+// policy take the values of DefaultResiliencePolicy
+func NewResilient(processor PaymentProcessor, policy ResiliencePolicy) *Resilient {
+	if policy.CallTimeout <= 0 {
+		policy.CallTimeout = DefaultResiliencePolicy.CallTimeout
+	}
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = DefaultResiliencePolicy.MaxAttempts
+	}
+	if policy.BaseBackoff <= 0 {
+		policy.BaseBackoff = DefaultResiliencePolicy.BaseBackoff
+	}
+	if policy.MaxBackoff < policy.BaseBackoff {
+		policy.MaxBackoff = policy.BaseBackoff
+	}
+	if policy.FailureThreshold <= 0 {
+		policy.FailureThreshold = DefaultResiliencePolicy.FailureThreshold
+	}
+	if policy.OpenDuration <= 0 {
+		policy.OpenDuration = DefaultResiliencePolicy.OpenDuration
+	}
+	r := &Resilient{
+		processor: processor,
+		policy:    policy,
+		state:     CircuitClosed,
+		now:       time.Now,
+	}
+	r.backoff = r.jitteredBackoff
+	return r
+}
+
+// State returns the state of the circuit
+func (r *Resilient) State() CircuitState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.state == CircuitOpen && r.now().Sub(r.openedAt) >= r.policy.OpenDuration {
+		return CircuitHalfOpen
+	}
+	return r.state
+}
+
+// Authorize holds the amount of the payment, retrying the transient errors
+// when the payment has an idempotency key
+func (r *Resilient) Authorize(ctx context.Context, payment PaymentRequest) (Authorization, error) {
+	var authorization Authorization
+	err := r.call(ctx, payment.IdempotencyKey != "", func(ctx context.Context) error {
+		var err error
+		authorization, err = r.processor.Authorize(ctx, payment)
+		return err
+	})
+	return authorization, err
+}
+
+// Capture charges amount of the authorization, without retrying
+func (r *Resilient) Capture(ctx context.Context, authorizationID string, amount entities.Money) (string, error) {
+	var confirmation string
+	err := r.call(ctx, false, func(ctx context.Context) error {
+		var err error
+		confirmation, err = r.processor.Capture(ctx, authorizationID, amount)
+		return err
+	})
+	return confirmation, err
+}
+
+// Void releases what was not captured of the authorization, retrying the transient errors
+func (r *Resilient) Void(ctx context.Context, authorizationID string) error {
+	return r.call(ctx, true, func(ctx context.Context) error {
+		return r.processor.Void(ctx, authorizationID)
+	})
+}
+
+// Refund gives back amount of the payment, without retrying
+func (r *Resilient) Refund(ctx context.Context, confirmationID string, amount entities.Money) (string, error) {
+	var confirmation string
+	err := r.call(ctx, false, func(ctx context.Context) error {
+		var err error
+		confirmation, err = r.processor.Refund(ctx, confirmationID, amount)
+		return err
+	})
+	return confirmation, err
+}
+
+// call makes the attempts of a call allowed by the circuit, retrying the
+// transient errors when retryable, and returns the error of the last one
+func (r *Resilient) call(ctx context.Context, retryable bool, attempt func(ctx context.Context) error) error {
+	attempts := 1
+	if retryable {
+		attempts = r.policy.MaxAttempts
+	}
+	var err error
+	for i := 1; i <= attempts; i++ {
+		if err = r.allow(); err != nil {
+			return err
+		}
+		err = r.attempt(ctx, attempt)
+		// the caller giving up tells nothing of the health of the processor
+		r.record(err, ctx.Err() == nil)
+		if err == nil || !IsTransient(err) || i == attempts || ctx.Err() != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(r.backoff(i)):
+		}
+	}
+	return err
+}
+
+// attempt makes an attempt bounded by the call timeout
+func (r *Resilient) attempt(ctx context.Context, attempt func(ctx context.Context) error) error {
+	callCtx, cancel := context.WithTimeout(ctx, r.policy.CallTimeout)
+	defer cancel()
+	err := attempt(callCtx)
+	if err != nil && !IsTransient(err) && (errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled)) {
+		return fmt.Errorf("%w: %v", ErrTimeout, err)
+	}
+	return err
+}
+
+// allow tells if the circuit lets a call through, moving an open circuit to
+// half-open once it was open for long enough
+func (r *Resilient) allow() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch r.state {
+	case CircuitOpen:
+		remaining := r.policy.OpenDuration - r.now().Sub(r.openedAt)
+		if remaining > 0 {
+			return &CircuitOpenError{RetryAfter: remaining}
+		}
+		r.state = CircuitHalfOpen
+		r.probing = true
+	case CircuitHalfOpen:
+		if r.probing {
+			// another call finds out if the processor recovered
+			return &CircuitOpenError{RetryAfter: time.Second}
+		}
+		r.probing = true
+	}
+	return nil
+}
+
+// record updates the circuit with the result of an attempt, declines are
+// answers too; the failures are only counted when count is set
+func (r *Resilient) record(err error, count bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.probing = false
+	if err != nil && !count {
+		return
+	}
+	if err == nil || !IsTransient(err) {
+		r.state = CircuitClosed
+		r.failures = 0
+		return
+	}
+	r.failures++
+	if r.state == CircuitHalfOpen || r.failures >= r.policy.FailureThreshold {
+		r.state = CircuitOpen
+		r.openedAt = r.now()
+	}
+}
+
+// jitteredBackoff draws the wait before a retry below the exponential backoff of the attempt
+func (r *Resilient) jitteredBackoff(attempt int) time.Duration {
+	backoff := r.policy.MaxBackoff
+	if attempt < 32 && r.policy.BaseBackoff<<(attempt-1) < backoff {
+		backoff = r.policy.BaseBackoff << (attempt - 1)
+	}
+	return time.Duration(rand.Int63n(int64(backoff) + 1))
+}
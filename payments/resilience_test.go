@@ -0,0 +1,115 @@
+package payments
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+)
+
+// testHelperResilient returns a fake gateway wrapped with the policy, retrying without waiting
+func testHelperResilient(policy ResiliencePolicy) (*Resilient, *FakeGateway, *time.Time) {
+	gateway := NewFakeGateway()
+	resilient := NewResilient(gateway, policy)
+	now := time.Now()
+	resilient.now = func() time.Time { return now }
+	resilient.backoff = func(int) time.Duration { return 0 }
+	return resilient, gateway, &now
+}
+
+func TestResilientRetries(t *testing.T) {
+	ctx := context.Background()
+	resilient, gateway, _ := testHelperResilient(ResiliencePolicy{CallTimeout: 20 * time.Millisecond, MaxAttempts: 3, FailureThreshold: 10})
+	payment := PaymentRequest{ID: "order-1", Amount: entities.NewMoney(5000, "USD"), IdempotencyKey: "key-1"}
+
+	gateway.Script(OpAuthorize, Unavailable(), Hang())
+	auth, err := resilient.Authorize(ctx, payment)
+	if err != nil || gateway.Calls(OpAuthorize) != 3 {
+		t.Fatalf("expected the third attempt to authorize, got %+v after %d calls (%v)", auth, gateway.Calls(OpAuthorize), err)
+	}
+
+	gateway.Script(OpAuthorize, Decline("insufficient funds"))
+	payment.IdempotencyKey = "key-2"
+	if _, err := resilient.Authorize(ctx, payment); !errors.Is(err, ErrDeclined) || gateway.Calls(OpAuthorize) != 4 {
+		t.Errorf("expected a decline not to be retried, got %d calls (%v)", gateway.Calls(OpAuthorize), err)
+	}
+
+	gateway.Script(OpAuthorize, Timeout())
+	payment.IdempotencyKey = ""
+	if _, err := resilient.Authorize(ctx, payment); !errors.Is(err, ErrTimeout) || gateway.Calls(OpAuthorize) != 5 {
+		t.Errorf("expected an authorization without idempotency key not to be retried, got %d calls (%v)", gateway.Calls(OpAuthorize), err)
+	}
+
+	gateway.Script(OpCapture, Unavailable())
+	if _, err := resilient.Capture(ctx, auth.ID, entities.NewMoney(5000, "USD")); !errors.Is(err, ErrUnavailable) || gateway.Calls(OpCapture) != 1 {
+		t.Errorf("expected a capture not to be retried, got %d calls (%v)", gateway.Calls(OpCapture), err)
+	}
+	gateway.Script(OpVoid, Hang(), Hang(), Hang())
+	if err := resilient.Void(ctx, auth.ID); !errors.Is(err, ErrTimeout) || gateway.Calls(OpVoid) != 3 {
+		t.Errorf("expected a void to be attempted 3 times, got %d calls (%v)", gateway.Calls(OpVoid), err)
+	}
+
+	// the deadline of the request is not extended by the retries
+	gateway.Script(OpAuthorize, Hang(), Hang(), Hang())
+	payment.IdempotencyKey = "key-3"
+	short, cancel := context.WithTimeout(ctx, 5*time.Millisecond)
+	defer cancel()
+	if _, err := resilient.Authorize(short, payment); !errors.Is(err, ErrTimeout) || gateway.Calls(OpAuthorize) != 6 {
+		t.Errorf("expected a single attempt within the deadline of the request, got %d calls (%v)", gateway.Calls(OpAuthorize), err)
+	}
+}
+
+func TestResilientCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	resilient, gateway, now := testHelperResilient(ResiliencePolicy{MaxAttempts: 1, FailureThreshold: 2, OpenDuration: time.Minute})
+	payment := PaymentRequest{ID: "order-1", Amount: entities.NewMoney(5000, "USD"), IdempotencyKey: "key-1"}
+
+	gateway.Script(OpAuthorize, Timeout(), Unavailable())
+	for i := 0; i < 2; i++ {
+		if _, err := resilient.Authorize(ctx, payment); !IsTransient(err) {
+			t.Fatalf("expected a transient error, got %v", err)
+		}
+	}
+	if state := resilient.State(); state != CircuitOpen {
+		t.Fatalf("expected the circuit to open after 2 failures, got %s", state)
+	}
+	_, err := resilient.Authorize(ctx, payment)
+	var circuitOpen *CircuitOpenError
+	if !errors.As(err, &circuitOpen) || !errors.Is(err, ErrUnavailable) || circuitOpen.RetryAfter != time.Minute || gateway.Calls(OpAuthorize) != 2 {
+		t.Errorf("expected the open circuit to fail fast, got %d calls (%v)", gateway.Calls(OpAuthorize), err)
+	}
+
+	// a failing probe opens the circuit again, an answered one closes it
+	*now = now.Add(time.Minute)
+	if state := resilient.State(); state != CircuitHalfOpen {
+		t.Errorf("expected the circuit to be half-open, got %s", state)
+	}
+	gateway.Script(OpAuthorize, Unavailable())
+	if _, err := resilient.Authorize(ctx, payment); !errors.Is(err, ErrUnavailable) || errors.As(err, &circuitOpen) {
+		t.Errorf("expected the probe to reach the gateway, got %v", err)
+	}
+	if state := resilient.State(); state != CircuitOpen {
+		t.Errorf("expected the failed probe to open the circuit, got %s", state)
+	}
+	*now = now.Add(time.Minute)
+	gateway.Script(OpAuthorize, Decline("insufficient funds"))
+	if _, err := resilient.Authorize(ctx, payment); !errors.Is(err, ErrDeclined) {
+		t.Errorf("expected the probe to be declined, got %v", err)
+	}
+	if state := resilient.State(); state != CircuitClosed {
+		t.Errorf("expected the answered probe to close the circuit, got %s", state)
+	}
+}
+
+func TestJitteredBackoff(t *testing.T) {
+	resilient := NewResilient(NewFakeGateway(), ResiliencePolicy{BaseBackoff: 100 * time.Millisecond, MaxBackoff: time.Second})
+	for attempt, limit := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 4: 800 * time.Millisecond, 5: time.Second, 40: time.Second} {
+		for i := 0; i < 100; i++ {
+			if backoff := resilient.jitteredBackoff(attempt); backoff < 0 || backoff > limit {
+				t.Fatalf("expected the backoff of attempt %d to be at most %s, got %s", attempt, limit, backoff)
+			}
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package payments
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+)
+
+// Defaults of the health tracking of a Router
+const (
+	// DefaultUnhealthyAfter is how many transient errors in a row make a provider unhealthy
+	DefaultUnhealthyAfter = 3
+	// DefaultHealthCooldown is how long an unhealthy provider is tried last before it is given another chance
+	DefaultHealthCooldown = 30 * time.Second
+)
+
+// providerIDSeparator separates the name of the provider from the IDs it returned
+const providerIDSeparator = ":"
+
+// Route sends the payments it matches to its providers, the first one that
+// answers is used. A route without conditions matches every payment.
+type Route struct {
+	// Currencies restricts the route to the payments in these currencies
+	Currencies []string `json:"currencies,omitempty"`
+	// Brands restricts the route to the payments with cards of these brands
+	Brands []entities.CardBrand `json:"brands,omitempty"`
+	// MinAmount and MaxAmount restrict the route to the payments of at least and at most these amounts
+	MinAmount *entities.Money `json:"min_amount,omitempty"`
+	MaxAmount *entities.Money `json:"max_amount,omitempty"`
+	// Providers are the names of the providers of the route, in order of preference
+	Providers []string `json:"providers"`
+}
+
+// Matches tells if the payment takes the route
+func (r Route) Matches(payment PaymentRequest) bool {
+	if len(r.Currencies) > 0 && !containsFold(r.Currencies, payment.Amount.Currency) {
+		return false
+	}
+	if len(r.Brands) > 0 {
+		found := false
+		for _, brand := range r.Brands {
+			found = found || brand == payment.CardBrand
+		}
+		if !found {
+			return false
+		}
+	}
+	if r.MinAmount != nil && (r.MinAmount.Currency != payment.Amount.Currency || payment.Amount.Cmp(*r.MinAmount) < 0) {
+		return false
+	}
+	if r.MaxAmount != nil && (r.MaxAmount.Currency != payment.Amount.Currency || payment.Amount.Cmp(*r.MaxAmount) > 0) {
+		return false
+	}
+	return true
+}
+
+// ProviderHealth defines how a provider of a Router has been answering
+type ProviderHealth struct {
+	Name string `json:"name"`
+	// Healthy providers are tried in the order of the routes, the others last
+	Healthy bool `json:"healthy"`
+	// ConsecutiveFailures counts the transient errors since the last answer
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	Calls               int       `json:"calls"`
+	Failures            int       `json:"failures"`
+	LastError           string    `json:"last_error,omitempty"`
+	LastFailureAt       time.Time `json:"last_failure_at"`
+	LastSuccessAt       time.Time `json:"last_success_at"`
+	// Circuit is the state of the circuit breaker of the providers wrapped by a Resilient processor
+	Circuit CircuitState `json:"circuit,omitempty"`
+}
+
+// provider is a payment processor registered with a Router
+type provider struct {
+	name      string
+	processor PaymentProcessor
+	health    ProviderHealth
+	// webhookSecret signs the webhooks of the provider, see ParseWebhook
+	webhookSecret string
+}
+
+// Router is a PaymentProcessor sending the payments to several providers.
+// Authorizations are routed by currency, amount and card brand, see Route,
+// and fail over to the next provider of their route when one is unavailable,
+// its circuit open included. A timed out authorization may have held the
+// amount on the card, so its error is returned rather than holding it again
+// with another provider: the payment is retried with the same idempotency
+// key, by Resilient or by the client. Declines are final. The IDs it returns
+// are prefixed by the name of the provider, e.g. "primary:auth-1", so that
+// captures, voids and refunds go to the provider of the authorization. The
+// providers answering with transient errors in a row are unhealthy and tried
+// last for a while.
+type Router struct {
+	// UnhealthyAfter is how many transient errors in a row make a provider unhealthy
+	UnhealthyAfter int
+	// HealthCooldown is how long an unhealthy provider is tried last
+	HealthCooldown time.Duration
+
+	mu        sync.Mutex
+	providers []*provider
+	routes    []Route
+	now       func() time.Time
+}
+
+// NewRouter creates a router without providers
+func NewRouter() *Router {
+	return &Router{
+		UnhealthyAfter: DefaultUnhealthyAfter,
+		HealthCooldown: DefaultHealthCooldown,
+		now:            time.Now,
+	}
+}
+
+// Register adds a provider; the payments no route matches go to the providers
+// in the order they were registered, and the IDs without the name of a
+// provider to the first one
+func (r *Router) Register(name string, processor PaymentProcessor) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if name == "" || strings.Contains(name, providerIDSeparator) {
+		return fmt.Errorf("invalid payment provider name %q", name)
+	}
+	if r.provider(name) != nil {
+		return fmt.Errorf("duplicate payment provider %q", name)
+	}
+	r.providers = append(r.providers, &provider{name: name, processor: processor, health: ProviderHealth{Name: name, Healthy: true}})
+	return nil
+}
+
+// AddRoute adds a route, the payments take the first route they match
+func (r *Router) AddRoute(route Route) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(route.Providers) == 0 {
+		return fmt.Errorf("payment route without providers")
+	}
+	for _, name := range route.Providers {
+		if r.provider(name) == nil {
+			return fmt.Errorf("payment route with unknown provider %q", name)
+		}
+	}
+	r.routes = append(r.routes, route)
+	return nil
+}
+
+// SetWebhookSecret sets the secret signing the webhooks of a provider
+func (r *Router) SetWebhookSecret(name string, secret string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p := r.provider(name)
+	if p == nil {
+		return fmt.Errorf("unknown payment provider %q", name)
+	}
+	p.webhookSecret = secret
+	return nil
+}
+
+// WebhookSecret returns the secret signing the webhooks of a provider, empty
+// when the provider is unknown or sends none
+func (r *Router) WebhookSecret(name string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if p := r.provider(name); p != nil {
+		return p.webhookSecret
+	}
+	return ""
+}
+
+// ProviderID returns the ID the router gives out for an ID of a provider,
+// e.g. for the IDs of the webhooks of the provider
+func (r *Router) ProviderID(name string, id string) string {
+	return name + providerIDSeparator + id
+}
+
+// Health returns the health of the providers in the order they were registered
+func (r *Router) Health() []ProviderHealth {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	health := make([]ProviderHealth, 0, len(r.providers))
+	for _, p := range r.providers {
+		h := p.health
+		h.Healthy = r.healthy(p)
+		if resilient, ok := p.processor.(*Resilient); ok {
+			h.Circuit = resilient.State()
+		}
+		health = append(health, h)
+	}
+	return health
+}
+
+// Authorize holds the amount of the payment with the first provider of its route that is available
+func (r *Router) Authorize(ctx context.Context, payment PaymentRequest) (Authorization, error) {
+	candidates := r.candidates(payment)
+	if len(candidates) == 0 {
+		return Authorization{}, fmt.Errorf("%w: no payment provider", ErrUnavailable)
+	}
+	var err error
+	for _, p := range candidates {
+		var authorization Authorization
+		authorization, err = p.processor.Authorize(ctx, payment)
+		r.record(p, err)
+		if err == nil {
+			authorization.ID = p.name + providerIDSeparator + authorization.ID
+			return authorization, nil
+		}
+		if !errors.Is(err, ErrUnavailable) || ctx.Err() != nil {
+			break
+		}
+	}
+	return Authorization{}, err
+}
+
+// Capture captures amount of the authorization with its provider
+func (r *Router) Capture(ctx context.Context, authorizationID string, amount entities.Money) (string, error) {
+	p, id, err := r.route(authorizationID, ErrCaptureFailed)
+	if err != nil {
+		return "", err
+	}
+	confirmation, err := p.processor.Capture(ctx, id, amount)
+	r.record(p, err)
+	if err != nil {
+		return "", err
+	}
+	return p.name + providerIDSeparator + confirmation, nil
+}
+
+// Void releases what was not captured of the authorization with its provider
+func (r *Router) Void(ctx context.Context, authorizationID string) error {
+	p, id, err := r.route(authorizationID, ErrVoidFailed)
+	if err != nil {
+		return err
+	}
+	err = p.processor.Void(ctx, id)
+	r.record(p, err)
+	return err
+}
+
+// Refund gives back amount of the payment with the confirmation ID with its provider
+func (r *Router) Refund(ctx context.Context, confirmationID string, amount entities.Money) (string, error) {
+	p, id, err := r.route(confirmationID, ErrRefundFailed)
+	if err != nil {
+		return "", err
+	}
+	confirmation, err := p.processor.Refund(ctx, id, amount)
+	r.record(p, err)
+	if err != nil {
+		return "", err
+	}
+	return p.name + providerIDSeparator + confirmation, nil
+}
+
+// candidates returns the providers of the route of the payment, the unhealthy ones last
+func (r *Router) candidates(payment PaymentRequest) []*provider {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	providers := r.providers
+	for _, route := range r.routes {
+		if route.Matches(payment) {
+			providers = make([]*provider, 0, len(route.Providers))
+			for _, name := range route.Providers {
+				providers = append(providers, r.provider(name))
+			}
+			break
+		}
+	}
+	healthy := make([]*provider, 0, len(providers))
+	var unhealthy []*provider
+	for _, p := range providers {
+		if r.healthy(p) {
+			healthy = append(healthy, p)
+		} else {
+			unhealthy = append(unhealthy, p)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+// route returns the provider of an ID it returned and the ID at the provider,
+// failing with failed when the provider is unknown
+func (r *Router) route(id string, failed error) (*provider, string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.providers) == 0 {
+		return nil, "", fmt.Errorf("%w: no payment provider", failed)
+	}
+	name, providerID, found := strings.Cut(id, providerIDSeparator)
+	if !found {
+		// paid before the providers were routed
+		return r.providers[0], id, nil
+	}
+	p := r.provider(name)
+	if p == nil {
+		return nil, "", fmt.Errorf("%w: unknown payment provider %q", failed, name)
+	}
+	return p, providerID, nil
+}
+
+// record updates the health of the provider with the result of a call
+func (r *Router) record(p *provider, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p.health.Calls++
+	if err == nil || !IsTransient(err) {
+		// declines are answers too
+		p.health.ConsecutiveFailures = 0
+		p.health.LastSuccessAt = r.now()
+		return
+	}
+	p.health.Failures++
+	p.health.ConsecutiveFailures++
+	p.health.LastError = err.Error()
+	p.health.LastFailureAt = r.now()
+}
+
+// healthy tells if the provider is healthy; mu must be held
+func (r *Router) healthy(p *provider) bool {
+	return p.health.ConsecutiveFailures < r.UnhealthyAfter || r.now().Sub(p.health.LastFailureAt) >= r.HealthCooldown
+}
+
+// provider returns the provider with the name, nil if there is none; mu must be held
+func (r *Router) provider(name string) *provider {
+	for _, p := range r.providers {
+		if p.name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// containsFold tells if the list contains s, ignoring case
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
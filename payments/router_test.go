@@ -0,0 +1,210 @@
+package payments
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+)
+
+// testHelperRouter returns a router of fake gateways registered under the names, in order
+func testHelperRouter(t *testing.T, names ...string) (*Router, map[string]*FakeGateway) {
+	t.Helper()
+	router := NewRouter()
+	gateways := make(map[string]*FakeGateway, len(names))
+	for _, name := range names {
+		gateways[name] = NewFakeGateway()
+		if err := router.Register(name, gateways[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return router, gateways
+}
+
+func TestRouterRoutes(t *testing.T) {
+	ctx := context.Background()
+	router, gateways := testHelperRouter(t, "primary", "europe", "amex")
+	large := entities.NewMoney(100000, "USD")
+	for _, route := range []Route{
+		{Currencies: []string{"eur", "GBP"}, Providers: []string{"europe", "primary"}},
+		{Brands: []entities.CardBrand{entities.CardBrandAmex}, MinAmount: &large, Providers: []string{"amex"}},
+	} {
+		if err := router.AddRoute(route); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := router.AddRoute(Route{Providers: []string{"unknown"}}); err == nil {
+		t.Error("expected a route with an unknown provider to be rejected")
+	}
+	if err := router.Register("primary", NewFakeGateway()); err == nil {
+		t.Error("expected a duplicate provider to be rejected")
+	}
+
+	tests := []struct {
+		name     string
+		payment  PaymentRequest
+		provider string
+	}{
+		{"by currency", PaymentRequest{Amount: entities.NewMoney(5000, "EUR")}, "europe"},
+		{"by brand and amount", PaymentRequest{Amount: entities.NewMoney(150000, "USD"), CardBrand: entities.CardBrandAmex}, "amex"},
+		{"below the amount", PaymentRequest{Amount: entities.NewMoney(5000, "USD"), CardBrand: entities.CardBrandAmex}, "primary"},
+		{"no route", PaymentRequest{Amount: entities.NewMoney(5000, "USD"), CardBrand: entities.CardBrandVisa}, "primary"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := gateways[tt.provider].Calls(OpAuthorize)
+			auth, err := router.Authorize(ctx, tt.payment)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(auth.ID, tt.provider+":") || gateways[tt.provider].Calls(OpAuthorize) != before+1 {
+				t.Errorf("expected the payment to go to %s, got %s", tt.provider, auth.ID)
+			}
+		})
+	}
+}
+
+func TestRouterFailover(t *testing.T) {
+	ctx := context.Background()
+	router, gateways := testHelperRouter(t, "primary", "backup")
+	now := time.Now()
+	router.now = func() time.Time { return now }
+	payment := PaymentRequest{ID: "order-1", Amount: entities.NewMoney(5000, "USD")}
+
+	// a timed out authorization may have held the amount, it is not asked of the backup
+	gateways["primary"].Script(OpAuthorize, Timeout())
+	if _, err := router.Authorize(ctx, payment); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("expected the timeout to be returned, got %v", err)
+	}
+	if calls := gateways["backup"].Calls(OpAuthorize); calls != 0 {
+		t.Fatalf("expected a timeout not to fail over, got %d authorizations with the backup", calls)
+	}
+
+	gateways["primary"].Script(OpAuthorize, Unavailable())
+	auth, err := router.Authorize(ctx, payment)
+	if err != nil || !strings.HasPrefix(auth.ID, "backup:") {
+		t.Fatalf("expected an unavailable provider to fail over to the backup, got %+v (%v)", auth, err)
+	}
+	// the authorization stays with its provider
+	if _, err := router.Capture(ctx, auth.ID, entities.NewMoney(2000, "USD")); err != nil {
+		t.Fatal(err)
+	}
+	if err := router.Void(ctx, auth.ID); err != nil {
+		t.Fatal(err)
+	}
+	refund, err := router.Refund(ctx, auth.ID, entities.NewMoney(2000, "USD"))
+	if err != nil || !strings.HasPrefix(refund, "backup:") {
+		t.Errorf("expected the refund to go to the backup, got %q (%v)", refund, err)
+	}
+	if fake, _ := gateways["backup"].Authorization(strings.TrimPrefix(auth.ID, "backup:")); !fake.Voided || fake.Refunded != entities.NewMoney(2000, "USD") {
+		t.Errorf("expected the backup to keep the books of the authorization, got %+v", fake)
+	}
+	if gateways["primary"].Calls(OpCapture)+gateways["primary"].Calls(OpRefund) != 0 {
+		t.Error("expected nothing but the authorization to go to the primary")
+	}
+
+	gateways["primary"].Script(OpAuthorize, Decline("insufficient funds"))
+	if _, err := router.Authorize(ctx, payment); !errors.Is(err, ErrDeclined) {
+		t.Errorf("expected a decline, got %v", err)
+	}
+	if calls := gateways["backup"].Calls(OpAuthorize); calls != 1 {
+		t.Errorf("expected a decline not to fail over, got %d authorizations with the backup", calls)
+	}
+
+	gateways["primary"].Script(OpAuthorize, Unavailable())
+	gateways["backup"].Script(OpAuthorize, Timeout())
+	if _, err := router.Authorize(ctx, payment); !errors.Is(err, ErrTimeout) {
+		t.Errorf("expected the last error once every provider failed, got %v", err)
+	}
+	if _, err := router.Capture(ctx, "nowhere:auth-1", entities.NewMoney(100, "USD")); !errors.Is(err, ErrCaptureFailed) {
+		t.Errorf("expected a capture with an unknown provider to fail, got %v", err)
+	}
+	legacy, err := gateways["primary"].Authorize(ctx, payment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := router.Capture(ctx, legacy.ID, entities.NewMoney(100, "USD")); err != nil {
+		t.Errorf("expected an ID without a provider to go to the first one, got %v", err)
+	}
+}
+
+func TestRouterHealth(t *testing.T) {
+	ctx := context.Background()
+	router, gateways := testHelperRouter(t, "primary", "backup")
+	now := time.Now()
+	router.now = func() time.Time { return now }
+	payment := PaymentRequest{ID: "order-1", Amount: entities.NewMoney(5000, "USD")}
+
+	gateways["primary"].Script(OpAuthorize, Unavailable(), Unavailable(), Unavailable())
+	for i := 0; i < 3; i++ {
+		if _, err := router.Authorize(ctx, payment); err != nil {
+			t.Fatal(err)
+		}
+	}
+	health := router.Health()
+	if health[0].Healthy || health[0].ConsecutiveFailures != 3 || health[0].Calls != 3 || health[0].LastError == "" || !health[1].Healthy {
+		t.Fatalf("expected the primary to be unhealthy after 3 failures, got %+v", health)
+	}
+
+	// the unhealthy primary is tried last until the cooldown is over
+	auth, err := router.Authorize(ctx, payment)
+	if err != nil || !strings.HasPrefix(auth.ID, "backup:") || gateways["primary"].Calls(OpAuthorize) != 3 {
+		t.Errorf("expected the backup to be tried first, got %+v (%v)", auth, err)
+	}
+	now = now.Add(DefaultHealthCooldown)
+	auth, err = router.Authorize(ctx, payment)
+	if err != nil || !strings.HasPrefix(auth.ID, "primary:") {
+		t.Errorf("expected the primary to be tried again after the cooldown, got %+v (%v)", auth, err)
+	}
+	if health := router.Health(); !health[0].Healthy || health[0].ConsecutiveFailures != 0 || health[0].Failures != 3 {
+		t.Errorf("expected the primary to be healthy again, got %+v", health[0])
+	}
+}
+
+func TestLoadProviders(t *testing.T) {
+	t.Setenv("TEST_PRIMARY_API_KEY", "secret")
+	t.Setenv("TEST_PRIMARY_WEBHOOK_SECRET", "whsec_test")
+	vault := NewVault()
+	router, err := Load(strings.NewReader(`{"providers": [
+		{"name": "primary", "type": "gateway", "api_key_env": "TEST_PRIMARY_API_KEY", "webhook_secret_env": "TEST_PRIMARY_WEBHOOK_SECRET"},
+		{"name": "local", "type": "fake"}],
+	 "routes": [{"currencies": ["EUR"], "providers": ["local"]}]}`), vault, DefaultResiliencePolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	card, err := vault.Tokenize("testuser", CreditCardDetails{Number: "4242424242424242", Expiration: "12/99", CVV: "123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := router.Authorize(context.Background(), PaymentRequest{Amount: entities.NewMoney(5000, "USD"), CardToken: card.Token})
+	if err != nil || !strings.HasPrefix(auth.ID, "primary:") {
+		t.Errorf("expected the gateway to authorize the card of the vault, got %+v (%v)", auth, err)
+	}
+	auth, err = router.Authorize(context.Background(), PaymentRequest{Amount: entities.NewMoney(5000, "EUR")})
+	if err != nil || auth.ID != "local:auth-1" {
+		t.Errorf("expected the euros to go to the fake provider, got %+v (%v)", auth, err)
+	}
+	if router.WebhookSecret("primary") != "whsec_test" || router.WebhookSecret("local") != "" {
+		t.Errorf("expected only the primary to send webhooks, got %q and %q", router.WebhookSecret("primary"), router.WebhookSecret("local"))
+	}
+	if health := router.Health(); health[0].Circuit != CircuitClosed {
+		t.Errorf("expected the providers to be called through a closed circuit, got %+v", health[0])
+	}
+
+	for _, config := range []string{
+		`{"providers": []}`,
+		`{"providers": [{"name": "primary", "type": "bank"}]}`,
+		`{"providers": [{"name": "primary", "type": "gateway", "api_key_env": "TEST_UNSET_API_KEY"}]}`,
+		`{"providers": [{"name": "a:b", "type": "fake"}]}`,
+		`{"providers": [{"name": "primary", "type": "fake", "webhook_secret_env": "TEST_UNSET_WEBHOOK_SECRET"}]}`,
+		`{"providers": [{"name": "primary", "type": "fake"}], "routes": [{"providers": ["backup"]}]}`,
+		`{"providers": [{"name": "primary", "type": "fake", "priority": 1}]}`,
+	} {
+		if _, err := Load(strings.NewReader(config), vault, DefaultResiliencePolicy); err == nil {
+			t.Errorf("expected %s to be rejected", config)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package payments
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+)
+
+// ErrInvalidToken is returned when a card token is unknown to the vault or belongs to another user
+var ErrInvalidToken = errors.New("invalid card token")
+
+// CardLookup gives out the cards of the tokens of a vault without their number nor CVV
+type CardLookup interface {
+	// Card returns the card of a token of the user
+	Card(userID string, token string) (entities.PaymentCard, error)
+}
+
+// VaultStore keeps the tokens of a Vault so that they outlive the server; it is
+// given their card, user and fingerprint, never the details of the card
+type VaultStore interface {
+	// SaveVaultCard keeps the card of a token, replacing the one kept with the token
+	SaveVaultCard(card entities.VaultCard) error
+	// ListVaultCards lists the cards kept
+	ListVaultCards() ([]entities.VaultCard, error)
+}
+
+// vaultEntry is a card kept by a Vault, the details of the cards loaded from
+// its store are unknown
+type vaultEntry struct {
+	userID  string
+	details CreditCardDetails
+	card    entities.PaymentCard
+}
+
+// Vault is a tokenization vault, standing for the one of the payment gateway:
+// it validates the details of the cards and keeps them, giving out opaque
+// tokens in exchange so that the rest of the bookstore never handles card
+// numbers. Tokens are per user and a user tokenizing the same card again gets
+// the same token. Cards are kept in memory until the server stops; the store
+// of the vault only keeps their tokens, with the brand, last four digits and
+// expiry of their card, so that the tokens outlive the server.
+type Vault struct {
+	mu     sync.RWMutex
+	tokens map[string]*vaultEntry
+	// cards lists the tokens by the fingerprint of their user and card
+	cards map[string]string
+	// secret keys the fingerprints, so that the card numbers cannot be
+	// guessed from the fingerprints of the store
+	secret []byte
+	// store keeps the tokens past the server, nil when they are only kept in memory
+	store VaultStore
+}
+
+// NewVault creates an empty vault keeping its cards in memory
+func NewVault() *Vault {
+	secret := make([]byte, sha256.Size)
+	if _, err := rand.Read(secret); err != nil {
+		panic(fmt.Sprintf("unable to create the fingerprint secret of the vault: %s", err))
+	}
+	return &Vault{
+		tokens: make(map[string]*vaultEntry),
+		cards:  make(map[string]string),
+		secret: secret,
+	}
+}
+
+// OpenVault creates a vault keeping its tokens in the store, with the ones it
+// already keeps. The fingerprints of the cards are keyed with the secret, which
+// must not be kept in the store; without one a random secret is used and the
+// cards tokenized again after a restart get new tokens.
+func OpenVault(store VaultStore, secret []byte) (*Vault, error) {
+	cards, err := store.ListVaultCards()
+	if err != nil {
+		return nil, fmt.Errorf("unable to load the cards of the vault: %w", err)
+	}
+	v := NewVault()
+	v.store = store
+	if len(secret) > 0 {
+		v.secret = secret
+	}
+	for _, card := range cards {
+		v.tokens[card.Token] = &vaultEntry{userID: card.UserID, card: card.Card}
+		v.cards[card.Fingerprint] = card.Token
+	}
+	return v, nil
+}
+
+// Tokenize validates the details of a card of the user, see
+// CreditCardDetails.Validate, keeps them and returns the card with its token
+func (v *Vault) Tokenize(userID string, details CreditCardDetails) (entities.PaymentCard, error) {
+	details = details.Normalize()
+	card, err := details.Validate(time.Now())
+	if err != nil {
+		return entities.PaymentCard{}, err
+	}
+	mac := hmac.New(sha256.New, v.secret)
+	mac.Write([]byte(userID + "\x00" + details.Number + "\x00" + details.Expiration))
+	fingerprint := hex.EncodeToString(mac.Sum(nil))
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	entry, ok := v.tokens[v.cards[fingerprint]]
+	if !ok {
+		card.Token, err = randomID("tok_")
+		if err != nil {
+			return entities.PaymentCard{}, fmt.Errorf("unable to create card token")
+		}
+		entry = &vaultEntry{userID: userID, card: card}
+		if err := v.save(fingerprint, entry); err != nil {
+			return entities.PaymentCard{}, err
+		}
+	}
+	// the CVV or the name may have been corrected
+	entry.details = details
+	v.tokens[entry.card.Token] = entry
+	v.cards[fingerprint] = entry.card.Token
+	return entry.card, nil
+}
+
+// save keeps the token of an entry in the store, without the details of its card; mu must be held
+func (v *Vault) save(fingerprint string, entry *vaultEntry) error {
+	if v.store == nil {
+		return nil
+	}
+	err := v.store.SaveVaultCard(entities.VaultCard{
+		Token:       entry.card.Token,
+		UserID:      entry.userID,
+		Fingerprint: fingerprint,
+		Card:        entry.card,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to keep the card: %w", err)
+	}
+	return nil
+}
+
+// Card returns the card of a token of the user, it fails once the card expired
+func (v *Vault) Card(userID string, token string) (entities.PaymentCard, error) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	entry, ok := v.tokens[token]
+	if !ok || entry.userID != userID {
+		return entities.PaymentCard{}, ErrInvalidToken
+	}
+	if entry.card.Expired(time.Now()) {
+		return entities.PaymentCard{}, fmt.Errorf("%w: the card ending in %s expired", entities.ErrInvalidCard, entry.card.Last4)
+	}
+	return entry.card, nil
+}
+
+// Detokenize returns the details of the card of a token, for the payment
+// gateway only; the details of the cards loaded from the store are unknown,
+// the gateway charges them by their token
+func (v *Vault) Detokenize(token string) (CreditCardDetails, error) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	entry, ok := v.tokens[token]
+	if !ok {
+		return CreditCardDetails{}, ErrInvalidToken
+	}
+	return entry.details, nil
+}
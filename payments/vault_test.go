@@ -0,0 +1,114 @@
+package payments
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+	"github.com/13thuser/bookstore/datastore"
+)
+
+func TestVault(t *testing.T) {
+	v := NewVault()
+	details := CreditCardDetails{FirstName: "Ada", Number: "4242 4242 4242 4242", Expiration: "12/99", CVV: "123"}
+	card, err := v.Tokenize("testuser", details)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if card.Token == "" || card.Brand != entities.CardBrandVisa || card.Last4 != "4242" || card.ExpiryMonth != 12 || card.ExpiryYear != 2099 {
+		t.Errorf("expected a tokenized visa ending in 4242, got %+v", card)
+	}
+	if _, err := v.Tokenize("testuser", CreditCardDetails{Number: "4242424242424241", Expiration: "12/99", CVV: "123"}); !errors.Is(err, entities.ErrInvalidCard) {
+		t.Errorf("expected a mistyped number to be rejected, got %v", err)
+	}
+
+	details.CVV = "321"
+	again, err := v.Tokenize("testuser", details)
+	if err != nil || again.Token != card.Token {
+		t.Errorf("expected the same card to get the same token, got %+v (%v)", again, err)
+	}
+	other, err := v.Tokenize("other", details)
+	if err != nil || other.Token == card.Token {
+		t.Errorf("expected tokens to be per user, got %+v (%v)", other, err)
+	}
+
+	if got, err := v.Card("testuser", card.Token); err != nil || got != card {
+		t.Errorf("expected the card of the token, got %+v (%v)", got, err)
+	}
+	if _, err := v.Card("other", card.Token); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expected the token of another user to be rejected, got %v", err)
+	}
+	stored, err := v.Detokenize(card.Token)
+	if err != nil || stored.Number != "4242424242424242" || stored.CVV != "321" {
+		t.Errorf("expected the normalized details of the card, got %+v (%v)", stored, err)
+	}
+
+	gateway := NewPaymentGateway(v)
+	payment := PaymentRequest{ID: "order-1", UserID: "testuser", Amount: entities.NewMoney(5000, "USD"), CardToken: card.Token}
+	if _, err := gateway.Authorize(context.Background(), payment); err != nil {
+		t.Errorf("expected the gateway to charge the card of the token, got %v", err)
+	}
+	payment.CardToken = "tok_unknown"
+	if _, err := gateway.Authorize(context.Background(), payment); !errors.Is(err, ErrDeclined) {
+		t.Errorf("expected the gateway to decline an unknown token, got %v", err)
+	}
+}
+
+func TestOpenVault(t *testing.T) {
+	store := datastore.NewCardVaultStore()
+	secret := []byte("vault-secret")
+	v, err := OpenVault(store, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	details := CreditCardDetails{FirstName: "Ada", Number: "4242 4242 4242 4242", Expiration: "12/99", CVV: "123"}
+	card, err := v.Tokenize("testuser", details)
+	if err != nil {
+		t.Fatal(err)
+	}
+	details.FirstName = "Ada L."
+	if _, err := v.Tokenize("testuser", details); err != nil {
+		t.Fatal(err)
+	}
+	kept, _ := store.ListVaultCards()
+	if len(kept) != 1 || kept[0].Token != card.Token || kept[0].Card != card {
+		t.Fatalf("expected the token to be kept with its card, got %+v", kept)
+	}
+	unkeyed := sha256.Sum256([]byte("testuser\x004242424242424242\x0012/99"))
+	if kept[0].Fingerprint == hex.EncodeToString(unkeyed[:]) {
+		t.Error("expected the fingerprint of the card to be keyed with the secret")
+	}
+
+	// after a restart
+	v, err = OpenVault(store, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := v.Detokenize(card.Token); err != nil || stored.Number != "" {
+		t.Errorf("expected the details of the card not to be kept, got %+v (%v)", stored, err)
+	}
+	if got, err := v.Card("testuser", card.Token); err != nil || got != card {
+		t.Errorf("expected the card of the token to be kept, got %+v (%v)", got, err)
+	}
+	if again, err := v.Tokenize("testuser", details); err != nil || again.Token != card.Token {
+		t.Errorf("expected the same card to keep its token, got %+v (%v)", again, err)
+	}
+	if _, err := NewPaymentGateway(v).Authorize(context.Background(), PaymentRequest{ID: "order-1", Amount: entities.NewMoney(5000, "USD"), CardToken: card.Token}); err != nil {
+		t.Errorf("expected the gateway to charge the kept card, got %v", err)
+	}
+
+	// without the secret the same card is taken for another one
+	v, err = OpenVault(store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := v.Tokenize("testuser", details); err != nil || again.Token == card.Token {
+		t.Errorf("expected the card to get a new token without the secret, got %+v (%v)", again, err)
+	}
+	if _, err := v.Card("testuser", card.Token); err != nil {
+		t.Errorf("expected the kept token to still be known, got %v", err)
+	}
+}
@@ -0,0 +1,220 @@
+package payments
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+)
+
+// WebhookSignatureHeader is the header signing the webhooks of the payment
+// providers, e.g. "t=1700000000,v1=5257a869...": v1 is the hex HMAC-SHA256,
+// keyed with the webhook secret of the provider, of the timestamp t, a dot and
+// the body of the request
+const WebhookSignatureHeader = "Payment-Signature"
+
+// WebhookTolerance is how old the signature of a webhook can be, older ones are replays
+const WebhookTolerance = 5 * time.Minute
+
+// Errors returned when receiving a webhook
+var (
+	// ErrInvalidSignature is returned when a webhook is not signed with the secret of its provider
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+	// ErrInvalidWebhook is returned when the event of a webhook is malformed
+	ErrInvalidWebhook = errors.New("invalid webhook event")
+	// ErrEventIgnored is returned when an event does not apply to its order as
+	// it stands, e.g. a failed payment of an order paid since; it is
+	// acknowledged so that the provider does not send it again
+	ErrEventIgnored = errors.New("payment event ignored")
+)
+
+// WebhookEventType defines what happened to a payment at its provider
+type WebhookEventType string
+
+const (
+	// EventPaymentSucceeded confirms an authorization, e.g. one that timed out when it was asked
+	EventPaymentSucceeded WebhookEventType = "payment.succeeded"
+	// EventPaymentFailed reports that an authorization was reversed before anything was captured
+	EventPaymentFailed WebhookEventType = "payment.failed"
+	// EventPaymentRefunded reports a refund, e.g. one made from the dashboard of the provider
+	EventPaymentRefunded WebhookEventType = "payment.refunded"
+	// EventPaymentDisputed reports that the cardholder disputed the payment with their issuer
+	EventPaymentDisputed WebhookEventType = "payment.disputed"
+)
+
+// WebhookEvent defines an event a payment provider sends about a payment
+type WebhookEvent struct {
+	// ID identifies the event at its provider, which may send it several times
+	ID   string           `json:"id"`
+	Type WebhookEventType `json:"type"`
+	// OrderID is the ID of the payment request
+	OrderID string `json:"order_id"`
+	// AuthorizationID is the ID of the authorization of the payment at the provider
+	AuthorizationID string `json:"authorization_id"`
+	// RefundID and DisputeID identify the refund and the dispute of the refunded and disputed events
+	RefundID  string `json:"refund_id,omitempty"`
+	DisputeID string `json:"dispute_id,omitempty"`
+	// Amount is what was authorized, refunded or disputed
+	Amount    entities.Money `json:"amount"`
+	Reason    string         `json:"reason,omitempty"`
+	CreatedAt time.Time      `json:"created_at"`
+}
+
+// Validate checks that the event has what its type needs
+func (e WebhookEvent) Validate() error {
+	if e.ID == "" || e.OrderID == "" || e.AuthorizationID == "" {
+		return fmt.Errorf("%w: id, order_id and authorization_id are required", ErrInvalidWebhook)
+	}
+	switch e.Type {
+	case EventPaymentSucceeded, EventPaymentFailed:
+	case EventPaymentRefunded:
+		if e.RefundID == "" || !e.Amount.IsPositive() {
+			return fmt.Errorf("%w: a refund needs a refund_id and a positive amount", ErrInvalidWebhook)
+		}
+	case EventPaymentDisputed:
+		if e.DisputeID == "" || !e.Amount.IsPositive() {
+			return fmt.Errorf("%w: a dispute needs a dispute_id and a positive amount", ErrInvalidWebhook)
+		}
+	default:
+		return fmt.Errorf("%w: unknown type %q", ErrInvalidWebhook, e.Type)
+	}
+	return nil
+}
+
+// SignWebhook returns the signature header of a webhook body sent at the time with the secret
+func SignWebhook(secret string, body []byte, at time.Time) string {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	return "t=" + timestamp + ",v1=" + webhookMAC(secret, timestamp, body)
+}
+
+// ParseWebhook checks the signature header of a webhook body against the
+// secret of its provider, refusing the signatures more than WebhookTolerance
+// apart from now, and returns its event
+func ParseWebhook(secret string, signature string, body []byte, now time.Time) (WebhookEvent, error) {
+	var timestamp string
+	var macs []string
+	for _, part := range strings.Split(signature, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			// several while the provider rolls its secret
+			macs = append(macs, value)
+		}
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(macs) == 0 {
+		return WebhookEvent{}, fmt.Errorf("%w: malformed %s header", ErrInvalidSignature, WebhookSignatureHeader)
+	}
+	if age := now.Sub(time.Unix(seconds, 0)); age > WebhookTolerance || age < -WebhookTolerance {
+		return WebhookEvent{}, fmt.Errorf("%w: signed at %s", ErrInvalidSignature, time.Unix(seconds, 0).UTC().Format(time.RFC3339))
+	}
+	expected := webhookMAC(secret, timestamp, body)
+	valid := false
+	for _, mac := range macs {
+		valid = valid || hmac.Equal([]byte(mac), []byte(expected))
+	}
+	if !valid {
+		return WebhookEvent{}, ErrInvalidSignature
+	}
+
+	var event WebhookEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return WebhookEvent{}, fmt.Errorf("%w: %v", ErrInvalidWebhook, err)
+	}
+	if err := event.Validate(); err != nil {
+		return WebhookEvent{}, err
+	}
+	return event, nil
+}
+
+// webhookMAC returns the hex HMAC-SHA256 of the timestamp and body with the secret
+func webhookMAC(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// WebhookSimulator sends signed webhooks like a payment provider, to test the
+// webhook endpoint locally. Its event IDs are sequential, e.g. "evt-1".
+type WebhookSimulator struct {
+	Secret string
+	// Client sends the webhooks, http.DefaultClient when nil
+	Client *http.Client
+
+	mu       sync.Mutex
+	sequence int
+}
+
+// NewWebhookSimulator creates a simulator signing with the secret
+func NewWebhookSimulator(secret string) *WebhookSimulator {
+	return &WebhookSimulator{Secret: secret}
+}
+
+// Event returns a new event of the type about the authorization of the order
+func (s *WebhookSimulator) Event(eventType WebhookEventType, orderID string, authorizationID string, amount entities.Money) WebhookEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sequence++
+	event := WebhookEvent{
+		ID:              fmt.Sprintf("evt-%d", s.sequence),
+		Type:            eventType,
+		OrderID:         orderID,
+		AuthorizationID: authorizationID,
+		Amount:          amount,
+		CreatedAt:       time.Now(),
+	}
+	switch eventType {
+	case EventPaymentRefunded:
+		event.RefundID = fmt.Sprintf("refund-evt-%d", s.sequence)
+	case EventPaymentDisputed:
+		event.DisputeID = fmt.Sprintf("dispute-evt-%d", s.sequence)
+	}
+	return event
+}
+
+// Request returns the request delivering the event to the URL, signed now
+func (s *WebhookSimulator) Request(url string, event WebhookEvent) (*http.Request, error) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(s.Secret, body, time.Now()))
+	return req, nil
+}
+
+// Send delivers the event to the URL and returns the status code of the answer
+func (s *WebhookSimulator) Send(ctx context.Context, url string, event WebhookEvent) (int, error) {
+	req, err := s.Request(url, event)
+	if err != nil {
+		return 0, err
+	}
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,60 @@
+package payments
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/13thuser/bookstore/bookstore/entities"
+)
+
+func TestParseWebhook(t *testing.T) {
+	now := time.Now()
+	simulator := NewWebhookSimulator("whsec_test")
+	event := simulator.Event(EventPaymentRefunded, "order-1", "auth-1", entities.NewMoney(500, "USD"))
+	req, err := simulator.Request("/webhooks/payments/gateway", event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(req.Body)
+	signature := req.Header.Get(WebhookSignatureHeader)
+
+	parsed, err := ParseWebhook("whsec_test", signature, body, now)
+	if err != nil || parsed.ID != "evt-1" || parsed.RefundID != "refund-evt-1" || parsed.Amount != event.Amount {
+		t.Fatalf("expected the signed event, got %+v (%v)", parsed, err)
+	}
+	// while the provider rolls its secret
+	rolled := signature + ",v1=" + strings.Repeat("0", 64)
+	if _, err := ParseWebhook("whsec_test", rolled, body, now); err != nil {
+		t.Errorf("expected one of the signatures to match, got %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		secret    string
+		signature string
+		body      string
+		want      error
+	}{
+		{"another secret", "whsec_other", signature, string(body), ErrInvalidSignature},
+		{"tampered body", "whsec_test", signature, strings.Replace(string(body), "500", "50000", 1), ErrInvalidSignature},
+		{"replayed", "whsec_test", SignWebhook("whsec_test", body, now.Add(-2*WebhookTolerance)), string(body), ErrInvalidSignature},
+		{"malformed", "whsec_test", "sha256=abc", string(body), ErrInvalidSignature},
+		{"unknown type", "whsec_test", "", `{"id": "evt-1", "type": "payment.lost", "order_id": "order-1", "authorization_id": "auth-1"}`, ErrInvalidWebhook},
+		{"refund without amount", "whsec_test", "", `{"id": "evt-1", "type": "payment.refunded", "order_id": "order-1", "authorization_id": "auth-1", "refund_id": "refund-1"}`, ErrInvalidWebhook},
+		{"not JSON", "whsec_test", "", `evt-1`, ErrInvalidWebhook},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signature := tt.signature
+			if signature == "" {
+				signature = SignWebhook(tt.secret, []byte(tt.body), now)
+			}
+			if _, err := ParseWebhook(tt.secret, signature, []byte(tt.body), now); !errors.Is(err, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, err)
+			}
+		})
+	}
+}